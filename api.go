@@ -0,0 +1,720 @@
+// Package main contains the main entry point for the Go application
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxAPIBodySize limits the size of JSON request bodies.
+const maxAPIBodySize = 1 << 20
+
+// validNoteTypes and validNoteStatuses match the options offered by the HTML forms.
+var (
+	validNoteTypes    = map[string]bool{"Note": true, "Task": true}
+	validNoteStatuses = map[string]bool{"": true, "None": true, "In Progress": true, "Completed": true, "Cancelled": true, "Delegated": true}
+	validPrivileges   = map[string]bool{"editor": true, "viewer": true}
+)
+
+// noteInput is the JSON body accepted when creating or updating a note.
+// Pointer fields tell PATCH which fields were supplied.
+type noteInput struct {
+	Title          *string   `json:"title"`
+	NoteType       *string   `json:"note_type"`
+	Description    *string   `json:"description"`
+	DueAt          *string   `json:"due_at"`
+	NoteStatus     *string   `json:"note_status"`
+	NoteDelegation *string   `json:"note_delegation"`
+	Tags           *[]string `json:"tags"`
+}
+
+// shareInput is the JSON body accepted when sharing a note or changing a share's privileges.
+type shareInput struct {
+	Username   string `json:"username"`
+	Privileges string `json:"privileges"`
+}
+
+// delegationInput is the JSON body accepted when delegating a note.
+type delegationInput struct {
+	Username string `json:"username"`
+}
+
+// apply copies the supplied fields onto the note. The due time is an RFC 3339 timestamp
+// with its time zone offset, or an empty string to remove it.
+func (in noteInput) apply(note *Note) error {
+	if in.Title != nil {
+		note.Title = *in.Title
+	}
+	if in.NoteType != nil {
+		note.NoteType = *in.NoteType
+	}
+	if in.Description != nil {
+		note.Description = *in.Description
+	}
+	if in.DueAt != nil {
+		note.DueAt = sql.NullTime{}
+		if *in.DueAt != "" {
+			dueAt, err := time.Parse(time.RFC3339, *in.DueAt)
+			if err != nil {
+				return errors.New("due_at must be an RFC 3339 timestamp, e.g. 2024-10-23T14:00:00+13:00")
+			}
+			note.DueAt = sql.NullTime{Time: dueAt, Valid: true}
+		}
+	}
+	if in.NoteStatus != nil {
+		note.NoteStatus = sql.NullString{String: *in.NoteStatus, Valid: true}
+	}
+	if in.NoteDelegation != nil {
+		note.NoteDelegation = sql.NullString{String: *in.NoteDelegation, Valid: true}
+	}
+	if in.Tags != nil {
+		note.Tags = *in.Tags
+	}
+	return nil
+}
+
+// validateNote checks a note before it is written to the database, and normalises its tags.
+func validateNote(note *Note) error {
+	if strings.TrimSpace(note.Title) == "" || strings.TrimSpace(note.Description) == "" {
+		return errors.New("title and description are required")
+	}
+	if len(note.Title) > MaxNoteLength || len(note.Description) > MaxNoteLength {
+		return fmt.Errorf("title or description exceeds %d characters", MaxNoteLength)
+	}
+	if !validNoteTypes[note.NoteType] {
+		return errors.New("note_type must be Note or Task")
+	}
+	if !validNoteStatuses[note.NoteStatus.String] {
+		return errors.New("note_status must be None, In Progress, Completed, Cancelled or Delegated")
+	}
+	tags, err := normalizeTags(note.Tags)
+	if err != nil {
+		return err
+	}
+	note.Tags = tags
+	return nil
+}
+
+// decodeJSON reads a JSON request body into v, rejecting unknown fields.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIBodySize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("invalid JSON body: %v", err)
+	}
+	return nil
+}
+
+// apiUsername returns the authenticated user for an API request, or writes a 401 response.
+func (a *App) apiUsername(w http.ResponseWriter, r *http.Request) (string, bool) {
+	username := currentUsername(r)
+	if username == "[guest]" {
+		respondWithError(w, http.StatusUnauthorized, "Authentication required")
+		return "", false
+	}
+	return username, true
+}
+
+// apiAuthorizeNote reads the {id} route variable and checks the user may perform the action on that note.
+// Users with no access to a note get a 404 so the API does not reveal which notes exist.
+func (a *App) apiAuthorizeNote(w http.ResponseWriter, r *http.Request, username string, action NoteAction) (int, NoteRole, bool) {
+	noteID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid note ID")
+		return 0, RoleNone, false
+	}
+
+	role, err := a.notes.NoteRole(noteID, username)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return 0, RoleNone, false
+	}
+	if role == RoleNone {
+		respondWithError(w, http.StatusNotFound, "Note not found")
+		return 0, RoleNone, false
+	}
+	if !role.can(action) {
+		respondWithError(w, http.StatusForbidden, "You do not have permission to do that to this note")
+		return 0, RoleNone, false
+	}
+
+	return noteID, role, true
+}
+
+// apiListNotesHandler handles GET /api/v1/notes, a page at a time.
+// Supported filters: scope (all, owned, shared, delegated), type, status, owner, tag, due
+// and from/to (days of creation), sort (created, title, due or status) and limit.
+// next_cursor and prev_cursor, when present, are passed back as cursor for the pages either side.
+func (a *App) apiListNotesHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := a.apiUsername(w, r)
+	if !ok {
+		return
+	}
+
+	scope := r.URL.Query().Get("scope")
+	if scope == "" {
+		scope = scopeAll
+	}
+	if scope != scopeAll && scope != scopeOwned && scope != scopeShared && scope != scopeDelegated {
+		respondWithError(w, http.StatusBadRequest, "scope must be all, owned, shared or delegated")
+		return
+	}
+	loc, err := a.userLocation(username)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	opts, err := parseNoteListOptions(r, loc, "cursor")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	opts.Scope = scope
+
+	page, err := a.notes.ListNotes(username, opts)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// Only owners see who their notes are shared with
+	var owned []int
+	for _, note := range page.Notes {
+		if NoteRole(note.Privileges).can(ActionShare) {
+			owned = append(owned, note.ID)
+		}
+	}
+	sharedUsers, err := a.shares.SharedUsers(owned)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	for i := range page.Notes {
+		page.Notes[i].SharedUsers = sharedUsers[page.Notes[i].ID]
+	}
+
+	body := map[string]interface{}{"notes": page.Notes}
+	if page.Next != nil {
+		body["next_cursor"] = page.Next.encode()
+	}
+	if page.Prev != nil {
+		body["prev_cursor"] = page.Prev.encode()
+	}
+	respondWithJSON(w, http.StatusOK, body)
+}
+
+// apiCreateNoteHandler handles POST /api/v1/notes.
+func (a *App) apiCreateNoteHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := a.apiUsername(w, r)
+	if !ok {
+		return
+	}
+
+	var in noteInput
+	if err := decodeJSON(w, r, &in); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	note := Note{Owner: username, NoteType: "Note"}
+	if err := in.apply(&note); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := validateNote(&note); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	id, err := a.notes.CreateNote(note)
+	if errors.Is(err, errUserNotFound) {
+		respondWithError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	created, err := a.notes.GetNote(id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	created.Privileges = string(RoleOwner)
+
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/notes/%d", id))
+	respondWithJSON(w, http.StatusCreated, created)
+}
+
+// apiGetNoteHandler handles GET /api/v1/notes/{id}.
+func (a *App) apiGetNoteHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := a.apiUsername(w, r)
+	if !ok {
+		return
+	}
+
+	noteID, role, ok := a.apiAuthorizeNote(w, r, username, ActionView)
+	if !ok {
+		return
+	}
+
+	note, err := a.notes.GetNote(noteID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	note.Privileges = string(role)
+
+	// Only owners see who their notes are shared with
+	if role.can(ActionShare) {
+		note.SharedUsers, err = a.shares.NoteShares(noteID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, note)
+}
+
+// apiUpdateNoteHandler handles PUT and PATCH /api/v1/notes/{id}.
+// PUT replaces every field, PATCH only changes the fields supplied.
+// As with the HTML form, delegates can only change the title and description.
+func (a *App) apiUpdateNoteHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := a.apiUsername(w, r)
+	if !ok {
+		return
+	}
+
+	noteID, role, ok := a.apiAuthorizeNote(w, r, username, ActionEdit)
+	if !ok {
+		return
+	}
+
+	var in noteInput
+	if err := decodeJSON(w, r, &in); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	existing, err := a.notes.GetNote(noteID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	note := *existing
+	if r.Method == http.MethodPut {
+		// Start from an empty note so omitted fields are cleared
+		note = Note{ID: existing.ID, Owner: existing.Owner, NoteCreated: existing.NoteCreated}
+		if in.Title == nil || in.NoteType == nil || in.Description == nil {
+			respondWithError(w, http.StatusBadRequest, "PUT requires title, note_type and description")
+			return
+		}
+	}
+	if err := in.apply(&note); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if role == RoleDelegate {
+		applyDelegateRestrictions(&note, existing)
+	}
+
+	if err := validateNote(&note); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := a.notes.UpdateNote(note, username); errors.Is(err, errUserNotFound) {
+		respondWithError(w, http.StatusNotFound, "User not found")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	updated, err := a.notes.GetNote(noteID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	updated.Privileges = string(role)
+
+	respondWithJSON(w, http.StatusOK, updated)
+}
+
+// apiDeleteNoteHandler handles DELETE /api/v1/notes/{id}.
+func (a *App) apiDeleteNoteHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := a.apiUsername(w, r)
+	if !ok {
+		return
+	}
+
+	noteID, _, ok := a.apiAuthorizeNote(w, r, username, ActionDelete)
+	if !ok {
+		return
+	}
+
+	if err := a.notes.DeleteNote(noteID, username); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiListSharesHandler handles GET /api/v1/notes/{id}/shares.
+func (a *App) apiListSharesHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := a.apiUsername(w, r)
+	if !ok {
+		return
+	}
+
+	// Only owners see who their notes are shared with
+	noteID, _, ok := a.apiAuthorizeNote(w, r, username, ActionShare)
+	if !ok {
+		return
+	}
+
+	shares, err := a.shares.NoteShares(noteID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	for i := range shares {
+		shares[i].NoteID = noteID
+	}
+	if shares == nil {
+		shares = []UserShare{}
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"shares": shares})
+}
+
+// apiCreateShareHandler handles POST /api/v1/notes/{id}/shares.
+func (a *App) apiCreateShareHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := a.apiUsername(w, r)
+	if !ok {
+		return
+	}
+
+	noteID, _, ok := a.apiAuthorizeNote(w, r, username, ActionShare)
+	if !ok {
+		return
+	}
+
+	var in shareInput
+	if err := decodeJSON(w, r, &in); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if in.Username == "" || !validPrivileges[in.Privileges] {
+		respondWithError(w, http.StatusBadRequest, "username is required and privileges must be editor or viewer")
+		return
+	}
+	if in.Username == username {
+		respondWithError(w, http.StatusBadRequest, "You cannot share a note with yourself")
+		return
+	}
+
+	err := a.shares.ShareNote(noteID, in.Username, in.Privileges)
+	if status, message, ok := shareErrorStatus(err); ok {
+		respondWithError(w, status, message)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, UserShare{
+		NoteID:     noteID,
+		Username:   sql.NullString{String: in.Username, Valid: true},
+		Privileges: sql.NullString{String: in.Privileges, Valid: true},
+	})
+}
+
+// apiUpdateShareHandler handles PUT /api/v1/notes/{id}/shares/{username}.
+func (a *App) apiUpdateShareHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := a.apiUsername(w, r)
+	if !ok {
+		return
+	}
+
+	noteID, _, ok := a.apiAuthorizeNote(w, r, username, ActionShare)
+	if !ok {
+		return
+	}
+
+	var in shareInput
+	if err := decodeJSON(w, r, &in); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !validPrivileges[in.Privileges] {
+		respondWithError(w, http.StatusBadRequest, "privileges must be editor or viewer")
+		return
+	}
+
+	sharedUsername := mux.Vars(r)["username"]
+	err := a.shares.UpdateShare(noteID, sharedUsername, in.Privileges)
+	if status, message, ok := shareErrorStatus(err); ok {
+		respondWithError(w, status, message)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, UserShare{
+		NoteID:     noteID,
+		Username:   sql.NullString{String: sharedUsername, Valid: true},
+		Privileges: sql.NullString{String: in.Privileges, Valid: true},
+	})
+}
+
+// apiDeleteShareHandler handles DELETE /api/v1/notes/{id}/shares/{username}.
+// The owner can remove anyone, other users can only remove themselves.
+func (a *App) apiDeleteShareHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := a.apiUsername(w, r)
+	if !ok {
+		return
+	}
+
+	noteID, role, ok := a.apiAuthorizeNote(w, r, username, ActionView)
+	if !ok {
+		return
+	}
+
+	sharedUsername := mux.Vars(r)["username"]
+	if !role.can(ActionShare) && sharedUsername != username {
+		respondWithError(w, http.StatusForbidden, "Only the owner can stop sharing with other users")
+		return
+	}
+
+	err := a.shares.RemoveShare(noteID, sharedUsername)
+	if status, message, ok := shareErrorStatus(err); ok {
+		respondWithError(w, status, message)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiGetDelegationHandler handles GET /api/v1/notes/{id}/delegation.
+func (a *App) apiGetDelegationHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := a.apiUsername(w, r)
+	if !ok {
+		return
+	}
+
+	noteID, _, ok := a.apiAuthorizeNote(w, r, username, ActionView)
+	if !ok {
+		return
+	}
+
+	note, err := a.notes.GetNote(noteID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"note_id":     noteID,
+		"username":    nullStringPtr(note.NoteDelegation),
+		"note_status": nullStringPtr(note.NoteStatus),
+	})
+}
+
+// apiSetDelegationHandler handles PUT /api/v1/notes/{id}/delegation.
+func (a *App) apiSetDelegationHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := a.apiUsername(w, r)
+	if !ok {
+		return
+	}
+
+	noteID, _, ok := a.apiAuthorizeNote(w, r, username, ActionDelegate)
+	if !ok {
+		return
+	}
+
+	var in delegationInput
+	if err := decodeJSON(w, r, &in); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if in.Username == "" {
+		respondWithError(w, http.StatusBadRequest, "username is required")
+		return
+	}
+
+	if err := a.notes.SetDelegation(noteID, in.Username); errors.Is(err, errUserNotFound) {
+		respondWithError(w, http.StatusNotFound, "User not found")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"note_id":     noteID,
+		"username":    in.Username,
+		"note_status": "Delegated",
+	})
+}
+
+// apiRemoveDelegationHandler handles DELETE /api/v1/notes/{id}/delegation.
+func (a *App) apiRemoveDelegationHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := a.apiUsername(w, r)
+	if !ok {
+		return
+	}
+
+	noteID, _, ok := a.apiAuthorizeNote(w, r, username, ActionUndelegate)
+	if !ok {
+		return
+	}
+
+	if err := a.notes.RemoveDelegation(noteID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiListRevisionsHandler handles GET /api/v1/notes/{id}/revisions.
+func (a *App) apiListRevisionsHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := a.apiUsername(w, r)
+	if !ok {
+		return
+	}
+
+	noteID, _, ok := a.apiAuthorizeNote(w, r, username, ActionView)
+	if !ok {
+		return
+	}
+
+	revisions, err := a.listNoteRevisions(noteID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"revisions": revisions})
+}
+
+// apiGetRevisionHandler handles GET /api/v1/notes/{id}/revisions/{revision}.
+func (a *App) apiGetRevisionHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := a.apiUsername(w, r)
+	if !ok {
+		return
+	}
+
+	noteID, _, ok := a.apiAuthorizeNote(w, r, username, ActionView)
+	if !ok {
+		return
+	}
+
+	revision, _ := strconv.Atoi(mux.Vars(r)["revision"])
+	nr, err := a.getNoteRevision(noteID, revision)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Revision not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, nr)
+}
+
+// apiDiffRevisionsHandler handles GET /api/v1/notes/{id}/revisions/diff?from=1&to=2.
+func (a *App) apiDiffRevisionsHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := a.apiUsername(w, r)
+	if !ok {
+		return
+	}
+
+	noteID, _, ok := a.apiAuthorizeNote(w, r, username, ActionView)
+	if !ok {
+		return
+	}
+
+	fromRev, fromErr := strconv.Atoi(r.URL.Query().Get("from"))
+	toRev, toErr := strconv.Atoi(r.URL.Query().Get("to"))
+	if fromErr != nil || toErr != nil {
+		respondWithError(w, http.StatusBadRequest, "from and to must be revision numbers")
+		return
+	}
+
+	from, err := a.getNoteRevision(noteID, fromRev)
+	if err == nil {
+		var to *NoteRevision
+		to, err = a.getNoteRevision(noteID, toRev)
+		if err == nil {
+			respondWithJSON(w, http.StatusOK, map[string]interface{}{
+				"from":    fromRev,
+				"to":      toRev,
+				"changes": diffNoteRevisions(*from, *to),
+			})
+			return
+		}
+	}
+
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Revision not found")
+		return
+	}
+	respondWithError(w, http.StatusInternalServerError, err.Error())
+}
+
+// apiRestoreRevisionHandler handles POST /api/v1/notes/{id}/revisions/{revision}/restore.
+// The restored note is saved as a new revision and returned.
+func (a *App) apiRestoreRevisionHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := a.apiUsername(w, r)
+	if !ok {
+		return
+	}
+
+	noteID, role, ok := a.apiAuthorizeNote(w, r, username, ActionEdit)
+	if !ok {
+		return
+	}
+
+	revision, _ := strconv.Atoi(mux.Vars(r)["revision"])
+	err := a.restoreNoteRevision(noteID, revision, username, role)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Revision not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	note, err := a.notes.GetNote(noteID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	note.Privileges = string(role)
+
+	respondWithJSON(w, http.StatusOK, note)
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// newAPITestApp returns an App with a mock database and the API routes registered
+func newAPITestApp(t *testing.T) (*App, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error occurred while opening a stub database connection: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	a := newSQLTestApp(db)
+	a.initializeRoutes()
+	return a, mock
+}
+
+// newSQLTestApp returns an app on a stub database, reaching it through the Postgres store.
+func newSQLTestApp(db *sql.DB) *App {
+	a := &App{db: db}
+	a.useStore(newPostgresStore(db))
+	return a
+}
+
+// testDueAt is the due time of the notes returned by expectNoteByID, 2pm on 23 October in Auckland
+var testDueAt = time.Date(2024, 10, 23, 1, 0, 0, 0, time.UTC)
+
+// expectNoteByID expects GetNote for a note and returns the given row
+func expectNoteByID(mock sqlmock.Sqlmock, noteID int, title, noteType, status, delegation, owner string) {
+	mock.ExpectQuery("SELECT id, title, description, noteType").WithArgs(noteID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "title", "description", "noteType", "due_at", "noteStatus", "noteDelegation", "owner", "noteCreated", "tags"}).
+			AddRow(noteID, title, "Description", noteType, testDueAt, status, delegation, owner, time.Date(2024, 10, 1, 9, 0, 0, 0, time.UTC), ""))
+}
+
+func serveAPI(a *App, method, target, body, username string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if username != "" {
+		req = withSession(req, username)
+		req.Header.Set(csrfHeader, csrfToken(req))
+	}
+
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestAPI_RequiresAuthentication(t *testing.T) {
+	a, mock := newAPITestApp(t)
+
+	rr := serveAPI(a, "GET", "/api/v1/notes", "", "")
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusUnauthorized)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected a JSON error, got Content-Type %q", ct)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPI_GetNote(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	expectNoteRole(mock, 7, "bob", "alice", nil, "viewer")
+	expectNoteByID(mock, 7, "Groceries", "Task", "In Progress", "", "alice")
+	// A viewer is not shown who else the note is shared with, so the shares are not queried
+
+	rr := serveAPI(a, "GET", "/api/v1/notes/7", "", "bob")
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v, want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Response is not valid JSON: %v", err)
+	}
+	if got["title"] != "Groceries" || got["privileges"] != "viewer" || got["note_status"] != "In Progress" {
+		t.Errorf("Unexpected note: %v", got)
+	}
+	if _, ok := got["fts_text"]; ok {
+		t.Errorf("fts_text should not be exposed: %v", got)
+	}
+	if _, ok := got["shared_users"]; ok {
+		t.Errorf("Expected the shares to be hidden from a viewer, got %v", got["shared_users"])
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPI_GetNote_NotFoundWithoutAccess(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	expectNoteRole(mock, 7, "mallory", "alice", nil, nil)
+
+	rr := serveAPI(a, "GET", "/api/v1/notes/7", "", "mallory")
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusNotFound)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPI_CreateNote(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	mock.ExpectBegin()
+	mock.ExpectPrepare("INSERT INTO notes").ExpectQuery().
+		WithArgs("Groceries", "Task", "Milk", sqlmock.AnyArg(), "None", "", "alice").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(42))
+	// The tags are stored and the search text recalculated to include them
+	mock.ExpectExec("DELETE FROM note_tags").WithArgs(42).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("UPDATE notes SET tags_text").WithArgs(42, "shopping weekly").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO tags").WithArgs("{shopping,weekly}").WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec("INSERT INTO note_tags").WithArgs(42, "{shopping,weekly}").WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+	expectNoteByID(mock, 42, "Groceries", "Task", "None", "", "alice")
+
+	body := `{"title":"Groceries","note_type":"Task","description":"Milk","due_at":"2024-10-23T14:00:00+13:00","note_status":"None","tags":["Weekly","#shopping"]}`
+	rr := serveAPI(a, "POST", "/api/v1/notes", body, "alice")
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Handler returned wrong status code: got %v, want %v: %s", rr.Code, http.StatusCreated, rr.Body.String())
+	}
+	if loc := rr.Header().Get("Location"); loc != "/api/v1/notes/42" {
+		t.Errorf("Unexpected Location header %q", loc)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPI_CreateNote_Validation(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"missing title", `{"description":"Milk"}`},
+		{"title too long", `{"title":"` + strings.Repeat("x", MaxNoteLength+1) + `","description":"Milk"}`},
+		{"bad note type", `{"title":"a","description":"b","note_type":"Memo"}`},
+		{"bad status", `{"title":"a","description":"b","note_status":"Done"}`},
+		{"bad tag", `{"title":"a","description":"b","tags":["two words"]}`},
+		{"unknown field", `{"title":"a","description":"b","colour":"red"}`},
+		{"malformed", `{"title":`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, mock := newAPITestApp(t)
+
+			rr := serveAPI(a, "POST", "/api/v1/notes", tt.body, "alice")
+
+			if rr.Code != http.StatusBadRequest {
+				t.Errorf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusBadRequest)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("Unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestAPI_PatchNote_DelegateKeepsTaskFields(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	expectNoteRole(mock, 1, "bob", "alice", "bob", nil)
+	expectNoteByID(mock, 1, "Old", "Task", "Delegated", "bob", "alice")
+	mock.ExpectBegin()
+	expectDelegateExists(mock, "bob", true)
+	mock.ExpectPrepare("UPDATE notes SET title").ExpectExec().
+		WithArgs("New", "Task", "Description", testDueAt, "Delegated", "bob", 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM note_tags").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("UPDATE notes SET tags_text").WithArgs(1, "").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO note_revisions").WithArgs(1, "bob").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	expectNoteByID(mock, 1, "New", "Task", "Delegated", "bob", "alice")
+
+	rr := serveAPI(a, "PATCH", "/api/v1/notes/1", `{"title":"New","note_status":"Completed"}`, "bob")
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("Handler returned wrong status code: got %v, want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPI_PutNote_RequiresAllFields(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	expectNoteRole(mock, 1, "alice", "alice", nil, nil)
+	expectNoteByID(mock, 1, "Old", "Note", "None", "", "alice")
+
+	rr := serveAPI(a, "PUT", "/api/v1/notes/1", `{"title":"New"}`, "alice")
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusBadRequest)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPI_DeleteNote_ForbiddenForEditor(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	expectNoteRole(mock, 1, "bob", "alice", nil, "editor")
+
+	rr := serveAPI(a, "DELETE", "/api/v1/notes/1", "", "bob")
+
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusForbidden)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPI_CreateShare_UnknownUser(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	expectNoteRole(mock, 1, "alice", "alice", nil, nil)
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO user_shares").WithArgs(1, "nobody", "viewer").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT owner FROM notes").WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"owner"}).AddRow("alice"))
+	mock.ExpectQuery("SELECT EXISTS\\(SELECT 1 FROM users").WithArgs("nobody").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectRollback()
+
+	rr := serveAPI(a, "POST", "/api/v1/notes/1/shares", `{"username":"nobody","privileges":"viewer"}`, "alice")
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusNotFound)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPI_CreateShare_AlreadyShared(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	expectNoteRole(mock, 1, "alice", "alice", nil, nil)
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO user_shares").WithArgs(1, "bob", "editor").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT owner FROM notes").WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"owner"}).AddRow("alice"))
+	mock.ExpectQuery("SELECT EXISTS\\(SELECT 1 FROM users").WithArgs("bob").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectRollback()
+
+	rr := serveAPI(a, "POST", "/api/v1/notes/1/shares", `{"username":"bob","privileges":"editor"}`, "alice")
+
+	if rr.Code != http.StatusConflict {
+		t.Errorf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusConflict)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPI_UpdateShare_NotShared(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	expectNoteRole(mock, 1, "alice", "alice", nil, nil)
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE user_shares SET privileges").WithArgs("editor", "carol", 1).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT EXISTS\\(SELECT 1 FROM notes").WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectRollback()
+
+	rr := serveAPI(a, "PUT", "/api/v1/notes/1/shares/carol", `{"privileges":"editor"}`, "alice")
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusNotFound)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPI_DeleteShare_SelfRemoval(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	expectNoteRole(mock, 1, "bob", "alice", nil, "viewer")
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM user_shares").WithArgs("bob", 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	rr := serveAPI(a, "DELETE", "/api/v1/notes/1/shares/bob", "", "bob")
+
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusNoContent)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPI_SetDelegation(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	expectNoteRole(mock, 1, "alice", "alice", nil, nil)
+	expectDelegateExists(mock, "bob", true)
+	mock.ExpectPrepare("UPDATE notes SET noteDelegation").ExpectExec().WithArgs("bob", 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	rr := serveAPI(a, "PUT", "/api/v1/notes/1/delegation", `{"username":"bob"}`, "alice")
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("Handler returned wrong status code: got %v, want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
@@ -3,6 +3,7 @@ package main
 
 import (
 	"context"
+	"database/sql"
 
 	"log"
 	"net/http"
@@ -10,64 +11,106 @@ import (
 	"os/signal"
 	"time"
 
+	"github.com/icza/session"
 	_ "github.com/jackc/pgx/v5/stdlib" //use pgx in database/sql mode
 )
 
 func (a *App) Initialize() {
 	// Initialize sets up the application by:
-	// - Creating the database connection
-	// - Checking data import status and importing demo data if needed
-	// - Setting up authentication
+	// - Loading the configuration (from the environment when not already set by main)
+	// - Opening the PostgreSQL or SQLite database, or the in-memory store
+	// - Applying any pending schema migrations
+	// - Seeding demo data if requested
+	// - Starting the trash purge job
+	// - Setting up the mailer and authentication
 	// - Initializing the application's routes
-	db, err := setupDatabase()
-	if err != nil {
-		log.Fatal(err)
+	if a.config == nil {
+		cfg, _, err := loadConfig(nil)
+		if err != nil {
+			log.Fatalf("Invalid configuration: %v", err)
+		}
+		a.config = cfg
 	}
-	a.db = db
 
-	// Check data import status
-	_, err = os.Stat("./imported")
-	if os.IsNotExist(err) {
-		log.Println("--- Importing demo data")
-		a.importData()
+	setupLogging(a.config.LogLevel)
+	log.Printf("Effective configuration:\n%s", a.config)
+
+	jobs, stopJobs := context.WithCancel(context.Background())
+	a.stopJobs = stopJobs
+
+	if a.config.Database.Backend == "memory" {
+		// Notes, users and shares are kept in memory, features that need a database report errNoDatabase
+		log.Println("--- Keeping notes in memory, they will be lost when the server stops")
+		a.db, _ = sql.Open("nodb", "")
+		a.useStore(newMemoryStore())
+
+		if a.config.SeedDemoData {
+			log.Println("--- Importing demo data")
+			if err := a.seedMemoryDemoData(); err != nil {
+				log.Fatal(err)
+			}
+		}
+	} else {
+		db, store, err := openDatabase(a.config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		a.db = db
+		a.useStore(store)
+
+		// Bring the schema up to date
+		log.Println("--- Applying database migrations")
+		if err := a.migrateUp(); err != nil {
+			log.Fatal(err)
+		}
+
+		// Seeding the demo users and notes is an optional step
+		if a.config.SeedDemoData {
+			log.Println("--- Importing demo data")
+			if err := a.seedDemoData(); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		// Start the background job that empties expired notes out of the trash
+		a.startTrashPurger(jobs)
 	}
 
+	// Emails are sent, or kept for local development, as configured
+	a.mailer = newMailer(a.config.Mail)
+
 	// Setup authentication (if applicable)
 	a.setupAuth()
 
 	// Initialize the application's routes
 	a.initializeRoutes()
-
-	// Set the default bind port
-	a.bindport = "60"
-
-	// Check if a different bind port was passed from the CLI via the PORT environment variable
-	tempport := os.Getenv("PORT")
-	if tempport != "" {
-		a.bindport = tempport
-	}
 }
 
-// Run starts the HTTP server on the specified address or the default if not provided.
-// It handles graceful shutdown on interrupt signal.
+// Run starts the HTTP server on the specified address or the configured bind address if not provided.
+// It serves HTTPS when a TLS certificate and key are configured, and handles graceful shutdown on interrupt signal.
 func (a *App) Run(addr string) {
-	if addr != "" {
-		a.bindport = addr
+	if addr == "" {
+		addr = a.config.Server.BindAddress
 	}
 
-	// In Docker, bind to 0.0.0.0
 	srv := &http.Server{
-		Addr:         "0.0.0.0:" + a.bindport,
+		Addr:         addr,
 		WriteTimeout: time.Second * 15,
 		ReadTimeout:  time.Second * 15,
 		IdleTimeout:  time.Second * 60,
 		Handler:      a.Router,
 	}
 
-	log.Printf("Starting HTTP service on port %s", a.bindport)
+	tlsEnabled := a.config.Server.TLSCertFile != ""
+	log.Printf("Starting HTTP service on %s (TLS: %t)", addr, tlsEnabled)
 
 	go func() {
-		if err = srv.ListenAndServe(); err != nil {
+		if tlsEnabled {
+			err = srv.ListenAndServeTLS(a.config.Server.TLSCertFile, a.config.Server.TLSKeyFile)
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil {
 			log.Println(err)
 		}
 	}()
@@ -75,11 +118,15 @@ func (a *App) Run(addr string) {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	<-c
-	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	ctx, cancel := context.WithTimeout(context.Background(), a.config.Server.ShutdownTimeout)
 	defer cancel()
 
 	log.Println("shutting HTTP service down")
 	srv.Shutdown(ctx)
+	log.Println("stopping background jobs")
+	a.stopJobs()
+	log.Println("stopping the session manager")
+	session.Global.Close()
 	log.Println("closing database connections")
 	a.db.Close()
 	log.Println("shutting down")
@@ -0,0 +1,37 @@
+// Package main contains the main entry point for the Go application
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+)
+
+// Events written to the audit log.
+const (
+	// auditLoginFailed is a login with an unknown username or a wrong password
+	auditLoginFailed = "login_failed"
+	// auditLoginLocked is a login refused because the account or address is locked out
+	auditLoginLocked = "login_locked"
+)
+
+// auditUsernameLength is the length of the audit log's username column. Longer usernames
+// cannot exist, and are cut short so they are still recorded.
+const auditUsernameLength = 50
+
+// audit records a security event for a username, which need not exist, and the address the
+// request came from. The event is logged too, and failing to store it does not fail the request.
+func (a *App) audit(r *http.Request, username, event string) {
+	address := clientAddress(r)
+	slog.Info("audit", "event", event, "user", username, "address", address)
+
+	if runes := []rune(username); len(runes) > auditUsernameLength {
+		username = string(runes[:auditUsernameLength])
+	}
+	_, err := a.db.Exec(`INSERT INTO audit_log (event, username, remote_addr) VALUES ($1, $2, $3)`,
+		event, username, address)
+	// The memory backend has no audit log, the log line above is all there is
+	if err != nil && !errors.Is(err, errNoDatabase) {
+		slog.Error("Writing the audit log failed", "err", err)
+	}
+}
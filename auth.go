@@ -3,10 +3,13 @@ package main
 
 import (
 	// Import statements
+	"context"
 	"database/sql"
 	"html/template"
-	"log"
+	"log/slog"
 	"net/http"
+	"strings"
+	"sync"
 
 	"github.com/icza/session"
 	"golang.org/x/crypto/bcrypt"
@@ -24,53 +27,14 @@ func (a *App) registerHandler(w http.ResponseWriter, r *http.Request) {
     // Grab user info
     username := r.FormValue("username")
     password := r.FormValue("password")
+    email := strings.TrimSpace(r.FormValue("email"))
 
-    // Prepare the SELECT statement to check if the user already exists
-	selectStmt, err := a.db.Prepare("SELECT username FROM users WHERE username = $1")
-	if err != nil {
-		// Handle the error
-		http.SetCookie(w, &http.Cookie{
-			Name:  "message",
-			Value: "Error preparing SELECT statement: " + err.Error(),
-			Path:  "/", // Set the path as needed
-		})
-		http.Redirect(w, r, "/login", http.StatusSeeOther)
-		return
-	}
-	defer selectStmt.Close() // Close the prepared statement when done with it
-
-	// Execute the SELECT query
-	var existingUser User
-	err = selectStmt.QueryRow(username).Scan(&existingUser.Username)
-
-	if err == nil {
-		// User already exists, set a cookie with the error message
-		http.SetCookie(w, &http.Cookie{
-			Name:  "message",
-			Value: "User already exists",
-			Path:  "/", // Set the path as needed
-		})
-		http.Redirect(w, r, "/login", http.StatusSeeOther)
-		return
-
-	} else if err != sql.ErrNoRows {
-		// An unexpected error occurred
-		http.SetCookie(w, &http.Cookie{
-			Name:  "message",
-			Value: "Error checking user existence: " + err.Error(),
-			Path:  "/", // Set the path as needed
-		})
-		http.Redirect(w, r, "/login", http.StatusSeeOther)
-		return
-	}
-
-    // User doesn't exist, proceed with registration
-    hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-    checkInternalServerError(err, w)
-    // Prepare the Insert stmt to Insert the user into the database
-	InsertStmt, err := a.db.Prepare(`INSERT INTO users(username, password) VALUES($1, $2)`)
+    // Refuse passwords that break the configured rules, and invalid email addresses
+    err := a.passwordRules().checkPassword(username, password)
+    if err == nil {
+        err = validateEmail(email)
+    }
     if err != nil {
-        // Registration failed, set a cookie with the error message
         http.SetCookie(w, &http.Cookie{
             Name:  "message",
             Value: "Error registering user: " + err.Error(),
@@ -80,9 +44,28 @@ func (a *App) registerHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-	// Insert user, with username and password into db
-	_, err = InsertStmt.Exec(username, hashedPassword)
-	if err != nil {
+    // Hash the password and add the user, unless the username is taken
+    hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+    if err != nil {
+        checkInternalServerError(err, w)
+        return
+    }
+
+    err = a.users.CreateUser(username, hashedPassword)
+    if err == nil && email != "" {
+        err = a.users.SetEmail(username, email)
+    }
+    if err == errUserExists {
+        // User already exists, set a cookie with the error message
+        http.SetCookie(w, &http.Cookie{
+            Name:  "message",
+            Value: "User already exists",
+            Path:  "/", // Set the path as needed
+        })
+        http.Redirect(w, r, "/login", http.StatusSeeOther)
+        return
+    }
+    if err != nil {
         // Registration failed, set a cookie with the error message
         http.SetCookie(w, &http.Cookie{
             Name:  "message",
@@ -103,13 +86,28 @@ func (a *App) registerHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 
+// The messages of a failed login. They are the same whether or not the username exists.
+const (
+	loginFailedMessage = "Invalid username or password."
+	loginLockedMessage = "Too many failed logins. Please wait a while and try again."
+)
+
+// dummyPasswordHash is compared with the password of logins with unknown usernames.
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, err := bcrypt.GenerateFromPassword([]byte("not the password of any user"), bcrypt.DefaultCost)
+	if err != nil {
+		panic(err)
+	}
+	return hash
+})
+
 func (a *App) loginHandler(w http.ResponseWriter, r *http.Request) {
 	// Log GET requests and handle POST requests for login
     // Serve the login page with an optional message
     // Retrieve user input and query the database for matching user
     // Compare hashed password and handle authentication
     // Create a new session on successful login
-    log.Printf("Method %s", r.Method)
+    slog.Debug("Login page", "method", r.Method)
 
     // Check for a message cookie
     cookie, err := r.Cookie("message")
@@ -150,91 +148,183 @@ func (a *App) loginHandler(w http.ResponseWriter, r *http.Request) {
     username := r.FormValue("usrname")
     password := r.FormValue("psw")
 
-    // query database to get matching username
-    var user User
-    err = a.db.QueryRow("SELECT username, password FROM users WHERE username=$1", username).Scan(&user.Username, &user.Password)
-    if err != nil {
-        if err == sql.ErrNoRows {
-            // Handle the case where no user with that username was found.
-            // Set an error message
-            http.SetCookie(w, &http.Cookie{
-                Name:  "message",
-                Value: "User not found.",
-                Path:  "/", // Set the path as needed
-            })
-            http.Redirect(w, r, "/login", http.StatusSeeOther)
-            return
-        }
+    // refuse the login while the account or the address is locked out, without checking the password
+    accountKey, addressKey := accountKey(username), addressKey(clientAddress(r))
+    if a.logins.retryAfter(accountKey, addressKey) > 0 {
+        a.audit(r, username, auditLoginLocked)
+        http.SetCookie(w, &http.Cookie{
+            Name:  "message",
+            Value: loginLockedMessage,
+            Path:  "/", // Set the path as needed
+        })
+        http.Redirect(w, r, "/login", http.StatusSeeOther)
+        return
+    }
 
+    // look up the password hash of the matching username
+    user := User{Username: username}
+    passwordHash, err := a.users.PasswordHash(username)
+    if err == sql.ErrNoRows {
+        // Compare with a hash anyway, so unknown usernames take as long as wrong passwords
+        passwordHash = dummyPasswordHash()
+    } else if err != nil {
         checkInternalServerError(err, w)
         return
     }
 
     // password is encrypted
-    err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
+    err = bcrypt.CompareHashAndPassword(passwordHash, []byte(password))
     if err != nil {
-        // Password does not match
-        // Set an error message
+        // Unknown username or wrong password, the message does not tell which
+        a.audit(r, username, auditLoginFailed)
+        if a.logins.fail(accountKey, a.logins.config.MaxFailures) {
+            slog.Warn("Locked out a user after too many failed logins", "user", username)
+        }
+        if a.logins.fail(addressKey, a.logins.config.MaxFailuresPerIP) {
+            slog.Warn("Locked out an address after too many failed logins", "address", clientAddress(r))
+        }
         http.SetCookie(w, &http.Cookie{
             Name:  "message",
-            Value: "Invalid username or password.",
+            Value: loginFailedMessage,
             Path:  "/", // Set the path as needed
         })
         http.Redirect(w, r, "/login", http.StatusSeeOther)
         return
     }
 
-    // Successful login. New session with initial constant and variable attributes
-    sess := session.NewSessionOptions(&session.SessOptions{
-        CAttrs: map[string]interface{}{"username": user.Username, "userid" : user.Id},
-        Attrs:  map[string]interface{}{"count": 1},
-    })
-    session.Add(sess, w)
+    // Users with an authenticator app give its code before they are logged in, see mfaLoginHandler.
+    // Failed logins are only cleared once they have.
+    totpSecret, err := a.users.TOTPSecret(username)
+    if err != nil {
+        checkInternalServerError(err, w)
+        return
+    }
+    if totpSecret != "" {
+        startMFALogin(w, username)
+        http.Redirect(w, r, "/login/mfa", http.StatusSeeOther)
+        return
+    }
+    a.logins.succeed(accountKey)
+
+    // Successful login
+    a.startSession(w, user, false)
     http.Redirect(w, r, "/list", http.StatusSeeOther)
 }
 
+// startSession logs the user in with a new session with the initial constant and variable
+// attributes. mfa records whether they gave a second factor, see requireAuth.
+func (a *App) startSession(w http.ResponseWriter, user User, mfa bool) {
+	sess := session.NewSessionOptions(&session.SessOptions{
+		CAttrs:  map[string]interface{}{"username": user.Username, "userid": user.Id, "mfa": mfa},
+		Attrs:   map[string]interface{}{"count": 1},
+		Timeout: a.config.Session.Timeout,
+	})
+	session.Add(sess, w)
+}
+
 func (a *App) logoutHandler(w http.ResponseWriter, r *http.Request) {
-	// Get the current session variables, log out the user, and redirect to login
-	s := session.Get(r)
-	username := s.CAttr("username").(string)
-	log.Printf("User %s has been logged out", username)
+	// Log out the user by removing the session, and redirect to login
+	slog.Debug("User logged out", "user", currentUsername(r))
 
-	// Remove the session
-	session.Remove(s, w)
-	s = nil
+	if s := session.Get(r); s != nil {
+		session.Remove(s, w)
+	}
 
-	// Redirect the user to the login page with a temporary (302) redirect
-	http.Redirect(w, r, "/login", 301)
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
 }
 
-func (a *App) isAuthenticated(w http.ResponseWriter, r *http.Request) {
-	// Check if the user is authenticated based on session attributes
-    // Redirect to login page if not authenticated
-	authenticated := false
+// userContextKey is the request context key holding the username requireAuth authenticated.
+type userContextKey struct{}
 
-	sess := session.Get(r)
+// withUser returns the request authenticated as the user. requireAuth stores the user this way,
+// and tests use it to call handlers as a user without a session or API token.
+func withUser(r *http.Request, username string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), userContextKey{}, username))
+}
 
-	if sess != nil {
-		u := sess.CAttr("username").(string)
-		c := sess.Attr("count").(int)
+// currentUsername returns the user requireAuth authenticated the request as, or "[guest]" if there is none.
+func currentUsername(r *http.Request) string {
+	if username, ok := r.Context().Value(userContextKey{}).(string); ok {
+		return username
+	}
+	return "[guest]"
+}
 
-		//just a simple authentication check for the current user
-		if c > 0 && len(u) > 0 {
-			authenticated = true
-		}
+// authenticateRequest returns the user of the API token (see tokenAuthMiddleware) or the login
+// session of a request, and false if it has neither.
+func authenticateRequest(r *http.Request) (string, bool) {
+	if token := tokenFromContext(r); token != nil {
+		return token.Username, true
 	}
 
-	if !authenticated {
-		http.Redirect(w, r, "/login", 301)
+	sess := session.Get(r)
+	if sess == nil {
+		return "", false
 	}
+	username, _ := sess.CAttr("username").(string)
+	count, _ := sess.Attr("count").(int)
+	return username, username != "" && count > 0
+}
+
+// isAPIRequest reports whether the request is for the JSON API, which answers with JSON errors
+// rather than pages and redirects.
+func isAPIRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/api/")
 }
 
+// requireAuth authenticates every request to the routes it wraps once, before the handler runs,
+// and stores the user in the request context for currentUsername. Requests without a valid
+// session or API token get a 401 JSON error from the API and are redirected to the login page otherwise.
+// When two-factor authentication is required, sessions logged in without it can only set it up.
+func (a *App) requireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, ok := authenticateRequest(r)
+		if !ok {
+			if isAPIRequest(r) {
+				respondWithError(w, http.StatusUnauthorized, "Authentication required")
+			} else {
+				http.Redirect(w, r, "/login", http.StatusSeeOther)
+			}
+			return
+		}
+
+		if a.mfaRequired() && tokenFromContext(r) == nil && !sessionHasMFA(r) && !mfaSetupPaths[r.URL.Path] {
+			if isAPIRequest(r) {
+				respondWithError(w, http.StatusForbidden, "Two-factor authentication is required, set it up at /mfa/setup")
+			} else {
+				http.Redirect(w, r, "/mfa/setup", http.StatusSeeOther)
+			}
+			return
+		}
+
+		next.ServeHTTP(w, withUser(r, username))
+	})
+}
 
 func (a *App) setupAuth() {
 	// Initialize the session manager with global settings
-	// For testing purposes, we want cookies to be sent over HTTP too (not just HTTPS)
+	// Sessions are kept in the database unless the in-memory store is configured
+	// Cookies are sent over HTTP too (not just HTTPS) unless secure cookies are configured
 	// refer to the auth.go for the authentication handlers using the sessions
+	var store userSessionStore
+	// There is no database to keep sessions in on the memory backend
+	if a.config.Session.Store != "memory" && a.config.Database.Backend != "memory" {
+		store = newPgSessionStore(a.db, a.config.Session.CleanupInterval)
+	} else {
+		store = newMemSessionStore()
+	}
+	a.sessions = store
+
+	// Failed logins and password reset requests are counted from startup
+	a.logins = newLoginThrottle(a.config.Login)
+	a.resets = newResetThrottle(a.config)
+
 	session.Global.Close()
-	session.Global = session.NewCookieManagerOptions(session.NewInMemStore(), &session.CookieMngrOptions{AllowHTTP: true})
+	// The session cookie is also marked SameSite, see sameSiteCookieManager
+	session.Global = &sameSiteCookieManager{
+		Manager:    session.NewCookieManagerOptions(store, &session.CookieMngrOptions{AllowHTTP: !a.config.Session.SecureCookies}),
+		cookieName: "sessid",
+		sameSite:   sameSiteAttributes[a.config.Session.SameSite],
+	}
 
 }
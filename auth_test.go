@@ -0,0 +1,201 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/icza/session"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// sessionCookieRequest returns a request with only the session cookie for the given session
+// attributes, not yet authenticated by requireAuth.
+func sessionCookieRequest(method, target string, cattrs map[string]interface{}) *http.Request {
+	sess := session.NewSessionOptions(&session.SessOptions{
+		CAttrs: cattrs,
+		Attrs:  map[string]interface{}{"count": 1},
+	})
+	rr := httptest.NewRecorder()
+	session.Add(sess, rr)
+
+	req := httptest.NewRequest(method, target, nil)
+	for _, c := range rr.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	return req
+}
+
+// echoUser is a handler that writes the user the request was authenticated as.
+var echoUser = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprint(w, currentUsername(r))
+})
+
+func TestRequireAuth_StoresSessionUser(t *testing.T) {
+	a := &App{}
+	req := sessionCookieRequest("GET", "/list", map[string]interface{}{"username": "alice", "userid": ""})
+
+	rr := httptest.NewRecorder()
+	a.requireAuth(echoUser).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK || rr.Body.String() != "alice" {
+		t.Errorf("Expected the handler to run as alice, got %v %q", rr.Code, rr.Body.String())
+	}
+}
+
+func TestRequireAuth_RedirectsPagesToLogin(t *testing.T) {
+	a := &App{}
+
+	for name, req := range map[string]*http.Request{
+		"no session":           httptest.NewRequest("GET", "/list", nil),
+		"session without user": sessionCookieRequest("GET", "/list", map[string]interface{}{}),
+	} {
+		rr := httptest.NewRecorder()
+		a.requireAuth(echoUser).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/login" {
+			t.Errorf("%s: expected a redirect to /login, got %v %q", name, rr.Code, rr.Header().Get("Location"))
+		}
+	}
+}
+
+func TestRequireAuth_ProtectsRoutes(t *testing.T) {
+	a := newMemoryTestApp(t, "alice")
+
+	for _, target := range []string{"/list", "/trash", "/settings", "/user-logout"} {
+		rr := httptest.NewRecorder()
+		a.Router.ServeHTTP(rr, httptest.NewRequest("GET", target, nil))
+
+		if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/login" {
+			t.Errorf("GET %s: expected a redirect to /login, got %v", target, rr.Code)
+		}
+	}
+
+	// Registering does not need a login
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, httptest.NewRequest("GET", "/register", nil))
+	if rr.Code == http.StatusSeeOther {
+		t.Errorf("Expected the registration page without logging in, got a redirect to %q", rr.Header().Get("Location"))
+	}
+}
+
+// postLogin posts the login form from the address and returns the response and the message it sets.
+func postLogin(a *App, username, password, remoteAddr string) (*httptest.ResponseRecorder, string) {
+	form := url.Values{"usrname": {username}, "psw": {password}}
+	req := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.RemoteAddr = remoteAddr
+
+	rr := httptest.NewRecorder()
+	a.loginHandler(rr, req)
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == "message" {
+			return rr, c.Value
+		}
+	}
+	return rr, ""
+}
+
+// newLoginTestApp returns an app on a stub database with a throttle that locks out after 2
+// failures and does not back off in between.
+func newLoginTestApp(t *testing.T) (*App, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error occurred while opening a stub database connection: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	a := newSQLTestApp(db)
+	a.config = &Config{Session: SessionConfig{Timeout: time.Minute}}
+	a.logins = newLoginThrottle(LoginConfig{MaxFailures: 2, MaxFailuresPerIP: 10, Lockout: time.Minute})
+	return a, mock
+}
+
+func expectPasswordHash(mock sqlmock.Sqlmock, username string, hash []byte) {
+	query := mock.ExpectQuery("SELECT password FROM users").WithArgs(username)
+	if hash == nil {
+		query.WillReturnError(sql.ErrNoRows)
+	} else {
+		query.WillReturnRows(sqlmock.NewRows([]string{"password"}).AddRow(string(hash)))
+	}
+}
+
+func expectAudit(mock sqlmock.Sqlmock, event, username string) {
+	mock.ExpectExec("INSERT INTO audit_log").WithArgs(event, username, "192.0.2.1").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+}
+
+func TestLoginHandler_SameMessageForUnknownUser(t *testing.T) {
+	a, mock := newLoginTestApp(t)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+
+	expectPasswordHash(mock, "alice", hash)
+	expectAudit(mock, auditLoginFailed, "alice")
+	expectPasswordHash(mock, "nobody", nil)
+	expectAudit(mock, auditLoginFailed, "nobody")
+
+	_, wrongPassword := postLogin(a, "alice", "guess", "192.0.2.1:1234")
+	_, unknownUser := postLogin(a, "nobody", "guess", "192.0.2.1:1234")
+
+	if wrongPassword != loginFailedMessage || unknownUser != loginFailedMessage {
+		t.Errorf("Expected %q for both, got %q and %q", loginFailedMessage, wrongPassword, unknownUser)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestLoginHandler_LocksOutAccount(t *testing.T) {
+	a, mock := newLoginTestApp(t)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+
+	for i := 0; i < 2; i++ {
+		expectPasswordHash(mock, "alice", hash)
+		expectAudit(mock, auditLoginFailed, "alice")
+		postLogin(a, "alice", "guess", "192.0.2.1:1234")
+	}
+
+	// Locked out, even with the right password, which is not checked
+	expectAudit(mock, auditLoginLocked, "alice")
+	rr, message := postLogin(a, "alice", "secret", "192.0.2.1:1234")
+
+	if message != loginLockedMessage || rr.Header().Get("Location") != "/login" {
+		t.Errorf("Expected the lockout message and a redirect to /login, got %q and %q", message, rr.Header().Get("Location"))
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestLoginHandler_SuccessClearsFailures(t *testing.T) {
+	a, mock := newLoginTestApp(t)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+
+	expectPasswordHash(mock, "alice", hash)
+	expectAudit(mock, auditLoginFailed, "alice")
+	postLogin(a, "alice", "guess", "192.0.2.1:1234")
+
+	expectPasswordHash(mock, "alice", hash)
+	mock.ExpectQuery("SELECT totp_secret FROM users").WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows([]string{"totp_secret"}).AddRow(nil))
+	rr, _ := postLogin(a, "alice", "secret", "192.0.2.1:1234")
+	if rr.Header().Get("Location") != "/list" {
+		t.Fatalf("Expected to be logged in, got a redirect to %q", rr.Header().Get("Location"))
+	}
+
+	// The earlier failure no longer counts towards a lockout
+	expectPasswordHash(mock, "alice", hash)
+	expectAudit(mock, auditLoginFailed, "alice")
+	if _, message := postLogin(a, "alice", "guess", "192.0.2.1:1234"); message != loginFailedMessage {
+		t.Errorf("Expected %q, got %q", loginFailedMessage, message)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
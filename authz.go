@@ -0,0 +1,96 @@
+// Package main contains the main entry point for the Go application
+package main
+
+import (
+	"database/sql"
+)
+
+// NoteRole describes the relationship a user has with a note.
+type NoteRole string
+
+// Roles a user can hold on a note, resolved by NoteStore.NoteRole.
+const (
+	RoleNone     NoteRole = "none"
+	RoleViewer   NoteRole = "viewer"
+	RoleDelegate NoteRole = "delegate"
+	RoleEditor   NoteRole = "editor"
+	RoleOwner    NoteRole = "owner"
+)
+
+// NoteAction is an operation a user may attempt on a note.
+type NoteAction int
+
+// Actions checked against a NoteRole before a handler touches the database.
+const (
+	ActionView NoteAction = iota
+	ActionEdit
+	ActionDelete
+	ActionShare
+	ActionDelegate
+	ActionUndelegate
+)
+
+// can reports whether the role is allowed to perform the given action.
+//   - Owners can do everything.
+//   - Editors can view, edit and delegate, but not delete or share.
+//   - Delegates can view, edit the title and description, and remove their delegation.
+//   - Viewers can only view.
+func (r NoteRole) can(action NoteAction) bool {
+	switch action {
+	case ActionView:
+		return r != RoleNone
+	case ActionEdit:
+		return r == RoleOwner || r == RoleEditor || r == RoleDelegate
+	case ActionDelete, ActionShare:
+		return r == RoleOwner
+	case ActionDelegate:
+		return r == RoleOwner || r == RoleEditor
+	case ActionUndelegate:
+		return r == RoleOwner || r == RoleDelegate
+	}
+	return false
+}
+
+// NoteRole resolves the role a user holds on a note.
+// A note that does not exist, or is in the trash, resolves to RoleNone.
+func (s *postgresStore) NoteRole(noteID int, username string) (NoteRole, error) {
+	// Fetch the owner and delegate of the note, along with the user's share (if any)
+	query := `
+		SELECT n.owner, n.noteDelegation, us.privileges
+		FROM notes n
+		LEFT JOIN user_shares us ON us.note_id = n.id AND us.username = $2
+		WHERE n.id = $1 AND n.deleted_at IS NULL
+	`
+
+	var owner, delegation, privileges sql.NullString
+	err := s.db.QueryRow(query, noteID, username).Scan(&owner, &delegation, &privileges)
+	if err == sql.ErrNoRows {
+		return RoleNone, nil
+	}
+	if err != nil {
+		return RoleNone, err
+	}
+
+	switch {
+	case owner.Valid && owner.String == username:
+		return RoleOwner, nil
+	case privileges.Valid && privileges.String == "editor":
+		return RoleEditor, nil
+	case delegation.Valid && delegation.String == username:
+		return RoleDelegate, nil
+	case privileges.Valid:
+		return RoleViewer, nil
+	}
+
+	return RoleNone, nil
+}
+
+// applyDelegateRestrictions resets every field a delegate is not allowed to change
+// back to the stored value, so a delegate can only edit the title and description.
+func applyDelegateRestrictions(note *Note, existing *Note) {
+	note.NoteType = existing.NoteType
+	note.DueAt = existing.DueAt
+	note.NoteStatus = existing.NoteStatus
+	note.NoteDelegation = existing.NoteDelegation
+	note.Tags = existing.Tags
+}
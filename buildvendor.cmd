@@ -3,4 +3,4 @@ set GO111MODULE=on
 set GOFLAGS=-mod=vendor
 go mod vendor
 :: strip debug info during build
-go build -ldflags="-s -w" .
+go build -tags sqlite_fts5 -ldflags="-s -w" .
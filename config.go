@@ -0,0 +1,694 @@
+// Package main contains the main entry point for the Go application
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds every setting the application needs at startup.
+// Values are layered: defaults, then the optional YAML file, then environment
+// variables, then command line flags.
+type Config struct {
+	Database     DatabaseConfig `yaml:"database"`
+	Server       ServerConfig   `yaml:"server"`
+	Session      SessionConfig  `yaml:"session"`
+	Login        LoginConfig    `yaml:"login"`
+	Password     PasswordConfig `yaml:"password"`
+	MFA          MFAConfig      `yaml:"mfa"`
+	Mail         MailConfig     `yaml:"mail"`
+	Trash        TrashConfig    `yaml:"trash"`
+	LogLevel     string         `yaml:"log_level"`
+	SeedDemoData bool           `yaml:"seed_demo_data"`
+	// DefaultTimezone is the IANA time zone due dates are shown in for users who have not chosen one.
+	DefaultTimezone string `yaml:"default_timezone"`
+}
+
+// DatabaseConfig holds the PostgreSQL connection and pool settings.
+// URL takes precedence over the individual connection fields when set.
+// Backend is "postgres", "sqlite" to keep everything in the SQLite file at Path,
+// or "memory" to keep everything in memory for local development.
+type DatabaseConfig struct {
+	Backend         string        `yaml:"backend"`
+	Path            string        `yaml:"path"`
+	URL             string        `yaml:"url"`
+	Host            string        `yaml:"host"`
+	Port            int           `yaml:"port"`
+	User            string        `yaml:"user"`
+	Password        string        `yaml:"password"`
+	Name            string        `yaml:"name"`
+	SSLMode         string        `yaml:"sslmode"`
+	MaxOpenConns    int           `yaml:"max_open_conns"`
+	MaxIdleConns    int           `yaml:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime"`
+}
+
+// ServerConfig holds the HTTP listener settings.
+// PublicURL is the address users reach the app at, used for links in emails.
+type ServerConfig struct {
+	BindAddress     string        `yaml:"bind_address"`
+	PublicURL       string        `yaml:"public_url"`
+	TLSCertFile     string        `yaml:"tls_cert_file"`
+	TLSKeyFile      string        `yaml:"tls_key_file"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+}
+
+// SessionConfig holds the login session settings.
+// Store is "database" to share sessions between instances and restarts, or "memory".
+// "postgres" is the earlier name for "database". SameSite is the SameSite attribute of the
+// session cookie: lax, strict or none.
+type SessionConfig struct {
+	Timeout         time.Duration `yaml:"timeout"`
+	SecureCookies   bool          `yaml:"secure_cookies"`
+	SameSite        string        `yaml:"same_site"`
+	Store           string        `yaml:"store"`
+	CleanupInterval time.Duration `yaml:"cleanup_interval"`
+}
+
+// LoginConfig limits failed logins, see loginThrottle. After each failure an account or client
+// address waits Backoff, doubled with every further failure, before it can try again, and after
+// MaxFailures failures of an account or MaxFailuresPerIP of an address it is locked out for Lockout.
+type LoginConfig struct {
+	MaxFailures      int           `yaml:"max_failures"`
+	MaxFailuresPerIP int           `yaml:"max_failures_per_ip"`
+	Backoff          time.Duration `yaml:"backoff"`
+	Lockout          time.Duration `yaml:"lockout"`
+}
+
+// PasswordConfig holds the rules new passwords must follow, see checkPassword, how long a
+// password reset link can be used, and how many reset links an account, or a client address,
+// can ask for before it has to wait for the login lockout.
+type PasswordConfig struct {
+	MinLength             int           `yaml:"min_length"`
+	RequireUpper          bool          `yaml:"require_upper"`
+	RequireLower          bool          `yaml:"require_lower"`
+	RequireDigit          bool          `yaml:"require_digit"`
+	RequireSymbol         bool          `yaml:"require_symbol"`
+	ResetTokenTTL         time.Duration `yaml:"reset_token_ttl"`
+	ResetMaxRequests      int           `yaml:"reset_max_requests"`
+	ResetMaxRequestsPerIP int           `yaml:"reset_max_requests_per_ip"`
+}
+
+// MFAConfig controls two-factor authentication with TOTP authenticator apps. When Required is
+// set, users who have not set it up are sent to the setup page until they do. Issuer is the
+// name authenticator apps show for the account.
+type MFAConfig struct {
+	Required bool   `yaml:"required"`
+	Issuer   string `yaml:"issuer"`
+}
+
+// MailConfig selects how emails such as password reset links are sent. Mailer is "log" to write
+// them to the log without the tokens of their links, "file" to append them to File, or "smtp" to
+// send them through an SMTP server.
+type MailConfig struct {
+	Mailer       string `yaml:"mailer"`
+	From         string `yaml:"from"`
+	File         string `yaml:"file"`
+	SMTPHost     string `yaml:"smtp_host"`
+	SMTPPort     int    `yaml:"smtp_port"`
+	SMTPUsername string `yaml:"smtp_username"`
+	SMTPPassword string `yaml:"smtp_password"`
+}
+
+// TrashConfig controls how long deleted notes stay in the trash before they are purged.
+type TrashConfig struct {
+	Retention     time.Duration `yaml:"retention"`
+	PurgeInterval time.Duration `yaml:"purge_interval"`
+}
+
+// defaultConfig returns the settings used when nothing else is configured.
+// They match the docker-compose setup.
+func defaultConfig() Config {
+	return Config{
+		Database: DatabaseConfig{
+			Backend:         "postgres",
+			Path:            "notes.db",
+			Host:            "notes-db",
+			Port:            5433,
+			User:            "postgres",
+			Password:        "postgres",
+			Name:            "notes",
+			SSLMode:         "disable",
+			MaxOpenConns:    25,
+			MaxIdleConns:    5,
+			ConnMaxLifetime: 30 * time.Minute,
+		},
+		Server: ServerConfig{
+			BindAddress:     "0.0.0.0:60",
+			PublicURL:       "http://localhost:60",
+			ShutdownTimeout: 15 * time.Second,
+		},
+		Session: SessionConfig{
+			Timeout:         30 * time.Minute,
+			SameSite:        "lax",
+			Store:           "database",
+			CleanupInterval: 5 * time.Minute,
+		},
+		Login: LoginConfig{
+			MaxFailures:      5,
+			MaxFailuresPerIP: 20,
+			Backoff:          time.Second,
+			Lockout:          15 * time.Minute,
+		},
+		Password: PasswordConfig{
+			MinLength:             8,
+			ResetTokenTTL:         time.Hour,
+			ResetMaxRequests:      3,
+			ResetMaxRequestsPerIP: 20,
+		},
+		MFA: MFAConfig{
+			Issuer: "Enterprise Notes",
+		},
+		Mail: MailConfig{
+			Mailer:   "log",
+			From:     "notes@localhost",
+			File:     "mail.log",
+			SMTPPort: 587,
+		},
+		Trash: TrashConfig{
+			Retention:     30 * 24 * time.Hour,
+			PurgeInterval: time.Hour,
+		},
+		LogLevel:        "info",
+		DefaultTimezone: "UTC",
+	}
+}
+
+// loadConfig builds the configuration from defaults, the config file, the environment and the
+// command line arguments. It returns the arguments left over after the flags, e.g. "migrate up".
+func loadConfig(args []string) (*Config, []string, error) {
+	cfg := defaultConfig()
+
+	// The config file can be given by flag or environment variable
+	configFile := os.Getenv("NOTES_CONFIG")
+	if file, ok := configFileFromArgs(args); ok {
+		configFile = file
+	}
+
+	if configFile != "" {
+		if err := cfg.loadFile(configFile); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := cfg.loadEnv(os.Getenv); err != nil {
+		return nil, nil, err
+	}
+
+	rest, err := cfg.loadFlags(args)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, nil, err
+	}
+
+	return &cfg, rest, nil
+}
+
+// configFileFromArgs finds the -config flag before the full flag set is parsed,
+// since the file has to be loaded before flags can override it.
+func configFileFromArgs(args []string) (string, bool) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || !strings.HasPrefix(arg, "-") {
+			break
+		}
+
+		name := strings.TrimLeft(arg, "-")
+		if value, found := strings.CutPrefix(name, "config="); found {
+			return value, true
+		}
+		if name == "config" && i+1 < len(args) {
+			return args[i+1], true
+		}
+	}
+
+	return "", false
+}
+
+// loadFile overlays the settings from a YAML file.
+func (c *Config) loadFile(fileName string) error {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+	defer f.Close()
+
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && err != io.EOF {
+		return fmt.Errorf("parsing config file %s: %w", fileName, err)
+	}
+
+	return nil
+}
+
+// loadEnv overlays the settings from environment variables.
+// The standard PG* variables are honoured so docker-compose can configure the database.
+func (c *Config) loadEnv(getenv func(string) string) error {
+	var errs []error
+
+	str := func(name string, target *string) {
+		if value := getenv(name); value != "" {
+			*target = value
+		}
+	}
+	integer := func(name string, target *int) {
+		if value := getenv(name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not a number", name, value))
+				return
+			}
+			*target = n
+		}
+	}
+	duration := func(name string, target *time.Duration) {
+		if value := getenv(name); value != "" {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not a duration", name, value))
+				return
+			}
+			*target = d
+		}
+	}
+	boolean := func(name string, target *bool) {
+		if value := getenv(name); value != "" {
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not true or false", name, value))
+				return
+			}
+			*target = b
+		}
+	}
+
+	str("DB_BACKEND", &c.Database.Backend)
+	str("DB_PATH", &c.Database.Path)
+	str("DATABASE_URL", &c.Database.URL)
+	str("PGHOST", &c.Database.Host)
+	integer("PGPORT", &c.Database.Port)
+	str("PGUSER", &c.Database.User)
+	str("PGPASSWORD", &c.Database.Password)
+	str("PGDATABASE", &c.Database.Name)
+	str("PGSSLMODE", &c.Database.SSLMode)
+	integer("DB_MAX_OPEN_CONNS", &c.Database.MaxOpenConns)
+	integer("DB_MAX_IDLE_CONNS", &c.Database.MaxIdleConns)
+	duration("DB_CONN_MAX_LIFETIME", &c.Database.ConnMaxLifetime)
+
+	// PORT only changes the port, BIND_ADDRESS replaces the whole address
+	if port := getenv("PORT"); port != "" {
+		host, _, err := net.SplitHostPort(c.Server.BindAddress)
+		if err != nil {
+			host = "0.0.0.0"
+		}
+		c.Server.BindAddress = net.JoinHostPort(host, port)
+	}
+	str("BIND_ADDRESS", &c.Server.BindAddress)
+	str("PUBLIC_URL", &c.Server.PublicURL)
+	str("TLS_CERT_FILE", &c.Server.TLSCertFile)
+	str("TLS_KEY_FILE", &c.Server.TLSKeyFile)
+	duration("SHUTDOWN_TIMEOUT", &c.Server.ShutdownTimeout)
+
+	duration("SESSION_TIMEOUT", &c.Session.Timeout)
+	boolean("SESSION_SECURE_COOKIES", &c.Session.SecureCookies)
+	str("SESSION_SAME_SITE", &c.Session.SameSite)
+	str("SESSION_STORE", &c.Session.Store)
+	duration("SESSION_CLEANUP_INTERVAL", &c.Session.CleanupInterval)
+
+	integer("LOGIN_MAX_FAILURES", &c.Login.MaxFailures)
+	integer("LOGIN_MAX_FAILURES_PER_IP", &c.Login.MaxFailuresPerIP)
+	duration("LOGIN_BACKOFF", &c.Login.Backoff)
+	duration("LOGIN_LOCKOUT", &c.Login.Lockout)
+
+	integer("PASSWORD_MIN_LENGTH", &c.Password.MinLength)
+	boolean("PASSWORD_REQUIRE_UPPER", &c.Password.RequireUpper)
+	boolean("PASSWORD_REQUIRE_LOWER", &c.Password.RequireLower)
+	boolean("PASSWORD_REQUIRE_DIGIT", &c.Password.RequireDigit)
+	boolean("PASSWORD_REQUIRE_SYMBOL", &c.Password.RequireSymbol)
+	duration("PASSWORD_RESET_TOKEN_TTL", &c.Password.ResetTokenTTL)
+	integer("PASSWORD_RESET_MAX_REQUESTS", &c.Password.ResetMaxRequests)
+	integer("PASSWORD_RESET_MAX_REQUESTS_PER_IP", &c.Password.ResetMaxRequestsPerIP)
+
+	boolean("MFA_REQUIRED", &c.MFA.Required)
+	str("MFA_ISSUER", &c.MFA.Issuer)
+
+	str("MAILER", &c.Mail.Mailer)
+	str("MAIL_FROM", &c.Mail.From)
+	str("MAIL_FILE", &c.Mail.File)
+	str("SMTP_HOST", &c.Mail.SMTPHost)
+	integer("SMTP_PORT", &c.Mail.SMTPPort)
+	str("SMTP_USERNAME", &c.Mail.SMTPUsername)
+	str("SMTP_PASSWORD", &c.Mail.SMTPPassword)
+
+	duration("TRASH_RETENTION", &c.Trash.Retention)
+	duration("TRASH_PURGE_INTERVAL", &c.Trash.PurgeInterval)
+
+	str("LOG_LEVEL", &c.LogLevel)
+	boolean("SEED_DEMO_DATA", &c.SeedDemoData)
+	str("DEFAULT_TIMEZONE", &c.DefaultTimezone)
+
+	return errors.Join(errs...)
+}
+
+// loadFlags overlays the settings from command line flags and returns the remaining arguments.
+func (c *Config) loadFlags(args []string) ([]string, error) {
+	fs := flag.NewFlagSet("notes", flag.ContinueOnError)
+
+	// Already applied by loadConfig, declared so it is accepted and listed in -help
+	fs.String("config", "", "path to a YAML config file (env NOTES_CONFIG)")
+
+	fs.StringVar(&c.Database.Backend, "db-backend", c.Database.Backend, "where notes are kept: postgres, sqlite, or memory for local development without a database (env DB_BACKEND)")
+	fs.StringVar(&c.Database.Path, "db-path", c.Database.Path, "SQLite database file for the sqlite backend (env DB_PATH)")
+	fs.StringVar(&c.Database.URL, "dsn", c.Database.URL, "PostgreSQL connection string, overrides the individual database settings (env DATABASE_URL)")
+	fs.IntVar(&c.Database.MaxOpenConns, "db-max-open-conns", c.Database.MaxOpenConns, "maximum open database connections, 0 for unlimited (env DB_MAX_OPEN_CONNS)")
+	fs.IntVar(&c.Database.MaxIdleConns, "db-max-idle-conns", c.Database.MaxIdleConns, "maximum idle database connections (env DB_MAX_IDLE_CONNS)")
+	fs.DurationVar(&c.Database.ConnMaxLifetime, "db-conn-max-lifetime", c.Database.ConnMaxLifetime, "maximum lifetime of a database connection (env DB_CONN_MAX_LIFETIME)")
+	fs.StringVar(&c.Server.BindAddress, "addr", c.Server.BindAddress, "address the HTTP server listens on (env BIND_ADDRESS, or PORT for the port only)")
+	fs.StringVar(&c.Server.PublicURL, "public-url", c.Server.PublicURL, "address users reach the app at, for links in emails (env PUBLIC_URL)")
+	fs.StringVar(&c.Server.TLSCertFile, "tls-cert", c.Server.TLSCertFile, "TLS certificate file, enables HTTPS together with -tls-key (env TLS_CERT_FILE)")
+	fs.StringVar(&c.Server.TLSKeyFile, "tls-key", c.Server.TLSKeyFile, "TLS private key file (env TLS_KEY_FILE)")
+	fs.DurationVar(&c.Server.ShutdownTimeout, "shutdown-timeout", c.Server.ShutdownTimeout, "time allowed for in-flight requests on shutdown (env SHUTDOWN_TIMEOUT)")
+	fs.DurationVar(&c.Session.Timeout, "session-timeout", c.Session.Timeout, "idle time before a login session expires (env SESSION_TIMEOUT)")
+	fs.BoolVar(&c.Session.SecureCookies, "secure-cookies", c.Session.SecureCookies, "only send session cookies over HTTPS (env SESSION_SECURE_COOKIES)")
+	fs.StringVar(&c.Session.SameSite, "session-same-site", c.Session.SameSite, "SameSite attribute of the session cookie: lax, strict or none (env SESSION_SAME_SITE)")
+	fs.StringVar(&c.Session.Store, "session-store", c.Session.Store, "where login sessions are kept: database or memory (env SESSION_STORE)")
+	fs.DurationVar(&c.Session.CleanupInterval, "session-cleanup-interval", c.Session.CleanupInterval, "how often expired sessions are deleted from the database (env SESSION_CLEANUP_INTERVAL)")
+	fs.IntVar(&c.Login.MaxFailures, "login-max-failures", c.Login.MaxFailures, "failed logins of an account before it is locked out (env LOGIN_MAX_FAILURES)")
+	fs.IntVar(&c.Login.MaxFailuresPerIP, "login-max-failures-per-ip", c.Login.MaxFailuresPerIP, "failed logins from an IP address before it is locked out (env LOGIN_MAX_FAILURES_PER_IP)")
+	fs.DurationVar(&c.Login.Backoff, "login-backoff", c.Login.Backoff, "wait after a failed login, doubled after each further failure (env LOGIN_BACKOFF)")
+	fs.DurationVar(&c.Login.Lockout, "login-lockout", c.Login.Lockout, "how long an account or IP address is locked out after too many failed logins (env LOGIN_LOCKOUT)")
+	fs.IntVar(&c.Password.MinLength, "password-min-length", c.Password.MinLength, "minimum length of new passwords (env PASSWORD_MIN_LENGTH)")
+	fs.BoolVar(&c.Password.RequireUpper, "password-require-upper", c.Password.RequireUpper, "new passwords need an upper case letter (env PASSWORD_REQUIRE_UPPER)")
+	fs.BoolVar(&c.Password.RequireLower, "password-require-lower", c.Password.RequireLower, "new passwords need a lower case letter (env PASSWORD_REQUIRE_LOWER)")
+	fs.BoolVar(&c.Password.RequireDigit, "password-require-digit", c.Password.RequireDigit, "new passwords need a digit (env PASSWORD_REQUIRE_DIGIT)")
+	fs.BoolVar(&c.Password.RequireSymbol, "password-require-symbol", c.Password.RequireSymbol, "new passwords need a character other than a letter or digit (env PASSWORD_REQUIRE_SYMBOL)")
+	fs.DurationVar(&c.Password.ResetTokenTTL, "password-reset-token-ttl", c.Password.ResetTokenTTL, "how long a password reset link can be used (env PASSWORD_RESET_TOKEN_TTL)")
+	fs.IntVar(&c.Password.ResetMaxRequests, "password-reset-max-requests", c.Password.ResetMaxRequests, "password reset links an account can ask for before it waits for the login lockout (env PASSWORD_RESET_MAX_REQUESTS)")
+	fs.IntVar(&c.Password.ResetMaxRequestsPerIP, "password-reset-max-requests-per-ip", c.Password.ResetMaxRequestsPerIP, "password reset links an IP address can ask for before it waits for the login lockout (env PASSWORD_RESET_MAX_REQUESTS_PER_IP)")
+	fs.BoolVar(&c.MFA.Required, "mfa-required", c.MFA.Required, "every user has to set up two-factor authentication (env MFA_REQUIRED)")
+	fs.StringVar(&c.MFA.Issuer, "mfa-issuer", c.MFA.Issuer, "name authenticator apps show for accounts (env MFA_ISSUER)")
+	fs.StringVar(&c.Mail.Mailer, "mailer", c.Mail.Mailer, "how emails are sent: log, file or smtp (env MAILER)")
+	fs.StringVar(&c.Mail.From, "mail-from", c.Mail.From, "sender address of emails (env MAIL_FROM)")
+	fs.StringVar(&c.Mail.File, "mail-file", c.Mail.File, "file the file mailer appends emails to (env MAIL_FILE)")
+	fs.StringVar(&c.Mail.SMTPHost, "smtp-host", c.Mail.SMTPHost, "SMTP server of the smtp mailer (env SMTP_HOST)")
+	fs.IntVar(&c.Mail.SMTPPort, "smtp-port", c.Mail.SMTPPort, "SMTP server port (env SMTP_PORT)")
+	fs.StringVar(&c.Mail.SMTPUsername, "smtp-username", c.Mail.SMTPUsername, "SMTP user name, if the server needs a login (env SMTP_USERNAME)")
+	fs.DurationVar(&c.Trash.Retention, "trash-retention", c.Trash.Retention, "how long deleted notes stay in the trash before they are purged (env TRASH_RETENTION)")
+	fs.DurationVar(&c.Trash.PurgeInterval, "trash-purge-interval", c.Trash.PurgeInterval, "how often the trash is checked for notes to purge (env TRASH_PURGE_INTERVAL)")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "log level: debug, info, warn or error (env LOG_LEVEL)")
+	fs.BoolVar(&c.SeedDemoData, "seed-demo-data", c.SeedDemoData, "import the demo users and notes into an empty database (env SEED_DEMO_DATA)")
+	fs.StringVar(&c.DefaultTimezone, "default-timezone", c.DefaultTimezone, "time zone for due dates of users who have not chosen one, e.g. Pacific/Auckland (env DEFAULT_TIMEZONE)")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	return fs.Args(), nil
+}
+
+// validate checks the configuration for mistakes and reports all of them at once.
+func (c *Config) validate() error {
+	var errs []error
+
+	switch {
+	case c.Database.Backend != "postgres" && c.Database.Backend != "sqlite" && c.Database.Backend != "memory":
+		errs = append(errs, fmt.Errorf("database backend %q must be postgres, sqlite or memory", c.Database.Backend))
+	case c.Database.Backend == "memory":
+		// Nothing to connect to
+	case c.Database.Backend == "sqlite":
+		if c.Database.Path == "" {
+			errs = append(errs, errors.New("database path is required for the sqlite backend"))
+		}
+	case c.Database.URL != "":
+		if _, err := pgx.ParseConfig(c.Database.URL); err != nil {
+			errs = append(errs, errors.New("database url is not a valid PostgreSQL connection string"))
+		}
+	default:
+		if c.Database.Host == "" {
+			errs = append(errs, errors.New("database host is required"))
+		}
+		if c.Database.Port < 1 || c.Database.Port > 65535 {
+			errs = append(errs, fmt.Errorf("database port %d is out of range", c.Database.Port))
+		}
+		if c.Database.User == "" {
+			errs = append(errs, errors.New("database user is required"))
+		}
+		if c.Database.Name == "" {
+			errs = append(errs, errors.New("database name is required"))
+		}
+	}
+
+	if c.Database.MaxOpenConns < 0 {
+		errs = append(errs, errors.New("database max open connections cannot be negative"))
+	}
+	if c.Database.MaxIdleConns < 0 {
+		errs = append(errs, errors.New("database max idle connections cannot be negative"))
+	}
+	if c.Database.MaxOpenConns > 0 && c.Database.MaxIdleConns > c.Database.MaxOpenConns {
+		errs = append(errs, errors.New("database max idle connections cannot exceed max open connections"))
+	}
+	if c.Database.ConnMaxLifetime < 0 {
+		errs = append(errs, errors.New("database connection max lifetime cannot be negative"))
+	}
+
+	if _, _, err := net.SplitHostPort(c.Server.BindAddress); err != nil {
+		errs = append(errs, fmt.Errorf("bind address %q must be host:port", c.Server.BindAddress))
+	}
+	if u, err := url.Parse(c.Server.PublicURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("public url %q must be an http or https URL", c.Server.PublicURL))
+	}
+	if (c.Server.TLSCertFile == "") != (c.Server.TLSKeyFile == "") {
+		errs = append(errs, errors.New("TLS needs both a certificate file and a key file"))
+	}
+	for _, file := range []string{c.Server.TLSCertFile, c.Server.TLSKeyFile} {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			errs = append(errs, fmt.Errorf("TLS file %s is not readable", file))
+		}
+	}
+	if c.Server.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("shutdown timeout must be positive"))
+	}
+
+	if c.Session.Timeout <= 0 {
+		errs = append(errs, errors.New("session timeout must be positive"))
+	}
+	if _, ok := sameSiteAttributes[c.Session.SameSite]; !ok {
+		errs = append(errs, fmt.Errorf("session same site %q must be lax, strict or none", c.Session.SameSite))
+	} else if c.Session.SameSite == "none" && !c.Session.SecureCookies {
+		errs = append(errs, errors.New("session same site none needs secure cookies"))
+	}
+	if c.Session.Store != "database" && c.Session.Store != "postgres" && c.Session.Store != "memory" {
+		errs = append(errs, fmt.Errorf("session store %q must be database or memory", c.Session.Store))
+	}
+	if c.Session.CleanupInterval <= 0 {
+		errs = append(errs, errors.New("session cleanup interval must be positive"))
+	}
+
+	if c.Login.MaxFailures < 1 {
+		errs = append(errs, errors.New("login max failures must be at least 1"))
+	}
+	if c.Login.MaxFailuresPerIP < 1 {
+		errs = append(errs, errors.New("login max failures per ip must be at least 1"))
+	}
+	if c.Login.Backoff < 0 {
+		errs = append(errs, errors.New("login backoff cannot be negative"))
+	}
+	if c.Login.Lockout <= 0 {
+		errs = append(errs, errors.New("login lockout must be positive"))
+	}
+
+	if c.Password.MinLength < 1 || c.Password.MinLength > maxPasswordLength {
+		errs = append(errs, fmt.Errorf("password min length must be between 1 and %d", maxPasswordLength))
+	}
+	if c.Password.ResetTokenTTL <= 0 {
+		errs = append(errs, errors.New("password reset token ttl must be positive"))
+	}
+	if c.Password.ResetMaxRequests < 1 {
+		errs = append(errs, errors.New("password reset max requests must be at least 1"))
+	}
+	if c.Password.ResetMaxRequestsPerIP < 1 {
+		errs = append(errs, errors.New("password reset max requests per ip must be at least 1"))
+	}
+
+	if strings.TrimSpace(c.MFA.Issuer) == "" || strings.Contains(c.MFA.Issuer, ":") {
+		errs = append(errs, fmt.Errorf("mfa issuer %q must be a name without a colon", c.MFA.Issuer))
+	}
+
+	switch c.Mail.Mailer {
+	case "log":
+	case "file":
+		if c.Mail.File == "" {
+			errs = append(errs, errors.New("mail file is required for the file mailer"))
+		}
+	case "smtp":
+		if c.Mail.SMTPHost == "" {
+			errs = append(errs, errors.New("smtp host is required for the smtp mailer"))
+		}
+		if c.Mail.SMTPPort < 1 || c.Mail.SMTPPort > 65535 {
+			errs = append(errs, fmt.Errorf("smtp port %d is out of range", c.Mail.SMTPPort))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("mailer %q must be log, file or smtp", c.Mail.Mailer))
+	}
+	if _, err := mail.ParseAddress(c.Mail.From); err != nil {
+		errs = append(errs, fmt.Errorf("mail from %q is not an email address", c.Mail.From))
+	}
+
+	if c.Trash.Retention <= 0 {
+		errs = append(errs, errors.New("trash retention must be positive"))
+	}
+	if c.Trash.PurgeInterval <= 0 {
+		errs = append(errs, errors.New("trash purge interval must be positive"))
+	}
+
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		errs = append(errs, err)
+	}
+
+	if _, err := time.LoadLocation(c.DefaultTimezone); err != nil || c.DefaultTimezone == "" {
+		errs = append(errs, fmt.Errorf("default time zone %q is not a known time zone", c.DefaultTimezone))
+	}
+
+	return errors.Join(errs...)
+}
+
+// databaseDSN returns the connection string for the database.
+func (c *Config) databaseDSN() string {
+	if c.Database.URL != "" {
+		return c.Database.URL
+	}
+
+	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+		quoteDSNValue(c.Database.Host), c.Database.Port, quoteDSNValue(c.Database.User),
+		quoteDSNValue(c.Database.Password), quoteDSNValue(c.Database.Name), quoteDSNValue(c.Database.SSLMode))
+}
+
+// quoteDSNValue quotes a keyword/value connection string value so spaces and quotes survive.
+func quoteDSNValue(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `'`, `\'`)
+	return "'" + value + "'"
+}
+
+// String prints the effective configuration with the database and SMTP passwords redacted.
+func (c Config) String() string {
+	database := fmt.Sprintf("host=%s port=%d user=%s dbname=%s sslmode=%s",
+		c.Database.Host, c.Database.Port, c.Database.User, c.Database.Name, c.Database.SSLMode)
+	hasPassword := c.Database.Password != ""
+	if c.Database.URL != "" {
+		// Only print what pgx understood from the URL, never the URL itself
+		database = "(from url)"
+		hasPassword = true
+		if parsed, err := pgx.ParseConfig(c.Database.URL); err == nil {
+			database = fmt.Sprintf("host=%s port=%d user=%s dbname=%s (from url)",
+				parsed.Host, parsed.Port, parsed.User, parsed.Database)
+			hasPassword = parsed.Password != ""
+		}
+	}
+
+	password := "(none)"
+	if hasPassword {
+		password = "********"
+	}
+
+	tls := "off"
+	if c.Server.TLSCertFile != "" {
+		tls = fmt.Sprintf("cert=%s key=%s", c.Server.TLSCertFile, c.Server.TLSKeyFile)
+	}
+
+	mailer := fmt.Sprintf("%s from=%s", c.Mail.Mailer, c.Mail.From)
+	switch c.Mail.Mailer {
+	case "file":
+		mailer += " file=" + c.Mail.File
+	case "smtp":
+		mailer += fmt.Sprintf(" host=%s port=%d user=%s", c.Mail.SMTPHost, c.Mail.SMTPPort, c.Mail.SMTPUsername)
+		if c.Mail.SMTPPassword != "" {
+			mailer += " password=********"
+		}
+	}
+
+	var b strings.Builder
+	switch c.Database.Backend {
+	case "memory":
+		database = "in memory, nothing is kept after the server stops"
+	case "sqlite":
+		database = "sqlite " + c.Database.Path
+	}
+
+	fmt.Fprintf(&b, "  database:        %s\n", database)
+	fmt.Fprintf(&b, "  db password:     %s\n", password)
+	fmt.Fprintf(&b, "  db pool:         max_open=%d max_idle=%d conn_max_lifetime=%s\n",
+		c.Database.MaxOpenConns, c.Database.MaxIdleConns, c.Database.ConnMaxLifetime)
+	fmt.Fprintf(&b, "  bind address:    %s\n", c.Server.BindAddress)
+	fmt.Fprintf(&b, "  public url:      %s\n", c.Server.PublicURL)
+	fmt.Fprintf(&b, "  tls:             %s\n", tls)
+	fmt.Fprintf(&b, "  shutdown:        %s\n", c.Server.ShutdownTimeout)
+	fmt.Fprintf(&b, "  session:         timeout=%s secure_cookies=%t same_site=%s store=%s cleanup_interval=%s\n",
+		c.Session.Timeout, c.Session.SecureCookies, c.Session.SameSite, c.Session.Store, c.Session.CleanupInterval)
+	fmt.Fprintf(&b, "  login:           max_failures=%d max_failures_per_ip=%d backoff=%s lockout=%s\n",
+		c.Login.MaxFailures, c.Login.MaxFailuresPerIP, c.Login.Backoff, c.Login.Lockout)
+	fmt.Fprintf(&b, "  password:        min_length=%d require_upper=%t require_lower=%t require_digit=%t require_symbol=%t reset_token_ttl=%s reset_max_requests=%d reset_max_requests_per_ip=%d\n",
+		c.Password.MinLength, c.Password.RequireUpper, c.Password.RequireLower, c.Password.RequireDigit,
+		c.Password.RequireSymbol, c.Password.ResetTokenTTL, c.Password.ResetMaxRequests, c.Password.ResetMaxRequestsPerIP)
+	fmt.Fprintf(&b, "  mfa:             required=%t issuer=%s\n", c.MFA.Required, c.MFA.Issuer)
+	fmt.Fprintf(&b, "  mail:            %s\n", mailer)
+	fmt.Fprintf(&b, "  trash:           retention=%s purge_interval=%s\n", c.Trash.Retention, c.Trash.PurgeInterval)
+	fmt.Fprintf(&b, "  log level:       %s\n", c.LogLevel)
+	fmt.Fprintf(&b, "  seed demo data:  %t\n", c.SeedDemoData)
+	fmt.Fprintf(&b, "  time zone:       %s", c.DefaultTimezone)
+
+	return b.String()
+}
+
+// parseLogLevel converts a configured log level name to a slog level.
+func parseLogLevel(level string) (slog.Level, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info", "":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+
+	return slog.LevelInfo, fmt.Errorf("log level %q must be debug, info, warn or error", level)
+}
+
+// setupLogging sets up slog at the configured level: debug traces requests and sessions, info adds
+// background jobs and the audit events, warn lockouts and error failures that do not stop the server.
+// The standard logger keeps writing straight to stderr whatever the level, so the startup messages
+// and the fatal errors that stop the server are never filtered out.
+func setupLogging(level string) {
+	lvl, err := parseLogLevel(level)
+	if err != nil {
+		lvl = slog.LevelInfo
+	}
+
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: lvl})))
+	// SetDefault sends the standard logger through the handler, at info level
+	log.SetOutput(os.Stderr)
+	log.SetFlags(log.LstdFlags)
+}
@@ -0,0 +1,141 @@
+// Package main contains the main entry point for the Go application
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/icza/session"
+)
+
+// Forms and scripts send the CSRF token of the session with every request that changes something,
+// as the csrf_token form field or the X-CSRF-Token header. Another site can make the browser send
+// the session cookie, but cannot read the token from our pages.
+const (
+	csrfFormField   = "csrf_token"
+	csrfHeader      = "X-CSRF-Token"
+	csrfSessionAttr = "csrf_token"
+)
+
+// csrfExemptPaths are the forms posted before there is a session to act for.
+var csrfExemptPaths = map[string]bool{
+	"/login":    true,
+	"/register": true,
+}
+
+// csrfToken returns the CSRF token of the request's session, creating it the first time,
+// or "" if there is no session.
+func csrfToken(r *http.Request) string {
+	sess := session.Get(r)
+	if sess == nil {
+		return ""
+	}
+	if token, ok := sess.Attr(csrfSessionAttr).(string); ok && token != "" {
+		return token
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	sess.SetAttr(csrfSessionAttr, token)
+	return token
+}
+
+// csrfSafeMethod reports whether requests with the method only read, and need no token.
+func csrfSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// csrfMiddleware rejects requests that change something on behalf of a session cookie
+// without the session's CSRF token. API requests with an Authorization header, which the
+// browser does not send by itself and which tokenAuthMiddleware authenticates instead of the
+// session, and requests without a session are passed through.
+func (a *App) csrfMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bearer := isAPIRequest(r) && r.Header.Get("Authorization") != ""
+		if csrfSafeMethod(r.Method) || csrfExemptPaths[r.URL.Path] || bearer || session.Get(r) == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		sent := r.Header.Get(csrfHeader)
+		if sent == "" {
+			sent = r.PostFormValue(csrfFormField)
+		}
+		expected := csrfToken(r)
+		if expected == "" || subtle.ConstantTimeCompare([]byte(sent), []byte(expected)) != 1 {
+			if isAPIRequest(r) {
+				respondWithError(w, http.StatusForbidden, "Missing or invalid CSRF token")
+			} else {
+				http.Error(w, "Forbidden: missing or invalid CSRF token, reload the page and try again", http.StatusForbidden)
+			}
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// csrfFuncs are the template functions that add the session's CSRF token to forms and scripts:
+// {{csrfField}} inside a form, and {{csrfToken}} for the X-CSRF-Token header of requests from scripts.
+func csrfFuncs(r *http.Request) template.FuncMap {
+	return template.FuncMap{
+		"csrfToken": func() string {
+			return csrfToken(r)
+		},
+		"csrfField": func() template.HTML {
+			return template.HTML(`<input type="hidden" name="` + csrfFormField + `" value="` +
+				template.HTMLEscapeString(csrfToken(r)) + `">`)
+		},
+	}
+}
+
+// sameSiteCookieManager sets the SameSite attribute of the session cookie, which the session
+// package does not, so browsers leave the cookie off requests started by other sites.
+type sameSiteCookieManager struct {
+	session.Manager
+	cookieName string
+	sameSite   string
+}
+
+// Add is to implement session.Manager.Add().
+func (m *sameSiteCookieManager) Add(sess session.Session, w http.ResponseWriter) {
+	m.Manager.Add(sess, w)
+	m.setSameSite(w)
+}
+
+// Remove is to implement session.Manager.Remove().
+func (m *sameSiteCookieManager) Remove(sess session.Session, w http.ResponseWriter) {
+	m.Manager.Remove(sess, w)
+	m.setSameSite(w)
+}
+
+// setSameSite adds the SameSite attribute to the session cookie the manager has just set.
+func (m *sameSiteCookieManager) setSameSite(w http.ResponseWriter) {
+	if m.sameSite == "" {
+		return
+	}
+	cookies := w.Header()["Set-Cookie"]
+	for i, cookie := range cookies {
+		if strings.HasPrefix(cookie, m.cookieName+"=") && !strings.Contains(cookie, "SameSite=") {
+			cookies[i] = cookie + "; SameSite=" + m.sameSite
+		}
+	}
+}
+
+// sameSiteAttributes are the SameSite values of the session.same_site setting.
+var sameSiteAttributes = map[string]string{
+	"lax":    "Lax",
+	"strict": "Strict",
+	"none":   "None",
+}
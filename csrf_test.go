@@ -0,0 +1,126 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/icza/session"
+)
+
+// postForm posts a form through the router as the user, with the session's CSRF token if withToken is set.
+func postForm(a *App, target string, form url.Values, username string, withToken bool) *httptest.ResponseRecorder {
+	sessionReq := withSession(httptest.NewRequest("GET", "/", nil), username)
+	if withToken {
+		form.Set(csrfFormField, csrfToken(sessionReq))
+	}
+
+	req := httptest.NewRequest("POST", target, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range sessionReq.Cookies() {
+		req.AddCookie(c)
+	}
+
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestCSRF_RejectsFormWithoutToken(t *testing.T) {
+	a, mock := newAPITestApp(t)
+
+	rr := postForm(a, "/share", url.Values{"Id": {"1"}, "SharedUsername": {"bob"}, "Privileges": {"viewer"}}, "alice", false)
+
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusForbidden)
+	}
+
+	// The handler never ran
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestCSRF_AcceptsFormToken(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	expectNoteRole(mock, 1, "bob", "alice", nil, "viewer")
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM user_shares").WithArgs("bob", 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	rr := postForm(a, "/remove-shared-note", url.Values{"noteID": {"1"}, "username": {"bob"}}, "bob", true)
+
+	if rr.Code != http.StatusSeeOther {
+		t.Errorf("Handler returned wrong status code: got %v, want %v: %s", rr.Code, http.StatusSeeOther, rr.Body.String())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestCSRF_RejectsAPIRequestWithWrongToken(t *testing.T) {
+	a, _ := newAPITestApp(t)
+
+	req := httptest.NewRequest("DELETE", "/api/v1/notes/1", nil)
+	req = withSession(req, "alice")
+	req.Header.Set(csrfHeader, "not-the-token")
+
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusForbidden)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected a JSON error, got Content-Type %q", ct)
+	}
+}
+
+func TestCSRF_MutatingRoutesArePostOnly(t *testing.T) {
+	a, _ := newAPITestApp(t)
+
+	for _, target := range []string{"/create", "/update", "/delete", "/share", "/update-privileges", "/remove-shared-note"} {
+		req := withSession(httptest.NewRequest("GET", target, nil), "alice")
+		rr := httptest.NewRecorder()
+		a.Router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusMethodNotAllowed {
+			t.Errorf("GET %s returned %v, want %v", target, rr.Code, http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func TestCSRFField_HasSessionToken(t *testing.T) {
+	req := withSession(httptest.NewRequest("GET", "/list", nil), "alice")
+	token := csrfToken(req)
+	if token == "" || csrfToken(req) != token {
+		t.Fatalf("Expected the same token for the session each time, got %q", token)
+	}
+
+	field := csrfFuncs(req)["csrfField"].(func() template.HTML)()
+	if !strings.Contains(string(field), `name="csrf_token" value="`+token+`"`) {
+		t.Errorf("Expected a hidden field with the token, got %s", field)
+	}
+}
+
+func TestSameSiteCookieManager(t *testing.T) {
+	m := &sameSiteCookieManager{
+		Manager:    session.NewCookieManagerOptions(session.NewInMemStore(), &session.CookieMngrOptions{AllowHTTP: true}),
+		cookieName: "sessid",
+		sameSite:   sameSiteAttributes["strict"],
+	}
+	defer m.Close()
+
+	rr := httptest.NewRecorder()
+	m.Add(session.NewSession(), rr)
+
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "sessid" || cookies[0].SameSite != http.SameSiteStrictMode {
+		t.Errorf("Expected a SameSite=Strict session cookie, got %v", rr.Header()["Set-Cookie"])
+	}
+}
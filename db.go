@@ -3,174 +3,51 @@ package main
 import (
 	"database/sql"
 	"fmt"
+	"strconv"
 	"strings"
 )
 
-// retrieveNotes fetches notes for a given username including shared users' data.
-func (a *App) retrieveNotes(username string) ([]Note, error) {
-	// Prepare the SQL statement for fetching notes and shared users' data
-	query := `
-		SELECT
-		n.id, n.title, n.noteType, n.description, n.noteCreated, n.taskCompletionTime, n.taskCompletionDate, n.noteStatus, n.noteDelegation, n.owner, u.username, us.privileges
-		FROM
-			notes n
-		LEFT JOIN
-			user_shares us ON n.id = us.note_id
-		LEFT JOIN
-			users u ON us.username = u.username
-		WHERE
-			n.owner = $1
-	`
-
-	stmt, err := a.db.Prepare(query)
-	if err != nil {
-		return nil, err
-	}
-	defer stmt.Close()
-
-	rows, err := stmt.Query(username)
-	if err != nil {
-		return nil, err
-	}
-
-	defer rows.Close()
-
-	notesMap := make(map[int]Note)
-	for rows.Next() {
-		var note Note
-		var sharedUser UserShare
-
-		err := rows.Scan(
-			&note.ID, &note.Title, &note.NoteType, &note.Description, &note.NoteCreated,
-			&note.TaskCompletionTime, &note.TaskCompletionDate, &note.NoteStatus,
-			&note.NoteDelegation, &note.Owner,
-			&sharedUser.Username, &sharedUser.Privileges,
-		)
-		if err != nil {
-			return nil, err
-		}
+// postgresStore keeps notes, users and shares in PostgreSQL. It implements Store.
+type postgresStore struct {
+	db *sql.DB
+}
 
-		// Append shared users to the note
-		note.SharedUsers = append(note.SharedUsers, sharedUser)
+// newPostgresStore returns a store on the database.
+func newPostgresStore(db *sql.DB) *postgresStore {
+	return &postgresStore{db: db}
+}
 
-		// Store the note in a map using its ID as the key
-		notesMap[note.ID] = note
+// CreateUser adds a user with a bcrypt password hash, or returns errUserExists if the name is taken.
+func (s *postgresStore) CreateUser(username string, passwordHash []byte) error {
+	var existing string
+	err := s.db.QueryRow("SELECT username FROM users WHERE username = $1", username).Scan(&existing)
+	if err == nil {
+		return errUserExists
 	}
-
-	// Convert the map of notes to a slice
-	notes := make([]Note, 0, len(notesMap))
-	for _, note := range notesMap {
-		notes = append(notes, note)
+	if err != sql.ErrNoRows {
+		return err
 	}
 
-	return notes, nil
-}
-
-// retrieveDelegatedNotes fetches notes delegated to a given username.
-func (a *App) retrieveDelegatedNotes(username string) ([]Note, error) {
-    // Prepare the SQL statement for fetching delegated notes
-    query := `
-        SELECT
-            n.id, n.title, n.noteType, n.description, n.noteCreated, n.taskCompletionTime, n.taskCompletionDate, n.noteStatus, n.noteDelegation, n.owner
-        FROM
-            notes n
-        WHERE
-            n.noteDelegation = $1
-    `
-
-    stmt, err := a.db.Prepare(query)
-    if err != nil {
-        return nil, err
-    }
-    defer stmt.Close()
-
-    rows, err := stmt.Query(username)
-    if err != nil {
-        return nil, err
-    }
-    defer rows.Close()
-
-    var delegatedNotes []Note
-    for rows.Next() {
-        var note Note
-
-        err := rows.Scan(
-			&note.ID,
-            &note.Title,
-            &note.NoteType,
-            &note.Description,
-            &note.NoteCreated,
-            &note.TaskCompletionTime,
-            &note.TaskCompletionDate,
-            &note.NoteStatus,
-            &note.NoteDelegation,
-            &note.Owner,
-        )
-        if err != nil {
-            return nil, err
-        }
-
-        delegatedNotes = append(delegatedNotes, note)
-    }
-
-    return delegatedNotes, nil
+	_, err = s.db.Exec("INSERT INTO users(username, password) VALUES($1, $2)", username, passwordHash)
+	return err
 }
 
-// retrieveSharedNotesWithPrivileges fetches shared notes for a given username with privileges.
-func (a *App) retrieveSharedNotesWithPrivileges(username string) ([]Note, error) {
-	// Prepare the SQL statement for fetching shared notes with privileges
-	query := `
-		SELECT n.*, us.privileges
-		FROM notes n
-		INNER JOIN user_shares us ON n.id = us.note_id
-		WHERE us.username = $1
-	`
-
-	stmt, err := a.db.Prepare(query)
-	if err != nil {
-		return nil, err
-	}
-	defer stmt.Close()
-
-	rows, err := stmt.Query(username)
+// PasswordHash returns the user's bcrypt password hash, or sql.ErrNoRows if there is no such user.
+func (s *postgresStore) PasswordHash(username string) ([]byte, error) {
+	var hash string
+	err := s.db.QueryRow("SELECT password FROM users WHERE username = $1", username).Scan(&hash)
 	if err != nil {
 		return nil, err
 	}
-
-	var sharedNotes []Note
-	for rows.Next() {
-		var sharedNote Note
-
-		err := rows.Scan(
-			&sharedNote.ID,
-			&sharedNote.Title,
-			&sharedNote.NoteType,
-			&sharedNote.Description,
-			&sharedNote.NoteCreated,
-			&sharedNote.TaskCompletionTime,
-			&sharedNote.TaskCompletionDate,
-			&sharedNote.NoteStatus,
-			&sharedNote.NoteDelegation,
-			&sharedNote.Owner,
-			&sharedNote.FTSText,
-			&sharedNote.Privileges, // Retrieve the 'privileges' field
-		)
-		if err != nil {
-			return nil, err
-		}
-
-		sharedNotes = append(sharedNotes, sharedNote)
-	}
-
-	return sharedNotes, nil
+	return []byte(hash), nil
 }
 
-// getAllUsers fetches all users except the owner.
-func (a *App) getAllUsers(ownerUsername string) ([]User, error) {
+// OtherUsers fetches all users except the owner.
+func (s *postgresStore) OtherUsers(ownerUsername string) ([]User, error) {
 	// Prepare the SQL statement for fetching all users except the owner
 	query := "SELECT username FROM users WHERE username != $1"
 
-	stmt, err := a.db.Prepare(query)
+	stmt, err := s.db.Prepare(query)
 	if err != nil {
 		return nil, err
 	}
@@ -198,15 +75,15 @@ func (a *App) getAllUsers(ownerUsername string) ([]User, error) {
 	return users, nil
 }
 
-// getSharedUsersForNote retrieves shared users and their privileges for a given noteID.
-func (a *App) getSharedUsersForNote(noteID int) ([]UserShare, error) {
+// NoteShares retrieves shared users and their privileges for a given noteID.
+func (s *postgresStore) NoteShares(noteID int) ([]UserShare, error) {
     // Initialize a slice to store the shared users
     var sharedUsers []UserShare
 
     // Prepare the SQL statement for fetching shared users and their privileges for the given noteID
     query := "SELECT username, privileges FROM user_shares WHERE note_id = $1"
 
-    stmt, err := a.db.Prepare(query)
+    stmt, err := s.db.Prepare(query)
     if err != nil {
         return nil, err
     }
@@ -245,17 +122,95 @@ func (a *App) getSharedUsersForNote(noteID int) ([]UserShare, error) {
     return sharedUsers, nil
 }
 
-// updateNoteInDatabase updates note fields in the database.
-func (a *App) updateNoteInDatabase(note Note) error {
+// SharedUsers retrieves the shared users of several notes in one query,
+// keyed by note ID. Notes that are not shared have no entry.
+func (s *postgresStore) SharedUsers(noteIDs []int) (map[int][]UserShare, error) {
+	sharedUsers := make(map[int][]UserShare)
+	if len(noteIDs) == 0 {
+		return sharedUsers, nil
+	}
+
+	rows, err := s.db.Query(`
+		SELECT note_id, username, privileges FROM user_shares
+		WHERE note_id = ANY($1::int[])
+		ORDER BY note_id, username
+	`, pgIntArray(noteIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var noteID int
+		var user UserShare
+		if err := rows.Scan(&noteID, &user.Username, &user.Privileges); err != nil {
+			return nil, err
+		}
+		sharedUsers[noteID] = append(sharedUsers[noteID], user)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sharedUsers, nil
+}
+
+// attachSharedUsers sets the shared users of each note, loading them with one SharedUsers call.
+func (a *App) attachSharedUsers(notes []Note) error {
+	noteIDs := make([]int, len(notes))
+	for i, note := range notes {
+		noteIDs[i] = note.ID
+	}
+
+	sharedUsers, err := a.shares.SharedUsers(noteIDs)
+	if err != nil {
+		return err
+	}
+	for i := range notes {
+		notes[i].SharedUsers = sharedUsers[notes[i].ID]
+	}
+	return nil
+}
+
+// pgIntArray formats IDs as a PostgreSQL array literal.
+func pgIntArray(ids []int) string {
+	values := make([]string, len(ids))
+	for i, id := range ids {
+		values[i] = strconv.Itoa(id)
+	}
+	return "{" + strings.Join(values, ",") + "}"
+}
+
+// UpdateNote updates note fields and tags in the database and records the
+// updated note as a new revision edited by editedBy. It returns errUserNotFound
+// if the note is delegated to a user that does not exist.
+func (s *postgresStore) UpdateNote(note Note, editedBy string) error {
+	return updateNote(s.db, note, editedBy, setNoteTags)
+}
+
+// updateNote updates a note, writing its tags with setTags, and records the new revision.
+func updateNote(db *sql.DB, note Note, editedBy string, setTags func(tx *sql.Tx, noteID int, tags []string) error) error {
+	// The update, tags and revision are written together or not at all
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := checkDelegate(tx, note.NoteDelegation.String); err != nil {
+		return err
+	}
+
 	// Prepare the SQL statement for updating note fields
 	updateQuery := `
         UPDATE notes
         SET title = $1, noteType = $2, description = $3,
-        taskcompletiontime = $4, taskcompletiondate = $5, notestatus = $6, notedelegation = $7
-        WHERE id = $8
+        due_at = $4, notestatus = $5, notedelegation = $6
+        WHERE id = $7
     `
 
-	updateStmt, err := a.db.Prepare(updateQuery)
+	updateStmt, err := tx.Prepare(updateQuery)
 	if err != nil {
 		return err
 	}
@@ -265,8 +220,7 @@ func (a *App) updateNoteInDatabase(note Note) error {
 		note.Title,
 		note.NoteType,
 		note.Description,
-		note.TaskCompletionTime.String,
-		note.TaskCompletionDate.String,
+		note.DueAt,
 		note.NoteStatus.String,
 		note.NoteDelegation.String,
 		note.ID,
@@ -275,130 +229,171 @@ func (a *App) updateNoteInDatabase(note Note) error {
 		return err
 	}
 
-	// Prepare the SQL statement for recalculating the fts_text field
-	recalculateQuery := `
-        UPDATE notes
-        SET fts_text = to_tsvector('english', title || ' ' || noteType || ' ' || description || ' ' || taskcompletiontime || ' ' || taskcompletiondate || ' ' || notestatus || ' ' || notedelegation)
-        WHERE id = $1
-    `
-
-	recalculateStmt, err := a.db.Prepare(recalculateQuery)
-	if err != nil {
+	if err := setTags(tx, note.ID, note.Tags); err != nil {
 		return err
 	}
-	defer recalculateStmt.Close()
 
-	_, err = recalculateStmt.Exec(note.ID)
-	if err != nil {
+	// Keep a snapshot of the note as it is now
+	if err := recordNoteRevision(tx, note.ID, editedBy); err != nil {
 		return err
 	}
 
-	return nil
+	return tx.Commit()
 }
 
-// insertNoteIntoDatabase inserts a new note into the database.
-func (a *App) insertNoteIntoDatabase(note Note) error {
-	// Prepare the SQL statement for inserting a new note
+// CreateNote inserts a new note and its tags into the database and returns its ID.
+// The new note is also recorded as its first revision. It returns errUserNotFound
+// if the note is delegated to a user that does not exist.
+func (s *postgresStore) CreateNote(note Note) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if err := checkDelegate(tx, note.NoteDelegation.String); err != nil {
+		return 0, err
+	}
+
+	// Prepare the SQL statement for inserting a new note and its first revision
 	insertQuery := `
-        INSERT INTO notes (title, noteType, description, TaskCompletionDate, TaskCompletionTime, NoteStatus, NoteDelegation, owner, fts_text)
-		VALUES (
-			$1::text, $2::text, $3::text, $4::text, $5::text, $6::text, $7::text, $8::text,
-			to_tsvector('english', $1::text || ' ' || $2::text || ' ' || $3::text || ' ' || $4::text || ' ' || $5::text || ' ' || $6::text || ' ' || $7::text)
+		WITH inserted AS (
+			INSERT INTO notes (title, noteType, description, due_at, NoteStatus, NoteDelegation, owner)
+			VALUES ($1::text, $2::text, $3::text, $4::timestamptz, $5::text, $6::text, $7::text)
+			RETURNING *
 		)
+		INSERT INTO note_revisions (note_id, revision, edited_by, edited_at, title, noteType, description,
+			due_at, noteStatus, noteDelegation)
+		SELECT id, 1, owner, noteCreated, title, noteType, description,
+			due_at, noteStatus, noteDelegation
+		FROM inserted
+		RETURNING note_id
 		`
 
-	insertStmt, err := a.db.Prepare(insertQuery)
+	insertStmt, err := tx.Prepare(insertQuery)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer insertStmt.Close()
 
-	_, err = insertStmt.Exec(
+	var id int
+	err = insertStmt.QueryRow(
 		note.Title,
 		note.NoteType,
 		note.Description,
-		note.TaskCompletionDate.String,
-		note.TaskCompletionTime.String,
+		note.DueAt,
 		note.NoteStatus.String,
 		note.NoteDelegation.String,
 		note.Owner,
-	)
+	).Scan(&id)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	return nil
+	if len(note.Tags) > 0 {
+		if err := setNoteTags(tx, id, note.Tags); err != nil {
+			return 0, err
+		}
+	}
+
+	return id, tx.Commit()
 }
 
-// searchNotesInDatabase searches notes in the database based on a search query.
-func (a *App) searchNotesInDatabase(searchQuery string, username string) ([]Note, error) {
+// SearchNotes searches the notes the user owns, has been delegated or has been shared.
+// The best matches come first, ranked by ts_rank_cd on the weighted search text,
+// and each note has its title and a snippet of its description with the matches marked.
+// A search with only qualifiers lists every matching note, newest first.
+func (s *postgresStore) SearchNotes(search searchQuery, username string) ([]Note, error) {
     // // isValidSearchQuery checks if the search query is valid. would alter search results so didn't keep
 	/*if !isValidSearchQuery(searchQuery) {
         fmt.Printf("Invalid search query")
         return []Note{}, nil
     }*/
-	
-	// Prepare the SQL statement for searching notes
-
-	// Can only search for "My Notes/Tasks" and "Notes/Tasks delegated to me" cant search for notes in "Notes/Tasks shared with me"
-
-    query := `
-        SELECT notes.id, notes.title, notes.noteType, notes.description, notes.noteCreated,
-               notes.taskCompletionDate, notes.taskCompletionTime, notes.noteStatus, notes.noteDelegation, notes.owner,
-               user_shares.username AS shared_username
-        FROM notes
-        LEFT JOIN user_shares ON notes.id = user_shares.note_id
-        WHERE (notes.fts_text @@ plainto_tsquery('english', $1) AND (notes.owner = $2 OR notes.noteDelegation = $2))
-        OR (user_shares.username ILIKE $1)
-    `
 
-    stmt, err := a.db.Prepare(query)
-    if err != nil {
-        return nil, err
-    }
-    defer stmt.Close()
+	// An empty search matches nothing
+	if search.isEmpty() {
+		return nil, nil
+	}
 
-    rows, err := stmt.Query(searchQuery, username)
-    if err != nil {
-        return nil, err
-    }
-    defer rows.Close()
+	match := searchMatch{ranking: "0 AS rank, n.title, n.description"}
+	if strings.TrimSpace(search.Text) != "" {
+		match = searchMatch{
+			ranking: `ts_rank_cd(n.search_vector, search_query) AS rank,
+				ts_headline('english', n.title, search_query, $3),
+				ts_headline('english', n.description, search_query, $4)`,
+			from:      "CROSS JOIN websearch_to_tsquery('english', $2) AS search_query",
+			condition: "n.search_vector @@ search_query",
+			args:      []interface{}{search.Text, titleHeadlineOptions, snippetHeadlineOptions},
+		}
+	}
 
-    var notes []Note
-    noteMap := make(map[int]*Note)
+	return querySearch(s.db, search, username, match, 0)
+}
 
-    for rows.Next() {
-        var note Note
-        var sharedUsername sql.NullString
+// searchMatch is how a search finds and ranks notes. The ranking selects the rank, title and
+// description headlines; the match's arguments are numbered from $2, after the username.
+type searchMatch struct {
+	ranking   string
+	from      string
+	condition string
+	args      []interface{}
+}
 
-        if err := rows.Scan(&note.ID, &note.Title, &note.NoteType, &note.Description, &note.NoteCreated,
-            &note.TaskCompletionDate.String, &note.TaskCompletionTime.String, &note.NoteStatus.String, &note.NoteDelegation.String, &note.Owner, &sharedUsername); err != nil {
-            return nil, err
-        }
+// querySearch runs a search on the notes the user can see, best match first, returning at
+// most limit notes when limit is positive. The qualifiers of the search apply to every match.
+// The query around the match is plain SQL, so both databases run it.
+func querySearch(db *sql.DB, search searchQuery, username string, match searchMatch, limit int) ([]Note, error) {
+	args := append([]interface{}{username}, match.args...)
+	conditions := []string{visibleNoteCondition}
+	if match.condition != "" {
+		conditions = append(conditions, match.condition)
+	}
 
-        // Check if the note is already in the notes slice
-        existingNote, exists := noteMap[note.ID]
-        if !exists {
-            // If it doesn't exist, add it to the map and slice
-            notes = append(notes, note)
-            noteMap[note.ID] = &notes[len(notes)-1]
-            existingNote = noteMap[note.ID]
-        }
+	filters, args := search.filterSQL(args)
+	conditions = append(conditions, filters...)
 
-        // If sharedUsername is not null, add it to the note's shared users
-        if sharedUsername.Valid {
-            sharedUser := UserShare{
-                Username: sharedUsername,
-            }
-            existingNote.SharedUsers = append(existingNote.SharedUsers, sharedUser)
-        }
-    }
+	// The user's share of the note, if any, gives their privileges on it
+	query := `
+		SELECT n.id, n.title, n.noteType, n.description, n.noteCreated,
+			n.due_at, n.noteStatus, n.noteDelegation, n.owner,
+			(SELECT us.privileges FROM user_shares us WHERE us.note_id = n.id AND us.username = $1),
+			` + noteTagsColumn("n") + `, ` + match.ranking + `
+		FROM notes n ` + match.from + `
+		WHERE ` + strings.Join(conditions, " AND ") + `
+		ORDER BY rank DESC, n.noteCreated DESC, n.id
+	`
+	if limit > 0 {
+		args = append(args, limit)
+		query += " LIMIT $" + strconv.Itoa(len(args))
+	}
 
-    if err := rows.Err(); err != nil {
-        return nil, err
-    }
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var notes []Note
+	for rows.Next() {
+		var note Note
+		var privileges sql.NullString
+		var tags string
+
+		if err := rows.Scan(&note.ID, &note.Title, &note.NoteType, &note.Description, &note.NoteCreated,
+			&note.DueAt, &note.NoteStatus, &note.NoteDelegation, &note.Owner, &privileges, &tags,
+			&note.Rank, &note.TitleHeadline, &note.Headline); err != nil {
+			return nil, err
+		}
+		note.Privileges = privileges.String
+		note.Tags = splitTags(tags)
+		notes = append(notes, note)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
-    return notes, nil
+	return notes, nil
 }
 
 // Attempted to validate search query, would alter search results so didn't keep
@@ -421,11 +416,11 @@ func isValidSearchQuery(textPattern string) bool {
 */
 
 // RemoveDelegation removes delegation from a note in the database.
-func (a *App) RemoveDelegation(noteID int) error {
+func (s *postgresStore) RemoveDelegation(noteID int) error {
 	// Prepare the SQL statement for removing delegation
 	query := "UPDATE notes SET noteDelegation = NULL, noteStatus = NULL WHERE id = $1"
 
-	stmt, err := a.db.Prepare(query)
+	stmt, err := s.db.Prepare(query)
 	if err != nil {
 		return err
 	}
@@ -439,8 +434,54 @@ func (a *App) RemoveDelegation(noteID int) error {
 	return nil
 }
 
-// getUnsharedUsersForNote retrieves unshared users for a given noteID and username.
-func (a *App) getUnsharedUsersForNote(noteID int, username string) ([]User, error) {
+// rowQueryer is a *sql.DB or a *sql.Tx.
+type rowQueryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// checkDelegate returns errUserNotFound if there is no user called username to delegate a
+// note to. An empty username, a note with no delegate, is always allowed.
+func checkDelegate(q rowQueryer, username string) error {
+	if username == "" {
+		return nil
+	}
+
+	var userExists bool
+	if err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE username = $1)", username).Scan(&userExists); err != nil {
+		return err
+	}
+	if !userExists {
+		return errUserNotFound
+	}
+	return nil
+}
+
+// SetDelegation delegates a note to a user and marks it as delegated. It returns
+// errUserNotFound if there is no such user.
+func (s *postgresStore) SetDelegation(noteID int, username string) error {
+	if err := checkDelegate(s.db, username); err != nil {
+		return err
+	}
+
+	// Prepare the SQL statement for setting the delegation
+	query := "UPDATE notes SET noteDelegation = $1, noteStatus = 'Delegated' WHERE id = $2"
+
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(username, noteID)
+	if err != nil {
+		return fmt.Errorf("Failed to set delegation: %v", err)
+	}
+
+	return nil
+}
+
+// UnsharedUsers retrieves unshared users for a given noteID and username.
+func (s *postgresStore) UnsharedUsers(noteID int, username string) ([]User, error) {
 	// Initialize a slice to store unshared users
 	var unsharedUsers []User
 
@@ -450,7 +491,7 @@ func (a *App) getUnsharedUsersForNote(noteID int, username string) ([]User, erro
         WHERE username NOT IN (SELECT username FROM user_shares WHERE note_id = $1) AND username != $2
     `
 
-	stmt, err := a.db.Prepare(query)
+	stmt, err := s.db.Prepare(query)
 	if err != nil {
 		return nil, err
 	}
@@ -486,18 +527,19 @@ func (a *App) getUnsharedUsersForNote(noteID int, username string) ([]User, erro
 	return unsharedUsers, nil
 }
 
-// deleteNoteFromDatabase deletes a note from the database by ID.
-func (a *App) deleteNoteFromDatabase(noteID int) error {
-    // Prepare the SQL statement for deleting a note by ID
-    query := "DELETE FROM notes WHERE id = $1"
+// DeleteNote moves a note to its owner's trash. The note, its shares and
+// its history are kept until the trash is purged, see trash.go.
+func (s *postgresStore) DeleteNote(noteID int, deletedBy string) error {
+    // Prepare the SQL statement for marking a note as deleted
+    query := "UPDATE notes SET deleted_at = CURRENT_TIMESTAMP, deleted_by = $2 WHERE id = $1 AND deleted_at IS NULL"
     
-    stmt, err := a.db.Prepare(query)
+    stmt, err := s.db.Prepare(query)
     if err != nil {
         return err
     }
     defer stmt.Close()
 
-    _, err = stmt.Exec(noteID)
+    _, err = stmt.Exec(noteID, deletedBy)
     if err != nil {
         return err
     }
@@ -505,95 +547,118 @@ func (a *App) deleteNoteFromDatabase(noteID int) error {
     return nil
 }
 
-// shareNoteWithUser shares a note with a user in the database.
-func (a *App) shareNoteWithUser(noteID int, sharedUsername string, privileges string) error {
-    // Prepare the SQL statement for checking if the shared user exists
-    checkUserQuery := "SELECT username FROM users WHERE username = $1"
-
-    // Prepare the SQL statement for checking if the note exists
-    checkNoteQuery := "SELECT EXISTS(SELECT 1 FROM notes WHERE id = $1)"
-
-    // Prepare the SQL statement for checking if there is an existing entry for the note and shared user
-    checkExistingShareQuery := "SELECT note_id FROM user_shares WHERE note_id = $1 AND username = $2"
+// ShareNote shares a note with a user in the database. The share is inserted in one statement,
+// which relies on the user_shares primary key rather than a check beforehand, so two users
+// sharing the same note at once cannot both succeed. When nothing is inserted, the note, the
+// user and the owner are looked up in the same transaction to tell why.
+func (s *postgresStore) ShareNote(noteID int, sharedUsername string, privileges string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-    // Prepare the SQL statement for inserting the user share
-    insertUserShareQuery := `
-        INSERT INTO user_shares (note_id, username, privileges)
-        VALUES ($1, $2, $3)
-    `
+	result, err := tx.Exec(`
+		INSERT INTO user_shares (note_id, username, privileges)
+		SELECT n.id, u.username, CAST($3 AS VARCHAR)
+		FROM notes n
+		JOIN users u ON u.username = $2
+		WHERE n.id = $1 AND n.deleted_at IS NULL AND n.owner <> u.username
+		ON CONFLICT (username, note_id) DO NOTHING
+	`, noteID, sharedUsername, privileges)
+	if err != nil {
+		return err
+	}
+	shared, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if shared > 0 {
+		return tx.Commit()
+	}
 
-    // Check if the shared user exists
-    var sharedUserID string
-    err := a.db.QueryRow(checkUserQuery, sharedUsername).Scan(&sharedUserID)
-    if err != nil {
-        // Handle the case where the shared user does not exist
-        return err
-    }
+	var owner string
+	err = tx.QueryRow("SELECT owner FROM notes WHERE id = $1 AND deleted_at IS NULL", noteID).Scan(&owner)
+	if err == sql.ErrNoRows {
+		return errNoteNotFound
+	}
+	if err != nil {
+		return err
+	}
 
-    // Check if the note with the given ID exists
-    var noteExists bool
-    err = a.db.QueryRow(checkNoteQuery, noteID).Scan(&noteExists)
-    if err != nil {
-        return err
-    }
+	var userExists bool
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE username = $1)", sharedUsername).Scan(&userExists); err != nil {
+		return err
+	}
+	switch {
+	case !userExists:
+		return errUserNotFound
+	case owner == sharedUsername:
+		return errShareForbidden
+	default:
+		return errAlreadyShared
+	}
+}
 
-    if !noteExists {
-        return fmt.Errorf("Note does not exist")
-    }
+// RemoveShare removes a shared note from a user in the database.
+func (s *postgresStore) RemoveShare(noteID int, username string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-    // Check if there is already an existing entry for the given note and shared user
-    var existingShareID int
-    err = a.db.QueryRow(checkExistingShareQuery, noteID, sharedUsername).Scan(&existingShareID)
-    if err == nil {
-        return fmt.Errorf("Note is already shared with this user")
-    } else if err != sql.ErrNoRows {
-        return err
-    }
+	result, err := tx.Exec("DELETE FROM user_shares WHERE username = $1 AND note_id = $2", username, noteID)
+	if err != nil {
+		return err
+	}
+	if err := requireShareChanged(tx, result, noteID); err != nil {
+		return err
+	}
 
-    // If no existing entry was found, proceed with sharing the note
-    _, err = a.db.Exec(insertUserShareQuery, noteID, sharedUsername, privileges)
-    return err
+	return tx.Commit()
 }
 
-// removeSharedNoteFromUser removes a shared note from a user in the database.
-func (a *App) removeSharedNoteFromUser(username string, noteID string) error {
-    // Prepare the SQL statement for removing the shared note from a user
-    query := "DELETE FROM user_shares WHERE username = $1 AND note_id = $2"
-
-    stmt, err := a.db.Prepare(query)
-    if err != nil {
-        return err
-    }
-    defer stmt.Close()
+// UpdateShare updates user privileges for a shared note in the database.
+func (s *postgresStore) UpdateShare(noteID int, selectedUsername, updatedPrivileges string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-    _, err = stmt.Exec(username, noteID)
-    if err != nil {
-        return err
-    }
+	result, err := tx.Exec("UPDATE user_shares SET privileges = $1 WHERE username = $2 AND note_id = $3",
+		updatedPrivileges, selectedUsername, noteID)
+	if err != nil {
+		return err
+	}
+	if err := requireShareChanged(tx, result, noteID); err != nil {
+		return err
+	}
 
-    return nil
+	return tx.Commit()
 }
 
-// updateUserPrivileges updates user privileges for a shared note in the database.
-func (a *App) updateUserPrivileges(selectedUsername, updatedPrivileges, noteID string) error {
-    // Prepare the SQL statement for updating user privileges
-    query := "UPDATE user_shares SET privileges = $1 WHERE username = $2 AND note_id = $3"
-
-    stmt, err := a.db.Prepare(query)
-    if err != nil {
-        return err
-    }
-    defer stmt.Close()
-
-    _, err = stmt.Exec(updatedPrivileges, selectedUsername, noteID)
-    if err != nil {
-        return err
-    }
+// requireShareChanged returns nil if a change to a share affected it, and otherwise
+// errNoteNotFound if the note does not exist or errShareNotFound if it is not shared with the user.
+func requireShareChanged(tx *sql.Tx, result sql.Result, noteID int) error {
+	changed, err := result.RowsAffected()
+	if err != nil || changed > 0 {
+		return err
+	}
 
-    return nil
+	var noteExists bool
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM notes WHERE id = $1 AND deleted_at IS NULL)", noteID).Scan(&noteExists); err != nil {
+		return err
+	}
+	if !noteExists {
+		return errNoteNotFound
+	}
+	return errShareNotFound
 }
 
-// findTextInNote searches for a text pattern in a note and returns results.
+// findTextInNote searches for a text pattern in a note and returns results. GetNote includes notes
+// in the trash, so callers check the user can view the note first.
 func (a *App) findTextInNote(noteID int, searchPattern string) ([]SearchResult, error) {
     results := []SearchResult{}
 
@@ -605,7 +670,7 @@ func (a *App) findTextInNote(noteID int, searchPattern string) ([]SearchResult,
         })
     } else {
         // Fetch the note with the given ID to access the title and description
-        note, err := a.getNoteByID(noteID)
+        note, err := a.notes.GetNote(noteID)
         if err != nil {
             return nil, err
         }
@@ -639,16 +704,19 @@ func countOccurrences(text, searchPattern string) int {
     return count
 }
 
-// getNoteByID retrieves a note from the database by ID.
-func (a *App) getNoteByID(noteID int) (*Note, error) {
-    query := "SELECT id, title, description, noteType, taskCompletionTime, taskCompletionDate, noteStatus, noteDelegation, owner FROM notes WHERE id = $1"
-    row := a.db.QueryRow(query, noteID)
+// GetNote retrieves a note from the database by ID.
+func (s *postgresStore) GetNote(noteID int) (*Note, error) {
+    query := "SELECT id, title, description, noteType, due_at, noteStatus, noteDelegation, owner, noteCreated, " +
+        noteTagsColumn("notes") + " FROM notes WHERE id = $1"
+    row := s.db.QueryRow(query, noteID)
 
     var note Note
-    err := row.Scan(&note.ID, &note.Title, &note.Description, &note.NoteType, &note.TaskCompletionTime, &note.TaskCompletionDate, &note.NoteStatus, &note.NoteDelegation, &note.Owner)
+    var tags string
+    err := row.Scan(&note.ID, &note.Title, &note.Description, &note.NoteType, &note.DueAt, &note.NoteStatus, &note.NoteDelegation, &note.Owner, &note.NoteCreated, &tags)
     if err != nil {
         return nil, err
     }
+    note.Tags = splitTags(tags)
 
     return &note, nil
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
 	"reflect"
 	"testing"
 	"time"
@@ -11,184 +12,6 @@ import (
 	// Import the package where your `Note` and `UserShare` types are defined
 )
 
-func TestRetrieveNotes_Success(t *testing.T) {
-	// Create a new SQL mock
-	db, mock, err := sqlmock.New()
-	if err != nil {
-		t.Fatalf("An error occurred while opening a stub database connection: %v", err)
-	}
-	defer db.Close()
-
-	// Create the App instance and set the database connection to the mock
-	a := App{db: db}
-
-	// Define the expected timestamp values
-	noteCreatedTime := time.Date(2023, 11, 1, 15, 6, 20, 935951100, time.UTC)
-
-	// Define the expected rows to be returned by the mock
-	rows := sqlmock.NewRows([]string{
-		"id", "title", "noteType", "description", "noteCreated", "taskCompletionTime", "taskCompletionDate", "noteStatus", "noteDelegation", "owner", "username", "privileges",
-	}).AddRow(
-		1, "Test Note", "Type1", "Test Description", noteCreatedTime,
-		sql.NullString{String: "12:00:00", Valid: true},
-		sql.NullString{String: "2023-11-01", Valid: true},
-		sql.NullString{String: "Status1", Valid: true},
-		sql.NullString{String: "Delegation1", Valid: true},
-		"user1",
-		sql.NullString{String: "shared_user1", Valid: true},
-		sql.NullString{String: "editor", Valid: true},
-	)
-
-	// Expect the query with a specific username
-
-	query := `
-		SELECT
-		n.id, n.title, n.noteType, n.description, n.noteCreated, n.taskCompletionTime, n.taskCompletionDate, n.noteStatus, n.noteDelegation, n.owner, u.username, us.privileges
-		FROM
-			notes n
-		LEFT JOIN
-			user_shares us ON n.id = us.note_id
-		LEFT JOIN
-			users u ON us.username = u.username
-		WHERE
-			n.owner = ?
-	`
-
-	mock.ExpectPrepare(query).ExpectQuery().
-		WithArgs("user1").
-		WillReturnRows(rows)
-
-	// Call the function to retrieve notes
-	notes, err := a.retrieveNotes("user1")
-	if err != nil {
-		t.Errorf("Expected no error, but got %v", err)
-	}
-
-	// Define the expected result
-	expectedNotes := []Note{
-		{
-			ID:               1,
-			Title:            "Test Note",
-			NoteType:         "Type1",
-			Description:      "Test Description",
-			NoteCreated:      noteCreatedTime,
-			TaskCompletionTime: sql.NullString{String: "12:00:00", Valid: true},
-			TaskCompletionDate: sql.NullString{String: "2023-11-01", Valid: true},
-			NoteStatus:        sql.NullString{String: "Status1", Valid: true},
-			NoteDelegation:    sql.NullString{String: "Delegation1", Valid: true},
-			Owner:            "user1",
-			SharedUsers: []UserShare{
-				{Username: sql.NullString{String: "shared_user1", Valid: true}, Privileges: sql.NullString{String: "editor", Valid: true}},
-			},
-		},
-	}
-
-	// Check if the expected result matches the actual result
-	if !reflect.DeepEqual(notes, expectedNotes) {
-		t.Errorf("Expected notes to be %v, but got %v", expectedNotes, notes)
-	}
-
-	// Ensure all expectations were met
-	if err := mock.ExpectationsWereMet(); err != nil {
-		t.Errorf("Unfulfilled expectations: %s", err)
-	}
-}
-
-func TestRetrieveSharedNotesWithPrivileges_Success(t *testing.T) {
-    // Create a new SQL mock
-    db, mock, err := sqlmock.New()
-    if err != nil {
-        t.Fatalf("An error occurred while opening a stub database connection: %v", err)
-    }
-    defer db.Close()
-
-    // Create the App instance and set the database connection to the mock
-    a := App{db: db}
-
-    // Define the expected timestamp values
-    noteCreatedTime := time.Date(2023, 11, 1, 15, 6, 20, 935951100, time.UTC)
-    taskCompletionTime := sql.NullString{String: "12:00:00", Valid: true}
-    taskCompletionDate := sql.NullString{String: "2023-11-01", Valid: true}
-
-    // Define the expected rows to be returned by the mock
-    rows := sqlmock.NewRows([]string{
-        "id", "title", "noteType", "description", "noteCreated",
-        "taskCompletionTime", "taskCompletionDate", "noteStatus", "noteDelegation", "owner",
-        "FTSText", "privileges",
-    }).AddRow(
-        1, "Test Note", "Type1", "Test Description", noteCreatedTime,
-        taskCompletionTime,
-        taskCompletionDate,
-        sql.NullString{String: "Status1", Valid: true},
-        sql.NullString{String: "Delegation1", Valid: true},
-        "user1",
-        sql.NullString{String: "Test FTSText", Valid: true},
-        "editor", // Privileges is a string
-    ).AddRow(
-        2, "Test Note 2", "Type2", "Test Description 2", noteCreatedTime,
-        sql.NullString{String: "13:00:00", Valid: true},
-        sql.NullString{String: "2023-11-02", Valid: true},
-        sql.NullString{String: "Status2", Valid: true},
-        sql.NullString{String: "Delegation2", Valid: true},
-        "user2",
-        sql.NullString{String: "Test FTSText 2", Valid: true},
-        "viewer", // Privileges is a string
-    )
-
-    // Expect the query with a specific username
-    mock.ExpectPrepare("SELECT n.*, us.privileges FROM notes n INNER JOIN user_shares us .*").ExpectQuery().
-        WithArgs("user1").
-        WillReturnRows(rows)
-
-    // Call the function to retrieve shared notes
-    sharedNotes, err := a.retrieveSharedNotesWithPrivileges("user1")
-    if err != nil {
-        t.Errorf("Expected no error, but got %v", err)
-    }
-
-    // Define the expected result
-    expectedNotes := []Note{
-        {
-            ID:               1,
-            Title:            "Test Note",
-            NoteType:         "Type1",
-            Description:      "Test Description",
-            NoteCreated:      noteCreatedTime,
-            TaskCompletionTime: taskCompletionTime,
-            TaskCompletionDate: taskCompletionDate,
-            NoteStatus:        sql.NullString{String: "Status1", Valid: true},
-            NoteDelegation:    sql.NullString{String: "Delegation1", Valid: true},
-            Owner:            "user1",
-            FTSText:          sql.NullString{String: "Test FTSText", Valid: true},
-            Privileges:       "editor", // Privileges is a string
-        },
-        {
-            ID:               2,
-            Title:            "Test Note 2",
-            NoteType:         "Type2",
-            Description:      "Test Description 2",
-            NoteCreated:      noteCreatedTime,
-            TaskCompletionTime: sql.NullString{String: "13:00:00", Valid: true},
-            TaskCompletionDate: sql.NullString{String: "2023-11-02", Valid: true},
-            NoteStatus:        sql.NullString{String: "Status2", Valid: true},
-            NoteDelegation:    sql.NullString{String: "Delegation2", Valid: true},
-            Owner:            "user2",
-            FTSText:          sql.NullString{String: "Test FTSText 2", Valid: true},
-            Privileges:       "viewer", // Privileges is a string
-        },
-    }
-
-    // Check if the expected result matches the actual result
-    if !reflect.DeepEqual(sharedNotes, expectedNotes) {
-        t.Errorf("Expected sharedNotes to be %v, but got %v", expectedNotes, sharedNotes)
-    }
-
-    // Ensure all expectations were met
-    if err := mock.ExpectationsWereMet(); err != nil {
-        t.Errorf("Unfulfilled expectations: %s", err)
-    }
-}
-
 func TestGetAllUsers_Success(t *testing.T) {
     // Create a new SQL mock
     db, mock, err := sqlmock.New()
@@ -198,7 +21,7 @@ func TestGetAllUsers_Success(t *testing.T) {
     defer db.Close()
 
     // Create the App instance and set the database connection to the mock
-    a := App{db: db}
+    a := newSQLTestApp(db)
 
     // Define the expected rows to be returned by the mock
     rows := sqlmock.NewRows([]string{"username"}).
@@ -212,7 +35,7 @@ func TestGetAllUsers_Success(t *testing.T) {
         WillReturnRows(rows)
 
     // Call the function to get all users
-    users, err := a.getAllUsers("owner")
+    users, err := a.users.OtherUsers("owner")
     if err != nil {
         t.Errorf("Expected no error, but got %v", err)
     }
@@ -244,30 +67,20 @@ func TestShareNoteWithUser(t *testing.T) {
     defer db.Close()
 
     // Create an instance of your App with the mock database
-    app := &App{db: db}
+    app := newSQLTestApp(db)
 
     noteID := 1
     sharedUsername := "testuser"
     privileges := "read"
 
-    // Define the expected SQL queries and their results using sqlmock
-    mock.ExpectQuery("SELECT username").
-        WithArgs(sharedUsername).
-        WillReturnRows(sqlmock.NewRows([]string{"username"}).AddRow(sharedUsername))
-
-    mock.ExpectQuery("SELECT EXISTS").
-        WithArgs(noteID).
-        WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(1))
-
-    mock.ExpectQuery("SELECT note_id").
-        WithArgs(noteID, sharedUsername).
-        WillReturnError(sql.ErrNoRows)
-
+    // The share is inserted in a transaction, relying on the primary key for duplicates
+    mock.ExpectBegin()
     mock.ExpectExec("INSERT INTO user_shares").
         WithArgs(noteID, sharedUsername, privileges).
-        WillReturnResult(sqlmock.NewResult(1, 1))
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectCommit()
 
-    err = app.shareNoteWithUser(noteID, sharedUsername, privileges)
+    err = app.shares.ShareNote(noteID, sharedUsername, privileges)
 
     // Check if there are any expectations that were not met
     if err := mock.ExpectationsWereMet(); err != nil {
@@ -279,6 +92,75 @@ func TestShareNoteWithUser(t *testing.T) {
     }
 }
 
+func TestShareNoteWithUser_Errors(t *testing.T) {
+	tests := []struct {
+		name       string
+		owner      *string
+		userExists bool
+		want       error
+	}{
+		{"note missing", nil, true, errNoteNotFound},
+		{"user missing", stringPtr("alice"), false, errUserNotFound},
+		{"owner", stringPtr("bob"), true, errShareForbidden},
+		{"already shared", stringPtr("alice"), true, errAlreadyShared},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			app := newSQLTestApp(db)
+
+			// Nothing is inserted, so the note and user are looked up to tell why
+			mock.ExpectBegin()
+			mock.ExpectExec("INSERT INTO user_shares").WithArgs(1, "bob", "viewer").
+				WillReturnResult(sqlmock.NewResult(0, 0))
+			owner := mock.ExpectQuery("SELECT owner FROM notes WHERE id = \\$1 AND deleted_at IS NULL").WithArgs(1)
+			if tt.owner == nil {
+				owner.WillReturnError(sql.ErrNoRows)
+			} else {
+				owner.WillReturnRows(sqlmock.NewRows([]string{"owner"}).AddRow(*tt.owner))
+				mock.ExpectQuery("SELECT EXISTS\\(SELECT 1 FROM users").WithArgs("bob").
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(tt.userExists))
+			}
+			mock.ExpectRollback()
+
+			if err := app.shares.ShareNote(1, "bob", "viewer"); err != tt.want {
+				t.Errorf("Expected %v, got %v", tt.want, err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("Unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestUpdateUserPrivileges_NotShared(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	app := newSQLTestApp(db)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE user_shares SET privileges").WithArgs("editor", "bob", 1).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT EXISTS\\(SELECT 1 FROM notes").WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectRollback()
+
+	if err := app.shares.UpdateShare(1, "bob", "editor"); err != errShareNotFound {
+		t.Errorf("Expected errShareNotFound, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
 func TestRemoveSharedNoteFromUser(t *testing.T) {
     // Create a new database connection with sqlmock
     db, mock, err := sqlmock.New()
@@ -288,18 +170,20 @@ func TestRemoveSharedNoteFromUser(t *testing.T) {
     defer db.Close()
 
     // Create an instance of your App with the mock database
-    app := &App{db: db}
+    app := newSQLTestApp(db)
 
     username := "testuser"
-    noteID := "1"
+    noteID := 1
 
     // Define the expected SQL query and result using sqlmock
     expectedQuery := "DELETE FROM user_shares"
-    mock.ExpectPrepare(expectedQuery).ExpectExec().
+    mock.ExpectBegin()
+    mock.ExpectExec(expectedQuery).
         WithArgs(username, noteID).
         WillReturnResult(sqlmock.NewResult(0, 1)) // 1 row affected
+    mock.ExpectCommit()
 
-    err = app.removeSharedNoteFromUser(username, noteID)
+    err = app.shares.RemoveShare(noteID, username)
 
     // Check if there are any expectations that were not met
     if err := mock.ExpectationsWereMet(); err != nil {
@@ -320,7 +204,7 @@ func TestRemoveDelegation(t *testing.T) {
     defer db.Close()
 
     // Create an instance of your App with the mock database
-    app := &App{db: db}
+    app := newSQLTestApp(db)
 
     noteID := 123 // Replace with the appropriate noteID
 
@@ -330,7 +214,7 @@ func TestRemoveDelegation(t *testing.T) {
         WithArgs(noteID).
         WillReturnResult(sqlmock.NewResult(0, 1)) // 1 row affected
 
-    err = app.RemoveDelegation(noteID)
+    err = app.notes.RemoveDelegation(noteID)
 
     // Check if there are any expectations that were not met
     if err := mock.ExpectationsWereMet(); err != nil {
@@ -351,7 +235,7 @@ func TestGetUnsharedUsersForNote(t *testing.T) {
     defer db.Close()
 
     // Create an instance of your App with the mock database
-    app := &App{db: db}
+    app := newSQLTestApp(db)
 
     noteID := 123 // Replace with the appropriate noteID
     username := "testuser" // Replace with the appropriate username
@@ -364,8 +248,8 @@ func TestGetUnsharedUsersForNote(t *testing.T) {
             AddRow("user1").
             AddRow("user2"))
 
-    // Call the getUnsharedUsersForNote function
-    unsharedUsers, err := app.getUnsharedUsersForNote(noteID, username)
+    // Call the UnsharedUsers method
+    unsharedUsers, err := app.shares.UnsharedUsers(noteID, username)
 
     // Check if there are any expectations that were not met
     if err := mock.ExpectationsWereMet(); err != nil {
@@ -394,17 +278,18 @@ func TestDeleteNoteFromDatabase(t *testing.T) {
     defer db.Close()
 
     // Create an instance of your App with the mock database
-    app := &App{db: db}
+    app := newSQLTestApp(db)
 
     noteID := 123 // Replace with the appropriate noteID
 
     // Define the expected SQL query and result using sqlmock
-    expectedQuery := "DELETE FROM notes"
+    // Deleting only moves the note to the trash
+    expectedQuery := "UPDATE notes SET deleted_at = CURRENT_TIMESTAMP, deleted_by"
     mock.ExpectPrepare(expectedQuery).ExpectExec().
-        WithArgs(noteID).
+        WithArgs(noteID, "mydog7").
         WillReturnResult(sqlmock.NewResult(0, 1)) // 1 row affected
 
-    err = app.deleteNoteFromDatabase(noteID)
+    err = app.notes.DeleteNote(noteID, "mydog7")
 
     // Check if there are any expectations that were not met
     if err := mock.ExpectationsWereMet(); err != nil {
@@ -425,19 +310,21 @@ func TestUpdateUserPrivileges(t *testing.T) {
     defer db.Close()
 
     // Create an instance of your App with the mock database
-    app := &App{db: db}
+    app := newSQLTestApp(db)
 
     selectedUsername := "testuser" // Replace with the appropriate username
     updatedPrivileges := "read"   // Replace with the updated privileges
-    noteID := "123"               // Replace with the appropriate noteID
+    noteID := 123                 // Replace with the appropriate noteID
 
     // Define the expected SQL query and result using sqlmock
     expectedQuery := "UPDATE user_shares SET privileges"
-    mock.ExpectPrepare(expectedQuery).ExpectExec().
+    mock.ExpectBegin()
+    mock.ExpectExec(expectedQuery).
         WithArgs(updatedPrivileges, selectedUsername, noteID).
         WillReturnResult(sqlmock.NewResult(0, 1)) // 1 row affected
+    mock.ExpectCommit()
 
-    err = app.updateUserPrivileges(selectedUsername, updatedPrivileges, noteID)
+    err = app.shares.UpdateShare(noteID, selectedUsername, updatedPrivileges)
 
     // Check if there are any expectations that were not met
     if err := mock.ExpectationsWereMet(); err != nil {
@@ -458,19 +345,19 @@ func TestGetNoteByID(t *testing.T) {
     defer db.Close()
 
     // Create an instance of your App with the mock database
-    app := &App{db: db}
+    app := newSQLTestApp(db)
 
     // Define the expected SQL query and result using sqlmock
-    expectedQuery := "SELECT id, title, description, noteType, taskCompletionTime, taskCompletionDate, noteStatus, noteDelegation, owner FROM notes WHERE id = ?"
+    expectedQuery := "SELECT id, title, description, noteType, due_at, noteStatus, noteDelegation, owner, noteCreated, .* FROM notes WHERE id = ?"
     expectedNoteID := 123 // Replace with the appropriate noteID
     mock.ExpectQuery(expectedQuery).
         WithArgs(expectedNoteID).
-        WillReturnRows(sqlmock.NewRows([]string{"id", "title", "description", "noteType", "taskCompletionTime", "taskCompletionDate", "noteStatus", "noteDelegation", "owner"}).
-            AddRow(123, "Sample Title", "Sample Description", "Type", "2023-11-01", "2023-11-02", "Status", "Delegation", "Owner"),
+        WillReturnRows(sqlmock.NewRows([]string{"id", "title", "description", "noteType", "due_at", "noteStatus", "noteDelegation", "owner", "noteCreated", "tags"}).
+            AddRow(123, "Sample Title", "Sample Description", "Type", time.Date(2023, 11, 2, 23, 59, 0, 0, time.UTC), "Status", "Delegation", "Owner", time.Date(2023, 11, 1, 15, 6, 20, 0, time.UTC), "work"),
         )
 
-    // Call the getNoteByID function
-    retrievedNote, err := app.getNoteByID(expectedNoteID)
+    // Call the GetNote method
+    retrievedNote, err := app.notes.GetNote(expectedNoteID)
 
     // Check if there are any expectations that were not met
     if err := mock.ExpectationsWereMet(); err != nil {
@@ -512,3 +399,103 @@ func TestCountOccurrences(t *testing.T) {
     }
 }
 
+
+func TestAttachSharedUsers_OneQuery(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error occurred while opening a stub database connection: %v", err)
+	}
+	defer db.Close()
+
+	a := newSQLTestApp(db)
+	mock.ExpectQuery(`SELECT note_id, username, privileges FROM user_shares\s+WHERE note_id = ANY\(\$1::int\[\]\)`).
+		WithArgs("{3,5,8}").
+		WillReturnRows(sqlmock.NewRows([]string{"note_id", "username", "privileges"}).
+			AddRow(3, "bob", "editor").
+			AddRow(8, "bob", "viewer").
+			AddRow(8, "carol", "editor"))
+
+	notes := []Note{{ID: 3}, {ID: 5}, {ID: 8}}
+	if err := a.attachSharedUsers(notes); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	if len(notes[0].SharedUsers) != 1 || len(notes[1].SharedUsers) != 0 || len(notes[2].SharedUsers) != 2 {
+		t.Errorf("Unexpected shares: %+v", notes)
+	}
+	if notes[2].SharedUsers[1].Privileges.String != "editor" {
+		t.Errorf("Expected carol's privileges on note 8, got %+v", notes[2].SharedUsers[1])
+	}
+
+	// Nothing to look up, nothing to query
+	if err := a.attachSharedUsers(nil); err != nil {
+		t.Errorf("Expected no error, but got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+// benchmarkNotes is the size of the page of notes the listing benchmarks load.
+const benchmarkNotes = 50
+
+// newListingBenchmarkApp returns an app on the PostgreSQL test database where alice owns a page
+// of notes, each shared with bob. The benchmark is skipped when NOTES_TEST_POSTGRES_URL is not set.
+func newListingBenchmarkApp(b *testing.B) *App {
+	a := newPostgresTestApp(b, "alice", "bob")
+
+	for i := 0; i < benchmarkNotes; i++ {
+		id, err := a.notes.CreateNote(Note{Title: fmt.Sprintf("Note %d", i), NoteType: "Note", Description: "Benchmark", Owner: "alice"})
+		if err != nil {
+			b.Fatalf("Creating a note: %v", err)
+		}
+		if err := a.shares.ShareNote(id, "bob", "editor"); err != nil {
+			b.Fatalf("Sharing a note: %v", err)
+		}
+	}
+	return a
+}
+
+// listOwnedNotes lists the page of alice's notes as the notes page does.
+func listOwnedNotes(b *testing.B, a *App) []Note {
+	page, err := a.notes.ListNotes("alice", noteListOptions{Scope: scopeOwned, Sort: sortCreated, Limit: benchmarkNotes})
+	if err != nil {
+		b.Fatal(err)
+	}
+	if len(page.Notes) != benchmarkNotes {
+		b.Fatalf("Expected %d notes, got %d", benchmarkNotes, len(page.Notes))
+	}
+	return page.Notes
+}
+
+// BenchmarkListNotes_SharedUsersPerNote lists the page and loads its shares the old way, one query per note.
+func BenchmarkListNotes_SharedUsersPerNote(b *testing.B) {
+	a := newListingBenchmarkApp(b)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		notes := listOwnedNotes(b, a)
+		for j := range notes {
+			shares, err := a.shares.NoteShares(notes[j].ID)
+			if err != nil {
+				b.Fatal(err)
+			}
+			notes[j].SharedUsers = shares
+		}
+	}
+}
+
+// BenchmarkListNotes_SharedUsersBatched lists the page and loads its shares in one query,
+// as listHandler does.
+func BenchmarkListNotes_SharedUsersBatched(b *testing.B) {
+	a := newListingBenchmarkApp(b)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		notes := listOwnedNotes(b, a)
+		if err := a.attachSharedUsers(notes); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -1,60 +1,67 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"fmt"
 	"log"
-	"os"
-	"time"
 
 	_ "github.com/jackc/pgx/v5/stdlib" // use pgx in database/sql mode
 
 	"github.com/gorilla/mux"
 )
 
-// PostgreSQl configuration if not passed as env variables
-const (
-	host     = "notes-db"
-	port     = 5433
-	user     = "postgres"
-	password = "postgres"
-	dbname   = "notes"
-)
-
 var (
-	err  error
-	wait time.Duration
+	err error
 )
 
 type App struct {
 	Router   *mux.Router
 	db       *sql.DB
-	bindport string
+	notes    NoteStore
+	users    UserStore
+	shares   ShareStore
+	search   SearchStore
+	config   *Config
+	logins   *loginThrottle   // failed logins, see loginHandler
+	resets   *loginThrottle   // password reset requests, see forgotPasswordHandler
+	sessions userSessionStore // login sessions, see setupAuth
+	mailer   Mailer           // sends password reset links
 	username string
+	stopJobs context.CancelFunc // stops the background jobs started by Initialize
+}
+
+// openDatabase connects to the configured database backend and returns the store on it.
+func openDatabase(cfg *Config) (*sql.DB, Store, error) {
+	if cfg.Database.Backend == "sqlite" {
+		db, err := setupSQLiteDatabase(cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		return db, newSQLiteStore(db), nil
+	}
+
+	db, err := setupDatabase(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return db, newPostgresStore(db), nil
 }
 
-func setupDatabase() (*sql.DB, error) {
-	psqlInfo := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable", host, port, user, password, dbname)
+func setupDatabase(cfg *Config) (*sql.DB, error) {
 	log.Println("Connecting to PostgreSQL")
-	log.Println(psqlInfo)
-	os.Unsetenv("PGDATABASE")
-	os.Unsetenv("PGHOST")
-	os.Unsetenv("PGUSER")
-	os.Unsetenv("PGPASSWORD")
 
-	// Set env to db name notes
-	os.Setenv("PGDATABASE", dbname)
-	os.Setenv("PGHOST", host)
-	os.Setenv("PGUSER", user)
-	os.Setenv("PGPASSWORD", password)
 	// Open a database connection using the pgx driver
-
-	db, err := sql.Open("pgx", psqlInfo)
+	db, err := sql.Open("pgx", cfg.databaseDSN())
 	if err != nil {
-		log.Println("Invalid DB arguments, or github.com/lib/pq not installed")
+		log.Println("Invalid DB arguments, or github.com/jackc/pgx not installed")
 		return nil, err
 	}
 
+	// Apply the connection pool limits
+	db.SetMaxOpenConns(cfg.Database.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.Database.MaxIdleConns)
+	db.SetConnMaxLifetime(cfg.Database.ConnMaxLifetime)
+
 	// test connection
 	err = db.Ping()
 	if err != nil {
@@ -0,0 +1,280 @@
+// Package main contains the main entry point for the Go application
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	// Time zone names must resolve on servers without a system zoneinfo database
+	_ "time/tzdata"
+)
+
+// invalidDueMessage explains the due date format on the HTML pages.
+const invalidDueMessage = "Enter the due date as a date, with an optional time."
+
+// dueFilter selects notes by when they are due. Days are counted in the user's time zone.
+type dueFilter string
+
+const (
+	dueAll     dueFilter = ""
+	dueOverdue dueFilter = "overdue" // past due and not completed or cancelled
+	dueToday   dueFilter = "today"
+	dueWeek    dueFilter = "week" // due today or in the next six days
+	dueNone    dueFilter = "none" // no due date
+)
+
+// dueFilterOption is a due filter offered on the list and search pages.
+type dueFilterOption struct {
+	Value dueFilter
+	Label string
+}
+
+// dueFilters are the due filters offered on the list and search pages, in display order.
+var dueFilters = []dueFilterOption{
+	{dueAll, "Any time"},
+	{dueOverdue, "Overdue"},
+	{dueToday, "Due today"},
+	{dueWeek, "Due this week"},
+	{dueNone, "No due date"},
+}
+
+// Note sort orders: newest first, soonest due first with undated notes last,
+// or best search match first.
+const (
+	sortCreated   = "created"
+	sortDue       = "due"
+	sortRelevance = "relevance"
+)
+
+// dueOptions reads the due filter and sort order from the request (?due=overdue&sort=due).
+// sorts are the sort orders the page offers, the first being the default.
+func dueOptions(r *http.Request, sorts ...string) (dueFilter, string, error) {
+	due := dueFilter(r.FormValue("due"))
+	if !validDueFilter(due) {
+		return "", "", errors.New("due must be overdue, today, week or none")
+	}
+
+	sortBy := r.FormValue("sort")
+	if sortBy == "" {
+		return due, sorts[0], nil
+	}
+	for _, s := range sorts {
+		if sortBy == s {
+			return due, sortBy, nil
+		}
+	}
+	return "", "", fmt.Errorf("sort must be %s", strings.Join(sorts, " or "))
+}
+
+// validDueFilter reports whether due is one of the due filters.
+func validDueFilter(due dueFilter) bool {
+	switch due {
+	case dueAll, dueOverdue, dueToday, dueWeek, dueNone:
+		return true
+	}
+	return false
+}
+
+// matches reports whether the note passes the filter at time now, with days starting at midnight in loc.
+func (f dueFilter) matches(note Note, now time.Time, loc *time.Location) bool {
+	local := now.In(loc)
+	startOfToday := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+	dueWithin := func(days int) bool {
+		return note.DueAt.Valid && !note.DueAt.Time.Before(startOfToday) &&
+			note.DueAt.Time.Before(startOfToday.AddDate(0, 0, days))
+	}
+
+	switch f {
+	case dueOverdue:
+		return isOverdue(note, now)
+	case dueToday:
+		return dueWithin(1)
+	case dueWeek:
+		return dueWithin(7)
+	case dueNone:
+		return !note.DueAt.Valid
+	}
+	return true
+}
+
+// filterNotesByDue keeps the notes that pass the due filter.
+func filterNotesByDue(notes []Note, due dueFilter, loc *time.Location) []Note {
+	if due == dueAll {
+		return notes
+	}
+
+	now := time.Now()
+	filtered := []Note{}
+	for _, note := range notes {
+		if due.matches(note, now, loc) {
+			filtered = append(filtered, note)
+		}
+	}
+	return filtered
+}
+
+// isOverdue reports whether a note was due before now and is still open.
+func isOverdue(note Note, now time.Time) bool {
+	if !note.DueAt.Valid || !note.DueAt.Time.Before(now) {
+		return false
+	}
+	return note.NoteStatus.String != "Completed" && note.NoteStatus.String != "Cancelled"
+}
+
+// sortNotes orders notes newest first, or by due time with undated notes last.
+// Search results sorted by relevance are left in the order of their rank.
+func sortNotes(notes []Note, sortBy string) {
+	if sortBy == sortRelevance {
+		return
+	}
+	sort.SliceStable(notes, func(i, j int) bool {
+		a, b := notes[i], notes[j]
+		if sortBy == sortDue && (a.DueAt.Valid || b.DueAt.Valid) {
+			if !a.DueAt.Valid || !b.DueAt.Valid {
+				return a.DueAt.Valid
+			}
+			if !a.DueAt.Time.Equal(b.DueAt.Time) {
+				return a.DueAt.Time.Before(b.DueAt.Time)
+			}
+		}
+		return a.NoteCreated.After(b.NoteCreated)
+	})
+}
+
+// parseDueAt combines a date (2006-01-02) and an optional time of day into a due time in loc.
+// Times can be 24 hour (15:04) or 12 hour (03:04 PM); a date without a time is due at 23:59.
+// An empty date means the note has no due time.
+func parseDueAt(date, clock string, loc *time.Location) (sql.NullTime, error) {
+	date, clock = strings.TrimSpace(date), strings.TrimSpace(clock)
+	if date == "" {
+		if clock != "" {
+			return sql.NullTime{}, errors.New("a due time needs a due date")
+		}
+		return sql.NullTime{}, nil
+	}
+
+	day, err := time.ParseInLocation("2006-01-02", date, loc)
+	if err != nil {
+		return sql.NullTime{}, fmt.Errorf("due date %q must be YYYY-MM-DD", date)
+	}
+
+	hour, minute := 23, 59
+	if clock != "" {
+		parsed, err := parseClock(clock)
+		if err != nil {
+			return sql.NullTime{}, err
+		}
+		hour, minute = parsed.Hour(), parsed.Minute()
+	}
+
+	due := time.Date(day.Year(), day.Month(), day.Day(), hour, minute, 0, 0, loc)
+	return sql.NullTime{Time: due, Valid: true}, nil
+}
+
+// parseClock reads a time of day in any of the formats the forms and demo data use.
+func parseClock(clock string) (time.Time, error) {
+	for _, layout := range []string{"15:04", "15:04:05", "03:04 PM", "3:04 PM"} {
+		if t, err := time.Parse(layout, clock); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("due time %q must be HH:MM", clock)
+}
+
+// formatDueAt formats a due time for revision diffs, in UTC so it does not depend on the viewer.
+func formatDueAt(due sql.NullTime) string {
+	if !due.Valid {
+		return ""
+	}
+	return due.Time.UTC().Format(time.RFC3339)
+}
+
+// dueFuncs are the template functions that show due times in the user's time zone.
+// The input formats match the date and time inputs of the note forms.
+func dueFuncs(loc *time.Location) template.FuncMap {
+	format := func(layout string) func(sql.NullTime) string {
+		return func(due sql.NullTime) string {
+			if !due.Valid {
+				return ""
+			}
+			return due.Time.In(loc).Format(layout)
+		}
+	}
+
+	return template.FuncMap{
+		"dueDate":      format("02/01/2006"),
+		"dueTime":      format("03:04 PM"),
+		"dueDateInput": format("2006-01-02"),
+		"dueTimeInput": format("15:04"),
+		"overdue": func(note Note) bool {
+			return isOverdue(note, time.Now())
+		},
+	}
+}
+
+// defaultLocation is the configured time zone for users who have not chosen their own.
+func (a *App) defaultLocation() *time.Location {
+	if a.config == nil {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(a.config.DefaultTimezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// Timezone returns the time zone the user has chosen, or "" if they use the default.
+func (s *postgresStore) Timezone(username string) (string, error) {
+	var timezone sql.NullString
+	err := s.db.QueryRow("SELECT timezone FROM users WHERE username = $1", username).Scan(&timezone)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	return timezone.String, nil
+}
+
+// userLocation returns the time zone due dates are entered and shown in for the user.
+func (a *App) userLocation(username string) (*time.Location, error) {
+	timezone, err := a.users.Timezone(username)
+	if err != nil {
+		return nil, err
+	}
+	return a.locationFor(timezone), nil
+}
+
+// locationFor loads a time zone chosen by a user, falling back to the default.
+func (a *App) locationFor(timezone string) *time.Location {
+	if timezone != "" {
+		if loc, err := time.LoadLocation(timezone); err == nil {
+			return loc
+		}
+	}
+	return a.defaultLocation()
+}
+
+// validateTimezone checks a time zone name chosen by a user. An empty name means the default.
+func validateTimezone(timezone string) error {
+	if timezone == "" {
+		return nil
+	}
+	if timezone == "Local" || len(timezone) > 64 {
+		return fmt.Errorf("%q is not a known time zone", timezone)
+	}
+	if _, err := time.LoadLocation(timezone); err != nil {
+		return fmt.Errorf("%q is not a known time zone", timezone)
+	}
+	return nil
+}
+
+// SetTimezone stores the user's time zone, checked with validateTimezone, or clears it to use the default.
+func (s *postgresStore) SetTimezone(username, timezone string) error {
+	_, err := s.db.Exec("UPDATE users SET timezone = NULLIF($2, '') WHERE username = $1", username, timezone)
+	return err
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// expectUserTimezone expects the lookup of a user's time zone, nil for the default
+func expectUserTimezone(mock sqlmock.Sqlmock, username string, timezone interface{}) {
+	mock.ExpectQuery("SELECT timezone FROM users").WithArgs(username).
+		WillReturnRows(sqlmock.NewRows([]string{"timezone"}).AddRow(timezone))
+}
+
+func TestParseDueAt(t *testing.T) {
+	auckland, err := time.LoadLocation("Pacific/Auckland")
+	if err != nil {
+		t.Fatalf("Loading time zone: %v", err)
+	}
+
+	tests := []struct {
+		date, clock string
+		want        sql.NullTime
+		wantErr     bool
+	}{
+		{"", "", sql.NullTime{}, false},
+		{"2024-10-23", "14:00", sql.NullTime{Time: time.Date(2024, 10, 23, 1, 0, 0, 0, time.UTC), Valid: true}, false},
+		{"2024-10-23", "02:00 PM", sql.NullTime{Time: time.Date(2024, 10, 23, 1, 0, 0, 0, time.UTC), Valid: true}, false},
+		{"2024-10-23", "13:00:00", sql.NullTime{Time: time.Date(2024, 10, 23, 0, 0, 0, 0, time.UTC), Valid: true}, false},
+		// A date on its own is due at the end of the day
+		{"2024-10-23", "", sql.NullTime{Time: time.Date(2024, 10, 23, 10, 59, 0, 0, time.UTC), Valid: true}, false},
+		{"", "14:00", sql.NullTime{}, true},
+		{"23/10/2024", "", sql.NullTime{}, true},
+		{"2024-10-23", "2pm", sql.NullTime{}, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseDueAt(tt.date, tt.clock, auckland)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseDueAt(%q, %q) error = %v, wantErr %v", tt.date, tt.clock, err, tt.wantErr)
+			continue
+		}
+		if got.Valid != tt.want.Valid || !got.Time.Equal(tt.want.Time) {
+			t.Errorf("parseDueAt(%q, %q) = %v, want %v", tt.date, tt.clock, got, tt.want)
+		}
+	}
+}
+
+func TestDueFilter_Matches(t *testing.T) {
+	auckland, err := time.LoadLocation("Pacific/Auckland")
+	if err != nil {
+		t.Fatalf("Loading time zone: %v", err)
+	}
+
+	// 10am on 23 October in Auckland
+	now := time.Date(2024, 10, 22, 21, 0, 0, 0, time.UTC)
+	due := func(t time.Time, status string) Note {
+		return Note{DueAt: sql.NullTime{Time: t, Valid: true}, NoteStatus: sql.NullString{String: status, Valid: true}}
+	}
+	earlierToday := due(time.Date(2024, 10, 23, 8, 0, 0, 0, auckland), "In Progress")
+	laterToday := due(time.Date(2024, 10, 23, 23, 59, 0, 0, auckland), "None")
+	nextWeek := due(time.Date(2024, 10, 29, 12, 0, 0, 0, auckland), "None")
+	finished := due(time.Date(2024, 10, 1, 12, 0, 0, 0, auckland), "Completed")
+	undated := Note{}
+
+	tests := []struct {
+		filter dueFilter
+		note   Note
+		want   bool
+	}{
+		{dueOverdue, earlierToday, true},
+		{dueOverdue, laterToday, false},
+		{dueOverdue, finished, false},
+		{dueOverdue, undated, false},
+		{dueToday, earlierToday, true},
+		{dueToday, laterToday, true},
+		{dueToday, nextWeek, false},
+		{dueWeek, nextWeek, true},
+		{dueWeek, finished, false},
+		{dueNone, undated, true},
+		{dueNone, laterToday, false},
+		{dueAll, undated, true},
+	}
+
+	for _, tt := range tests {
+		if got := tt.filter.matches(tt.note, now, auckland); got != tt.want {
+			t.Errorf("%q.matches(%v) = %v, want %v", tt.filter, tt.note.DueAt, got, tt.want)
+		}
+	}
+}
+
+func TestSortNotes_ByDue(t *testing.T) {
+	created := time.Date(2024, 10, 1, 9, 0, 0, 0, time.UTC)
+	notes := []Note{
+		{ID: 1, NoteCreated: created},
+		{ID: 2, NoteCreated: created, DueAt: sql.NullTime{Time: created.AddDate(0, 0, 5), Valid: true}},
+		{ID: 3, NoteCreated: created.Add(time.Hour)},
+		{ID: 4, NoteCreated: created, DueAt: sql.NullTime{Time: created.AddDate(0, 0, 1), Valid: true}},
+	}
+
+	sortNotes(notes, sortDue)
+
+	// Soonest first, then undated notes newest first
+	want := []int{4, 2, 3, 1}
+	for i, note := range notes {
+		if note.ID != want[i] {
+			t.Fatalf("Expected order %v, but note %d is at position %d", want, note.ID, i)
+		}
+	}
+}
+
+func TestAPI_UpdateMe_SetsTimezone(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	cfg := defaultConfig()
+	a.config = &cfg
+	mock.ExpectExec("UPDATE users SET timezone").WithArgs("alice", "Pacific/Auckland").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectUserTimezone(mock, "alice", "Pacific/Auckland")
+
+	rr := serveAPI(a, "PATCH", "/api/v1/me", `{"timezone":"Pacific/Auckland"}`, "alice")
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v, want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	var body map[string]string
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Decoding response: %v", err)
+	}
+	if body["effective_timezone"] != "Pacific/Auckland" {
+		t.Errorf("Expected the new time zone, got %v", body)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPI_UpdateMe_RejectsUnknownTimezone(t *testing.T) {
+	a, mock := newAPITestApp(t)
+
+	rr := serveAPI(a, "PATCH", "/api/v1/me", `{"timezone":"Mars/Olympus"}`, "alice")
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusBadRequest)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,234 @@
+// Package main contains the main entry point for the Go application
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Number of notes suggested as the user types a search, by default and at most.
+const (
+	defaultSearchSuggestions = 8
+	maxSearchSuggestions     = 20
+)
+
+// searchWordPattern matches the words of a search, as PostgreSQL splits them.
+var searchWordPattern = regexp.MustCompile(`[\p{L}\p{N}]+`)
+
+// searchResults are the notes found by a search. When nothing matches exactly they are the
+// fuzzy matches instead, along with a corrected search to suggest, if one was found.
+type searchResults struct {
+	Notes      []Note
+	Fuzzy      bool
+	DidYouMean string
+}
+
+// searchSuggestion is a note suggested while the user types a search.
+type searchSuggestion struct {
+	ID           int           `json:"id"`
+	Title        string        `json:"title"`
+	TitleSnippet template.HTML `json:"title_snippet"`
+}
+
+// searchWords returns the lower case words of the search text, without OR and excluded (-word) terms.
+func searchWords(text string) []string {
+	var words []string
+	for _, token := range splitSearchTokens(text) {
+		if token == "OR" || strings.HasPrefix(token, "-") {
+			continue
+		}
+		for _, word := range searchWordPattern.FindAllString(token, -1) {
+			words = append(words, strings.ToLower(word))
+		}
+	}
+	return words
+}
+
+// prefixTSQuery builds a to_tsquery expression matching notes with words starting with every word,
+// so "grocer" finds "groceries". Words are letters and digits only, so they need no escaping.
+func prefixTSQuery(words []string) string {
+	terms := make([]string, len(words))
+	for i, word := range words {
+		terms[i] = word + ":*"
+	}
+	return strings.Join(terms, " & ")
+}
+
+// quotedTextArray formats words as a PostgreSQL array literal, quoting each so words
+// such as "null" stay text. Words are letters and digits only, so they need no escaping.
+func quotedTextArray(words []string) string {
+	return `{"` + strings.Join(words, `","`) + `"}`
+}
+
+// searchWithFallback runs a search and, when its text matches nothing exactly, falls back to
+// prefix and trigram matching and looks for a corrected search to suggest.
+// input is the search as typed, which the suggestion is based on.
+func (a *App) searchWithFallback(input string, search searchQuery, username string) (searchResults, error) {
+	notes, err := a.search.SearchNotes(search, username)
+	if err != nil || len(notes) > 0 || strings.TrimSpace(search.Text) == "" {
+		return searchResults{Notes: notes}, err
+	}
+
+	notes, err = a.search.FuzzySearchNotes(search, username, 0)
+	if err != nil {
+		return searchResults{}, err
+	}
+	didYouMean, err := a.suggestSearch(input, search, username)
+	if err != nil {
+		return searchResults{}, err
+	}
+
+	return searchResults{Notes: notes, Fuzzy: true, DidYouMean: didYouMean}, nil
+}
+
+// FuzzySearchNotes finds notes with words starting with the words of the search, or a title
+// or description similar to it (pg_trgm), for searches with partial or misspelt words.
+// Notes matching by prefix rank above those only similar to the search.
+func (s *postgresStore) FuzzySearchNotes(search searchQuery, username string, limit int) ([]Note, error) {
+	words := searchWords(search.Text)
+	if len(words) == 0 {
+		return nil, nil
+	}
+
+	match := searchMatch{
+		ranking: `ts_rank_cd(n.search_vector, prefix_query) +
+				GREATEST(word_similarity($2, n.title), word_similarity($2, n.description)) AS rank,
+			ts_headline('english', n.title, prefix_query, $4),
+			ts_headline('english', n.description, prefix_query, $5)`,
+		from:      "CROSS JOIN to_tsquery('english', $3) AS prefix_query",
+		condition: "(n.search_vector @@ prefix_query OR $2 <% n.title OR $2 <% n.description)",
+		args:      []interface{}{strings.Join(words, " "), prefixTSQuery(words), titleHeadlineOptions, snippetHeadlineOptions},
+	}
+
+	return querySearch(s.db, search, username, match, limit)
+}
+
+// suggestSearch offers a corrected search for "did you mean", replacing each word of the text with
+// the most similar word in the notes the user can see. It returns "" when no word would change.
+func (a *App) suggestSearch(input string, search searchQuery, username string) (string, error) {
+	words := searchWords(search.Text)
+	if len(words) == 0 {
+		return "", nil
+	}
+
+	corrections, err := a.search.SimilarWords(words, username)
+	if err != nil {
+		return "", err
+	}
+	return correctSearch(input, corrections), nil
+}
+
+// SimilarWords finds the most similar word (pg_trgm) in the notes the user can see to each word.
+func (s *postgresStore) SimilarWords(words []string, username string) (map[string]string, error) {
+	rows, err := s.db.Query(`
+		SELECT DISTINCT ON (q.word) q.word, w.word
+		FROM unnest($2::text[]) AS q(word)
+		JOIN (
+			SELECT DISTINCT regexp_split_to_table(
+				lower(n.title || ' ' || n.description || ' ' || `+noteTagsColumn("n")+`), '[^[:alnum:]]+') AS word
+			FROM notes n
+			WHERE `+visibleNoteCondition+`
+		) w ON w.word % q.word
+		ORDER BY q.word, similarity(w.word, q.word) DESC, w.word
+	`, username, quotedTextArray(words))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	corrections := make(map[string]string)
+	for rows.Next() {
+		var word, correction string
+		if err := rows.Scan(&word, &correction); err != nil {
+			return nil, err
+		}
+		corrections[word] = correction
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return corrections, nil
+}
+
+// correctSearch rewrites the words of a search with their corrections, keeping its qualifiers,
+// quotes and operators. It returns "" when no word changes.
+func correctSearch(input string, corrections map[string]string) string {
+	changed := false
+	tokens := splitSearchTokens(input)
+	for i, token := range tokens {
+		if key, _, found := strings.Cut(token, ":"); found && isSearchQualifier(strings.ToLower(key)) {
+			continue
+		}
+		tokens[i] = searchWordPattern.ReplaceAllStringFunc(token, func(word string) string {
+			correction, ok := corrections[strings.ToLower(word)]
+			if !ok || correction == strings.ToLower(word) {
+				return word
+			}
+			changed = true
+			return correction
+		})
+	}
+
+	if !changed {
+		return ""
+	}
+	return strings.Join(tokens, " ")
+}
+
+// apiAutocompleteSearchHandler handles GET /api/v1/search/autocomplete?q=...&limit=..., returning the
+// notes with words starting with, or similar to, what has been typed so far. Qualifiers are supported.
+func (a *App) apiAutocompleteSearchHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := a.apiUsername(w, r)
+	if !ok {
+		return
+	}
+
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if len(query) > MaxSearchLength {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("q must be at most %d characters", MaxSearchLength))
+		return
+	}
+	limit := defaultSearchSuggestions
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxSearchSuggestions {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxSearchSuggestions))
+			return
+		}
+	}
+
+	loc, err := a.userLocation(username)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	search, err := parseSearchQuery(query, loc)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	notes, err := a.search.FuzzySearchNotes(search, username, limit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	suggestions := make([]searchSuggestion, 0, len(notes))
+	for _, note := range notes {
+		suggestions = append(suggestions, searchSuggestion{
+			ID:           note.ID,
+			Title:        note.Title,
+			TitleSnippet: highlightSnippet(note.TitleHeadline),
+		})
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"results": suggestions})
+}
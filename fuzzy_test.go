@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestSearchWords_SkipsOperatorsAndExclusions(t *testing.T) {
+	got := prefixTSQuery(searchWords(`"Weekly plan" OR groc -draft`))
+	want := "weekly:* & plan:* & groc:*"
+	if got != want {
+		t.Errorf("prefixTSQuery() = %q, want %q", got, want)
+	}
+}
+
+func TestCorrectSearch_KeepsQualifiers(t *testing.T) {
+	corrections := map[string]string{"grocries": "groceries", "list": "list", "completed": "complete"}
+
+	got := correctSearch(`Grocries list status:completed`, corrections)
+	if want := "groceries list status:completed"; got != want {
+		t.Errorf("correctSearch() = %q, want %q", got, want)
+	}
+	if got := correctSearch("list", corrections); got != "" {
+		t.Errorf("Expected no suggestion when nothing changes, got %q", got)
+	}
+}
+
+func TestAPI_SearchNotes_FallsBackToFuzzy(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	created := time.Date(2024, 10, 1, 9, 0, 0, 0, time.UTC)
+	expectUserTimezone(mock, "alice", nil)
+
+	// Nothing matches the misspelt word exactly
+	mock.ExpectQuery(`websearch_to_tsquery`).
+		WithArgs("alice", "grocries", titleHeadlineOptions, snippetHeadlineOptions).
+		WillReturnRows(sqlmock.NewRows(searchRowColumns))
+	mock.ExpectQuery(`word_similarity\(\$2, n.title\).*to_tsquery\('english', \$3\) AS prefix_query.*\$2 <% n.title`).
+		WithArgs("alice", "grocries", "grocries:*", titleHeadlineOptions, snippetHeadlineOptions).
+		WillReturnRows(sqlmock.NewRows(searchRowColumns).
+			AddRow(4, "Groceries", "Note", "Milk and eggs", created, nil, "None", "", "alice", nil, "", 0.7,
+				"Groceries", "Milk and eggs"))
+	mock.ExpectQuery(`unnest\(\$2::text\[\]\).*w.word % q.word`).
+		WithArgs("alice", `{"grocries"}`).
+		WillReturnRows(sqlmock.NewRows([]string{"word", "correction"}).AddRow("grocries", "groceries"))
+
+	rr := serveAPI(a, "GET", "/api/v1/search?q=grocries", "", "alice")
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v, want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	var body struct {
+		Results    []struct{ Note struct{ ID int } } `json:"results"`
+		Fuzzy      bool                              `json:"fuzzy"`
+		DidYouMean string                            `json:"did_you_mean"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Decoding response: %v", err)
+	}
+	if len(body.Results) != 1 || body.Results[0].Note.ID != 4 || !body.Fuzzy {
+		t.Errorf("Expected the similar note 4, got %+v", body)
+	}
+	if body.DidYouMean != "groceries" {
+		t.Errorf("Expected did you mean groceries, got %q", body.DidYouMean)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPI_AutocompleteSearch_ReturnsTitles(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	created := time.Date(2024, 10, 1, 9, 0, 0, 0, time.UTC)
+	expectUserTimezone(mock, "alice", nil)
+	mock.ExpectQuery(`prefix_query.*AND n.noteType = \$6.*LIMIT \$7`).
+		WithArgs("alice", "grocer", "grocer:*", titleHeadlineOptions, snippetHeadlineOptions, "Task", 5).
+		WillReturnRows(sqlmock.NewRows(searchRowColumns).
+			AddRow(4, "Groceries", "Task", "Milk and eggs", created, nil, "None", "", "alice", nil, "", 0.7,
+				"\x02Groceries\x03", "Milk and eggs"))
+
+	rr := serveAPI(a, "GET", "/api/v1/search/autocomplete?q=grocer+type:task&limit=5", "", "alice")
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v, want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	var body struct {
+		Results []searchSuggestion `json:"results"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Decoding response: %v", err)
+	}
+	if len(body.Results) != 1 || body.Results[0].Title != "Groceries" ||
+		body.Results[0].TitleSnippet != "<mark>Groceries</mark>" {
+		t.Errorf("Unexpected suggestions: %+v", body.Results)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPI_AutocompleteSearch_RejectsBadLimit(t *testing.T) {
+	a, mock := newAPITestApp(t)
+
+	rr := serveAPI(a, "GET", "/api/v1/search/autocomplete?q=grocer&limit=500", "", "alice")
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusBadRequest)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
@@ -2,33 +2,21 @@ package main
 
 import (
 	"bytes"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"net/http"
-	"os"
-	"sort"
 	"strconv"
-	"time"
 
 	"github.com/gorilla/mux"
-	"github.com/icza/session"
 )
 
 
 
 func (a *App) listHandler(w http.ResponseWriter, r *http.Request) {
-    if os.Getenv("DISABLE_AUTH") != "1" {
-        // Perform authentication checks only if the environment variable is not set
-        a.isAuthenticated(w, r)
-	}
-
-    sess := session.Get(r)
-    username := "[guest]"
-
-    if sess != nil {
-        username = sess.CAttr("username").(string)
-    }
+    username := currentUsername(r)
 
     // Check for a message cookie
     cookie, err := r.Cookie("errorMessage")
@@ -47,59 +35,69 @@ func (a *App) listHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    // Retrieve all notes
-    notes, err := a.retrieveNotes(username)
+    // Filters, sort order and page of each list, with days counted in the user's time zone.
+    // Each list has its own cursor so they can be paged through separately.
+    loc, err := a.userLocation(username)
     if err != nil {
         checkInternalServerError(err, w)
         return
     }
-	
-
-	 // Sort the notes by NoteCreated in descending order
-    sort.Slice(notes, func(i, j int) bool {
-        return notes[i].NoteCreated.After(notes[j].NoteCreated)
-    })
-
-    // Retrieve all shared notes with privileges
-    sharedNotes, err := a.retrieveSharedNotesWithPrivileges(username)
+    opts, err := parseNoteListOptions(r, loc, "cursor")
     if err != nil {
-        checkInternalServerError(err, w)
+        http.Error(w, err.Error(), http.StatusBadRequest)
         return
     }
+    lists := []struct {
+        scope  string
+        cursor string
+        page   notePage
+    }{
+        {scope: scopeOwned, cursor: "cursor"},
+        {scope: scopeShared, cursor: "shared_cursor"},
+        {scope: scopeDelegated, cursor: "delegated_cursor"},
+    }
+    for i := range lists {
+        listOpts := opts
+        listOpts.Scope = lists[i].scope
+        listOpts.Cursor, err = noteCursorParam(r, lists[i].cursor, opts.Sort)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        lists[i].page, err = a.notes.ListNotes(username, listOpts)
+        if err != nil {
+            checkInternalServerError(err, w)
+            return
+        }
+    }
+    notes, sharedNotes, delegatedNotes := lists[0].page.Notes, lists[1].page.Notes, lists[2].page.Notes
 
-	// Sort the shared notes by NoteCreated in descending order
-    sort.Slice(sharedNotes, func(i, j int) bool {
-        return sharedNotes[i].NoteCreated.After(sharedNotes[j].NoteCreated)
-    })
-
-	// Retrieve all notes
-    delegatedNotes, err := a.retrieveDelegatedNotes(username)
+    // Tags on every note the user can see, with counts, for the tag filter
+    tagCounts, err := a.notes.TagCounts(username)
     if err != nil {
         checkInternalServerError(err, w)
         return
     }
 
-	// Sort the delegated notes by NoteCreated in descending order
-    sort.Slice(delegatedNotes, func(i, j int) bool {
-        return delegatedNotes[i].NoteCreated.After(delegatedNotes[j].NoteCreated)
-    })
+    // Saved searches, the user's own and those shared with them. There are none without a database.
+    savedSearches, err := a.listSavedSearches(username)
+    if err != nil && !errors.Is(err, errNoDatabase) {
+        checkInternalServerError(err, w)
+        return
+    }
 
     // Get the list of all users
-    allUsers, err := a.getAllUsers(username)
+    allUsers, err := a.users.OtherUsers(username)
     if err != nil {
         // Handle the error appropriately (e.g., log it or show an error page)
         http.Error(w, "Internal Server Error", http.StatusInternalServerError)
         return
     }
 
-    // Fetch the list of shared users for each note
-    for i := range notes {
-        sharedUsers, err := a.getSharedUsersForNote(notes[i].ID)
-        if err != nil {
-            checkInternalServerError(err, w)
-            return
-        }
-        notes[i].SharedUsers = sharedUsers
+    // Fetch the shared users of every note on the page in one query
+    if err := a.attachSharedUsers(notes); err != nil {
+        checkInternalServerError(err, w)
+        return
     }
 
     // Pass the shared notes with privileges to the template
@@ -110,7 +108,21 @@ func (a *App) listHandler(w http.ResponseWriter, r *http.Request) {
         AllUsers      []User
         SharedNotes   []Note
         Message string
-        
+        TagCounts     []TagCount
+        ActiveTags    []string
+        SavedSearches []SavedSearch
+        Due           dueFilter
+        Sort          string
+        DueFilters    []dueFilterOption
+        Timezone      string
+        Type          string
+        Status        string
+        Owner         string
+        From          string
+        To            string
+        NotesPages     pageLinks
+        SharedPages    pageLinks
+        DelegatedPages pageLinks
     }{
         Username:      username,
         Notes:         notes,
@@ -118,17 +130,26 @@ func (a *App) listHandler(w http.ResponseWriter, r *http.Request) {
         AllUsers:      allUsers,
         SharedNotes:   sharedNotes,
         Message: message,
-        
-    }
-
-    t, err := template.New("list.html").Funcs(template.FuncMap{
-		"formatDate": func(layout, value string) (string, error) {
-			t, err := time.Parse(layout, value)
-			if err != nil {
-				return "", err
-			}
-			return t.Format("02/01/2006"), nil
-		},
+        TagCounts:     tagCounts,
+        ActiveTags:    opts.Filter.Tags,
+        SavedSearches: savedSearches,
+        Due:           opts.Due,
+        Sort:          opts.Sort,
+        DueFilters:    dueFilters,
+        Timezone:      loc.String(),
+        Type:          opts.Filter.NoteType,
+        Status:        opts.Filter.Status,
+        Owner:         opts.Filter.Owner,
+        From:          r.URL.Query().Get("from"),
+        To:            r.URL.Query().Get("to"),
+        NotesPages:     notePageLinks(r, lists[0].cursor, lists[0].page),
+        SharedPages:    notePageLinks(r, lists[1].cursor, lists[1].page),
+        DelegatedPages: notePageLinks(r, lists[2].cursor, lists[2].page),
+    }
+
+    t, err := template.New("list.html").Funcs(dueFuncs(loc)).Funcs(csrfFuncs(r)).Funcs(template.FuncMap{
+		"joinTags": joinTags,
+		"hasTag": hasTag,
 	}).ParseFiles("tmpl/list.html")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -160,9 +181,19 @@ func (a *App) getSharedUsersForNoteHandler(w http.ResponseWriter, r *http.Reques
         return
     }
 
+    // Only owners see who their notes are shared with, as in the API
+    role, err := a.notes.NoteRole(noteID, currentUsername(r))
+    if err != nil {
+        checkInternalServerError(err, w)
+        return
+    }
+    if !role.can(ActionShare) {
+        http.Error(w, "Forbidden: you cannot share this note", http.StatusForbidden)
+        return
+    }
 
     // Fetch the shared users for the given noteID
-    sharedUsers, err := a.getSharedUsersForNote(noteID)
+    sharedUsers, err := a.shares.NoteShares(noteID)
     if err != nil {
         http.Error(w, "Failed to fetching shared users: "+err.Error(), http.StatusInternalServerError)
         return
@@ -200,16 +231,25 @@ func (a *App) getUnsharedUsersForNoteHandler(w http.ResponseWriter, r *http.Requ
         return
     }
 
-	// Get the current username from the session
-    sess := session.Get(r)
-    username := "[guest]"
+	username := currentUsername(r)
 
-    if sess != nil {
-        username = sess.CAttr("username").(string)
+    // Only users who can share the note need the users it could be shared with
+    role, err := a.notes.NoteRole(noteID, username)
+    if err != nil {
+        checkInternalServerError(err, w)
+        return
+    }
+    if role == RoleNone {
+        http.Error(w, "Note not found", http.StatusNotFound)
+        return
+    }
+    if !role.can(ActionShare) {
+        http.Error(w, "Forbidden: you cannot share this note", http.StatusForbidden)
+        return
     }
 
     // Fetch the unshared users for the given noteID
-    unsharedUsers, err := a.getUnsharedUsersForNote(noteID, username)
+    unsharedUsers, err := a.shares.UnsharedUsers(noteID, username)
     if err != nil {
         http.Error(w, "Failed to fetch unshared users: "+err.Error(), http.StatusInternalServerError)
         return
@@ -234,20 +274,10 @@ func (a *App) getUnsharedUsersForNoteHandler(w http.ResponseWriter, r *http.Requ
 }
 
 func (a *App) searchNotesHandler(w http.ResponseWriter, r *http.Request) {
-	if os.Getenv("DISABLE_AUTH") != "1" {
-        // Perform authentication checks only if the environment variable is not set
-        a.isAuthenticated(w, r)
-	}
-
-	sess := session.Get(r)
-    username := "[guest]"
-
-    if sess != nil {
-        username = sess.CAttr("username").(string)
-    }
+	username := currentUsername(r)
 
 	// Get the list of all users
-    allUsers, err := a.getAllUsers(username)
+    allUsers, err := a.users.OtherUsers(username)
     if err != nil {
         // Handle the error appropriately (e.g., log it or show an error page)
         http.Error(w, "Internal Server Error", http.StatusInternalServerError)
@@ -257,36 +287,72 @@ func (a *App) searchNotesHandler(w http.ResponseWriter, r *http.Request) {
 
     searchQuery := r.FormValue("searchQuery")
 
-	const MaxSearchLength = 50
-
 	// Validate the length of title and description
     if len(searchQuery) > MaxSearchLength  {
         
         
         http.SetCookie(w, &http.Cookie{
             Name:  "errorMessage",
-            Value: "Search Error: Search query exceeds 50 characters.", // Set your error message
+            Value: fmt.Sprintf("Search Error: Search query exceeds %d characters.", MaxSearchLength), // Set your error message
             Path:  "/list", // Set the path as needed
         })
         http.Redirect(w, r, "/list", http.StatusSeeOther)
         return
     }
 
-    // Query your database using FTS to search for notes based on searchQuery
-    results, err := a.searchNotesInDatabase(searchQuery, username)
+    // Due date filter and sort order, as on the list page
+    due, sortBy, err := dueOptions(r, searchSorts...)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    // A saved search (?saved=ID) brings its own query, due filter and sort order
+    saved, err := a.savedSearchFromRequest(r, username)
+    if err == sql.ErrNoRows {
+        http.Error(w, "Saved search not found", http.StatusNotFound)
+        return
+    }
+    if err != nil {
+        http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+        return
+    }
+    if saved != nil {
+        searchQuery, due, sortBy = saved.Query, saved.Due, saved.Sort
+    }
+
+    loc, err := a.userLocation(username)
+    if err != nil {
+        http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+        return
+    }
+
+    // Split the qualifiers (status:, type:, owner:, tag:, due:) from the search text
+    search, err := parseSearchQuery(searchQuery, loc)
+    if err != nil {
+        http.SetCookie(w, &http.Cookie{
+            Name:  "errorMessage",
+            Value: "Search Error: " + err.Error(),
+            Path:  "/list",
+        })
+        http.Redirect(w, r, "/list", http.StatusSeeOther)
+        return
+    }
+
+    // Query your database using FTS to search for notes based on searchQuery,
+    // falling back to similar notes and a "did you mean" when nothing matches
+    found, err := a.searchWithFallback(searchQuery, search, username)
     if err != nil {
         http.Error(w, "Internal Server Error", http.StatusInternalServerError)
         return
     }
+    results := filterNotesByDue(found.Notes, due, loc)
+    sortNotes(results, sortBy)
 
-    // Retrieve shared users for each note in the search results
-    for i, note := range results {
-        sharedUsers, err := a.getSharedUsersForNote(note.ID)
-        if err != nil {
-            http.Error(w, "Failed to fetch shared users: "+err.Error(), http.StatusInternalServerError)
-            return
-        }
-        results[i].SharedUsers = sharedUsers
+    // Retrieve the shared users of all the search results in one query
+    if err := a.attachSharedUsers(results); err != nil {
+        http.Error(w, "Failed to fetch shared users: "+err.Error(), http.StatusInternalServerError)
+        return
     }
 
     // Pass the search results with shared users to the template
@@ -294,25 +360,33 @@ func (a *App) searchNotesHandler(w http.ResponseWriter, r *http.Request) {
 		Username string
         SearchResults []Note
 		SearchQuery string
+		Fuzzy         bool
+		DidYouMean    string
+		Saved         *SavedSearch
 		AllUsers      []User
+		Due           dueFilter
+		Sort          string
+		DueFilters    []dueFilterOption
+		Timezone      string
     }{
 		Username: username,
         SearchResults: results,
 		SearchQuery: searchQuery,
+		Fuzzy:         found.Fuzzy,
+		DidYouMean:    found.DidYouMean,
+		Saved:         saved,
 		AllUsers:      allUsers, 
+		Due:           due,
+		Sort:          sortBy,
+		DueFilters:    dueFilters,
+		Timezone:      loc.String(),
     }
 
-	var funcMap = template.FuncMap{
-		"formatDate": func(layout, value string) (string, error) {
-			t, err := time.Parse(layout, value)
-			if err != nil {
-				return "", err
-			}
-			return t.Format("02/01/2006"), nil
-		},
-	}
+	var funcMap = dueFuncs(loc)
+	funcMap["joinTags"] = joinTags
+	funcMap["highlight"] = highlightSnippet
 
-    t, err := template.New("search_results.html").Funcs(funcMap).ParseFiles("tmpl/search_results.html")
+    t, err := template.New("search_results.html").Funcs(funcMap).Funcs(csrfFuncs(r)).ParseFiles("tmpl/search_results.html")
 
 	var buf bytes.Buffer
     err = t.Execute(&buf, data)
@@ -326,39 +400,37 @@ func (a *App) searchNotesHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (a *App) createHandler(w http.ResponseWriter, r *http.Request) {
-    if os.Getenv("DISABLE_AUTH") != "1" {
-        // Perform authentication checks only if the environment variable is not set
-        a.isAuthenticated(w, r)
-    }
-
-    sess := session.Get(r)
-    if sess == nil {
-        // Handle the case when session is not found or authenticated
-        http.Error(w, "Unauthorized", http.StatusSeeOther)
-        return
-    }
-
-    username := sess.CAttr("username").(string)
+    username := currentUsername(r)
 
     if r.Method != http.MethodPost {
         http.Redirect(w, r, "/", http.StatusSeeOther)
         return
     }
 
-    const MaxNoteLength = 256
-
-
     var note Note
     note.Title = r.FormValue("Title")
     note.NoteType = r.FormValue("NoteType")
     note.Description = r.FormValue("Description")
     note.Owner = username
-    note.TaskCompletionDate.String = r.FormValue("TaskCompletionDate")
-    note.TaskCompletionTime.String = r.FormValue("TaskCompletionTime")
     note.NoteStatus.String = r.FormValue("NoteStatus")
     note.NoteDelegation.String = r.FormValue("NoteDelegation")
 
-	note.TaskCompletionTime.String = convertTo12HourFormat(r.FormValue("TaskCompletionTime"))
+    // The due date and time are entered in the user's time zone
+    loc, err := a.userLocation(username)
+    if err != nil {
+        checkInternalServerError(err, w)
+        return
+    }
+    note.DueAt, err = parseDueAt(r.FormValue("TaskCompletionDate"), r.FormValue("TaskCompletionTime"), loc)
+    if err != nil {
+        http.SetCookie(w, &http.Cookie{
+            Name:  "errorMessage",
+            Value: "Create Error: " + invalidDueMessage,
+            Path:  "/list",
+        })
+        http.Redirect(w, r, "/list", http.StatusSeeOther)
+        return
+    }
 	
 
     // Validate the length of title and description
@@ -374,8 +446,24 @@ func (a *App) createHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
 
+    // Validate the tags
+    note.Tags, err = parseTags(r.FormValue("Tags"))
+    if err != nil {
+        http.SetCookie(w, &http.Cookie{
+            Name:  "errorMessage",
+            Value: "Create Error: " + invalidTagsMessage,
+            Path:  "/list",
+        })
+        http.Redirect(w, r, "/list", http.StatusSeeOther)
+        return
+    }
+
     // Insert the new note into the database
-    err := a.insertNoteIntoDatabase(note)
+    _, err = a.notes.CreateNote(note)
+    if errors.Is(err, errUserNotFound) {
+        http.Error(w, "User not found", http.StatusNotFound)
+        return
+    }
     if err != nil {
         checkInternalServerError(err, w)
         return
@@ -386,28 +474,18 @@ func (a *App) createHandler(w http.ResponseWriter, r *http.Request) {
 
 
 func (a *App) updateHandler(w http.ResponseWriter, r *http.Request) {
-    if os.Getenv("DISABLE_AUTH") != "1" {
-        // Perform authentication checks only if the environment variable is not set
-        a.isAuthenticated(w, r)
-	}
-
     if r.Method != http.MethodPost {
         http.Redirect(w, r, "/", http.StatusSeeOther)
         return
     }
 
-	const MaxNoteLength = 256
-
     var note Note
     note.ID, _ = strconv.Atoi(r.FormValue("Id")) // Given ID
     note.Title = r.FormValue("Title")
     note.NoteType = r.FormValue("NoteType")
     note.Description = r.FormValue("Description")
-    note.TaskCompletionTime.String = r.FormValue("TaskCompletionTime")
-    note.TaskCompletionDate.String = r.FormValue("TaskCompletionDate")
     note.NoteStatus.String = r.FormValue("NoteStatus")
     note.NoteDelegation.String = r.FormValue("NoteDelegation")
-	note.TaskCompletionTime.String = convertTo12HourFormat(r.FormValue("TaskCompletionTime"))
 
 
 	// Validate the length of title and description
@@ -423,46 +501,74 @@ func (a *App) updateHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    // Update the note in the database
-    err := a.updateNoteInDatabase(note)
+    // Validate the tags
+    tags, err := parseTags(r.FormValue("Tags"))
     if err != nil {
-        checkInternalServerError(err, w)
+        http.SetCookie(w, &http.Cookie{
+            Name:  "errorMessage",
+            Value: "Update Error: " + invalidTagsMessage,
+            Path:  "/list",
+        })
+        http.Redirect(w, r, "/list", http.StatusSeeOther)
         return
     }
+    note.Tags = tags
 
-    // Redirect back to the list page or another appropriate page
-    http.Redirect(w, r, "/list", http.StatusSeeOther)
-}
+    // The due date and time are entered in the user's time zone
+    username := currentUsername(r)
+    loc, err := a.userLocation(username)
+    if err != nil {
+        checkInternalServerError(err, w)
+        return
+    }
+    note.DueAt, err = parseDueAt(r.FormValue("TaskCompletionDate"), r.FormValue("TaskCompletionTime"), loc)
+    if err != nil {
+        http.SetCookie(w, &http.Cookie{
+            Name:  "errorMessage",
+            Value: "Update Error: " + invalidDueMessage,
+            Path:  "/list",
+        })
+        http.Redirect(w, r, "/list", http.StatusSeeOther)
+        return
+    }
 
-func convertTo12HourFormat(time24hr string) string {
-    t, err := time.Parse("15:04", time24hr)
+    // Check the current user is allowed to edit this note
+    role, err := a.notes.NoteRole(note.ID, username)
     if err != nil {
-        // Handle the error, e.g., return an error message
-        return ""
+        checkInternalServerError(err, w)
+        return
+    }
+    if !role.can(ActionEdit) {
+        http.Error(w, "Forbidden: you do not have permission to edit this note", http.StatusForbidden)
+        return
     }
 
-    hour := t.Hour()
-    minute := t.Minute()
-    ampm := "AM"
-    if hour >= 12 {
-        ampm = "PM"
-        if hour > 12 {
-            hour -= 12
+    // Delegates may only change the title and description, keep the rest as stored
+    if role == RoleDelegate {
+        existing, err := a.notes.GetNote(note.ID)
+        if err != nil {
+            checkInternalServerError(err, w)
+            return
         }
+        applyDelegateRestrictions(&note, existing)
     }
-    if hour == 0 {
-        hour = 12
+
+    // Update the note in the database
+    err = a.notes.UpdateNote(note, username)
+    if errors.Is(err, errUserNotFound) {
+        http.Error(w, "User not found", http.StatusNotFound)
+        return
+    }
+    if err != nil {
+        checkInternalServerError(err, w)
+        return
     }
 
-    return fmt.Sprintf("%02d:%02d %s", hour, minute, ampm)
+    // Redirect back to the list page or another appropriate page
+    http.Redirect(w, r, "/list", http.StatusSeeOther)
 }
 
 func (a *App) deleteHandler(w http.ResponseWriter, r *http.Request) {
-    if os.Getenv("DISABLE_AUTH") != "1" {
-        // Perform authentication checks only if the environment variable is not set
-        a.isAuthenticated(w, r)
-	}
-
     if r.Method != http.MethodPost {
         http.Redirect(w, r, "/", http.StatusSeeOther)
         return
@@ -470,8 +576,20 @@ func (a *App) deleteHandler(w http.ResponseWriter, r *http.Request) {
 
     noteID, _ := strconv.Atoi(r.FormValue("Id"))
 
-    // Delete the note from the database
-    err := a.deleteNoteFromDatabase(noteID)
+    // Only the owner may delete a note
+    username := currentUsername(r)
+    role, err := a.notes.NoteRole(noteID, username)
+    if err != nil {
+        checkInternalServerError(err, w)
+        return
+    }
+    if !role.can(ActionDelete) {
+        http.Error(w, "Forbidden: only the owner can delete this note", http.StatusForbidden)
+        return
+    }
+
+    // Move the note to the owner's trash
+    err = a.notes.DeleteNote(noteID, username)
     if err != nil {
         checkInternalServerError(err, w)
         return
@@ -481,12 +599,25 @@ func (a *App) deleteHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 
-func (a *App) shareHandler(w http.ResponseWriter, r *http.Request) {
-    if os.Getenv("DISABLE_AUTH") != "1" {
-        // Perform authentication checks only if the environment variable is not set
-        a.isAuthenticated(w, r)
+// shareErrorStatus returns the HTTP status and the message for the user for an error of the
+// share store. ok is false for any other error, which is an internal server error.
+func shareErrorStatus(err error) (status int, message string, ok bool) {
+	switch {
+	case errors.Is(err, errNoteNotFound):
+		return http.StatusNotFound, "Note not found", true
+	case errors.Is(err, errUserNotFound):
+		return http.StatusNotFound, "User not found", true
+	case errors.Is(err, errShareNotFound):
+		return http.StatusNotFound, "The note is not shared with this user", true
+	case errors.Is(err, errAlreadyShared):
+		return http.StatusConflict, "The note is already shared with this user", true
+	case errors.Is(err, errShareForbidden):
+		return http.StatusForbidden, "You cannot share a note with its owner", true
 	}
+	return 0, "", false
+}
 
+func (a *App) shareHandler(w http.ResponseWriter, r *http.Request) {
     if r.Method != http.MethodPost {
         http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
         return
@@ -497,10 +628,25 @@ func (a *App) shareHandler(w http.ResponseWriter, r *http.Request) {
     privileges := r.FormValue("Privileges")
     noteID, _ := strconv.Atoi(r.FormValue("Id"))
 
+    // Only the owner may share a note
+    role, err := a.notes.NoteRole(noteID, currentUsername(r))
+    if err != nil {
+        checkInternalServerError(err, w)
+        return
+    }
+    if !role.can(ActionShare) {
+        http.Error(w, "Forbidden: only the owner can share this note", http.StatusForbidden)
+        return
+    }
+
     // Share the note with the user in the database
-    err := a.shareNoteWithUser(noteID, sharedUsername, privileges)
+    err = a.shares.ShareNote(noteID, sharedUsername, privileges)
+    if status, message, ok := shareErrorStatus(err); ok {
+        http.Error(w, message, status)
+        return
+    }
     if err != nil {
-        http.Error(w, err.Error(), http.StatusBadRequest)
+        checkInternalServerError(err, w)
         return
     }
 
@@ -512,11 +658,6 @@ func (a *App) shareHandler(w http.ResponseWriter, r *http.Request) {
 
 
 func (a *App) removeSharedNoteHandler(w http.ResponseWriter, r *http.Request) {
-    if os.Getenv("DISABLE_AUTH") != "1" {
-        // Perform authentication checks only if the environment variable is not set
-        a.isAuthenticated(w, r)
-	}
-
     if r.Method != http.MethodPost {
         http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
         return
@@ -526,8 +667,30 @@ func (a *App) removeSharedNoteHandler(w http.ResponseWriter, r *http.Request) {
     noteID := r.FormValue("noteID")
 	username := r.FormValue("username")
 
+    id, err := strconv.Atoi(noteID)
+    if err != nil {
+        http.Error(w, "Invalid noteID", http.StatusBadRequest)
+        return
+    }
+
+    // The owner can stop sharing with anyone, other users can only remove themselves
+    currentUser := currentUsername(r)
+    role, err := a.notes.NoteRole(id, currentUser)
+    if err != nil {
+        checkInternalServerError(err, w)
+        return
+    }
+    if !role.can(ActionShare) && !(username == currentUser && role.can(ActionView)) {
+        http.Error(w, "Forbidden: you do not have permission to change sharing on this note", http.StatusForbidden)
+        return
+    }
+
     // Implement the logic to remove the shared note from the user_shares table
-    err := a.removeSharedNoteFromUser(username, noteID)
+    err = a.shares.RemoveShare(id, username)
+    if status, message, ok := shareErrorStatus(err); ok {
+        http.Error(w, message, status)
+        return
+    }
     if err != nil {
         // Handle the error appropriately (e.g., log it or show an error page)
         http.Error(w, "Internal Server Error", http.StatusInternalServerError)
@@ -539,11 +702,6 @@ func (a *App) removeSharedNoteHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (a *App) removeDelegationHandler(w http.ResponseWriter, r *http.Request) {
-    if os.Getenv("DISABLE_AUTH") != "1" {
-        // Perform authentication checks only if the environment variable is not set
-        a.isAuthenticated(w, r)
-    }
-
 	vars := mux.Vars(r)
     noteIDStr, ok := vars["noteID"]
     if !ok {
@@ -557,8 +715,19 @@ func (a *App) removeDelegationHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
 
+    // Only the owner or the delegate may remove a delegation
+    role, err := a.notes.NoteRole(noteID, currentUsername(r))
+    if err != nil {
+        respondWithError(w, http.StatusInternalServerError, err.Error())
+        return
+    }
+    if !role.can(ActionUndelegate) {
+        respondWithError(w, http.StatusForbidden, "You do not have permission to remove this delegation")
+        return
+    }
+
     // Call the database function to remove delegation
-    if err := a.RemoveDelegation(noteID); // Replace with your actual DB function
+    if err := a.notes.RemoveDelegation(noteID); // Replace with your actual DB function
     err != nil {
         respondWithError(w, http.StatusInternalServerError, err.Error())
         return
@@ -569,18 +738,35 @@ func (a *App) removeDelegationHandler(w http.ResponseWriter, r *http.Request) {
 
 
 func (a *App) updatePrivilegesHandler(w http.ResponseWriter, r *http.Request) {
-	if os.Getenv("DISABLE_AUTH") != "1" {
-        // Perform authentication checks only if the environment variable is not set
-        a.isAuthenticated(w, r)
-	}
     // Parse the POST data to retrieve the selected username and updated privileges
     r.ParseForm()
     selectedUsername := r.Form.Get("username")
     updatedPrivileges := r.Form.Get("privileges")
     noteID := r.Form.Get("noteID")
 
+    id, err := strconv.Atoi(noteID)
+    if err != nil {
+        http.Error(w, "Invalid noteID", http.StatusBadRequest)
+        return
+    }
+
+    // Only the owner may change the privileges of shared users
+    role, err := a.notes.NoteRole(id, currentUsername(r))
+    if err != nil {
+        checkInternalServerError(err, w)
+        return
+    }
+    if !role.can(ActionShare) {
+        http.Error(w, "Forbidden: only the owner can change privileges on this note", http.StatusForbidden)
+        return
+    }
+
     // Perform the database update to change privileges for the selected user and noteID
-    err := a.updateUserPrivileges(selectedUsername, updatedPrivileges, noteID)
+    err = a.shares.UpdateShare(id, selectedUsername, updatedPrivileges)
+    if status, message, ok := shareErrorStatus(err); ok {
+        http.Error(w, message, status)
+        return
+    }
     if err != nil {
         http.Error(w, "Failed to update privileges: "+err.Error(), http.StatusInternalServerError)
         return
@@ -592,10 +778,6 @@ func (a *App) updatePrivilegesHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (a *App) findInNoteHandler(w http.ResponseWriter, r *http.Request) {
-	if os.Getenv("DISABLE_AUTH") != "1" {
-        // Perform authentication checks only if the environment variable is not set
-        a.isAuthenticated(w, r)
-	}
     vars := mux.Vars(r)
     noteIDStr, ok := vars["noteID"]
     if !ok {
@@ -611,6 +793,16 @@ func (a *App) findInNoteHandler(w http.ResponseWriter, r *http.Request) {
 
 	searchPattern := r.FormValue("searchInput")
 
+    // Only users who can see the note may search it, and notes in the trash have no role
+    role, err := a.notes.NoteRole(noteID, currentUsername(r))
+    if err != nil {
+        checkInternalServerError(err, w)
+        return
+    }
+    if !role.can(ActionView) {
+        http.Error(w, "Forbidden: you cannot view this note", http.StatusForbidden)
+        return
+    }
 
     // Implement your search logic to find text in the note with the given noteID.
     // This could involve searching in your data store, such as a database, for the specified text pattern.
@@ -639,10 +831,6 @@ func (a *App) findInNoteHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (a *App) indexHandler(w http.ResponseWriter, r *http.Request) {
-	if os.Getenv("DISABLE_AUTH") != "1" {
-        // Perform authentication checks only if the environment variable is not set
-        a.isAuthenticated(w, r)
-	}
 	http.Redirect(w, r, "/list", http.StatusSeeOther)
 }
 
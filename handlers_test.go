@@ -2,17 +2,19 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
 
 	"net/http"
 	"net/http/httptest"
 	"net/url"
-	"os"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/gorilla/mux"
+	"github.com/icza/session"
 	"github.com/stretchr/testify/mock"
 	// Import other necessary packages for your tests
 )
@@ -28,17 +30,45 @@ func (m *MockSession) Get(key string) interface{} {
     return args.Get(0)
 }
 
+// withSession attaches a session cookie for the given username to the request, and authenticates
+// the request as that user like requireAuth
+func withSession(req *http.Request, username string) *http.Request {
+    sess := session.NewSessionOptions(&session.SessOptions{
+        CAttrs: map[string]interface{}{"username": username, "userid": ""},
+        Attrs:  map[string]interface{}{"count": 1},
+    })
+
+    rr := httptest.NewRecorder()
+    session.Add(sess, rr)
+    for _, c := range rr.Result().Cookies() {
+        req.AddCookie(c)
+    }
+
+    return withUser(req, username)
+}
+
+// expectNoteRole expects the role lookup for a note and returns the given owner, delegation and privileges
+func expectNoteRole(mock sqlmock.Sqlmock, noteID int, username string, owner string, delegation interface{}, privileges interface{}) {
+    mock.ExpectQuery("SELECT n.owner, n.noteDelegation, us.privileges FROM notes n").
+        WithArgs(noteID, username).
+        WillReturnRows(sqlmock.NewRows([]string{"owner", "noteDelegation", "privileges"}).
+            AddRow(owner, delegation, privileges))
+}
+
+// expectDelegateExists expects the check that the user a note is delegated to exists
+func expectDelegateExists(mock sqlmock.Sqlmock, username string, exists bool) {
+    mock.ExpectQuery("SELECT EXISTS\\(SELECT 1 FROM users").WithArgs(username).
+        WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(exists))
+}
 
 func TestListHandler(t *testing.T) {
     // Create a new instance of your application
     a := App{}
     a.Initialize()
 
-	// Set the DISABLE_AUTH environment variable to "1" to disable authentication checks
-    os.Setenv("DISABLE_AUTH", "1")
-
     // Create a mock HTTP request with GET method (simulating a successful request)
     req := httptest.NewRequest("GET", "/list", nil)
+    req = withUser(req, "testuser") // as requireAuth would
 
     // Create a ResponseRecorder to capture the response
     rr := httptest.NewRecorder()
@@ -63,7 +93,7 @@ func TestGetSharedUsersForNote_Success(t *testing.T) {
     defer db.Close()
 
     // Create the App instance and set the database connection to the mock
-    a := App{db: db}
+    a := newSQLTestApp(db)
 
     // Define the expected rows to be returned by the mock
     rows := sqlmock.NewRows([]string{"username", "privileges"}).
@@ -75,7 +105,7 @@ func TestGetSharedUsersForNote_Success(t *testing.T) {
         WithArgs(123).WillReturnRows(rows)
 
     // Call the function with the noteID
-    sharedUsers, err := a.getSharedUsersForNote(123)
+    sharedUsers, err := a.shares.NoteShares(123)
     if err != nil {
         t.Errorf("Expected no error, but got %v", err)
     }
@@ -117,7 +147,7 @@ func TestGetUnsharedUsersForNoteHandler(t *testing.T) {
     defer db.Close()
 
     // Create the App instance and set the database connection to the mock
-    a := App{db: db}
+    a := newSQLTestApp(db)
 
     
 
@@ -132,7 +162,7 @@ func TestGetUnsharedUsersForNoteHandler(t *testing.T) {
 
 
     // Fetch the unshared users for the given noteID
-    unsharedUsers, err := a.getUnsharedUsersForNote(123, "testuser")
+    unsharedUsers, err := a.shares.UnsharedUsers(123, "testuser")
     if err != nil {
         t.Errorf("Expected no error, but got %v", err)
     }
@@ -168,11 +198,9 @@ func TestSearchNotesHandler(t *testing.T) {
     a := App{}
     a.Initialize()
 
-    // Set the DISABLE_AUTH environment variable to "1" to disable authentication checks
-    os.Setenv("DISABLE_AUTH", "1")
-
     // Create a mock HTTP request with GET method (simulating a successful request)
     req := httptest.NewRequest("GET", "/search", nil)
+    req = withUser(req, "testuser") // as requireAuth would
 
     // Create a ResponseRecorder to capture the response
     rr := httptest.NewRecorder()
@@ -194,9 +222,6 @@ func TestCreateHandler(t *testing.T) {
     a := App{}
 	a.Initialize()
 
-    // Set the DISABLE_AUTH environment variable to "1" to disable authentication checks
-    os.Setenv("DISABLE_AUTH", "1")
-
     // Create a mock HTTP request with POST method (simulating a successful request)
     form := url.Values{}
     form.Add("Title", "Test Title")
@@ -208,6 +233,7 @@ func TestCreateHandler(t *testing.T) {
     form.Add("NoteDelegation", "Test Delegation")
 	
     req := httptest.NewRequest("POST", "/create", strings.NewReader(form.Encode()))
+    req = withUser(req, "testuser") // as requireAuth would
     req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
     // Create a ResponseRecorder to capture the response
@@ -228,9 +254,6 @@ func TestUpdateHandler(t *testing.T) {
     a := App{}
     a.Initialize()
 
-    // Set the DISABLE_AUTH environment variable to "1" to disable authentication checks
-    os.Setenv("DISABLE_AUTH", "1")
-
     // Create a mock HTTP request with POST method (simulating a successful request)
     form := url.Values{}
     form.Add("Id", "1")
@@ -243,7 +266,9 @@ func TestUpdateHandler(t *testing.T) {
     form.Add("NoteDelegation", "Updated Delegation")
 
     req := httptest.NewRequest("POST", "/update", strings.NewReader(form.Encode()))
+    req = withUser(req, "testuser") // as requireAuth would
     req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    req = withSession(req, "mydog7") // Owner of note 1 in the demo data
 
     // Create a ResponseRecorder to capture the response
     rr := httptest.NewRecorder()
@@ -265,15 +290,14 @@ func TestDeleteHandler(t *testing.T) {
 	a := App{}
 	a.Initialize()
 
-	// Set the DISABLE_AUTH environment variable to "1" to disable authentication checks
-	os.Setenv("DISABLE_AUTH", "1")
-
 	// Create a mock HTTP request with POST method (simulating a successful request)
 	form := url.Values{}
 	form.Add("Id", "1")
 
 	req := httptest.NewRequest("POST", "/delete", strings.NewReader(form.Encode()))
+	req = withUser(req, "testuser") // as requireAuth would
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req = withSession(req, "mydog7") // Owner of note 1 in the demo data
 
 	// Create a ResponseRecorder to capture the response
 	rr := httptest.NewRecorder()
@@ -295,9 +319,6 @@ func TestUpdatePrivilegesHandler(t *testing.T) {
     a := App{}
     a.Initialize()
 
-	// Set the DISABLE_AUTH environment variable to "1" to disable authentication checks
-    os.Setenv("DISABLE_AUTH", "1")
-
     // Create a mock HTTP request with POST method and form data
     form := url.Values{
         "username":   {"testuser"},   // Replace with the appropriate username
@@ -306,7 +327,9 @@ func TestUpdatePrivilegesHandler(t *testing.T) {
     }
     body := strings.NewReader(form.Encode())
     req := httptest.NewRequest("POST", "/update-privileges", body)
+    req = withUser(req, "testuser") // as requireAuth would
     req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    req = withSession(req, "mydog7") // Owner of note 1 in the demo data
 
     // Create a ResponseRecorder to capture the response
     rr := httptest.NewRecorder()
@@ -328,12 +351,10 @@ func TestFindInNoteHandler(t *testing.T) {
     a := App{}
     a.Initialize()
 
-    // Set the DISABLE_AUTH environment variable to "1" to disable authentication checks
-    os.Setenv("DISABLE_AUTH", "1")
-	
 
     // Create a mock HTTP request with a valid noteID and search pattern
     req := httptest.NewRequest("GET", "/find-note/{noteID}", nil)
+    req = withUser(req, "testuser") // as requireAuth would
     req = mux.SetURLVars(req, map[string]string{"noteID": "1"})
 
     // Create a ResponseRecorder to capture the response
@@ -358,11 +379,9 @@ func TestIndexHandler(t *testing.T) {
     a := App{}
     a.Initialize()
 
-	// Set the DISABLE_AUTH environment variable to "1" to disable authentication checks
-    os.Setenv("DISABLE_AUTH", "1")
-
     // Create a mock authenticated request
     req := httptest.NewRequest("GET", "/index", nil)
+    req = withUser(req, "testuser") // as requireAuth would
     req.AddCookie(&http.Cookie{Name: "authCookie", Value: "authToken"}) // Replace with your authentication method
 
     // Create a ResponseRecorder to capture the response
@@ -381,3 +400,408 @@ func TestIndexHandler(t *testing.T) {
 
 
 
+
+func TestGetNoteRole(t *testing.T) {
+    tests := []struct {
+        name       string
+        owner      string
+        delegation interface{}
+        privileges interface{}
+        want       NoteRole
+    }{
+        {"owner", "bob", nil, nil, RoleOwner},
+        {"editor", "alice", nil, "editor", RoleEditor},
+        {"delegate", "alice", "bob", nil, RoleDelegate},
+        {"editor and delegate", "alice", "bob", "editor", RoleEditor},
+        {"viewer", "alice", nil, "viewer", RoleViewer},
+        {"unrelated", "alice", "carol", nil, RoleNone},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            db, mock, err := sqlmock.New()
+            if err != nil {
+                t.Fatalf("An error occurred while opening a stub database connection: %v", err)
+            }
+            defer db.Close()
+
+            a := newSQLTestApp(db)
+            expectNoteRole(mock, 1, "bob", tt.owner, tt.delegation, tt.privileges)
+
+            role, err := a.notes.NoteRole(1, "bob")
+            if err != nil {
+                t.Errorf("Expected no error, but got %v", err)
+            }
+            if role != tt.want {
+                t.Errorf("Expected role %q, but got %q", tt.want, role)
+            }
+        })
+    }
+}
+
+func TestGetNoteRole_NoteNotFound(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    if err != nil {
+        t.Fatalf("An error occurred while opening a stub database connection: %v", err)
+    }
+    defer db.Close()
+
+    a := newSQLTestApp(db)
+    mock.ExpectQuery("SELECT n.owner").WithArgs(99, "bob").WillReturnError(sql.ErrNoRows)
+
+    role, err := a.notes.NoteRole(99, "bob")
+    if err != nil {
+        t.Errorf("Expected no error, but got %v", err)
+    }
+    if role != RoleNone {
+        t.Errorf("Expected role %q, but got %q", RoleNone, role)
+    }
+}
+
+func TestUpdateHandler_ForbiddenForViewer(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    if err != nil {
+        t.Fatalf("An error occurred while opening a stub database connection: %v", err)
+    }
+    defer db.Close()
+
+    a := newSQLTestApp(db)
+    expectUserTimezone(mock, "bob", nil)
+    expectNoteRole(mock, 1, "bob", "alice", nil, "viewer")
+
+    form := url.Values{"Id": {"1"}, "Title": {"Hijacked"}, "NoteType": {"Note"}, "Description": {"Hijacked"}}
+    req := httptest.NewRequest("POST", "/update", strings.NewReader(form.Encode()))
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    req = withSession(req, "bob")
+
+    rr := httptest.NewRecorder()
+    a.updateHandler(rr, req)
+
+    if status := rr.Code; status != http.StatusForbidden {
+        t.Errorf("Handler returned wrong status code: got %v, want %v", status, http.StatusForbidden)
+    }
+
+    // No UPDATE should have been issued
+    if err := mock.ExpectationsWereMet(); err != nil {
+        t.Errorf("Unfulfilled expectations: %s", err)
+    }
+}
+
+func TestUpdateHandler_AllowedForEditor(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    if err != nil {
+        t.Fatalf("An error occurred while opening a stub database connection: %v", err)
+    }
+    defer db.Close()
+
+    a := newSQLTestApp(db)
+    expectUserTimezone(mock, "bob", nil)
+    expectNoteRole(mock, 1, "bob", "alice", nil, "editor")
+    mock.ExpectBegin()
+    mock.ExpectPrepare("UPDATE notes SET title").ExpectExec().WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec("DELETE FROM note_tags").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 0))
+    mock.ExpectExec("UPDATE notes SET tags_text").WithArgs(1, "").WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec("INSERT INTO note_revisions").WithArgs(1, "bob").WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectCommit()
+
+    form := url.Values{"Id": {"1"}, "Title": {"Edited"}, "NoteType": {"Note"}, "Description": {"Edited"}}
+    req := httptest.NewRequest("POST", "/update", strings.NewReader(form.Encode()))
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    req = withSession(req, "bob")
+
+    rr := httptest.NewRecorder()
+    a.updateHandler(rr, req)
+
+    if status := rr.Code; status != http.StatusSeeOther {
+        t.Errorf("Handler returned wrong status code: got %v, want %v", status, http.StatusSeeOther)
+    }
+
+    if err := mock.ExpectationsWereMet(); err != nil {
+        t.Errorf("Unfulfilled expectations: %s", err)
+    }
+}
+
+func TestUpdateHandler_DelegateKeepsTaskFields(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    if err != nil {
+        t.Fatalf("An error occurred while opening a stub database connection: %v", err)
+    }
+    defer db.Close()
+
+    a := newSQLTestApp(db)
+    expectUserTimezone(mock, "bob", "Pacific/Auckland")
+    expectNoteRole(mock, 1, "bob", "alice", "bob", nil)
+    mock.ExpectQuery("SELECT id, title, description, noteType").WithArgs(1).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "title", "description", "noteType", "due_at", "noteStatus", "noteDelegation", "owner", "noteCreated", "tags"}).
+            AddRow(1, "Old", "Old", "Task", testDueAt, "Delegated", "bob", "alice", time.Now(), "work"))
+    // The delegate's new title and description are saved, the task fields are kept as stored
+    mock.ExpectBegin()
+    expectDelegateExists(mock, "bob", true)
+    mock.ExpectPrepare("UPDATE notes SET title").ExpectExec().
+        WithArgs("New", "Task", "New", testDueAt, "Delegated", "bob", 1).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    // The owner's tags are kept too
+    mock.ExpectExec("DELETE FROM note_tags").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec("UPDATE notes SET tags_text").WithArgs(1, "work").WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec("INSERT INTO tags").WithArgs("{work}").WillReturnResult(sqlmock.NewResult(0, 0))
+    mock.ExpectExec("INSERT INTO note_tags").WithArgs(1, "{work}").WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec("INSERT INTO note_revisions").WithArgs(1, "bob").WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectCommit()
+
+    form := url.Values{"Id": {"1"}, "Title": {"New"}, "NoteType": {"Note"}, "Description": {"New"}, "NoteStatus": {"Completed"}, "NoteDelegation": {""}, "Tags": {"other"}, "TaskCompletionDate": {"2024-10-30"}, "TaskCompletionTime": {"09:00"}}
+    req := httptest.NewRequest("POST", "/update", strings.NewReader(form.Encode()))
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    req = withSession(req, "bob")
+
+    rr := httptest.NewRecorder()
+    a.updateHandler(rr, req)
+
+    if status := rr.Code; status != http.StatusSeeOther {
+        t.Errorf("Handler returned wrong status code: got %v, want %v", status, http.StatusSeeOther)
+    }
+
+    if err := mock.ExpectationsWereMet(); err != nil {
+        t.Errorf("Unfulfilled expectations: %s", err)
+    }
+}
+
+func TestDeleteHandler_ForbiddenForEditor(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    if err != nil {
+        t.Fatalf("An error occurred while opening a stub database connection: %v", err)
+    }
+    defer db.Close()
+
+    a := newSQLTestApp(db)
+    expectNoteRole(mock, 1, "bob", "alice", nil, "editor")
+
+    form := url.Values{"Id": {"1"}}
+    req := httptest.NewRequest("POST", "/delete", strings.NewReader(form.Encode()))
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    req = withSession(req, "bob")
+
+    rr := httptest.NewRecorder()
+    a.deleteHandler(rr, req)
+
+    if status := rr.Code; status != http.StatusForbidden {
+        t.Errorf("Handler returned wrong status code: got %v, want %v", status, http.StatusForbidden)
+    }
+
+    if err := mock.ExpectationsWereMet(); err != nil {
+        t.Errorf("Unfulfilled expectations: %s", err)
+    }
+}
+
+func TestDeleteHandler_AllowedForOwner(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    if err != nil {
+        t.Fatalf("An error occurred while opening a stub database connection: %v", err)
+    }
+    defer db.Close()
+
+    a := newSQLTestApp(db)
+    expectNoteRole(mock, 1, "alice", "alice", nil, nil)
+    mock.ExpectPrepare("UPDATE notes SET deleted_at").ExpectExec().WithArgs(1, "alice").WillReturnResult(sqlmock.NewResult(0, 1))
+
+    form := url.Values{"Id": {"1"}}
+    req := httptest.NewRequest("POST", "/delete", strings.NewReader(form.Encode()))
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    req = withSession(req, "alice")
+
+    rr := httptest.NewRecorder()
+    a.deleteHandler(rr, req)
+
+    if status := rr.Code; status != http.StatusSeeOther {
+        t.Errorf("Handler returned wrong status code: got %v, want %v", status, http.StatusSeeOther)
+    }
+
+    if err := mock.ExpectationsWereMet(); err != nil {
+        t.Errorf("Unfulfilled expectations: %s", err)
+    }
+}
+
+func TestShareHandler_ForbiddenForNonOwner(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    if err != nil {
+        t.Fatalf("An error occurred while opening a stub database connection: %v", err)
+    }
+    defer db.Close()
+
+    a := newSQLTestApp(db)
+    expectNoteRole(mock, 1, "bob", "alice", nil, "editor")
+
+    form := url.Values{"Id": {"1"}, "SharedUsername": {"carol"}, "Privileges": {"editor"}}
+    req := httptest.NewRequest("POST", "/share", strings.NewReader(form.Encode()))
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    req = withSession(req, "bob")
+
+    rr := httptest.NewRecorder()
+    a.shareHandler(rr, req)
+
+    if status := rr.Code; status != http.StatusForbidden {
+        t.Errorf("Handler returned wrong status code: got %v, want %v", status, http.StatusForbidden)
+    }
+
+    if err := mock.ExpectationsWereMet(); err != nil {
+        t.Errorf("Unfulfilled expectations: %s", err)
+    }
+}
+
+func TestUpdatePrivilegesHandler_ForbiddenForEditor(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    if err != nil {
+        t.Fatalf("An error occurred while opening a stub database connection: %v", err)
+    }
+    defer db.Close()
+
+    a := newSQLTestApp(db)
+    expectNoteRole(mock, 1, "bob", "alice", nil, "editor")
+
+    form := url.Values{"username": {"bob"}, "privileges": {"editor"}, "noteID": {"1"}}
+    req := httptest.NewRequest("POST", "/update-privileges", strings.NewReader(form.Encode()))
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    req = withSession(req, "bob")
+
+    rr := httptest.NewRecorder()
+    a.updatePrivilegesHandler(rr, req)
+
+    if status := rr.Code; status != http.StatusForbidden {
+        t.Errorf("Handler returned wrong status code: got %v, want %v", status, http.StatusForbidden)
+    }
+
+    if err := mock.ExpectationsWereMet(); err != nil {
+        t.Errorf("Unfulfilled expectations: %s", err)
+    }
+}
+
+func TestRemoveSharedNoteHandler_AllowsSelfRemoval(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    if err != nil {
+        t.Fatalf("An error occurred while opening a stub database connection: %v", err)
+    }
+    defer db.Close()
+
+    a := newSQLTestApp(db)
+    expectNoteRole(mock, 1, "bob", "alice", nil, "viewer")
+    mock.ExpectBegin()
+    mock.ExpectExec("DELETE FROM user_shares").WithArgs("bob", 1).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectCommit()
+
+    form := url.Values{"noteID": {"1"}, "username": {"bob"}}
+    req := httptest.NewRequest("POST", "/remove-shared-note", strings.NewReader(form.Encode()))
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    req = withSession(req, "bob")
+
+    rr := httptest.NewRecorder()
+    a.removeSharedNoteHandler(rr, req)
+
+    if status := rr.Code; status != http.StatusSeeOther {
+        t.Errorf("Handler returned wrong status code: got %v, want %v", status, http.StatusSeeOther)
+    }
+
+    if err := mock.ExpectationsWereMet(); err != nil {
+        t.Errorf("Unfulfilled expectations: %s", err)
+    }
+}
+
+func TestRemoveSharedNoteHandler_ForbiddenForOtherUser(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    if err != nil {
+        t.Fatalf("An error occurred while opening a stub database connection: %v", err)
+    }
+    defer db.Close()
+
+    a := newSQLTestApp(db)
+    expectNoteRole(mock, 1, "bob", "alice", nil, "editor")
+
+    form := url.Values{"noteID": {"1"}, "username": {"carol"}}
+    req := httptest.NewRequest("POST", "/remove-shared-note", strings.NewReader(form.Encode()))
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    req = withSession(req, "bob")
+
+    rr := httptest.NewRecorder()
+    a.removeSharedNoteHandler(rr, req)
+
+    if status := rr.Code; status != http.StatusForbidden {
+        t.Errorf("Handler returned wrong status code: got %v, want %v", status, http.StatusForbidden)
+    }
+
+    if err := mock.ExpectationsWereMet(); err != nil {
+        t.Errorf("Unfulfilled expectations: %s", err)
+    }
+}
+
+func TestNoteLookupHandlers_NeedViewRole(t *testing.T) {
+    a := newMemoryTestApp(t, "alice", "bob")
+    noteID, err := a.notes.CreateNote(Note{Title: "Secret plans", NoteType: "Note", Owner: "alice"})
+    if err != nil {
+        t.Fatalf("Expected no error, but got %v", err)
+    }
+
+    get := func(target, username string) int {
+        req := withSession(httptest.NewRequest("GET", target, nil), username)
+        rr := httptest.NewRecorder()
+        a.Router.ServeHTTP(rr, req)
+        return rr.Code
+    }
+    targets := []string{
+        fmt.Sprintf("/find/%d?searchInput=plans", noteID),
+        fmt.Sprintf("/getSharedUsersForNote/%d", noteID),
+    }
+
+    for _, target := range targets {
+        if code := get(target, "alice"); code != http.StatusOK {
+            t.Errorf("GET %s as the owner: got %v, want %v", target, code, http.StatusOK)
+        }
+        if code := get(target, "bob"); code != http.StatusForbidden {
+            t.Errorf("GET %s as another user: got %v, want %v", target, code, http.StatusForbidden)
+        }
+    }
+
+    // Viewers can find text in the note, but only the owner sees who it is shared with
+    if err := a.shares.ShareNote(noteID, "bob", "viewer"); err != nil {
+        t.Fatalf("Expected no error, but got %v", err)
+    }
+    if code := get(targets[0], "bob"); code != http.StatusOK {
+        t.Errorf("GET %s as a viewer: got %v, want %v", targets[0], code, http.StatusOK)
+    }
+    if code := get(targets[1], "bob"); code != http.StatusForbidden {
+        t.Errorf("GET %s as a viewer: got %v, want %v", targets[1], code, http.StatusForbidden)
+    }
+
+    // Notes in the trash cannot be looked into, even by their owner
+    if err := a.notes.DeleteNote(noteID, "alice"); err != nil {
+        t.Fatalf("Expected no error, but got %v", err)
+    }
+    for _, target := range targets {
+        if code := get(target, "alice"); code != http.StatusForbidden {
+            t.Errorf("GET %s of a note in the trash: got %v, want %v", target, code, http.StatusForbidden)
+        }
+    }
+}
+
+func TestUnsharedUsersHandler_NeedsShareRole(t *testing.T) {
+    a := newMemoryTestApp(t, "alice", "bob", "carol")
+    noteID, err := a.notes.CreateNote(Note{Title: "Secret plans", NoteType: "Note", Owner: "alice"})
+    if err != nil {
+        t.Fatalf("Expected no error, but got %v", err)
+    }
+    if err := a.shares.ShareNote(noteID, "bob", "viewer"); err != nil {
+        t.Fatalf("Expected no error, but got %v", err)
+    }
+
+    target := fmt.Sprintf("/getUnsharedUsersForNote/%d", noteID)
+    tests := map[string]int{
+        "alice": http.StatusOK,        // the owner shares the note
+        "bob":   http.StatusForbidden, // a viewer cannot share it
+        "carol": http.StatusNotFound,  // other users do not learn the note exists
+    }
+    for username, want := range tests {
+        req := withSession(httptest.NewRequest("GET", target, nil), username)
+        rr := httptest.NewRecorder()
+        a.Router.ServeHTTP(rr, req)
+        if rr.Code != want {
+            t.Errorf("GET %s as %s: got %v, want %v", target, username, rr.Code, want)
+        }
+    }
+}
@@ -0,0 +1,415 @@
+// Package main contains the main entry point for the Go application
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Note list page sizes: the default, and the most that can be asked for at once.
+const (
+	defaultNotePageSize = 25
+	maxNotePageSize     = 200
+)
+
+// Note list scopes: every note the user can see, or only those they own, have been shared or delegated.
+const (
+	scopeAll       = "all"
+	scopeOwned     = "owned"
+	scopeShared    = "shared"
+	scopeDelegated = "delegated"
+)
+
+// Note list sort orders besides sortCreated and sortDue: by title, and by status.
+const (
+	sortTitle  = "title"
+	sortStatus = "status"
+)
+
+// listSorts are the sort orders offered for note lists, newest first by default.
+var listSorts = []string{sortCreated, sortTitle, sortDue, sortStatus}
+
+// noteSortKey orders a note list in SQL. expr wraps the column, or the cursor key cast to cast,
+// so notes and cursors compare the same way; notes with the same key are ordered by ID.
+type noteSortKey struct {
+	column string
+	expr   string
+	cast   string
+	desc   bool
+	// key returns the note's value of the column as written in a cursor, nil for NULL
+	key func(Note) *string
+}
+
+// noteSortKeys are the sort keys of listSorts. Notes without a due date come last,
+// and notes without a status first.
+var noteSortKeys = map[string]noteSortKey{
+	sortCreated: {column: "n.noteCreated", expr: "%s", cast: "timestamp", desc: true, key: func(n Note) *string {
+		return stringPtr(n.NoteCreated.UTC().Format(time.RFC3339Nano))
+	}},
+	sortTitle: {column: "n.title", expr: "lower(%s)", cast: "text", key: func(n Note) *string {
+		return stringPtr(n.Title)
+	}},
+	sortDue: {column: "n.due_at", expr: "COALESCE(%s, 'infinity'::timestamptz)", cast: "timestamptz", key: func(n Note) *string {
+		if !n.DueAt.Valid {
+			return nil
+		}
+		return stringPtr(n.DueAt.Time.Format(time.RFC3339Nano))
+	}},
+	sortStatus: {column: "n.noteStatus", expr: "COALESCE(%s, '')", cast: "text", key: func(n Note) *string {
+		return nullStringPtr(n.NoteStatus)
+	}},
+}
+
+// stringPtr returns a pointer to a copy of s.
+func stringPtr(s string) *string {
+	return &s
+}
+
+// bindArgs numbers the ? placeholders of condition in order after the values already in args,
+// appending values to args.
+func bindArgs(condition string, args []interface{}, values ...interface{}) (string, []interface{}) {
+	for _, value := range values {
+		args = append(args, value)
+		condition = strings.Replace(condition, "?", "$"+strconv.Itoa(len(args)), 1)
+	}
+	return condition, args
+}
+
+// noteCursor marks a place in a note list: the sort key and ID of the note next to it.
+// A cursor to the next page holds the last note of a page, a cursor to the previous page
+// (Before) the first one.
+type noteCursor struct {
+	Sort   string  `json:"s"`
+	Key    *string `json:"k"`
+	ID     int     `json:"i"`
+	Before bool    `json:"b,omitempty"`
+}
+
+// encode writes the cursor as an opaque URL safe string.
+func (c noteCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeNoteCursor reads a cursor written by encode.
+func decodeNoteCursor(s string) (*noteCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	var c noteCursor
+	if err := json.Unmarshal(data, &c); err != nil || noteSortKeys[c.Sort].column == "" {
+		return nil, errors.New("invalid cursor")
+	}
+	return &c, nil
+}
+
+// noteListOptions are the scope, filters, sort order and page of a note list, all applied in SQL.
+type noteListOptions struct {
+	Scope string
+	// Filter holds the type, status, owner and tag filters
+	Filter searchQuery
+	Due    dueFilter
+	// CreatedFrom (inclusive) and CreatedBefore (exclusive) bound the creation time when set
+	CreatedFrom   time.Time
+	CreatedBefore time.Time
+	Sort          string
+	Limit         int
+	Cursor        *noteCursor
+	// Location is the user's time zone, days for the due filter start at midnight in it
+	Location *time.Location
+}
+
+// notePage is a page of a note list, with cursors to the pages either side of it, if there are any.
+type notePage struct {
+	Notes []Note
+	Next  *noteCursor
+	Prev  *noteCursor
+}
+
+// parseNoteListOptions reads the filters, sort order and page of a note list from the request:
+//
+//	type=task  status=completed  owner=BIGCAT  tag=work  due=overdue  from=2024-01-01  to=2024-01-31
+//	sort=created|title|due|status  limit=25  cursor=...
+//
+// from and to are days of creation in loc, both included. cursorParam names the cursor parameter,
+// "cursor" for the API. The scope is left for the caller to set.
+func parseNoteListOptions(r *http.Request, loc *time.Location, cursorParam string) (noteListOptions, error) {
+	query := r.URL.Query()
+	opts := noteListOptions{Scope: scopeAll, Limit: defaultNotePageSize, Location: loc}
+
+	var err error
+	opts.Due, opts.Sort, err = dueOptions(r, listSorts...)
+	if err != nil {
+		return opts, err
+	}
+
+	if value := query.Get("type"); value != "" {
+		noteType, ok := canonicalValue(validNoteTypes, value)
+		if !ok {
+			return opts, errors.New("type must be Note or Task")
+		}
+		opts.Filter.NoteType = noteType
+	}
+	if value := query.Get("status"); value != "" {
+		status, ok := canonicalValue(validNoteStatuses, strings.NewReplacer("-", " ", "_", " ").Replace(value))
+		if !ok {
+			return opts, errors.New("status must be None, In Progress, Completed, Cancelled or Delegated")
+		}
+		opts.Filter.Status = status
+	}
+	opts.Filter.Owner = strings.TrimSpace(query.Get("owner"))
+	if opts.Filter.Tags, err = tagFilter(r); err != nil {
+		return opts, err
+	}
+
+	if value := query.Get("from"); value != "" {
+		if opts.CreatedFrom, err = time.ParseInLocation("2006-01-02", value, loc); err != nil {
+			return opts, errors.New("from must be a date like 2024-01-31")
+		}
+	}
+	if value := query.Get("to"); value != "" {
+		to, err := time.ParseInLocation("2006-01-02", value, loc)
+		if err != nil {
+			return opts, errors.New("to must be a date like 2024-01-31")
+		}
+		opts.CreatedBefore = to.AddDate(0, 0, 1)
+	}
+
+	if value := query.Get("limit"); value != "" {
+		opts.Limit, err = strconv.Atoi(value)
+		if err != nil || opts.Limit < 1 || opts.Limit > maxNotePageSize {
+			return opts, fmt.Errorf("limit must be between 1 and %d", maxNotePageSize)
+		}
+	}
+
+	opts.Cursor, err = noteCursorParam(r, cursorParam, opts.Sort)
+	return opts, err
+}
+
+// noteCursorParam reads the cursor in the named parameter of the request, nil when there is none.
+// The cursor must be for the list's sort order.
+func noteCursorParam(r *http.Request, name, sortBy string) (*noteCursor, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return nil, nil
+	}
+	cursor, err := decodeNoteCursor(value)
+	if err != nil {
+		return nil, err
+	}
+	if cursor.Sort != sortBy {
+		return nil, errors.New("the cursor is for another sort order")
+	}
+	return cursor, nil
+}
+
+// dueFilterSQL returns the condition on notes n for a due filter at time now,
+// with days starting at midnight in loc, appending its values to args.
+func dueFilterSQL(f dueFilter, now time.Time, loc *time.Location, args []interface{}) (string, []interface{}) {
+	local := now.In(loc)
+	startOfToday := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+
+	switch f {
+	case dueOverdue:
+		return bindArgs("n.due_at < ? AND COALESCE(n.noteStatus, '') NOT IN ('Completed', 'Cancelled')", args, now)
+	case dueToday:
+		return bindArgs("n.due_at >= ? AND n.due_at < ?", args, startOfToday, startOfToday.AddDate(0, 0, 1))
+	case dueWeek:
+		return bindArgs("n.due_at >= ? AND n.due_at < ?", args, startOfToday, startOfToday.AddDate(0, 0, 7))
+	case dueNone:
+		return "n.due_at IS NULL", args
+	}
+	return "", args
+}
+
+// noteScopeCondition limits a query on notes n to the notes in scope for user $1.
+func noteScopeCondition(scope string) string {
+	switch scope {
+	case scopeOwned:
+		return "n.owner = $1"
+	case scopeShared:
+		return "EXISTS (SELECT 1 FROM user_shares us WHERE us.note_id = n.id AND us.username = $1)"
+	case scopeDelegated:
+		return "n.noteDelegation = $1"
+	}
+	return `(n.owner = $1 OR n.noteDelegation = $1
+		OR EXISTS (SELECT 1 FROM user_shares us WHERE us.note_id = n.id AND us.username = $1))`
+}
+
+// noteOrdering is how a database compares the sort keys of notes with those of cursors.
+type noteOrdering struct {
+	// expr returns the sort key's expression on operand, the column or the placeholder of a cursor's key
+	expr func(sortKey noteSortKey, operand string, cursor bool) string
+	// value returns the value of a cursor's key to bind to its placeholder
+	value func(sortKey noteSortKey, key *string) (interface{}, error)
+}
+
+// postgresOrdering casts the cursor's key to the type of the column.
+var postgresOrdering = noteOrdering{
+	expr: func(sortKey noteSortKey, operand string, cursor bool) string {
+		if cursor {
+			operand += "::" + sortKey.cast
+		}
+		return fmt.Sprintf(sortKey.expr, operand)
+	},
+	value: func(sortKey noteSortKey, key *string) (interface{}, error) {
+		return key, nil
+	},
+}
+
+// ListNotes returns a page of the notes in scope for the user, filtered and sorted in SQL.
+// Pages are found with keyset pagination: a cursor holds the sort key and ID of the note
+// at the edge of the page it came from, so a page costs the same wherever it is in the list.
+// Each note's privileges are the user's role on it: owner, their share's privileges or delegate.
+func (s *postgresStore) ListNotes(username string, opts noteListOptions) (notePage, error) {
+	return listNotePage(s.db, postgresOrdering, username, opts)
+}
+
+// listNotePage runs ListNotes on db, comparing sort keys with ordering. Apart from the
+// sort keys the query is plain SQL, so both databases run it.
+func listNotePage(db *sql.DB, ordering noteOrdering, username string, opts noteListOptions) (notePage, error) {
+	sortKey := noteSortKeys[opts.Sort]
+	args := []interface{}{username}
+	conditions := []string{"n.deleted_at IS NULL", noteScopeCondition(opts.Scope)}
+
+	filters, args := opts.Filter.filterSQL(args)
+	conditions = append(conditions, filters...)
+
+	if opts.Due != dueAll {
+		var condition string
+		condition, args = dueFilterSQL(opts.Due, time.Now(), opts.Location, args)
+		conditions = append(conditions, condition)
+	}
+	if !opts.CreatedFrom.IsZero() {
+		var condition string
+		condition, args = bindArgs("n.noteCreated >= ?", args, opts.CreatedFrom.UTC())
+		conditions = append(conditions, condition)
+	}
+	if !opts.CreatedBefore.IsZero() {
+		var condition string
+		condition, args = bindArgs("n.noteCreated < ?", args, opts.CreatedBefore.UTC())
+		conditions = append(conditions, condition)
+	}
+
+	// Going back from a cursor walks the list in reverse, and the page is turned around after
+	backwards := opts.Cursor != nil && opts.Cursor.Before
+	descending := sortKey.desc != backwards
+	column := ordering.expr(sortKey, sortKey.column, false)
+
+	if opts.Cursor != nil {
+		comparison := ">"
+		if descending {
+			comparison = "<"
+		}
+		key, err := ordering.value(sortKey, opts.Cursor.Key)
+		if err != nil {
+			return notePage{}, err
+		}
+		var condition string
+		condition, args = bindArgs(fmt.Sprintf("(%s, n.id) %s (%s, ?)",
+			column, comparison, ordering.expr(sortKey, "?", true)), args, key, opts.Cursor.ID)
+		conditions = append(conditions, condition)
+	}
+
+	direction := "ASC"
+	if descending {
+		direction = "DESC"
+	}
+
+	// One more note than the page holds tells whether there is another page
+	args = append(args, opts.Limit+1)
+	query := `
+		SELECT n.id, n.title, n.noteType, n.description, n.noteCreated, n.due_at,
+			n.noteStatus, n.noteDelegation, n.owner,
+			CASE WHEN n.owner = $1 THEN 'owner'
+				ELSE COALESCE((SELECT us.privileges FROM user_shares us WHERE us.note_id = n.id AND us.username = $1), 'delegate')
+			END,
+			` + noteTagsColumn("n") + `
+		FROM notes n
+		WHERE ` + strings.Join(conditions, " AND ") + `
+		ORDER BY ` + column + ` ` + direction + `, n.id ` + direction + `
+		LIMIT $` + strconv.Itoa(len(args))
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return notePage{}, err
+	}
+	defer rows.Close()
+
+	notes := []Note{}
+	for rows.Next() {
+		var note Note
+		var tags string
+		if err := rows.Scan(&note.ID, &note.Title, &note.NoteType, &note.Description, &note.NoteCreated,
+			&note.DueAt, &note.NoteStatus, &note.NoteDelegation, &note.Owner, &note.Privileges, &tags); err != nil {
+			return notePage{}, err
+		}
+		note.Tags = splitTags(tags)
+		notes = append(notes, note)
+	}
+
+	if err := rows.Err(); err != nil {
+		return notePage{}, err
+	}
+
+	more := len(notes) > opts.Limit
+	if more {
+		notes = notes[:opts.Limit]
+	}
+	if backwards {
+		for i, j := 0, len(notes)-1; i < j; i, j = i+1, j-1 {
+			notes[i], notes[j] = notes[j], notes[i]
+		}
+	}
+
+	page := notePage{Notes: notes}
+	if len(notes) == 0 {
+		return page, nil
+	}
+	// Going forwards, there is a previous page if we came from one; going back, there is a next page
+	hasNext, hasPrev := more, opts.Cursor != nil
+	if backwards {
+		hasNext, hasPrev = true, more
+	}
+	if hasNext {
+		last := notes[len(notes)-1]
+		page.Next = &noteCursor{Sort: opts.Sort, Key: sortKey.key(last), ID: last.ID}
+	}
+	if hasPrev {
+		first := notes[0]
+		page.Prev = &noteCursor{Sort: opts.Sort, Key: sortKey.key(first), ID: first.ID, Before: true}
+	}
+	return page, nil
+}
+
+// pageLinks are the links to the pages either side of a list on an HTML page, empty when there is none.
+type pageLinks struct {
+	Next string
+	Prev string
+}
+
+// notePageLinks builds the links to the pages around a page of a list, keeping the other
+// parameters of the request. cursorParam is the list's cursor parameter.
+func notePageLinks(r *http.Request, cursorParam string, page notePage) pageLinks {
+	link := func(cursor *noteCursor) string {
+		if cursor == nil {
+			return ""
+		}
+		query := url.Values{}
+		for key, values := range r.URL.Query() {
+			query[key] = values
+		}
+		query.Set(cursorParam, cursor.encode())
+		return r.URL.Path + "?" + query.Encode()
+	}
+	return pageLinks{Next: link(page.Next), Prev: link(page.Prev)}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var listRowColumns = []string{"id", "title", "noteType", "description", "noteCreated", "due_at", "noteStatus",
+	"noteDelegation", "owner", "privileges", "tags"}
+
+func TestNoteCursor_RoundTrip(t *testing.T) {
+	cursor := noteCursor{Sort: sortTitle, Key: stringPtr("Buy milk"), ID: 7, Before: true}
+
+	got, err := decodeNoteCursor(cursor.encode())
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if got.Sort != cursor.Sort || *got.Key != *cursor.Key || got.ID != cursor.ID || !got.Before {
+		t.Errorf("decodeNoteCursor() = %+v, want %+v", got, cursor)
+	}
+
+	for _, bad := range []string{"not a cursor!", "e30", noteCursor{Sort: "colour", ID: 1}.encode()} {
+		if _, err := decodeNoteCursor(bad); err == nil {
+			t.Errorf("decodeNoteCursor(%q) expected an error", bad)
+		}
+	}
+}
+
+func TestParseNoteListOptions(t *testing.T) {
+	auckland, err := time.LoadLocation("Pacific/Auckland")
+	if err != nil {
+		t.Fatalf("Loading time zone: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/list?type=task&status=in-progress&owner=BIGCAT&from=2024-01-01&to=2024-01-31&sort=title&limit=10", nil)
+	opts, err := parseNoteListOptions(req, auckland, "cursor")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if opts.Filter.NoteType != "Task" || opts.Filter.Status != "In Progress" || opts.Filter.Owner != "BIGCAT" {
+		t.Errorf("Unexpected filter %+v", opts.Filter)
+	}
+	// Both days are included, in the user's time zone
+	if !opts.CreatedFrom.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, auckland)) ||
+		!opts.CreatedBefore.Equal(time.Date(2024, 2, 1, 0, 0, 0, 0, auckland)) {
+		t.Errorf("Unexpected date range %v to %v", opts.CreatedFrom, opts.CreatedBefore)
+	}
+	if opts.Sort != sortTitle || opts.Limit != 10 || opts.Cursor != nil {
+		t.Errorf("Unexpected sort, limit or cursor: %+v", opts)
+	}
+
+	dueCursor := noteCursor{Sort: sortDue, ID: 3}.encode()
+	for _, query := range []string{"sort=colour", "type=memo", "status=finished", "from=01/01/2024",
+		"limit=0", "limit=500", "cursor=" + dueCursor} {
+		req := httptest.NewRequest("GET", "/list?"+query, nil)
+		if _, err := parseNoteListOptions(req, auckland, "cursor"); err == nil {
+			t.Errorf("parseNoteListOptions(%q) expected an error", query)
+		}
+	}
+}
+
+func TestListNotes_NextPageByTitle(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error occurred while opening a stub database connection: %v", err)
+	}
+	defer db.Close()
+
+	a := newSQLTestApp(db)
+	created := time.Date(2024, 10, 1, 9, 0, 0, 0, time.UTC)
+	// Tasks alice owns after "milk" (note 4), one more than the page to see if there is another
+	mock.ExpectQuery(`WHERE n.deleted_at IS NULL AND n.owner = \$1 AND n.noteType = \$2 `+
+		`AND \(lower\(n.title\), n.id\) > \(lower\(\$3::text\), \$4\)\s+`+
+		`ORDER BY lower\(n.title\) ASC, n.id ASC\s+LIMIT \$5`).
+		WithArgs("alice", "Task", "milk", 4, 3).
+		WillReturnRows(sqlmock.NewRows(listRowColumns).
+			AddRow(9, "Oats", "Task", "", created, nil, "None", "", "alice", "owner", "").
+			AddRow(2, "Pay rent", "Task", "", created, nil, "None", "", "alice", "owner", "").
+			AddRow(5, "Walk dog", "Task", "", created, nil, "None", "", "alice", "owner", ""))
+
+	page, err := a.notes.ListNotes("alice", noteListOptions{
+		Scope:  scopeOwned,
+		Filter: searchQuery{NoteType: "Task"},
+		Sort:   sortTitle,
+		Limit:  2,
+		Cursor: &noteCursor{Sort: sortTitle, Key: stringPtr("milk"), ID: 4},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	if len(page.Notes) != 2 || page.Notes[0].ID != 9 || page.Notes[1].ID != 2 {
+		t.Fatalf("Expected notes 9 and 2, got %+v", page.Notes)
+	}
+	if page.Next == nil || page.Next.ID != 2 || *page.Next.Key != "Pay rent" || page.Next.Before {
+		t.Errorf("Expected the next page after note 2, got %+v", page.Next)
+	}
+	if page.Prev == nil || page.Prev.ID != 9 || !page.Prev.Before {
+		t.Errorf("Expected the previous page before note 9, got %+v", page.Prev)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestListNotes_PreviousPageNewestFirst(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error occurred while opening a stub database connection: %v", err)
+	}
+	defer db.Close()
+
+	a := newSQLTestApp(db)
+	cursorTime := time.Date(2024, 10, 1, 9, 0, 0, 0, time.UTC)
+	// Going back walks the list oldest first from the cursor, the page is turned around after
+	mock.ExpectQuery(`\(n.noteCreated, n.id\) > \(\$2::timestamp, \$3\)\s+`+
+		`ORDER BY n.noteCreated ASC, n.id ASC\s+LIMIT \$4`).
+		WithArgs("alice", cursorTime.Format(time.RFC3339Nano), 4, 3).
+		WillReturnRows(sqlmock.NewRows(listRowColumns).
+			AddRow(6, "Older", "Note", "", cursorTime.Add(time.Hour), nil, "None", "", "alice", "owner", "").
+			AddRow(8, "Newer", "Note", "", cursorTime.Add(2*time.Hour), nil, "None", "", "bob", "viewer", "work"))
+
+	page, err := a.notes.ListNotes("alice", noteListOptions{
+		Scope:  scopeAll,
+		Sort:   sortCreated,
+		Limit:  2,
+		Cursor: &noteCursor{Sort: sortCreated, Key: stringPtr(cursorTime.Format(time.RFC3339Nano)), ID: 4, Before: true},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	if len(page.Notes) != 2 || page.Notes[0].ID != 8 || page.Notes[1].ID != 6 {
+		t.Fatalf("Expected notes 8 then 6, got %+v", page.Notes)
+	}
+	if page.Notes[0].Privileges != "viewer" || len(page.Notes[0].Tags) != 1 {
+		t.Errorf("Expected alice's privileges and the tags of note 8, got %+v", page.Notes[0])
+	}
+	// The page we came from is next, and nothing is newer than a short page
+	if page.Next == nil || page.Next.ID != 6 || page.Prev != nil {
+		t.Errorf("Expected only a next page after note 6, got next %+v prev %+v", page.Next, page.Prev)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPI_ListNotes_ReturnsNextCursor(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	expectUserTimezone(mock, "alice", nil)
+	due := time.Date(2024, 10, 23, 1, 0, 0, 0, time.UTC)
+	// Notes bob shared with alice, soonest due first, with undated notes last
+	mock.ExpectQuery(`EXISTS \(SELECT 1 FROM user_shares us WHERE us.note_id = n.id AND us.username = \$1\)\s+`+
+		`ORDER BY COALESCE\(n.due_at, 'infinity'::timestamptz\) ASC, n.id ASC\s+LIMIT \$2`).
+		WithArgs("alice", 2).
+		WillReturnRows(sqlmock.NewRows(listRowColumns).
+			AddRow(3, "Report", "Task", "", due, due, "None", "", "bob", "editor", "").
+			AddRow(5, "Plan", "Task", "", due, nil, "None", "", "bob", "editor", ""))
+
+	rr := serveAPI(a, "GET", "/api/v1/notes?scope=shared&sort=due&limit=1", "", "alice")
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v, want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+
+	var body struct {
+		Notes      []struct{ ID int } `json:"notes"`
+		NextCursor string             `json:"next_cursor"`
+		PrevCursor *string            `json:"prev_cursor"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Decoding response: %v", err)
+	}
+	if len(body.Notes) != 1 || body.Notes[0].ID != 3 || body.PrevCursor != nil {
+		t.Fatalf("Expected only note 3 and no previous page, got %s", rr.Body.String())
+	}
+	next, err := decodeNoteCursor(body.NextCursor)
+	if err != nil || next.ID != 3 || *next.Key != due.Format(time.RFC3339Nano) {
+		t.Errorf("Expected a cursor after note 3, got %+v (%v)", next, err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
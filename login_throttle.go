@@ -0,0 +1,120 @@
+// Package main contains the main entry point for the Go application
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// loginThrottleSweepSize is how many accounts and addresses the throttle remembers before it
+// forgets the ones whose failures have expired.
+const loginThrottleSweepSize = 10000
+
+// loginThrottle counts the failed logins of each account and each client address. After every
+// failure the account or address has to wait before it can try again, twice as long as after the
+// failure before, and after MaxFailures (or MaxFailuresPerIP) failures it is locked out for
+// Lockout. Failures are forgotten once the lockout has passed since the last one.
+//
+// The counts are kept in memory, so each instance of the app counts the logins it serves.
+type loginThrottle struct {
+	config LoginConfig
+	now    func() time.Time
+
+	mu       sync.Mutex
+	failures map[string]*loginFailures
+}
+
+// loginFailures are the recent failed logins of an account or address.
+type loginFailures struct {
+	count        int
+	last         time.Time
+	blockedUntil time.Time
+}
+
+func newLoginThrottle(config LoginConfig) *loginThrottle {
+	return &loginThrottle{
+		config:   config,
+		now:      time.Now,
+		failures: make(map[string]*loginFailures),
+	}
+}
+
+// accountKey and addressKey are the throttle keys of a username and a client address.
+func accountKey(username string) string { return "user:" + username }
+func addressKey(address string) string  { return "ip:" + address }
+
+// retryAfter returns how long until any of the keys may try to log in again, 0 if they all may now.
+func (t *loginThrottle) retryAfter(keys ...string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	var wait time.Duration
+	for _, key := range keys {
+		if f, ok := t.failures[key]; ok && f.blockedUntil.After(now) {
+			wait = max(wait, f.blockedUntil.Sub(now))
+		}
+	}
+	return wait
+}
+
+// fail records a failed login for the key, which may fail maxFailures times before it is
+// locked out, and reports whether it is locked out now.
+func (t *loginThrottle) fail(key string, maxFailures int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	if len(t.failures) >= loginThrottleSweepSize {
+		t.sweep(now)
+	}
+
+	f, ok := t.failures[key]
+	if !ok || now.Sub(f.last) >= t.config.Lockout {
+		f = &loginFailures{}
+		t.failures[key] = f
+	}
+	f.count++
+	f.last = now
+
+	if f.count >= maxFailures {
+		f.blockedUntil = now.Add(t.config.Lockout)
+		return true
+	}
+
+	// 1, 2, 4, ... times the backoff, never longer than the lockout
+	backoff := t.config.Backoff
+	for i := 1; i < f.count && backoff < t.config.Lockout; i++ {
+		backoff *= 2
+	}
+	f.blockedUntil = now.Add(min(backoff, t.config.Lockout))
+	return false
+}
+
+// succeed forgets the failed logins of the key.
+func (t *loginThrottle) succeed(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.failures, key)
+}
+
+// sweep forgets the keys whose failures have expired. The caller holds t.mu.
+func (t *loginThrottle) sweep(now time.Time) {
+	for key, f := range t.failures {
+		if now.Sub(f.last) >= t.config.Lockout && !f.blockedUntil.After(now) {
+			delete(t.failures, key)
+		}
+	}
+}
+
+// clientAddress returns the IP address the request came from. The app does not trust
+// X-Forwarded-For, so behind a proxy this is the proxy's address.
+func clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestLoginThrottle returns a throttle on a clock the test moves with the returned function.
+func newTestLoginThrottle() (*loginThrottle, func(time.Duration)) {
+	now := time.Date(2024, 10, 23, 9, 0, 0, 0, time.UTC)
+	t := newLoginThrottle(LoginConfig{MaxFailures: 3, MaxFailuresPerIP: 10, Backoff: time.Second, Lockout: time.Minute})
+	t.now = func() time.Time { return now }
+	return t, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestLoginThrottle_BacksOffExponentially(t *testing.T) {
+	throttle, advance := newTestLoginThrottle()
+	key := accountKey("alice")
+
+	if throttle.fail(key, 3) {
+		t.Fatal("Expected no lockout after the first failure")
+	}
+	if wait := throttle.retryAfter(key); wait != time.Second {
+		t.Errorf("Expected to wait 1s after the first failure, got %s", wait)
+	}
+
+	advance(time.Second)
+	if wait := throttle.retryAfter(key); wait != 0 {
+		t.Errorf("Expected to be able to try again after the backoff, got %s to wait", wait)
+	}
+	throttle.fail(key, 3)
+	if wait := throttle.retryAfter(key); wait != 2*time.Second {
+		t.Errorf("Expected to wait 2s after the second failure, got %s", wait)
+	}
+
+	// Other accounts are not held up
+	if wait := throttle.retryAfter(accountKey("bob")); wait != 0 {
+		t.Errorf("Expected bob not to wait, got %s", wait)
+	}
+}
+
+func TestLoginThrottle_LocksOutAfterMaxFailures(t *testing.T) {
+	throttle, advance := newTestLoginThrottle()
+	account, address := accountKey("alice"), addressKey("192.0.2.1")
+
+	for i := 1; i < 3; i++ {
+		if throttle.fail(account, 3) {
+			t.Fatalf("Expected no lockout after %d failures", i)
+		}
+		advance(time.Hour / 1000)
+	}
+	if !throttle.fail(account, 3) {
+		t.Fatal("Expected a lockout after 3 failures")
+	}
+	if wait := throttle.retryAfter(address, account); wait != time.Minute {
+		t.Errorf("Expected to wait out the 1m lockout, got %s", wait)
+	}
+
+	// Once the lockout has passed the failures are forgotten
+	advance(time.Minute)
+	if wait := throttle.retryAfter(account); wait != 0 {
+		t.Errorf("Expected the lockout to be over, got %s to wait", wait)
+	}
+	throttle.fail(account, 3)
+	if wait := throttle.retryAfter(account); wait != time.Second {
+		t.Errorf("Expected the count to start over, got %s to wait", wait)
+	}
+}
+
+func TestLoginThrottle_SuccessForgetsFailures(t *testing.T) {
+	throttle, advance := newTestLoginThrottle()
+	key := accountKey("alice")
+
+	throttle.fail(key, 3)
+	advance(time.Second)
+	throttle.fail(key, 3)
+	advance(2 * time.Second)
+	throttle.succeed(key)
+
+	throttle.fail(key, 3)
+	if wait := throttle.retryAfter(key); wait != time.Second {
+		t.Errorf("Expected the count to start over after a login, got %s to wait", wait)
+	}
+}
@@ -0,0 +1,117 @@
+// Package main contains the main entry point for the Go application
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mail is a plain text email.
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends emails. The mail.mailer setting picks the implementation: logMailer and
+// fileMailer keep emails on the machine for local development, smtpMailer sends them.
+type Mailer interface {
+	Send(m Mail) error
+}
+
+// newMailer returns the mailer configured by the mail settings.
+func newMailer(cfg MailConfig) Mailer {
+	switch cfg.Mailer {
+	case "file":
+		return &fileMailer{from: cfg.From, path: cfg.File}
+	case "smtp":
+		return &smtpMailer{
+			from:     cfg.From,
+			addr:     net.JoinHostPort(cfg.SMTPHost, strconv.Itoa(cfg.SMTPPort)),
+			host:     cfg.SMTPHost,
+			username: cfg.SMTPUsername,
+			password: cfg.SMTPPassword,
+		}
+	}
+	return logMailer{from: cfg.From}
+}
+
+// formatMail returns the message of an email with its headers, lines ending in CRLF as SMTP expects.
+func formatMail(from string, m Mail) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", m.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", m.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(m.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// logMailer writes emails to the log instead of sending them. The tokens of links are left out,
+// so reading the log is not enough to reset someone's password; the file mailer keeps them.
+type logMailer struct {
+	from string
+}
+
+// linkToken matches the token query parameter of links in emails, and the parameter name before it.
+var linkToken = regexp.MustCompile(`([?&]token=)[^&\s]+`)
+
+// Send is to implement Mailer.Send().
+func (l logMailer) Send(m Mail) error {
+	body := linkToken.ReplaceAllString(m.Body, "${1}[redacted]")
+	log.Printf("Email from %s to %s: %s\n%s", l.from, m.To, m.Subject, body)
+	return nil
+}
+
+// fileMailer appends emails to a file instead of sending them.
+type fileMailer struct {
+	from string
+	path string
+	mu   sync.Mutex
+}
+
+// Send is to implement Mailer.Send().
+func (f *fileMailer) Send(m Mail) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(formatMail(f.from, m), "\r\n\r\n"...)); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// smtpMailer sends emails through an SMTP server, logging in if a username is configured.
+// net/smtp only sends the password over TLS or to localhost.
+type smtpMailer struct {
+	from     string
+	addr     string
+	host     string
+	username string
+	password string
+}
+
+// Send is to implement Mailer.Send().
+func (s *smtpMailer) Send(m Mail) error {
+	var auth smtp.Auth
+	if s.username != "" {
+		auth = smtp.PlainAuth("", s.username, s.password, s.host)
+	}
+	return smtp.SendMail(s.addr, auth, s.from, []string{m.To}, formatMail(s.from, m))
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileMailer_AppendsMail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mail.log")
+	mailer := newMailer(MailConfig{Mailer: "file", From: "notes@example.com", File: path})
+
+	for _, to := range []string{"alice@example.com", "bob@example.com"} {
+		if err := mailer.Send(Mail{To: to, Subject: "Hello", Body: "First line\nSecond line"}); err != nil {
+			t.Fatalf("Expected no error, but got %v", err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Reading the mail file: %v", err)
+	}
+	content := string(data)
+	for _, want := range []string{"From: notes@example.com\r\n", "To: alice@example.com\r\n", "To: bob@example.com\r\n", "Subject: Hello\r\n", "First line\r\nSecond line"} {
+		if !strings.Contains(content, want) {
+			t.Errorf("Expected the mail file to contain %q, got:\n%s", want, content)
+		}
+	}
+}
+
+func TestLogMailer_RedactsLinkTokens(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	mailer := newMailer(MailConfig{Mailer: "log", From: "notes@example.com"})
+	body := "Open this link:\n\nhttps://notes.example.com/reset-password?token=s3cr3t-T0ken_value&x=1\n"
+	if err := mailer.Send(Mail{To: "alice@example.com", Subject: "Reset", Body: body}); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	logged := buf.String()
+	if strings.Contains(logged, "s3cr3t") {
+		t.Errorf("Expected the token to be left out of the log, got:\n%s", logged)
+	}
+	if !strings.Contains(logged, "/reset-password?token=[redacted]&x=1") || !strings.Contains(logged, "alice@example.com") {
+		t.Errorf("Expected the rest of the email in the log, got:\n%s", logged)
+	}
+}
@@ -1,7 +1,24 @@
 package main
 
+import (
+	"log"
+	"os"
+)
+
 func main() {
-	a := App{}
+	cfg, args, err := loadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	a := App{config: cfg}
+
+	// "notes [flags] migrate [up|down|status] [steps]" manages the schema without starting the server
+	if len(args) > 0 && args[0] == "migrate" {
+		a.migrateCommand(args[1:])
+		return
+	}
+
 	a.Initialize()
 	a.Run("")
 }
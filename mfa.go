@@ -0,0 +1,501 @@
+// Package main contains the main entry point for the Go application
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/icza/session"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Events of two-factor authentication written to the audit log, see audit.
+const (
+	auditMFAEnabled               = "mfa_enabled"
+	auditMFADisabled              = "mfa_disabled"
+	auditMFAFailed                = "mfa_failed"
+	auditRecoveryCodeUsed         = "recovery_code_used"
+	auditRecoveryCodesRegenerated = "recovery_codes_regenerated"
+)
+
+const (
+	// recoveryCodeCount is how many recovery codes a user gets at a time
+	recoveryCodeCount = 10
+	// mfaLoginTimeout is how long the code of a login may take after the password was accepted
+	mfaLoginTimeout = 5 * time.Minute
+	// mfaPendingSecretAttr is the session attribute holding the secret being set up, until a code of it is given
+	mfaPendingSecretAttr = "mfa_pending_secret"
+)
+
+// mfaSetupPaths are the pages a user who has to set up two-factor authentication can still open.
+var mfaSetupPaths = map[string]bool{
+	"/mfa/setup":   true,
+	"/user-logout": true,
+}
+
+// mfaRequired reports whether every user has to use two-factor authentication.
+func (a *App) mfaRequired() bool {
+	return a.config != nil && a.config.MFA.Required
+}
+
+// mfaIssuer returns the name authenticator apps show for the account.
+func (a *App) mfaIssuer() string {
+	if a.config == nil {
+		return defaultConfig().MFA.Issuer
+	}
+	return a.config.MFA.Issuer
+}
+
+// sessionHasMFA reports whether the request's session was logged in with a second factor.
+func sessionHasMFA(r *http.Request) bool {
+	sess := session.Get(r)
+	if sess == nil {
+		return false
+	}
+	mfa, _ := sess.CAttr("mfa").(bool)
+	return mfa
+}
+
+// TOTPSecret returns the secret of the user's authenticator app, or "" if they have not set one up.
+func (s *postgresStore) TOTPSecret(username string) (string, error) {
+	var secret sql.NullString
+	err := s.db.QueryRow("SELECT totp_secret FROM users WHERE username = $1", username).Scan(&secret)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	return secret.String, nil
+}
+
+// EnableTOTP stores the secret of the user's authenticator app and replaces their recovery codes.
+func (s *postgresStore) EnableTOTP(username, secret string, recoveryCodeHashes []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE users SET totp_secret = $2, totp_last_step = NULL WHERE username = $1", username, secret)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	if err := replaceRecoveryCodes(tx, username, recoveryCodeHashes); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DisableTOTP removes the user's authenticator app secret and recovery codes.
+func (s *postgresStore) DisableTOTP(username string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE users SET totp_secret = NULL, totp_last_step = NULL WHERE username = $1", username); err != nil {
+		return err
+	}
+	if err := replaceRecoveryCodes(tx, username, nil); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UseTOTPStep records that a code of the time step was used, or returns false if a code of it
+// or a later step already was. The check and the update are one statement, so two requests
+// with the same code cannot both succeed.
+func (s *postgresStore) UseTOTPStep(username string, step int64) (bool, error) {
+	result, err := s.db.Exec(`
+		UPDATE users SET totp_last_step = $2
+		WHERE username = $1 AND totp_secret IS NOT NULL AND (totp_last_step IS NULL OR totp_last_step < $2)
+	`, username, step)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// UseRecoveryCode deletes the user's recovery code with the hash, or returns false if there is none.
+func (s *postgresStore) UseRecoveryCode(username, codeHash string) (bool, error) {
+	result, err := s.db.Exec("DELETE FROM recovery_codes WHERE username = $1 AND code_hash = $2", username, codeHash)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// RecoveryCodesLeft returns how many unused recovery codes the user has.
+func (s *postgresStore) RecoveryCodesLeft(username string) (int, error) {
+	var count int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM recovery_codes WHERE username = $1", username).Scan(&count)
+	return count, err
+}
+
+// SetRecoveryCodes replaces the user's recovery codes.
+func (s *postgresStore) SetRecoveryCodes(username string, codeHashes []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := replaceRecoveryCodes(tx, username, codeHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// replaceRecoveryCodes deletes the user's recovery codes and inserts the given ones.
+func replaceRecoveryCodes(tx *sql.Tx, username string, codeHashes []string) error {
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE username = $1", username); err != nil {
+		return err
+	}
+	for _, h := range codeHashes {
+		if _, err := tx.Exec("INSERT INTO recovery_codes (username, code_hash) VALUES ($1, $2)", username, h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// generateRecoveryCodes returns new recovery codes of 80 random bits each, like "abcd-efgh-ijkl-mnop",
+// and their hashes to store.
+func generateRecoveryCodes() (codes, hashes []string, err error) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(b))
+		codes = append(codes, code[0:4]+"-"+code[4:8]+"-"+code[8:12]+"-"+code[12:16])
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode returns the hash a recovery code is stored as. Only the hash is stored, like
+// API tokens, and the code is compared without case, dashes or spaces.
+func hashRecoveryCode(code string) string {
+	code = strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(strings.TrimSpace(code)))
+	return hashAPIToken(code)
+}
+
+// isTOTPCode reports whether a code looks like one of an authenticator app rather than a recovery code.
+func isTOTPCode(code string) bool {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != totpDigits {
+		return false
+	}
+	for _, c := range code {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// checkSecondFactor checks a code of the user's authenticator app, which can be used once, or
+// one of their recovery codes, which is then used up.
+func (a *App) checkSecondFactor(r *http.Request, username, code string) (bool, error) {
+	secret, err := a.users.TOTPSecret(username)
+	if err != nil || secret == "" {
+		return false, err
+	}
+
+	if isTOTPCode(code) {
+		step, ok := validTOTP(secret, code, time.Now())
+		if !ok {
+			return false, nil
+		}
+		return a.users.UseTOTPStep(username, step)
+	}
+
+	used, err := a.users.UseRecoveryCode(username, hashRecoveryCode(code))
+	if used {
+		a.audit(r, username, auditRecoveryCodeUsed)
+	}
+	return used, err
+}
+
+// startMFALogin keeps a user whose password was accepted in a short session that only allows
+// giving the second factor on /login/mfa, without logging them in yet.
+func startMFALogin(w http.ResponseWriter, username string) {
+	sess := session.NewSessionOptions(&session.SessOptions{
+		CAttrs:  map[string]interface{}{"mfa_username": username},
+		Timeout: mfaLoginTimeout,
+	})
+	session.Add(sess, w)
+}
+
+// mfaLoginHandler asks for the code of the authenticator app or a recovery code after the password (GET),
+// and logs the user in once it is right (POST). Wrong codes count as failed logins of the account.
+func (a *App) mfaLoginHandler(w http.ResponseWriter, r *http.Request) {
+	sess := session.Get(r)
+	var username string
+	if sess != nil {
+		username, _ = sess.CAttr("mfa_username").(string)
+	}
+	if username == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	// backToLogin ends the pending login with a message on the login page
+	backToLogin := func(message string) {
+		session.Remove(sess, w)
+		http.SetCookie(w, &http.Cookie{Name: "message", Value: message, Path: "/"})
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+	}
+
+	var message string
+	if r.Method == http.MethodPost {
+		key := accountKey(username)
+		if a.logins.retryAfter(key) > 0 {
+			a.audit(r, username, auditLoginLocked)
+			backToLogin(loginLockedMessage)
+			return
+		}
+
+		ok, err := a.checkSecondFactor(r, username, r.FormValue("code"))
+		if err != nil {
+			checkInternalServerError(err, w)
+			return
+		}
+		if !ok {
+			a.audit(r, username, auditMFAFailed)
+			if a.logins.fail(key, a.logins.config.MaxFailures) {
+				slog.Warn("Locked out a user after too many failed logins", "user", username)
+				backToLogin(loginLockedMessage)
+				return
+			}
+			message = "The code is not correct, or was already used."
+		} else {
+			a.logins.succeed(key)
+			session.Remove(sess, w)
+			a.startSession(w, User{Username: username}, true)
+			http.Redirect(w, r, "/list", http.StatusSeeOther)
+			return
+		}
+	}
+
+	renderFormPage(w, r, "mfa_login.html", struct {
+		Message string
+	}{
+		Message: message,
+	})
+}
+
+// mfaSetupPage is the data of the two-factor authentication settings page.
+type mfaSetupPage struct {
+	Username string
+	Enabled  bool
+	Required bool
+	// Secret, URI and QRCode set up an authenticator app, when it is not enabled yet
+	Secret string
+	URI    template.URL
+	QRCode template.URL
+	// RecoveryCodes are shown once, right after they were generated
+	RecoveryCodes []string
+	CodesLeft     int
+	Message       string
+	Saved         string
+}
+
+// mfaSetupHandler sets up an authenticator app (GET shows its QR code, POST "enable" checks a code
+// of it), and once it is set up shows how many recovery codes are left, generates new ones
+// ("regenerate") and turns two-factor authentication off ("disable") unless it is required.
+func (a *App) mfaSetupHandler(w http.ResponseWriter, r *http.Request) {
+	username := currentUsername(r)
+	sess := session.Get(r)
+	if sess == nil {
+		http.Error(w, "Two-factor authentication is set up from a logged in browser", http.StatusForbidden)
+		return
+	}
+
+	secret, err := a.users.TOTPSecret(username)
+	if err != nil {
+		checkInternalServerError(err, w)
+		return
+	}
+
+	// A session that was logged in without the second factor has to log in again with it
+	if secret != "" && a.mfaRequired() && !sessionHasMFA(r) {
+		session.Remove(sess, w)
+		http.SetCookie(w, &http.Cookie{Name: "message", Value: "Log in again with your authenticator app.", Path: "/"})
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	page := mfaSetupPage{Username: username, Enabled: secret != "", Required: a.mfaRequired()}
+
+	if r.Method == http.MethodPost {
+		switch r.FormValue("action") {
+		case "enable":
+			if page.Enabled {
+				break
+			}
+			page.RecoveryCodes, page.Message = a.enableMFA(w, r, sess, username)
+			if page.Message == "" {
+				page.Enabled = true
+				page.Saved = "Two-factor authentication is on. You have been logged out everywhere else."
+			}
+		case "regenerate":
+			if !page.Enabled {
+				break
+			}
+			if page.Message = a.confirmMFAChange(r, username, false); page.Message != "" {
+				break
+			}
+			codes, hashes, err := generateRecoveryCodes()
+			if err == nil {
+				err = a.users.SetRecoveryCodes(username, hashes)
+			}
+			if err != nil {
+				checkInternalServerError(err, w)
+				return
+			}
+			a.audit(r, username, auditRecoveryCodesRegenerated)
+			page.RecoveryCodes = codes
+			page.Saved = "New recovery codes were generated. The old ones no longer work."
+		case "disable":
+			if !page.Enabled {
+				break
+			}
+			if page.Required {
+				page.Message = "Two-factor authentication is required on this server and cannot be turned off."
+				break
+			}
+			if page.Message = a.confirmMFAChange(r, username, true); page.Message != "" {
+				break
+			}
+			if err := a.users.DisableTOTP(username); err != nil {
+				checkInternalServerError(err, w)
+				return
+			}
+			a.audit(r, username, auditMFADisabled)
+			page.Enabled = false
+			page.Saved = "Two-factor authentication is off."
+		}
+	}
+
+	if page.Enabled {
+		if page.CodesLeft, err = a.users.RecoveryCodesLeft(username); err != nil {
+			checkInternalServerError(err, w)
+			return
+		}
+	} else {
+		if page.Required && page.Message == "" && page.Saved == "" {
+			page.Message = "Two-factor authentication is required. Set it up to continue."
+		}
+		if err := a.pendingTOTPSecret(sess, &page); err != nil {
+			checkInternalServerError(err, w)
+			return
+		}
+	}
+
+	renderFormPage(w, r, "mfa_setup.html", page)
+}
+
+// pendingTOTPSecret fills in the secret being set up and its QR code, generating the secret
+// the first time. It is kept in the session until a code of it is given.
+func (a *App) pendingTOTPSecret(sess session.Session, page *mfaSetupPage) error {
+	secret, _ := sess.Attr(mfaPendingSecretAttr).(string)
+	if secret == "" {
+		var err error
+		if secret, err = generateTOTPSecret(); err != nil {
+			return err
+		}
+		sess.SetAttr(mfaPendingSecretAttr, secret)
+	}
+
+	page.Secret = secret
+	uri := totpProvisioningURI(a.mfaIssuer(), page.Username, secret)
+	// The otpauth scheme is not one html/template lets through in links by itself
+	page.URI = template.URL(uri)
+	qr, err := totpQRCode(uri)
+	if err != nil {
+		return err
+	}
+	page.QRCode = qr
+	return nil
+}
+
+// enableMFA turns two-factor authentication on once a code of the pending secret is given, and
+// returns the new recovery codes, or what was wrong. The user's other sessions are logged out, and
+// this one is replaced by a session that counts as logged in with the second factor.
+func (a *App) enableMFA(w http.ResponseWriter, r *http.Request, sess session.Session, username string) ([]string, string) {
+	secret, _ := sess.Attr(mfaPendingSecretAttr).(string)
+	if secret == "" {
+		return nil, "The setup has expired, scan the new QR code and try again."
+	}
+	step, ok := validTOTP(secret, r.FormValue("code"), time.Now())
+	if !ok {
+		return nil, "The code is not correct. Check that the time on your phone is right and try again."
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err == nil {
+		err = a.users.EnableTOTP(username, secret, hashes)
+	}
+	if err == nil {
+		// The code just given cannot be used to log in again
+		_, err = a.users.UseTOTPStep(username, step)
+	}
+	if err != nil {
+		slog.Error("Enabling two-factor authentication failed", "user", username, "err", err)
+		return nil, "Two-factor authentication could not be turned on, please try again."
+	}
+
+	a.audit(r, username, auditMFAEnabled)
+	a.endOtherSessions(r, username)
+	session.Remove(sess, w)
+	a.startSession(w, User{Username: username}, true)
+	return codes, ""
+}
+
+// confirmMFAChange checks the code, and the password if asked for, before two-factor authentication
+// is changed, and returns what was wrong. Wrong ones count as failed logins of the account.
+func (a *App) confirmMFAChange(r *http.Request, username string, withPassword bool) string {
+	key := accountKey(username)
+	if a.logins.retryAfter(key) > 0 {
+		a.audit(r, username, auditLoginLocked)
+		return loginLockedMessage
+	}
+
+	if withPassword {
+		hash, err := a.users.PasswordHash(username)
+		if err != nil {
+			slog.Error("Loading a password failed", "user", username, "err", err)
+			return "Two-factor authentication could not be changed, please try again."
+		}
+		if bcrypt.CompareHashAndPassword(hash, []byte(r.FormValue("password"))) != nil {
+			a.audit(r, username, auditLoginFailed)
+			a.logins.fail(key, a.logins.config.MaxFailures)
+			return "The password is not correct."
+		}
+	}
+
+	ok, err := a.checkSecondFactor(r, username, r.FormValue("code"))
+	if err != nil {
+		slog.Error("Checking a two-factor code failed", "user", username, "err", err)
+		return "Two-factor authentication could not be changed, please try again."
+	}
+	if !ok {
+		a.audit(r, username, auditMFAFailed)
+		a.logins.fail(key, a.logins.config.MaxFailures)
+		return "The code is not correct, or was already used."
+	}
+	return ""
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testBrowser sends requests to an app's routes, keeping the cookies it is sent and adding the
+// CSRF token of its session to the forms it posts.
+type testBrowser struct {
+	a       *App
+	cookies map[string]*http.Cookie
+}
+
+func newTestBrowser(a *App) *testBrowser {
+	return &testBrowser{a: a, cookies: make(map[string]*http.Cookie)}
+}
+
+func (b *testBrowser) request(method, target string, body string) *http.Request {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	for _, c := range b.cookies {
+		req.AddCookie(c)
+	}
+	return req
+}
+
+// do gets the target, or posts the form to it if there is one, and returns the response.
+func (b *testBrowser) do(target string, form url.Values) *httptest.ResponseRecorder {
+	method, body := "GET", ""
+	if form != nil {
+		if token := csrfToken(b.request("GET", "/", "")); token != "" {
+			form.Set(csrfFormField, token)
+		}
+		method, body = "POST", form.Encode()
+	}
+
+	req := b.request(method, target, body)
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	rr := httptest.NewRecorder()
+	b.a.Router.ServeHTTP(rr, req)
+
+	for _, c := range rr.Result().Cookies() {
+		if c.MaxAge < 0 {
+			delete(b.cookies, c.Name)
+		} else {
+			b.cookies[c.Name] = c
+		}
+	}
+	return rr
+}
+
+// login posts the login form and returns where it redirects to.
+func (b *testBrowser) login(username, password string) string {
+	rr := b.do("/login", url.Values{"usrname": {username}, "psw": {password}})
+	return rr.Header().Get("Location")
+}
+
+// newMFATestApp returns an app on the memory backend with alice, whose password is "secret",
+// and a throttle that locks out after 3 failures without backing off in between.
+func newMFATestApp(t *testing.T, required bool) *App {
+	a := newMemoryTestApp(t, "alice")
+	a.config = &Config{
+		Session: SessionConfig{Timeout: time.Minute},
+		MFA:     MFAConfig{Required: required, Issuer: "Enterprise Notes"},
+	}
+	a.logins = newLoginThrottle(LoginConfig{MaxFailures: 3, MaxFailuresPerIP: 20, Lockout: time.Minute})
+	setTestPassword(t, a, "alice", "secret")
+	return a
+}
+
+// enableTestTOTP sets up an authenticator app for the user with a recovery code, and returns its secret.
+func enableTestTOTP(t *testing.T, a *App, username, recoveryCode string) string {
+	t.Helper()
+	secret, _ := generateTOTPSecret()
+	if err := a.users.EnableTOTP(username, secret, []string{hashRecoveryCode(recoveryCode)}); err != nil {
+		t.Fatalf("Enabling two-factor authentication: %v", err)
+	}
+	return secret
+}
+
+// currentTOTP returns the code of the secret a number of steps from now.
+func currentTOTP(secret string, steps int64) string {
+	code, _ := totpCode(secret, totpStep(time.Now())+steps)
+	return code
+}
+
+func TestMFA_SetupThenLoginWithCodes(t *testing.T) {
+	a := newMFATestApp(t, false)
+	b := newTestBrowser(a)
+
+	if location := b.login("alice", "secret"); location != "/list" {
+		t.Fatalf("Expected to be logged in without a second factor, got a redirect to %q", location)
+	}
+
+	rr := b.do("/mfa/setup", nil)
+	match := regexp.MustCompile(`<code>([A-Z2-7]+)</code>`).FindStringSubmatch(rr.Body.String())
+	if rr.Code != http.StatusOK || match == nil || !strings.Contains(rr.Body.String(), "data:image/png;base64,") {
+		t.Fatalf("Expected the secret and its QR code, got %v: %s", rr.Code, rr.Body.String())
+	}
+	secret := match[1]
+
+	rr = b.do("/mfa/setup", url.Values{"action": {"enable"}, "code": {"000000x"}})
+	if !strings.Contains(rr.Body.String(), "The code is not correct.") {
+		t.Errorf("Expected a wrong code to be refused, got %s", rr.Body.String())
+	}
+
+	setupCode := currentTOTP(secret, 0)
+	rr = b.do("/mfa/setup", url.Values{"action": {"enable"}, "code": {setupCode}})
+	recoveryCodes := regexp.MustCompile(`[a-z2-7]{4}-[a-z2-7]{4}-[a-z2-7]{4}-[a-z2-7]{4}`).FindAllString(rr.Body.String(), -1)
+	if len(recoveryCodes) != recoveryCodeCount {
+		t.Fatalf("Expected %d recovery codes, got %v: %s", recoveryCodeCount, rr.Code, rr.Body.String())
+	}
+	if stored, _ := a.users.TOTPSecret("alice"); stored != secret {
+		t.Errorf("Expected the secret to be stored, got %q", stored)
+	}
+	// The session was replaced by one that gave the second factor
+	if rr := b.do("/list", nil); rr.Code != http.StatusOK {
+		t.Errorf("Expected to stay logged in, got %v", rr.Code)
+	}
+
+	// The password alone no longer logs in
+	b.do("/user-logout", nil)
+	if location := b.login("alice", "secret"); location != "/login/mfa" {
+		t.Fatalf("Expected to be asked for a code, got a redirect to %q", location)
+	}
+	if rr := b.do("/list", nil); rr.Header().Get("Location") != "/login" {
+		t.Errorf("Expected the pending login not to be logged in, got %v %q", rr.Code, rr.Header().Get("Location"))
+	}
+
+	// The code given at setup cannot be used again
+	rr = b.do("/login/mfa", url.Values{"code": {setupCode}})
+	if !strings.Contains(rr.Body.String(), "was already used") {
+		t.Errorf("Expected the used code to be refused, got %v: %s", rr.Code, rr.Body.String())
+	}
+
+	rr = b.do("/login/mfa", url.Values{"code": {strings.ToUpper(recoveryCodes[0])}})
+	if rr.Header().Get("Location") != "/list" {
+		t.Fatalf("Expected the recovery code to log in, got %v %q", rr.Code, rr.Header().Get("Location"))
+	}
+	if rr := b.do("/list", nil); rr.Code != http.StatusOK {
+		t.Errorf("Expected to be logged in, got %v", rr.Code)
+	}
+
+	// Each recovery code works once
+	b.do("/user-logout", nil)
+	b.login("alice", "secret")
+	rr = b.do("/login/mfa", url.Values{"code": {recoveryCodes[0]}})
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "was already used") {
+		t.Errorf("Expected the used recovery code to be refused, got %v %q", rr.Code, rr.Header().Get("Location"))
+	}
+	if left, _ := a.users.RecoveryCodesLeft("alice"); left != recoveryCodeCount-1 {
+		t.Errorf("Expected %d recovery codes left, got %d", recoveryCodeCount-1, left)
+	}
+}
+
+func TestMFA_WrongCodesLockOut(t *testing.T) {
+	a := newMFATestApp(t, false)
+	secret := enableTestTOTP(t, a, "alice", "recovery")
+	b := newTestBrowser(a)
+
+	b.login("alice", "secret")
+	for i := 0; i < 2; i++ {
+		b.do("/login/mfa", url.Values{"code": {"000000"}})
+	}
+	rr := b.do("/login/mfa", url.Values{"code": {"000000"}})
+	if rr.Header().Get("Location") != "/login" || b.cookies["message"] == nil || b.cookies["message"].Value != loginLockedMessage {
+		t.Fatalf("Expected to be sent back to the login page locked out, got %v %q", rr.Code, rr.Header().Get("Location"))
+	}
+
+	// Logging in with the password again does not clear the failures
+	b.login("alice", "secret")
+	b.do("/login/mfa", url.Values{"code": {currentTOTP(secret, 0)}})
+	if rr := b.do("/list", nil); rr.Code == http.StatusOK {
+		t.Error("Expected the account to stay locked out")
+	}
+}
+
+func TestMFA_DisableNeedsPasswordAndCode(t *testing.T) {
+	a := newMFATestApp(t, false)
+	secret := enableTestTOTP(t, a, "alice", "recovery")
+	b := newTestBrowser(a)
+
+	b.login("alice", "secret")
+	if rr := b.do("/login/mfa", url.Values{"code": {currentTOTP(secret, 0)}}); rr.Header().Get("Location") != "/list" {
+		t.Fatalf("Expected the code to log in, got %v %q", rr.Code, rr.Header().Get("Location"))
+	}
+
+	rr := b.do("/mfa/setup", url.Values{"action": {"disable"}, "password": {"wrong"}, "code": {currentTOTP(secret, 1)}})
+	if !strings.Contains(rr.Body.String(), "The password is not correct.") {
+		t.Errorf("Expected the wrong password to be refused, got %s", rr.Body.String())
+	}
+
+	b.do("/mfa/setup", url.Values{"action": {"disable"}, "password": {"secret"}, "code": {currentTOTP(secret, 1)}})
+	if stored, _ := a.users.TOTPSecret("alice"); stored != "" {
+		t.Errorf("Expected two-factor authentication to be off, got secret %q", stored)
+	}
+}
+
+func TestMFA_RequiredSendsUsersToSetup(t *testing.T) {
+	a := newMFATestApp(t, true)
+	b := newTestBrowser(a)
+
+	b.login("alice", "secret")
+	if rr := b.do("/list", nil); rr.Header().Get("Location") != "/mfa/setup" {
+		t.Errorf("Expected a redirect to /mfa/setup, got %v %q", rr.Code, rr.Header().Get("Location"))
+	}
+	if rr := b.do("/api/v1/me", nil); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected the API to refuse the session, got %v", rr.Code)
+	}
+	rr := b.do("/mfa/setup", nil)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "Two-factor authentication is required.") {
+		t.Errorf("Expected the setup page, got %v: %s", rr.Code, rr.Body.String())
+	}
+
+	// Once it is set up, it cannot be turned off
+	secret := enableTestTOTP(t, a, "alice", "recovery")
+	b.do("/user-logout", nil)
+	b.login("alice", "secret")
+	b.do("/login/mfa", url.Values{"code": {currentTOTP(secret, 0)}})
+	if rr := b.do("/list", nil); rr.Code != http.StatusOK {
+		t.Fatalf("Expected to be logged in, got %v %q", rr.Code, rr.Header().Get("Location"))
+	}
+	rr = b.do("/mfa/setup", url.Values{"action": {"disable"}, "password": {"secret"}, "code": {currentTOTP(secret, 1)}})
+	if !strings.Contains(rr.Body.String(), "cannot be turned off") {
+		t.Errorf("Expected turning it off to be refused, got %s", rr.Body.String())
+	}
+}
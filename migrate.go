@@ -0,0 +1,336 @@
+// Package main contains the main entry point for the Go application
+package main
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"log/slog"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// migrationFiles holds the numbered SQL migrations compiled into the binary.
+// Each version has an up file and a down file, e.g. 0001_initial_schema.up.sql.
+// The SQLite schema has its own set in migrations/sqlite.
+//
+//go:embed migrations/*.sql migrations/sqlite/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID is the advisory lock key that serialises migrations between
+// app instances sharing the same database.
+const migrationLockID = 4207311
+
+var migrationFileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// migration is a single versioned schema change.
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// loadMigrations reads the migrations in dir of fsys and returns them sorted by version.
+func loadMigrations(fsys fs.FS, dir string) ([]migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*migration)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		match := migrationFileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("invalid migration file name %q", entry.Name())
+		}
+
+		version, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, err
+		}
+
+		body, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m, exists := byVersion[version]
+		if !exists {
+			m = &migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migration version %d is used by both %q and %q", version, m.Name, match[2])
+		}
+
+		if match[3] == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %04d_%s must have both an up and a down file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// usesSQLite reports whether the app is configured for the SQLite database backend.
+// Tests that build an App without a config run against PostgreSQL.
+func (a *App) usesSQLite() bool {
+	return a.config != nil && a.config.Database.Backend == "sqlite"
+}
+
+// loadAppMigrations returns the migrations for the app's database backend.
+func (a *App) loadAppMigrations() ([]migration, error) {
+	if a.usesSQLite() {
+		return loadMigrations(migrationFiles, "migrations/sqlite")
+	}
+	return loadMigrations(migrationFiles, "migrations")
+}
+
+// ensureMigrationsTable creates the schema_migrations table if it does not exist yet.
+func (a *App) ensureMigrationsTable() error {
+	_, err := a.db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY NOT NULL,
+			name VARCHAR(255) NOT NULL,
+			applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	return err
+}
+
+// appliedMigrations returns the versions recorded in schema_migrations, in ascending order.
+func (a *App) appliedMigrations() ([]int, error) {
+	rows, err := a.db.Query("SELECT version FROM schema_migrations ORDER BY version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []int
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return versions, nil
+}
+
+// migrateUp applies every embedded migration that has not been recorded in schema_migrations.
+func (a *App) migrateUp() error {
+	migrations, err := a.loadAppMigrations()
+	if err != nil {
+		return err
+	}
+
+	if err := a.ensureMigrationsTable(); err != nil {
+		return err
+	}
+
+	applied, err := a.appliedMigrations()
+	if err != nil {
+		return err
+	}
+
+	done := make(map[int]bool, len(applied))
+	for _, version := range applied {
+		done[version] = true
+	}
+
+	for _, m := range migrations {
+		if done[m.Version] {
+			continue
+		}
+
+		if err := a.runMigration(m, true); err != nil {
+			return fmt.Errorf("migration %04d_%s failed: %w", m.Version, m.Name, err)
+		}
+		slog.Info("Applied migration", "version", m.Version, "name", m.Name)
+	}
+
+	return nil
+}
+
+// migrateDown reverts the most recently applied migrations, up to the given number of steps.
+func (a *App) migrateDown(steps int) error {
+	migrations, err := a.loadAppMigrations()
+	if err != nil {
+		return err
+	}
+
+	if err := a.ensureMigrationsTable(); err != nil {
+		return err
+	}
+
+	applied, err := a.appliedMigrations()
+	if err != nil {
+		return err
+	}
+
+	byVersion := make(map[int]migration, len(migrations))
+	for _, m := range migrations {
+		byVersion[m.Version] = m
+	}
+
+	for i := len(applied) - 1; i >= 0 && steps > 0; i-- {
+		m, ok := byVersion[applied[i]]
+		if !ok {
+			return fmt.Errorf("migration %04d is applied but not embedded in this binary", applied[i])
+		}
+
+		if err := a.runMigration(m, false); err != nil {
+			return fmt.Errorf("reverting migration %04d_%s failed: %w", m.Version, m.Name, err)
+		}
+		slog.Info("Reverted migration", "version", m.Version, "name", m.Name)
+		steps--
+	}
+
+	return nil
+}
+
+// runMigration applies (up) or reverts (down) a single migration in a transaction.
+// The advisory lock and re-check make it safe for several instances to start at once.
+// SQLite has no advisory locks, but its write transactions already exclude each other.
+func (a *App) runMigration(m migration, up bool) error {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if !a.usesSQLite() {
+		if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", migrationLockID); err != nil {
+			return err
+		}
+	}
+
+	var applied bool
+	err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM schema_migrations WHERE version = $1)", m.Version).Scan(&applied)
+	if err != nil {
+		return err
+	}
+
+	// Another instance got there first
+	if applied == up {
+		return nil
+	}
+
+	if up {
+		if _, err := tx.Exec(m.Up); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", m.Version, m.Name); err != nil {
+			return err
+		}
+	} else {
+		if _, err := tx.Exec(m.Down); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM schema_migrations WHERE version = $1", m.Version); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// migrationStatus logs every embedded migration and whether it has been applied.
+func (a *App) migrationStatus() error {
+	migrations, err := a.loadAppMigrations()
+	if err != nil {
+		return err
+	}
+
+	if err := a.ensureMigrationsTable(); err != nil {
+		return err
+	}
+
+	applied, err := a.appliedMigrations()
+	if err != nil {
+		return err
+	}
+
+	done := make(map[int]bool, len(applied))
+	for _, version := range applied {
+		done[version] = true
+	}
+
+	for _, m := range migrations {
+		state := "pending"
+		if done[m.Version] {
+			state = "applied"
+		}
+		log.Printf("%04d_%s: %s", m.Version, m.Name, state)
+	}
+
+	return nil
+}
+
+// migrateCommand runs the "migrate" command line: up (default), down [steps] or status.
+func (a *App) migrateCommand(args []string) {
+	setupLogging(a.config.LogLevel)
+
+	if a.config.Database.Backend == "memory" {
+		log.Fatal("migrations do not apply to the memory backend")
+	}
+
+	db, _, err := openDatabase(a.config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	a.db = db
+	defer a.db.Close()
+
+	action := "up"
+	if len(args) > 0 {
+		action = args[0]
+	}
+
+	switch action {
+	case "up":
+		err = a.migrateUp()
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				log.Fatalf("invalid number of steps %q", args[1])
+			}
+		}
+		err = a.migrateDown(steps)
+	case "status":
+		err = a.migrationStatus()
+	default:
+		log.Fatalf("unknown migrate command %q, expected up, down or status", action)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS user_shares;
+DROP TABLE IF EXISTS notes;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,15 @@
+-- Personal access tokens for scripts and integrations. Only the SHA-256 hash
+-- of a token is stored, the plain token is shown to the user once.
+CREATE TABLE "api_tokens" (
+    id SERIAL PRIMARY KEY NOT NULL,
+    username VARCHAR(50) NOT NULL,
+    name VARCHAR(100) NOT NULL,
+    token_hash CHAR(64) UNIQUE NOT NULL,
+    scopes VARCHAR(255) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_used_at TIMESTAMPTZ,
+    expires_at TIMESTAMPTZ,
+    FOREIGN KEY (username) REFERENCES users (username) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+CREATE INDEX api_tokens_username_idx ON api_tokens (username);
@@ -0,0 +1,13 @@
+-- Login sessions, shared by every app instance so restarts and deploys do not
+-- log users out. data holds the gob encoded session attributes.
+CREATE TABLE "sessions" (
+    id VARCHAR(64) PRIMARY KEY NOT NULL,
+    username VARCHAR(50),
+    data BYTEA NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    accessed_at TIMESTAMPTZ NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX sessions_expires_at_idx ON sessions (expires_at);
+CREATE INDEX sessions_username_idx ON sessions (username);
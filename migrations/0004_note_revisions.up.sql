@@ -0,0 +1,26 @@
+-- Every change to a note is kept as a full snapshot, numbered per note.
+-- Revision 1 is the note as it was created, or as it was when history was introduced.
+CREATE TABLE "note_revisions" (
+    id SERIAL PRIMARY KEY NOT NULL,
+    note_id INTEGER NOT NULL,
+    revision INTEGER NOT NULL,
+    edited_by VARCHAR(50),
+    edited_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    title VARCHAR(255) NOT NULL,
+    noteType VARCHAR(255) NOT NULL,
+    description VARCHAR(255) NOT NULL,
+    taskCompletionTime VARCHAR(255),
+    taskCompletionDate VARCHAR(255),
+    noteStatus VARCHAR(20),
+    noteDelegation VARCHAR(50),
+    UNIQUE (note_id, revision),
+    FOREIGN KEY (note_id) REFERENCES notes (id) ON UPDATE CASCADE ON DELETE CASCADE,
+    FOREIGN KEY (edited_by) REFERENCES users (username) ON UPDATE CASCADE ON DELETE SET NULL
+);
+
+-- Start the history of existing notes from their current state
+INSERT INTO note_revisions (note_id, revision, edited_by, edited_at, title, noteType, description,
+    taskCompletionTime, taskCompletionDate, noteStatus, noteDelegation)
+SELECT id, 1, owner, noteCreated, title, noteType, description,
+    taskCompletionTime, taskCompletionDate, noteStatus, noteDelegation
+FROM notes;
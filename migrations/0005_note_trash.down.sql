@@ -0,0 +1,6 @@
+-- Notes still in the trash are deleted for good, since older versions cannot hide them
+DELETE FROM notes WHERE deleted_at IS NOT NULL;
+
+DROP INDEX IF EXISTS notes_deleted_at_idx;
+ALTER TABLE notes DROP COLUMN IF EXISTS deleted_by;
+ALTER TABLE notes DROP COLUMN IF EXISTS deleted_at;
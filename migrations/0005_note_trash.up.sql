@@ -0,0 +1,5 @@
+-- Deleted notes are kept in their owner's trash until they are restored or purged.
+ALTER TABLE notes ADD COLUMN deleted_at TIMESTAMPTZ;
+ALTER TABLE notes ADD COLUMN deleted_by VARCHAR(50) REFERENCES users (username) ON UPDATE CASCADE ON DELETE SET NULL;
+
+CREATE INDEX notes_deleted_at_idx ON notes (deleted_at) WHERE deleted_at IS NOT NULL;
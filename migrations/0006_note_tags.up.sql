@@ -0,0 +1,16 @@
+-- Free-form tags on notes. Tag names are stored lower case and shared by all users,
+-- each note links to its tags through note_tags.
+CREATE TABLE "tags" (
+    id SERIAL PRIMARY KEY NOT NULL,
+    name VARCHAR(32) NOT NULL UNIQUE
+);
+
+CREATE TABLE "note_tags" (
+    note_id INTEGER NOT NULL,
+    tag_id INTEGER NOT NULL,
+    PRIMARY KEY (note_id, tag_id),
+    FOREIGN KEY (note_id) REFERENCES notes (id) ON UPDATE CASCADE ON DELETE CASCADE,
+    FOREIGN KEY (tag_id) REFERENCES tags (id) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+CREATE INDEX note_tags_tag_id_idx ON note_tags (tag_id);
@@ -0,0 +1,12 @@
+ALTER TABLE users DROP COLUMN IF EXISTS timezone;
+
+ALTER TABLE note_revisions ADD COLUMN taskCompletionTime VARCHAR(255), ADD COLUMN taskCompletionDate VARCHAR(255);
+UPDATE note_revisions SET taskCompletionDate = to_char(due_at, 'YYYY-MM-DD'), taskCompletionTime = to_char(due_at, 'HH12:MI AM')
+WHERE due_at IS NOT NULL;
+ALTER TABLE note_revisions DROP COLUMN due_at;
+
+ALTER TABLE notes ADD COLUMN taskCompletionTime VARCHAR(255), ADD COLUMN taskCompletionDate VARCHAR(255);
+UPDATE notes SET taskCompletionDate = to_char(due_at, 'YYYY-MM-DD'), taskCompletionTime = to_char(due_at, 'HH12:MI AM')
+WHERE due_at IS NOT NULL;
+DROP INDEX IF EXISTS notes_due_at_idx;
+ALTER TABLE notes DROP COLUMN due_at;
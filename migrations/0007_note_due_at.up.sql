@@ -0,0 +1,42 @@
+-- Replace the free text completion date and time of notes with a single due timestamp.
+-- Existing values are read as a date (YYYY-MM-DD) and a time such as "02:00 PM" or "14:00"
+-- in the database's time zone. A date without a time is due at the end of that day, and
+-- values that cannot be read are dropped.
+CREATE OR REPLACE FUNCTION pg_temp.parse_due_at(due_date TEXT, due_time TEXT) RETURNS TIMESTAMPTZ AS $$
+DECLARE
+    due_day DATE;
+    due_time_of_day TIME := TIME '23:59';
+BEGIN
+    BEGIN
+        due_day := NULLIF(btrim(due_date), '')::DATE;
+    EXCEPTION WHEN others THEN
+        RETURN NULL;
+    END;
+    IF due_day IS NULL THEN
+        RETURN NULL;
+    END IF;
+
+    BEGIN
+        due_time_of_day := COALESCE(NULLIF(btrim(due_time), '')::TIME, due_time_of_day);
+    EXCEPTION WHEN others THEN
+        -- keep the end of the day
+        NULL;
+    END;
+
+    RETURN (due_day + due_time_of_day)::TIMESTAMPTZ;
+END;
+$$ LANGUAGE plpgsql;
+
+ALTER TABLE notes ADD COLUMN due_at TIMESTAMPTZ;
+UPDATE notes SET due_at = pg_temp.parse_due_at(taskCompletionDate, taskCompletionTime);
+ALTER TABLE notes DROP COLUMN taskCompletionTime, DROP COLUMN taskCompletionDate;
+CREATE INDEX notes_due_at_idx ON notes (due_at) WHERE due_at IS NOT NULL;
+
+ALTER TABLE note_revisions ADD COLUMN due_at TIMESTAMPTZ;
+UPDATE note_revisions SET due_at = pg_temp.parse_due_at(taskCompletionDate, taskCompletionTime);
+ALTER TABLE note_revisions DROP COLUMN taskCompletionTime, DROP COLUMN taskCompletionDate;
+
+DROP FUNCTION pg_temp.parse_due_at(TEXT, TEXT);
+
+-- Due dates are shown in each user's time zone. NULL uses the configured default.
+ALTER TABLE users ADD COLUMN timezone VARCHAR(64);
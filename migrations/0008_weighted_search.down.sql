@@ -0,0 +1,5 @@
+-- Go back to the unweighted search text.
+UPDATE notes n SET fts_text = to_tsvector('english', concat_ws(' ', n.title, n.noteType, n.description,
+    to_char(n.due_at, 'YYYY-MM-DD'), n.noteStatus, n.noteDelegation,
+    COALESCE((SELECT string_agg(t.name, ' ' ORDER BY t.name)
+        FROM note_tags nt JOIN tags t ON t.id = nt.tag_id WHERE nt.note_id = n.id), '')));
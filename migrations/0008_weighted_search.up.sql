@@ -0,0 +1,10 @@
+-- Rebuild the search text of every note with weights, so title matches rank above
+-- tag matches, tag matches above description matches, and the type, due date,
+-- status and delegate lowest. Kept in step with searchVectorSQL.
+UPDATE notes n SET fts_text =
+    setweight(to_tsvector('english', COALESCE(n.title, '')), 'A') ||
+    setweight(to_tsvector('english', COALESCE((SELECT string_agg(t.name, ' ' ORDER BY t.name)
+        FROM note_tags nt JOIN tags t ON t.id = nt.tag_id WHERE nt.note_id = n.id), '')), 'B') ||
+    setweight(to_tsvector('english', COALESCE(n.description, '')), 'C') ||
+    setweight(to_tsvector('english', concat_ws(' ', n.noteType, to_char(n.due_at, 'YYYY-MM-DD'),
+        n.noteStatus, n.noteDelegation)), 'D');
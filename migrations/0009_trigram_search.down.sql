@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS notes_description_trgm_idx;
+DROP INDEX IF EXISTS notes_title_trgm_idx;
+
+DROP EXTENSION IF EXISTS pg_trgm;
@@ -0,0 +1,6 @@
+-- Trigram indexes for the fuzzy search fallback, so partial and misspelt words
+-- still find notes by the similarity of their title or description.
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+CREATE INDEX notes_title_trgm_idx ON notes USING GIN (title gin_trgm_ops);
+CREATE INDEX notes_description_trgm_idx ON notes USING GIN (description gin_trgm_ops);
@@ -0,0 +1,13 @@
+-- Go back to the fts_text column maintained by the application.
+DROP INDEX IF EXISTS notes_search_vector_idx;
+ALTER TABLE notes DROP COLUMN IF EXISTS search_vector;
+
+ALTER TABLE notes ADD COLUMN fts_text tsvector;
+UPDATE notes n SET fts_text =
+    setweight(to_tsvector('english', COALESCE(n.title, '')), 'A') ||
+    setweight(to_tsvector('english', n.tags_text), 'B') ||
+    setweight(to_tsvector('english', COALESCE(n.description, '')), 'C') ||
+    setweight(to_tsvector('english', concat_ws(' ', n.noteType, to_char(n.due_at, 'YYYY-MM-DD'),
+        n.noteStatus, n.noteDelegation)), 'D');
+
+ALTER TABLE notes DROP COLUMN IF EXISTS tags_text;
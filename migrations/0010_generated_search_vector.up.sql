@@ -0,0 +1,22 @@
+-- The search text of a note is now kept up to date by the database, as a stored
+-- generated column with a GIN index, instead of fts_text being rebuilt by the
+-- application after every change. A generated column can only read its own row,
+-- so notes keep a copy of their tags in tags_text, written along with note_tags.
+ALTER TABLE notes ADD COLUMN tags_text TEXT NOT NULL DEFAULT '';
+
+UPDATE notes n SET tags_text = COALESCE((SELECT string_agg(t.name, ' ' ORDER BY t.name)
+    FROM note_tags nt JOIN tags t ON t.id = nt.tag_id WHERE nt.note_id = n.id), '');
+
+ALTER TABLE notes DROP COLUMN fts_text;
+
+-- Adding the column computes it for every existing note. Only immutable expressions
+-- are allowed, so the due date is left out: the due: search qualifier covers it.
+ALTER TABLE notes ADD COLUMN search_vector tsvector GENERATED ALWAYS AS (
+    setweight(to_tsvector('english', COALESCE(title, '')), 'A') ||
+    setweight(to_tsvector('english', tags_text), 'B') ||
+    setweight(to_tsvector('english', COALESCE(description, '')), 'C') ||
+    setweight(to_tsvector('english', COALESCE(noteType, '') || ' ' || COALESCE(noteStatus, '') || ' ' ||
+        COALESCE(noteDelegation, '')), 'D')
+) STORED;
+
+CREATE INDEX notes_search_vector_idx ON notes USING GIN (search_vector);
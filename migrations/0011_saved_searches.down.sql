@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS "saved_search_shares";
+DROP TABLE IF EXISTS "saved_searches";
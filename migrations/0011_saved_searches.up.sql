@@ -0,0 +1,23 @@
+-- Searches saved under a name, with the due filter and sort order to run them with.
+-- A saved search can be shared with other users, who run it over the notes they can see.
+CREATE TABLE "saved_searches" (
+    id SERIAL PRIMARY KEY NOT NULL,
+    owner VARCHAR(50) NOT NULL,
+    name VARCHAR(64) NOT NULL,
+    query VARCHAR(100) NOT NULL,
+    due VARCHAR(16) NOT NULL DEFAULT '',
+    sort VARCHAR(16) NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (owner, name),
+    FOREIGN KEY (owner) REFERENCES users (username) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+CREATE TABLE "saved_search_shares" (
+    saved_search_id INTEGER NOT NULL,
+    username VARCHAR(50) NOT NULL,
+    PRIMARY KEY (saved_search_id, username),
+    FOREIGN KEY (saved_search_id) REFERENCES saved_searches (id) ON UPDATE CASCADE ON DELETE CASCADE,
+    FOREIGN KEY (username) REFERENCES users (username) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+CREATE INDEX saved_search_shares_username_idx ON saved_search_shares (username);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS notes_delegation_created_idx;
+DROP INDEX IF EXISTS notes_owner_title_idx;
+DROP INDEX IF EXISTS notes_owner_created_idx;
@@ -0,0 +1,6 @@
+-- Indexes for the keyset pagination of the notes lists, matching their sort orders
+-- (newest first, or by title) with the note id as a tiebreak.
+CREATE INDEX notes_owner_created_idx ON notes (owner, noteCreated DESC, id DESC) WHERE deleted_at IS NULL;
+CREATE INDEX notes_owner_title_idx ON notes (owner, lower(title), id) WHERE deleted_at IS NULL;
+CREATE INDEX notes_delegation_created_idx ON notes (noteDelegation, noteCreated DESC, id DESC)
+    WHERE deleted_at IS NULL AND noteDelegation IS NOT NULL;
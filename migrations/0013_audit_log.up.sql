@@ -0,0 +1,11 @@
+-- Security events such as failed logins, for administrators to review. The username is
+-- the one that was tried, which need not exist, so it does not reference users.
+CREATE TABLE "audit_log" (
+    id SERIAL PRIMARY KEY NOT NULL,
+    event VARCHAR(32) NOT NULL,
+    username VARCHAR(50) NOT NULL,
+    remote_addr VARCHAR(64) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX audit_log_username_created_idx ON audit_log (username, created_at);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS "password_reset_tokens";
+ALTER TABLE users DROP COLUMN IF EXISTS email;
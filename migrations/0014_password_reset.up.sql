@@ -0,0 +1,13 @@
+-- An optional email address for password reset links, and the links sent. Only the
+-- SHA-256 hash of a reset token is stored, and a token is deleted once it is used.
+ALTER TABLE users ADD COLUMN email VARCHAR(254);
+
+CREATE TABLE "password_reset_tokens" (
+    token_hash CHAR(64) PRIMARY KEY NOT NULL,
+    username VARCHAR(50) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    FOREIGN KEY (username) REFERENCES users (username) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+CREATE INDEX password_reset_tokens_username_idx ON password_reset_tokens (username);
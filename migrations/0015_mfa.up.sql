@@ -0,0 +1,13 @@
+-- Two-factor authentication. totp_secret is set once a user has set up an authenticator app,
+-- and totp_last_step is the time step of the last code used, so a code cannot be used twice.
+-- Only the SHA-256 hashes of the recovery codes are stored, and a code is deleted once used.
+ALTER TABLE users ADD COLUMN totp_secret VARCHAR(64);
+ALTER TABLE users ADD COLUMN totp_last_step BIGINT;
+
+CREATE TABLE "recovery_codes" (
+    username VARCHAR(50) NOT NULL,
+    code_hash CHAR(64) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (username, code_hash),
+    FOREIGN KEY (username) REFERENCES users (username) ON UPDATE CASCADE ON DELETE CASCADE
+);
@@ -0,0 +1,11 @@
+DROP TABLE notes_fts;
+DROP TABLE saved_search_shares;
+DROP TABLE saved_searches;
+DROP TABLE note_tags;
+DROP TABLE tags;
+DROP TABLE note_revisions;
+DROP TABLE sessions;
+DROP TABLE api_tokens;
+DROP TABLE user_shares;
+DROP TABLE notes;
+DROP TABLE users;
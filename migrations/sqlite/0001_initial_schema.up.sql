@@ -0,0 +1,131 @@
+-- The schema of the PostgreSQL migrations up to 0012, for SQLite. Timestamps are stored
+-- as UTC text, which sorts in time order, and TIMESTAMP columns are read back as times.
+CREATE TABLE users (
+    username VARCHAR(50) PRIMARY KEY NOT NULL,
+    password VARCHAR(255) NOT NULL,
+    timezone VARCHAR(64)
+);
+
+CREATE TABLE notes (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    title VARCHAR(255) NOT NULL,
+    noteType VARCHAR(255) NOT NULL,
+    description VARCHAR(255) NOT NULL,
+    noteCreated TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    due_at TIMESTAMP,
+    noteStatus VARCHAR(20),
+    noteDelegation VARCHAR(50),
+    owner VARCHAR(50) REFERENCES users (username) ON UPDATE CASCADE ON DELETE CASCADE,
+    tags_text TEXT NOT NULL DEFAULT '',
+    deleted_at TIMESTAMP,
+    deleted_by VARCHAR(50) REFERENCES users (username) ON UPDATE CASCADE ON DELETE SET NULL
+);
+
+CREATE INDEX notes_deleted_at_idx ON notes (deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE INDEX notes_due_at_idx ON notes (due_at) WHERE due_at IS NOT NULL;
+CREATE INDEX notes_owner_created_idx ON notes (owner, noteCreated DESC, id DESC) WHERE deleted_at IS NULL;
+CREATE INDEX notes_owner_title_idx ON notes (owner, lower(title), id) WHERE deleted_at IS NULL;
+CREATE INDEX notes_delegation_created_idx ON notes (noteDelegation, noteCreated DESC, id DESC)
+    WHERE deleted_at IS NULL AND noteDelegation IS NOT NULL;
+
+CREATE TABLE user_shares (
+    note_id INTEGER NOT NULL REFERENCES notes (id) ON UPDATE CASCADE ON DELETE CASCADE,
+    username VARCHAR(50) NOT NULL REFERENCES users (username) ON UPDATE CASCADE ON DELETE CASCADE,
+    privileges VARCHAR(20) NOT NULL,
+    PRIMARY KEY (username, note_id)
+);
+
+CREATE INDEX user_shares_note_id_idx ON user_shares (note_id);
+
+CREATE TABLE api_tokens (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    username VARCHAR(50) NOT NULL REFERENCES users (username) ON UPDATE CASCADE ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    token_hash CHAR(64) UNIQUE NOT NULL,
+    scopes VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_used_at TIMESTAMP,
+    expires_at TIMESTAMP
+);
+
+CREATE INDEX api_tokens_username_idx ON api_tokens (username);
+
+CREATE TABLE sessions (
+    id VARCHAR(64) PRIMARY KEY NOT NULL,
+    username VARCHAR(50),
+    data BLOB NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    accessed_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX sessions_expires_at_idx ON sessions (expires_at);
+CREATE INDEX sessions_username_idx ON sessions (username);
+
+CREATE TABLE note_revisions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    note_id INTEGER NOT NULL REFERENCES notes (id) ON UPDATE CASCADE ON DELETE CASCADE,
+    revision INTEGER NOT NULL,
+    edited_by VARCHAR(50) REFERENCES users (username) ON UPDATE CASCADE ON DELETE SET NULL,
+    edited_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    title VARCHAR(255) NOT NULL,
+    noteType VARCHAR(255) NOT NULL,
+    description VARCHAR(255) NOT NULL,
+    due_at TIMESTAMP,
+    noteStatus VARCHAR(20),
+    noteDelegation VARCHAR(50),
+    UNIQUE (note_id, revision)
+);
+
+CREATE TABLE tags (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    name VARCHAR(32) NOT NULL UNIQUE
+);
+
+CREATE TABLE note_tags (
+    note_id INTEGER NOT NULL REFERENCES notes (id) ON UPDATE CASCADE ON DELETE CASCADE,
+    tag_id INTEGER NOT NULL REFERENCES tags (id) ON UPDATE CASCADE ON DELETE CASCADE,
+    PRIMARY KEY (note_id, tag_id)
+);
+
+CREATE INDEX note_tags_tag_id_idx ON note_tags (tag_id);
+
+CREATE TABLE saved_searches (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    owner VARCHAR(50) NOT NULL REFERENCES users (username) ON UPDATE CASCADE ON DELETE CASCADE,
+    name VARCHAR(64) NOT NULL,
+    query VARCHAR(100) NOT NULL,
+    due VARCHAR(16) NOT NULL DEFAULT '',
+    sort VARCHAR(16) NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (owner, name)
+);
+
+CREATE TABLE saved_search_shares (
+    saved_search_id INTEGER NOT NULL REFERENCES saved_searches (id) ON UPDATE CASCADE ON DELETE CASCADE,
+    username VARCHAR(50) NOT NULL REFERENCES users (username) ON UPDATE CASCADE ON DELETE CASCADE,
+    PRIMARY KEY (saved_search_id, username)
+);
+
+CREATE INDEX saved_search_shares_username_idx ON saved_search_shares (username);
+
+-- The full text index of the notes, weighted like search_vector in PostgreSQL: title, tags,
+-- description, then the type, status and delegate. Triggers keep it in step with the notes.
+CREATE VIRTUAL TABLE notes_fts USING fts5(title, tags, description, details, tokenize = 'porter unicode61');
+
+CREATE TRIGGER notes_fts_insert AFTER INSERT ON notes BEGIN
+    INSERT INTO notes_fts (rowid, title, tags, description, details)
+    VALUES (new.id, new.title, new.tags_text, new.description,
+        concat_ws(' ', new.noteType, new.noteStatus, new.noteDelegation));
+END;
+
+CREATE TRIGGER notes_fts_update AFTER UPDATE OF title, tags_text, description, noteType, noteStatus, noteDelegation
+ON notes BEGIN
+    UPDATE notes_fts SET title = new.title, tags = new.tags_text, description = new.description,
+        details = concat_ws(' ', new.noteType, new.noteStatus, new.noteDelegation)
+    WHERE rowid = new.id;
+END;
+
+CREATE TRIGGER notes_fts_delete AFTER DELETE ON notes BEGIN
+    DELETE FROM notes_fts WHERE rowid = old.id;
+END;
@@ -0,0 +1,10 @@
+-- The audit log of PostgreSQL migration 0013.
+CREATE TABLE audit_log (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    event VARCHAR(32) NOT NULL,
+    username VARCHAR(50) NOT NULL,
+    remote_addr VARCHAR(64) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX audit_log_username_created_idx ON audit_log (username, created_at);
@@ -0,0 +1,11 @@
+-- The email addresses and password reset tokens of PostgreSQL migration 0014.
+ALTER TABLE users ADD COLUMN email VARCHAR(254);
+
+CREATE TABLE password_reset_tokens (
+    token_hash CHAR(64) PRIMARY KEY NOT NULL,
+    username VARCHAR(50) NOT NULL REFERENCES users (username) ON UPDATE CASCADE ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX password_reset_tokens_username_idx ON password_reset_tokens (username);
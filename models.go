@@ -4,7 +4,7 @@ package main
 import (
 	"database/sql"
 	"encoding/csv"
-	"fmt"
+	"encoding/json"
 	"log"
 	"os"
 	"time"
@@ -12,6 +12,9 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
+// MaxNoteLength is the maximum length of a note's title and description.
+const MaxNoteLength = 256
+
 // UserShare represents a user's sharing permissions for a note.
 type UserShare struct {
 	NoteID int `json:"note_id"`
@@ -27,14 +30,84 @@ type Note struct {
 	NoteType           string `json:"note_type"`
 	Description        string `json:"description"`
 	NoteCreated        time.Time `json:"note_created"`
-	TaskCompletionTime sql.NullString `json:"task_completion_time"`
-	TaskCompletionDate sql.NullString `json:"task_completion_date"`
+	DueAt              sql.NullTime `json:"due_at"`
 	NoteStatus         sql.NullString `json:"note_status"`
 	NoteDelegation     sql.NullString `json:"note_delegation"`
 	Owner              string    `json:"owner"`
-	FTSText            sql.NullString `json:"fts_text"`
+	Tags               []string
 	Privileges         string
 	SharedUsers		   []UserShare
+	// Set by searches only: the relevance of the match and the title and
+	// description with the matched terms marked, see highlightSnippet
+	Rank               float64
+	TitleHeadline      string
+	Headline           string
+}
+
+// MarshalJSON writes the share with plain string fields instead of the database/sql wrapper types.
+func (us UserShare) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		NoteID     int     `json:"note_id,omitempty"`
+		Username   *string `json:"username"`
+		Privileges *string `json:"privileges"`
+	}{
+		NoteID:     us.NoteID,
+		Username:   nullStringPtr(us.Username),
+		Privileges: nullStringPtr(us.Privileges),
+	})
+}
+
+// MarshalJSON writes the note with nullable columns as plain strings (or null),
+// and leaves out the internal full text search vector.
+func (n Note) MarshalJSON() ([]byte, error) {
+	tags := n.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	return json.Marshal(struct {
+		ID                 int         `json:"id"`
+		Title              string      `json:"title"`
+		NoteType           string      `json:"note_type"`
+		Description        string      `json:"description"`
+		NoteCreated        time.Time   `json:"note_created"`
+		DueAt              *time.Time  `json:"due_at"`
+		NoteStatus         *string     `json:"note_status"`
+		NoteDelegation     *string     `json:"note_delegation"`
+		Owner              string      `json:"owner"`
+		Tags               []string    `json:"tags"`
+		Privileges         string      `json:"privileges,omitempty"`
+		SharedUsers        []UserShare `json:"shared_users,omitempty"`
+	}{
+		ID:                 n.ID,
+		Title:              n.Title,
+		NoteType:           n.NoteType,
+		Description:        n.Description,
+		NoteCreated:        n.NoteCreated,
+		DueAt:              nullTimePtr(n.DueAt),
+		NoteStatus:         nullStringPtr(n.NoteStatus),
+		NoteDelegation:     nullStringPtr(n.NoteDelegation),
+		Owner:              n.Owner,
+		Tags:               tags,
+		Privileges:         n.Privileges,
+		SharedUsers:        n.SharedUsers,
+	})
+}
+
+// nullStringPtr converts a sql.NullString to a *string that marshals to null when not valid.
+func nullStringPtr(s sql.NullString) *string {
+	if !s.Valid {
+		return nil
+	}
+	return &s.String
+}
+
+// nullTimePtr converts a sql.NullTime to a *time.Time in UTC that marshals to null when not valid.
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	utc := t.Time.UTC()
+	return &utc
 }
 
 // User represents a user in the application.
@@ -77,143 +150,54 @@ func readData(fileName string) ([][]string, error) {
 	return records, nil
 }
 
-// importData initializes the database schema and imports data from CSV files.
-func (a *App) importData() error {
-
-	// Drop foreign key constraints if they exist
-	dropFKConstraintsSQL := `
-	ALTER TABLE IF EXISTS user_shares DROP CONSTRAINT IF EXISTS user_shares_note_id_fkey;
-	ALTER TABLE IF EXISTS user_shares DROP CONSTRAINT IF EXISTS user_shares_username_fkey;
-	ALTER TABLE IF EXISTS notes DROP CONSTRAINT IF EXISTS notes_owner_fkey;
-	
-	`
-
-	_, err := a.db.Exec(dropFKConstraintsSQL)
-	if err != nil {
-		log.Println("Error dropping foreign key constraints:", err)
-	} else {
-		log.Printf("Foreign key constraints dropped.")
-	}
-
-	log.Printf("Dropping existing tables...")
-
-	// Drop tables if they exist
-	dropTablesSQL := `
-	DROP TABLE IF EXISTS users;
-	DROP TABLE IF EXISTS user_shares;
-	DROP TABLE IF EXISTS notes;
-	
-	`
-
-	_, err = a.db.Exec(dropTablesSQL)
+// seedDemoData inserts the two demo users and the demo notes from data/notes.csv.
+// It is an optional step run after the migrations, and only seeds an empty database
+// so existing users and notes are never touched.
+func (a *App) seedDemoData() error {
+	var userCount int
+	err := a.db.QueryRow("SELECT COUNT(*) FROM users").Scan(&userCount)
 	if err != nil {
-		log.Println("Error dropping tables:", err)
-	} else {
-		log.Printf("Tables notes and user_shares dropped.")
+		return err
 	}
 
-	
-    log.Printf("Creating tables...")
-
-    // Create table as required, along with attribute constraints
-    createTablesSQL := `
-    CREATE TABLE IF NOT EXISTS "users" (
-        username VARCHAR(50) UNIQUE PRIMARY KEY NOT NULL,
-        password VARCHAR(255) NOT NULL
-    );
-
-    CREATE TABLE IF NOT EXISTS "notes" (
-        id SERIAL PRIMARY KEY NOT NULL,
-        title VARCHAR(255) NOT NULL,
-        noteType VARCHAR(255) NOT NULL,
-        description VARCHAR(255) NOT NULL,
-        noteCreated TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
-        taskCompletionTime VARCHAR(255),
-        taskCompletionDate VARCHAR(255),
-        noteStatus VARCHAR(20),
-        noteDelegation VARCHAR(50),
-        owner VARCHAR(50),
-        fts_text tsvector,
-        FOREIGN KEY (owner) REFERENCES users (username) ON UPDATE CASCADE ON DELETE CASCADE
-    );
-
-    CREATE TABLE IF NOT EXISTS "user_shares" (
-        note_id INTEGER NOT NULL,
-        username VARCHAR(50) NOT NULL,
-        privileges VARCHAR(20) NOT NULL,
-        PRIMARY KEY (username, note_id),
-        FOREIGN KEY (note_id) REFERENCES notes (id) ON UPDATE CASCADE ON DELETE CASCADE,
-        FOREIGN KEY (username) REFERENCES users (username) ON UPDATE CASCADE ON DELETE CASCADE
-    );
-`
-
-    _, err = a.db.Exec(createTablesSQL)
-	if err != nil {
-		log.Println("Error creating tables:", err)
-	} else {
-		log.Printf("Tables notes, user_shares, and users created.")
+	if userCount > 0 {
+		log.Printf("Database already has users, skipping demo data.")
+		return nil
 	}
 
-    log.Printf("Inserting data...")
+	log.Printf("Inserting data...")
 
 	// Insert two users with hashed passwords
-    hashedPasswordMydog7, err := bcrypt.GenerateFromPassword([]byte("admin"), bcrypt.DefaultCost)
-    if err != nil {
-        log.Fatal(err)
-    }
-    _, err = a.db.Exec("INSERT INTO users(username, password) VALUES($1, $2)", "mydog7", hashedPasswordMydog7)
-    if err != nil {
-        log.Fatal(err)
-    }
-
-    hashedPasswordBIGCAT, err := bcrypt.GenerateFromPassword([]byte("admin"), bcrypt.DefaultCost)
-    if err != nil {
-        log.Fatal(err)
-    }
-    _, err = a.db.Exec("INSERT INTO users(username, password) VALUES($1, $2)", "BIGCAT", hashedPasswordBIGCAT)
-    if err != nil {
-        log.Fatal(err)
-    }
+	for _, username := range []string{"mydog7", "BIGCAT"} {
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte("admin"), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+
+		_, err = a.db.Exec("INSERT INTO users(username, password) VALUES($1, $2)", username, hashedPassword)
+		if err != nil {
+			return err
+		}
+	}
 
-    insertQuery := `
-        INSERT INTO notes (title, noteType, description, TaskCompletionDate, TaskCompletionTime, NoteStatus, NoteDelegation, owner, fts_text)
-		VALUES (
-			$1::text, $2::text, $3::text, $4::text, $5::text, $6::text, $7::text, $8::text,
-			to_tsvector('english', $1::text || ' ' || $2::text || ' ' || $3::text || ' ' || $4::text || ' ' || $5::text || ' ' || $6::text || ' ' || $7::text)
-		)
-		`
+	return importDataFromCSV(a, "data/notes.csv", importNotesData)
+}
 
-	insertStmt, err := a.db.Prepare(insertQuery)
+// importDataFromCSV reads data from a CSV file and imports each row into the database using the provided importer.
+func importDataFromCSV(a *App, fileName string, dataImporter func(*App, []string) error) error {
+	data, err := readData(fileName)
 	if err != nil {
 		return err
 	}
 
+	for _, row := range data {
+		err := dataImporter(a, row)
+		if err != nil {
+			return err
+		}
+	}
 
-    importDataFromCSV(a, "data/notes.csv", insertStmt, importNotesData)
-
-    // Create a temp file to notify data imported (can use the database directly, but this is an example)
-    file, err := os.Create("./imported")
-    if err != nil {
-        log.Fatal(err)
-    }
-    defer file.Close()
-
-    return nil // Return nil to indicate success
-}
-
-// importDataFromCSV reads data from a CSV file and imports it into the database using the provided statement.
-func importDataFromCSV(a *App, fileName string, stmt *sql.Stmt, dataImporter func(*App, []string) error) {
-    data, err := readData(fileName)
-    if err != nil {
-        log.Fatal(err)
-    }
-
-    for _, row := range data {
-        err := dataImporter(a, row)
-        if err != nil {
-            log.Fatal(err)
-        }
-    }
+	return nil
 }
 
 // importNotesData imports note data from a CSV row into the database.
@@ -226,12 +210,15 @@ func importNotesData(a *App, row []string) error {
     noteStatus := row[5]
     noteDelegation := row[6]
     owner := row[7]
-    
-    // Calculate fts_text using to_tsvector
-    ftsText := fmt.Sprintf("%s %s %s %s %s %s %s", title, noteType, description, taskCompletionTime, taskCompletionDate, noteStatus, noteDelegation)
 
-    _, err := a.db.Exec("INSERT INTO notes (title, noteType, description, taskCompletionTime, taskCompletionDate, noteStatus, noteDelegation, owner, fts_text) VALUES($1,$2,$3,$4,$5,$6,$7,$8, to_tsvector('english', $9))", title, noteType, description, taskCompletionTime, taskCompletionDate, noteStatus, noteDelegation, owner, ftsText)
+    // The demo data keeps the completion date and time apart, due in the default time zone
+    dueAt, err := parseDueAt(taskCompletionDate, taskCompletionTime, a.defaultLocation())
+    if err != nil {
+        return err
+    }
 
+    // The search text is generated by the database from the stored fields
+    _, err = a.db.Exec("INSERT INTO notes (title, noteType, description, due_at, noteStatus, noteDelegation, owner) VALUES($1,$2,$3,$4,$5,$6,$7)", title, noteType, description, dueAt, noteStatus, noteDelegation, owner)
     return err
 }
 
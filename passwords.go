@@ -0,0 +1,499 @@
+// Package main contains the main entry point for the Go application
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/icza/session"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// maxPasswordLength is the most bytes of a password bcrypt hashes. Longer passwords are refused
+// rather than silently cut short.
+const maxPasswordLength = 72
+
+// Events of the password pages written to the audit log, see audit.
+const (
+	auditPasswordChanged        = "password_changed"
+	auditPasswordChangeFailed   = "password_change_failed"
+	auditPasswordResetRequested = "password_reset_requested"
+	auditPasswordResetThrottled = "password_reset_throttled"
+	auditPasswordReset          = "password_reset"
+	auditEmailChangeFailed      = "email_change_failed"
+	auditEmailChanged           = "email_changed"
+)
+
+// errResetTokenInvalid is returned for password reset tokens that do not exist, have expired or were used.
+var errResetTokenInvalid = errors.New("this reset link is invalid or has expired")
+
+// passwordRules returns the configured password rules, or the defaults when the app has no config.
+func (a *App) passwordRules() PasswordConfig {
+	if a.config == nil {
+		return defaultConfig().Password
+	}
+	return a.config.Password
+}
+
+// requirements lists what the rules ask of a password, e.g. "at least 8 characters, a digit".
+func (c PasswordConfig) requirements() string {
+	needs := []string{fmt.Sprintf("at least %d characters", c.MinLength)}
+	if c.RequireUpper {
+		needs = append(needs, "an upper case letter")
+	}
+	if c.RequireLower {
+		needs = append(needs, "a lower case letter")
+	}
+	if c.RequireDigit {
+		needs = append(needs, "a digit")
+	}
+	if c.RequireSymbol {
+		needs = append(needs, "a symbol")
+	}
+	return strings.Join(needs, ", ")
+}
+
+// checkPassword checks a new password for the user against the rules.
+func (c PasswordConfig) checkPassword(username, password string) error {
+	if len(password) > maxPasswordLength {
+		return fmt.Errorf("password cannot be longer than %d bytes", maxPasswordLength)
+	}
+	if strings.EqualFold(password, username) {
+		return errors.New("password cannot be the same as the username")
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case !unicode.IsLetter(r):
+			symbol = true
+		}
+	}
+
+	if len([]rune(password)) < c.MinLength || (c.RequireUpper && !upper) || (c.RequireLower && !lower) ||
+		(c.RequireDigit && !digit) || (c.RequireSymbol && !symbol) {
+		return fmt.Errorf("password needs %s", c.requirements())
+	}
+	return nil
+}
+
+// validateEmail checks an email address given by a user. An empty address means none.
+func validateEmail(email string) error {
+	if email == "" {
+		return nil
+	}
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email || len(email) > 254 {
+		return fmt.Errorf("%q is not an email address", email)
+	}
+	return nil
+}
+
+// SetPasswordHash replaces the user's bcrypt password hash, or returns sql.ErrNoRows if there is no such user.
+func (s *postgresStore) SetPasswordHash(username string, passwordHash []byte) error {
+	result, err := s.db.Exec("UPDATE users SET password = $2 WHERE username = $1", username, passwordHash)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return err
+}
+
+// Email returns the user's email address, or "" if they have not given one.
+func (s *postgresStore) Email(username string) (string, error) {
+	var email sql.NullString
+	err := s.db.QueryRow("SELECT email FROM users WHERE username = $1", username).Scan(&email)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	return email.String, nil
+}
+
+// SetEmail stores the user's email address, checked with validateEmail, or removes it.
+func (s *postgresStore) SetEmail(username, email string) error {
+	_, err := s.db.Exec("UPDATE users SET email = NULLIF($2, '') WHERE username = $1", username, email)
+	return err
+}
+
+// createPasswordResetToken stores a new reset token for the user and returns it in plain text.
+// Only its hash is stored, like API tokens, and expired tokens of every user are cleared out.
+func (a *App) createPasswordResetToken(username string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	now := time.Now()
+	if _, err := a.db.Exec("DELETE FROM password_reset_tokens WHERE expires_at <= $1", now); err != nil {
+		return "", err
+	}
+	_, err := a.db.Exec(
+		"INSERT INTO password_reset_tokens (token_hash, username, expires_at) VALUES ($1, $2, $3)",
+		hashAPIToken(token), username, now.Add(a.passwordRules().ResetTokenTTL),
+	)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// passwordResetUser returns the user a reset token was sent to, or errResetTokenInvalid.
+func (a *App) passwordResetUser(token string) (string, error) {
+	var username string
+	err := a.db.QueryRow(
+		"SELECT username FROM password_reset_tokens WHERE token_hash = $1 AND expires_at > $2",
+		hashAPIToken(token), time.Now(),
+	).Scan(&username)
+	if err == sql.ErrNoRows {
+		return "", errResetTokenInvalid
+	}
+	return username, err
+}
+
+// resetPassword uses up a reset token to set its user's password, and returns the user. Every
+// other reset token and every API token of the user stop working too, and every session of the
+// user is logged out.
+func (a *App) resetPassword(token string, passwordHash []byte) (string, error) {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var username string
+	err = tx.QueryRow(
+		"SELECT username FROM password_reset_tokens WHERE token_hash = $1 AND expires_at > $2",
+		hashAPIToken(token), time.Now(),
+	).Scan(&username)
+	if err == sql.ErrNoRows {
+		return "", errResetTokenInvalid
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// Deleting the token decides the race between two requests with the same link
+	result, err := tx.Exec("DELETE FROM password_reset_tokens WHERE token_hash = $1", hashAPIToken(token))
+	if err != nil {
+		return "", err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return "", errResetTokenInvalid
+	}
+
+	if _, err := tx.Exec("DELETE FROM password_reset_tokens WHERE username = $1", username); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec("UPDATE users SET password = $2 WHERE username = $1", username, passwordHash); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec("DELETE FROM api_tokens WHERE username = $1", username); err != nil {
+		return "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+
+	a.endSessions(username, "")
+	return username, nil
+}
+
+// replacePassword sets the user's password hash and revokes their API tokens in one transaction.
+// The memory backend has no API tokens, so there it only sets the hash.
+func (a *App) replacePassword(username string, passwordHash []byte) error {
+	tx, err := a.db.Begin()
+	if errors.Is(err, errNoDatabase) {
+		return a.users.SetPasswordHash(username, passwordHash)
+	}
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE users SET password = $2 WHERE username = $1", username, passwordHash)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return sql.ErrNoRows
+	}
+	if _, err := tx.Exec("DELETE FROM api_tokens WHERE username = $1", username); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// endOtherSessions logs the user out of every session except the request's own.
+func (a *App) endOtherSessions(r *http.Request, username string) {
+	current := ""
+	if sess := session.Get(r); sess != nil {
+		current = sess.ID()
+	}
+	a.endSessions(username, current)
+}
+
+// endSessions logs the user out of every session in the session store except the one with the ID exceptID.
+func (a *App) endSessions(username, exceptID string) {
+	if err := a.sessions.RemoveUser(username, exceptID); err != nil {
+		slog.Error("Ending the sessions of a user failed", "user", username, "err", err)
+	}
+}
+
+// renderFormPage renders one of the templates of the password and two-factor pages with the data.
+func renderFormPage(w http.ResponseWriter, r *http.Request, name string, data interface{}) {
+	t, err := template.New(name).Funcs(csrfFuncs(r)).ParseFiles("tmpl/" + name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	buf.WriteTo(w)
+}
+
+// passwordHandler shows the change password form (GET) and changes the current user's password (POST).
+// The current password has to be given, and wrong ones count as failed logins.
+func (a *App) passwordHandler(w http.ResponseWriter, r *http.Request) {
+	username := currentUsername(r)
+	rules := a.passwordRules()
+	var message, saved string
+
+	if r.Method == http.MethodPost {
+		message = a.changePassword(r, username, rules)
+		if message == "" {
+			saved = "Password changed. You have been logged out everywhere else and your API tokens have been revoked."
+		}
+	}
+
+	renderFormPage(w, r, "password.html", struct {
+		Username     string
+		Requirements string
+		Message      string
+		Saved        string
+	}{
+		Username:     username,
+		Requirements: rules.requirements(),
+		Message:      message,
+		Saved:        saved,
+	})
+}
+
+// changePassword changes the user's password from the posted form, returning what was wrong if it could not.
+func (a *App) changePassword(r *http.Request, username string, rules PasswordConfig) string {
+	password := r.FormValue("new_password")
+
+	if message := a.checkCurrentPassword(r, username, auditPasswordChangeFailed); message != "" {
+		return message
+	}
+
+	if password != r.FormValue("confirm_password") {
+		return "The new passwords do not match."
+	}
+	if err := rules.checkPassword(username, password); err != nil {
+		return "The new " + err.Error() + "."
+	}
+
+	newHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err == nil {
+		err = a.replacePassword(username, newHash)
+	}
+	if err != nil {
+		slog.Error("Changing a password failed", "user", username, "err", err)
+		return "The password could not be changed, please try again."
+	}
+
+	a.audit(r, username, auditPasswordChanged)
+	a.endOtherSessions(r, username)
+	return ""
+}
+
+// checkCurrentPassword checks the current_password form field before a change to the account,
+// and returns what was wrong. Wrong passwords are audited as the event and count as failed logins.
+func (a *App) checkCurrentPassword(r *http.Request, username, failedEvent string) string {
+	key := accountKey(username)
+	if a.logins.retryAfter(key) > 0 {
+		a.audit(r, username, auditLoginLocked)
+		return loginLockedMessage
+	}
+
+	hash, err := a.users.PasswordHash(username)
+	if err != nil {
+		slog.Error("Loading a password failed", "user", username, "err", err)
+		return "The current password could not be checked, please try again."
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(r.FormValue("current_password"))) != nil {
+		a.audit(r, username, failedEvent)
+		a.logins.fail(key, a.logins.config.MaxFailures)
+		return "The current password is not correct."
+	}
+	return ""
+}
+
+// forgotPasswordMessage is shown after a reset link is requested, whether or not one was sent,
+// so the page does not tell which usernames exist or have an email address.
+const forgotPasswordMessage = "If the account has an email address, a link to reset its password has been sent to it."
+
+// resetThrottledMessage is shown when an account or address has asked for too many reset links.
+// Unknown usernames are throttled too, so it does not tell which exist either.
+const resetThrottledMessage = "Too many password reset requests. Please wait a while and try again."
+
+// newResetThrottle returns the throttle of password reset requests. Every request counts, and
+// after ResetMaxRequests for an account or ResetMaxRequestsPerIP from an address, it is locked
+// out for the login lockout. There is no backoff between the requests before that.
+func newResetThrottle(c *Config) *loginThrottle {
+	return newLoginThrottle(LoginConfig{
+		MaxFailures:      c.Password.ResetMaxRequests,
+		MaxFailuresPerIP: c.Password.ResetMaxRequestsPerIP,
+		Lockout:          c.Login.Lockout,
+	})
+}
+
+// forgotPasswordHandler shows the forgotten password form (GET) and emails a reset link to the
+// address of the account (POST). Requests are throttled by account and address, see newResetThrottle.
+func (a *App) forgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var message string
+
+	if r.Method == http.MethodPost {
+		username := strings.TrimSpace(r.FormValue("username"))
+		accountKey, addressKey := accountKey(username), addressKey(clientAddress(r))
+
+		if a.resets.retryAfter(accountKey, addressKey) > 0 {
+			a.audit(r, username, auditPasswordResetThrottled)
+			message = resetThrottledMessage
+		} else {
+			a.audit(r, username, auditPasswordResetRequested)
+			if a.resets.fail(accountKey, a.resets.config.MaxFailures) {
+				slog.Warn("Throttled password reset requests for a user", "user", username)
+			}
+			if a.resets.fail(addressKey, a.resets.config.MaxFailuresPerIP) {
+				slog.Warn("Throttled password reset requests from an address", "address", clientAddress(r))
+			}
+			if err := a.sendPasswordReset(username); err != nil {
+				slog.Error("Sending a password reset link failed", "user", username, "err", err)
+			}
+			message = forgotPasswordMessage
+		}
+	}
+
+	renderFormPage(w, r, "forgot_password.html", struct {
+		Message string
+	}{
+		Message: message,
+	})
+}
+
+// sendPasswordReset emails a reset link to the user, if they have an email address.
+func (a *App) sendPasswordReset(username string) error {
+	email, err := a.users.Email(username)
+	if err != nil || email == "" {
+		return err
+	}
+
+	token, err := a.createPasswordResetToken(username)
+	if err != nil {
+		return err
+	}
+
+	link := strings.TrimSuffix(a.config.Server.PublicURL, "/") + "/reset-password?token=" + token
+	return a.mailer.Send(Mail{
+		To:      email,
+		Subject: "Reset your Enterprise Notes password",
+		Body: fmt.Sprintf("Someone asked to reset the password of %s on Enterprise Notes.\n\n"+
+			"To choose a new password, open this link within %s:\n\n%s\n\n"+
+			"The link can only be used once. If you did not ask for it, you can ignore this email.\n",
+			username, a.passwordRules().ResetTokenTTL, link),
+	})
+}
+
+// resetPasswordHandler shows the form for a new password to a reset link (GET) and sets it (POST).
+func (a *App) resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	rules := a.passwordRules()
+	token := r.FormValue("token")
+
+	username, err := a.passwordResetUser(token)
+	if err != nil && err != errResetTokenInvalid {
+		checkInternalServerError(err, w)
+		return
+	}
+
+	var message string
+	if err == nil && r.Method == http.MethodPost {
+		message = a.resetPasswordFromForm(w, r, token, username, rules)
+		if message == "" {
+			return
+		}
+	}
+
+	renderFormPage(w, r, "reset_password.html", struct {
+		Token        string
+		Valid        bool
+		Requirements string
+		Message      string
+	}{
+		Token:        token,
+		Valid:        err == nil,
+		Requirements: rules.requirements(),
+		Message:      message,
+	})
+}
+
+// resetPasswordFromForm sets the password posted with a reset token and sends the user to the login
+// page, or returns what was wrong with it.
+func (a *App) resetPasswordFromForm(w http.ResponseWriter, r *http.Request, token, username string, rules PasswordConfig) string {
+	password := r.FormValue("new_password")
+	if password != r.FormValue("confirm_password") {
+		return "The new passwords do not match."
+	}
+	if err := rules.checkPassword(username, password); err != nil {
+		return "The new " + err.Error() + "."
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err == nil {
+		username, err = a.resetPassword(token, hash)
+	}
+	if err == errResetTokenInvalid {
+		return "This reset link has already been used."
+	}
+	if err != nil {
+		slog.Error("Resetting a password failed", "user", username, "err", err)
+		return "The password could not be reset, please try again."
+	}
+
+	a.audit(r, username, auditPasswordReset)
+	// Whoever asked for the link has shown they own the account
+	a.logins.succeed(accountKey(username))
+
+	http.SetCookie(w, &http.Cookie{
+		Name:  "message",
+		Value: "Your password has been reset. Please log in.",
+		Path:  "/",
+	})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+	return ""
+}
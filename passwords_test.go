@@ -0,0 +1,308 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// recordingMailer keeps the emails it is asked to send.
+type recordingMailer struct {
+	sent []Mail
+}
+
+func (m *recordingMailer) Send(mail Mail) error {
+	m.sent = append(m.sent, mail)
+	return nil
+}
+
+// resetLinkToken matches the token of the reset link in an email.
+var resetLinkToken = regexp.MustCompile(`/reset-password\?token=([A-Za-z0-9_-]+)`)
+
+// postPublicForm posts a form through the router without a session, as from the login page.
+func postPublicForm(a *App, target string, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", target, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	return rr
+}
+
+// setTestPassword gives the user a real bcrypt hash of the password.
+func setTestPassword(t *testing.T, a *App, username, password string) {
+	t.Helper()
+	hash, _ := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err := a.users.SetPasswordHash(username, hash); err != nil {
+		t.Fatalf("Setting the password of %s: %v", username, err)
+	}
+}
+
+// hasPassword reports whether the user's password is now the given one.
+func hasPassword(a *App, username, password string) bool {
+	hash, err := a.users.PasswordHash(username)
+	return err == nil && bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
+
+func TestCheckPassword(t *testing.T) {
+	rules := PasswordConfig{MinLength: 8, RequireUpper: true, RequireDigit: true}
+
+	tests := map[string]struct {
+		password string
+		valid    bool
+	}{
+		"empty":             {"", false},
+		"too short":         {"Abc1", false},
+		"no upper case":     {"abcdefg1", false},
+		"no digit":          {"Abcdefgh", false},
+		"same as username":  {"Alice1234", false},
+		"too long for hash": {"A1" + strings.Repeat("x", 71), false},
+		"strong enough":     {"Abcdefg1", true},
+		"counts characters": {"Äbcdéfg1", true},
+	}
+
+	for name, test := range tests {
+		err := rules.checkPassword("alice1234", test.password)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: %q got %v", name, test.password, err)
+		}
+	}
+}
+
+func TestValidateEmail(t *testing.T) {
+	for email, valid := range map[string]bool{
+		"":                            true,
+		"alice@example.com":           true,
+		"not an address":              false,
+		"Alice <alice@example.com>":   false,
+		"alice@example.com\r\nBcc: x": false,
+	} {
+		if err := validateEmail(email); (err == nil) != valid {
+			t.Errorf("%q: got %v", email, err)
+		}
+	}
+}
+
+func TestRegisterHandler_RejectsWeakPassword(t *testing.T) {
+	a := newMemoryTestApp(t)
+
+	rr := postPublicForm(a, "/register", url.Values{"username": {"bob"}, "password": {"short"}})
+
+	if rr.Code != http.StatusSeeOther {
+		t.Fatalf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusSeeOther)
+	}
+	if cookie := rr.Result().Cookies(); len(cookie) != 1 || !strings.Contains(cookie[0].Value, "password needs at least 8 characters") {
+		t.Errorf("Expected a message about the password rules, got %v", cookie)
+	}
+	if _, err := a.users.PasswordHash("bob"); err != sql.ErrNoRows {
+		t.Errorf("Expected bob not to be registered, got %v", err)
+	}
+}
+
+func TestPasswordHandler_ChecksCurrentPassword(t *testing.T) {
+	a := newMemoryTestApp(t, "alice")
+	// Wrong passwords count as failed logins, without a backoff here
+	a.logins = newLoginThrottle(LoginConfig{MaxFailures: 5, MaxFailuresPerIP: 20, Lockout: time.Minute})
+	setTestPassword(t, a, "alice", "old password")
+
+	form := url.Values{"current_password": {"wrong"}, "new_password": {"new password"}, "confirm_password": {"new password"}}
+	rr := postForm(a, "/password", form, "alice", true)
+	if !strings.Contains(rr.Body.String(), "The current password is not correct.") || !hasPassword(a, "alice", "old password") {
+		t.Errorf("Expected the password to stay the same, got %v: %s", rr.Code, rr.Body.String())
+	}
+
+	form.Set("current_password", "old password")
+	rr = postForm(a, "/password", form, "alice", true)
+	if !strings.Contains(rr.Body.String(), "Password changed.") || !hasPassword(a, "alice", "new password") {
+		t.Errorf("Expected the password to be changed, got %v: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestPasswordHandler_RevokesOtherSessionsAndTokens_SQLite(t *testing.T) {
+	a := newSQLiteTestApp(t, "alice")
+	a.logins = newLoginThrottle(LoginConfig{MaxFailures: 5, MaxFailuresPerIP: 20, Lockout: time.Minute})
+	setTestPassword(t, a, "alice", "old password")
+	token, err := a.createAPIToken("alice", "script", []string{"notes:read"}, sql.NullTime{})
+	if err != nil {
+		t.Fatalf("Creating an API token: %v", err)
+	}
+
+	current, other := newTestBrowser(a), newTestBrowser(a)
+	for _, b := range []*testBrowser{current, other} {
+		if location := b.login("alice", "old password"); location != "/list" {
+			t.Fatalf("Expected to be logged in, got a redirect to %q", location)
+		}
+	}
+
+	rr := current.do("/password", url.Values{"current_password": {"old password"}, "new_password": {"new password"}, "confirm_password": {"new password"}})
+	if !strings.Contains(rr.Body.String(), "Password changed.") {
+		t.Fatalf("Expected the password to be changed, got %v: %s", rr.Code, rr.Body.String())
+	}
+
+	if rr := current.do("/list", nil); rr.Code != http.StatusOK {
+		t.Errorf("Expected the session that changed the password to stay logged in, got %v", rr.Code)
+	}
+	if rr := other.do("/list", nil); rr.Header().Get("Location") != "/login" {
+		t.Errorf("Expected the other session to be logged out, got %v %q", rr.Code, rr.Header().Get("Location"))
+	}
+	if _, err := a.lookupAPIToken(token); err != sql.ErrNoRows {
+		t.Errorf("Expected the API token to be revoked, got %v", err)
+	}
+}
+
+func TestSettingsHandler_EmailNeedsCurrentPassword(t *testing.T) {
+	a := newMemoryTestApp(t, "alice")
+	a.logins = newLoginThrottle(LoginConfig{MaxFailures: 5, MaxFailuresPerIP: 20, Lockout: time.Minute})
+	setTestPassword(t, a, "alice", "secret")
+
+	form := url.Values{"email": {"alice@example.com"}, "current_password": {"wrong"}}
+	rr := postForm(a, "/settings", form, "alice", true)
+	if email, _ := a.users.Email("alice"); email != "" || !strings.Contains(rr.Body.String(), "The current password is not correct.") {
+		t.Errorf("Expected the email address not to change, got %q: %s", email, rr.Body.String())
+	}
+
+	form.Set("current_password", "secret")
+	rr = postForm(a, "/settings", form, "alice", true)
+	if email, _ := a.users.Email("alice"); email != "alice@example.com" {
+		t.Errorf("Expected the email address to be saved, got %q: %s", email, rr.Body.String())
+	}
+}
+
+func TestAccountHandlers_RejectTokenAuth(t *testing.T) {
+	a := newMemoryTestApp(t, "alice")
+	setTestPassword(t, a, "alice", "secret")
+
+	form := url.Values{
+		"email":            {"mallory@example.com"},
+		"current_password": {"secret"},
+		"new_password":     {"Mallory1234"},
+		"confirm_password": {"Mallory1234"},
+	}
+	// API tokens only log in to /api/v1, so the account pages never see one
+	for _, target := range []string{"/settings", "/password"} {
+		req := httptest.NewRequest("POST", target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer nt_valid")
+
+		rr := httptest.NewRecorder()
+		a.Router.ServeHTTP(rr, req)
+		if rr.Code == http.StatusOK {
+			t.Errorf("POST %s: expected an API token to be refused, got %v", target, rr.Code)
+		}
+	}
+
+	if email, _ := a.users.Email("alice"); email != "" || !hasPassword(a, "alice", "secret") {
+		t.Errorf("Expected the account not to change, got email %q", email)
+	}
+}
+
+func TestPasswordReset_SQLite(t *testing.T) {
+	a := newSQLiteTestApp(t, "alice")
+	a.logins = newLoginThrottle(a.config.Login)
+	a.resets = newResetThrottle(a.config)
+	mailer := &recordingMailer{}
+	a.mailer = mailer
+	setTestPassword(t, a, "alice", "old password")
+	if err := a.users.SetEmail("alice", "alice@example.com"); err != nil {
+		t.Fatalf("Setting the email address: %v", err)
+	}
+	apiToken, err := a.createAPIToken("alice", "script", []string{"notes:read"}, sql.NullTime{})
+	if err != nil {
+		t.Fatalf("Creating an API token: %v", err)
+	}
+	browser := newTestBrowser(a)
+	if location := browser.login("alice", "old password"); location != "/list" {
+		t.Fatalf("Expected to be logged in, got a redirect to %q", location)
+	}
+
+	// Unknown users get the same answer, and no email
+	for _, username := range []string{"nobody", "alice"} {
+		rr := postPublicForm(a, "/forgot-password", url.Values{"username": {username}})
+		if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), forgotPasswordMessage) {
+			t.Errorf("%s: expected the same message, got %v: %s", username, rr.Code, rr.Body.String())
+		}
+	}
+	if len(mailer.sent) != 1 || mailer.sent[0].To != "alice@example.com" {
+		t.Fatalf("Expected one email to alice, got %v", mailer.sent)
+	}
+	match := resetLinkToken.FindStringSubmatch(mailer.sent[0].Body)
+	if match == nil || !strings.Contains(mailer.sent[0].Body, a.config.Server.PublicURL+match[0]) {
+		t.Fatalf("Expected a reset link to the public URL, got %q", mailer.sent[0].Body)
+	}
+	token := match[1]
+
+	// The password rules apply, and the link can be used again after a mistake
+	rr := postPublicForm(a, "/reset-password", url.Values{"token": {token}, "new_password": {"short"}, "confirm_password": {"short"}})
+	if !strings.Contains(rr.Body.String(), "password needs at least 8 characters") {
+		t.Errorf("Expected a message about the password rules, got %s", rr.Body.String())
+	}
+
+	rr = postPublicForm(a, "/reset-password", url.Values{"token": {token}, "new_password": {"new password"}, "confirm_password": {"new password"}})
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/login" {
+		t.Fatalf("Expected a redirect to the login page, got %v: %s", rr.Code, rr.Body.String())
+	}
+	if !hasPassword(a, "alice", "new password") {
+		t.Error("Expected the password to be reset")
+	}
+	if rr := browser.do("/list", nil); rr.Header().Get("Location") != "/login" {
+		t.Errorf("Expected the session to be logged out, got %v %q", rr.Code, rr.Header().Get("Location"))
+	}
+	if _, err := a.lookupAPIToken(apiToken); err != sql.ErrNoRows {
+		t.Errorf("Expected the API token to be revoked, got %v", err)
+	}
+
+	// The link only works once
+	rr = postPublicForm(a, "/reset-password", url.Values{"token": {token}, "new_password": {"other password"}, "confirm_password": {"other password"}})
+	if !strings.Contains(rr.Body.String(), "invalid or has expired") || !hasPassword(a, "alice", "new password") {
+		t.Errorf("Expected the used link to be refused, got %v: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestForgotPassword_Throttled(t *testing.T) {
+	a := newMemoryTestApp(t, "alice", "bob")
+	cfg := defaultConfig()
+	cfg.Password.ResetMaxRequests = 2
+	cfg.Password.ResetMaxRequestsPerIP = 3
+	a.config = &cfg
+	a.resets = newResetThrottle(a.config)
+
+	request := func(username, address string) string {
+		req := httptest.NewRequest("POST", "/forgot-password", strings.NewReader(url.Values{"username": {username}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = address + ":1234"
+		rr := httptest.NewRecorder()
+		a.Router.ServeHTTP(rr, req)
+		return rr.Body.String()
+	}
+
+	// An account can ask for ResetMaxRequests links, whatever address they come from
+	for i, address := range []string{"192.0.2.1", "192.0.2.2"} {
+		if body := request("alice", address); !strings.Contains(body, forgotPasswordMessage) {
+			t.Fatalf("Request %d: expected a link to be sent, got %s", i+1, body)
+		}
+	}
+	if body := request("alice", "192.0.2.3"); !strings.Contains(body, resetThrottledMessage) {
+		t.Errorf("Expected the account to be throttled, got %s", body)
+	}
+
+	// An address can ask for ResetMaxRequestsPerIP links, whatever accounts they are for,
+	// including ones that do not exist
+	for i, username := range []string{"bob", "nobody"} {
+		if body := request(username, "192.0.2.2"); !strings.Contains(body, forgotPasswordMessage) {
+			t.Fatalf("Request %d: expected a link to be sent, got %s", i+1, body)
+		}
+	}
+	if body := request("carol", "192.0.2.2"); !strings.Contains(body, resetThrottledMessage) {
+		t.Errorf("Expected the address to be throttled, got %s", body)
+	}
+	if body := request("bob", "192.0.2.4"); !strings.Contains(body, forgotPasswordMessage) {
+		t.Errorf("Expected another address to ask for bob's link, got %s", body)
+	}
+}
@@ -0,0 +1,306 @@
+// Package main contains the main entry point for the Go application
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// NoteRevision is a snapshot of a note after one of its changes.
+// Revisions are numbered from 1 for each note.
+type NoteRevision struct {
+	NoteID         int
+	Revision       int
+	EditedBy       sql.NullString
+	EditedAt       time.Time
+	Title          string
+	NoteType       string
+	Description    string
+	DueAt          sql.NullTime
+	NoteStatus     sql.NullString
+	NoteDelegation sql.NullString
+}
+
+// FieldChange is a single field that differs between two revisions.
+type FieldChange struct {
+	Field string `json:"field"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+}
+
+// MarshalJSON writes the revision with nullable columns as plain strings (or null).
+func (nr NoteRevision) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		NoteID         int        `json:"note_id"`
+		Revision       int        `json:"revision"`
+		EditedBy       *string    `json:"edited_by"`
+		EditedAt       time.Time  `json:"edited_at"`
+		Title          string     `json:"title"`
+		NoteType       string     `json:"note_type"`
+		Description    string     `json:"description"`
+		DueAt          *time.Time `json:"due_at"`
+		NoteStatus     *string    `json:"note_status"`
+		NoteDelegation *string    `json:"note_delegation"`
+	}{
+		NoteID:         nr.NoteID,
+		Revision:       nr.Revision,
+		EditedBy:       nullStringPtr(nr.EditedBy),
+		EditedAt:       nr.EditedAt,
+		Title:          nr.Title,
+		NoteType:       nr.NoteType,
+		Description:    nr.Description,
+		DueAt:          nullTimePtr(nr.DueAt),
+		NoteStatus:     nullStringPtr(nr.NoteStatus),
+		NoteDelegation: nullStringPtr(nr.NoteDelegation),
+	})
+}
+
+// recordNoteRevision stores the note's current state as its next revision.
+// It must run in the same transaction as the update, whose row lock keeps revision numbers unique.
+func recordNoteRevision(tx *sql.Tx, noteID int, editedBy string) error {
+	var editor sql.NullString
+	if editedBy != "" && editedBy != "[guest]" {
+		editor = sql.NullString{String: editedBy, Valid: true}
+	}
+
+	_, err := tx.Exec(`
+		INSERT INTO note_revisions (note_id, revision, edited_by, title, noteType, description,
+			due_at, noteStatus, noteDelegation)
+		SELECT n.id, COALESCE((SELECT MAX(r.revision) FROM note_revisions r WHERE r.note_id = n.id), 0) + 1, $2,
+			n.title, n.noteType, n.description, n.due_at, n.noteStatus, n.noteDelegation
+		FROM notes n
+		WHERE n.id = $1
+	`, noteID, editor)
+	return err
+}
+
+const noteRevisionColumns = `note_id, revision, edited_by, edited_at, title, noteType, description,
+	due_at, noteStatus, noteDelegation`
+
+// scanNoteRevision reads a row selected with noteRevisionColumns.
+func scanNoteRevision(row interface{ Scan(...interface{}) error }) (NoteRevision, error) {
+	var nr NoteRevision
+	err := row.Scan(&nr.NoteID, &nr.Revision, &nr.EditedBy, &nr.EditedAt, &nr.Title, &nr.NoteType, &nr.Description,
+		&nr.DueAt, &nr.NoteStatus, &nr.NoteDelegation)
+	return nr, err
+}
+
+// listNoteRevisions returns every revision of a note, newest first.
+func (a *App) listNoteRevisions(noteID int) ([]NoteRevision, error) {
+	rows, err := a.db.Query("SELECT "+noteRevisionColumns+" FROM note_revisions WHERE note_id = $1 ORDER BY revision DESC", noteID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := []NoteRevision{}
+	for rows.Next() {
+		nr, err := scanNoteRevision(rows)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, nr)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return revisions, nil
+}
+
+// getNoteRevision returns one revision of a note, or sql.ErrNoRows if it does not exist.
+func (a *App) getNoteRevision(noteID, revision int) (*NoteRevision, error) {
+	row := a.db.QueryRow("SELECT "+noteRevisionColumns+" FROM note_revisions WHERE note_id = $1 AND revision = $2", noteID, revision)
+	nr, err := scanNoteRevision(row)
+	if err != nil {
+		return nil, err
+	}
+	return &nr, nil
+}
+
+// diffNoteRevisions lists the fields that changed going from one revision to another.
+func diffNoteRevisions(from, to NoteRevision) []FieldChange {
+	fields := []struct {
+		name     string
+		from, to string
+	}{
+		{"title", from.Title, to.Title},
+		{"note_type", from.NoteType, to.NoteType},
+		{"description", from.Description, to.Description},
+		{"due_at", formatDueAt(from.DueAt), formatDueAt(to.DueAt)},
+		{"note_status", from.NoteStatus.String, to.NoteStatus.String},
+		{"note_delegation", from.NoteDelegation.String, to.NoteDelegation.String},
+	}
+
+	changes := []FieldChange{}
+	for _, f := range fields {
+		if f.from != f.to {
+			changes = append(changes, FieldChange{Field: f.name, From: f.from, To: f.to})
+		}
+	}
+	return changes
+}
+
+// restoreNoteRevision writes a previous revision back to the note as a new update.
+// As with other edits, a delegate only gets the title and description back.
+func (a *App) restoreNoteRevision(noteID, revision int, username string, role NoteRole) error {
+	nr, err := a.getNoteRevision(noteID, revision)
+	if err != nil {
+		return err
+	}
+
+	note := Note{
+		ID:             noteID,
+		Title:          nr.Title,
+		NoteType:       nr.NoteType,
+		Description:    nr.Description,
+		DueAt:          nr.DueAt,
+		NoteStatus:     nr.NoteStatus,
+		NoteDelegation: nr.NoteDelegation,
+	}
+
+	// Tags are not part of the history, so the note keeps its current tags
+	existing, err := a.notes.GetNote(noteID)
+	if err != nil {
+		return err
+	}
+	note.Tags = existing.Tags
+
+	if role == RoleDelegate {
+		applyDelegateRestrictions(&note, existing)
+	}
+
+	return a.notes.UpdateNote(note, username)
+}
+
+// historyHandler shows the revisions of a note. With from and to query parameters it
+// also shows the fields that changed between those two revisions.
+func (a *App) historyHandler(w http.ResponseWriter, r *http.Request) {
+	noteID, err := strconv.Atoi(mux.Vars(r)["noteID"])
+	if err != nil {
+		http.Error(w, "Invalid note ID", http.StatusBadRequest)
+		return
+	}
+
+	username := currentUsername(r)
+	role, err := a.notes.NoteRole(noteID, username)
+	if err != nil {
+		checkInternalServerError(err, w)
+		return
+	}
+	if !role.can(ActionView) {
+		http.Error(w, "Forbidden: you do not have permission to view this note", http.StatusForbidden)
+		return
+	}
+
+	revisions, err := a.listNoteRevisions(noteID)
+	if err != nil {
+		checkInternalServerError(err, w)
+		return
+	}
+
+	// Due times are shown in the viewer's time zone
+	loc, err := a.userLocation(username)
+	if err != nil {
+		checkInternalServerError(err, w)
+		return
+	}
+
+	// Compare the two requested revisions, if any
+	var from, to *NoteRevision
+	var changes []FieldChange
+	fromRev, fromErr := strconv.Atoi(r.URL.Query().Get("from"))
+	toRev, toErr := strconv.Atoi(r.URL.Query().Get("to"))
+	if fromErr == nil && toErr == nil {
+		for i := range revisions {
+			if revisions[i].Revision == fromRev {
+				from = &revisions[i]
+			}
+			if revisions[i].Revision == toRev {
+				to = &revisions[i]
+			}
+		}
+		if from == nil || to == nil {
+			http.Error(w, "Revision not found", http.StatusNotFound)
+			return
+		}
+		changes = diffNoteRevisions(*from, *to)
+	}
+
+	data := struct {
+		Username   string
+		NoteID     int
+		Revisions  []NoteRevision
+		From       *NoteRevision
+		To         *NoteRevision
+		Changes    []FieldChange
+		CanRestore bool
+	}{
+		Username:   username,
+		NoteID:     noteID,
+		Revisions:  revisions,
+		From:       from,
+		To:         to,
+		Changes:    changes,
+		CanRestore: role.can(ActionEdit),
+	}
+
+	t, err := template.New("history.html").Funcs(dueFuncs(loc)).Funcs(csrfFuncs(r)).ParseFiles("tmpl/history.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	buf.WriteTo(w)
+}
+
+// restoreRevisionHandler restores a previous revision of a note and returns to its history.
+func (a *App) restoreRevisionHandler(w http.ResponseWriter, r *http.Request) {
+	noteID, err := strconv.Atoi(mux.Vars(r)["noteID"])
+	if err != nil {
+		http.Error(w, "Invalid note ID", http.StatusBadRequest)
+		return
+	}
+	revision, err := strconv.Atoi(r.FormValue("revision"))
+	if err != nil {
+		http.Error(w, "Invalid revision", http.StatusBadRequest)
+		return
+	}
+
+	username := currentUsername(r)
+	role, err := a.notes.NoteRole(noteID, username)
+	if err != nil {
+		checkInternalServerError(err, w)
+		return
+	}
+	if !role.can(ActionEdit) {
+		http.Error(w, "Forbidden: you do not have permission to edit this note", http.StatusForbidden)
+		return
+	}
+
+	err = a.restoreNoteRevision(noteID, revision, username, role)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Revision not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		checkInternalServerError(err, w)
+		return
+	}
+
+	http.Redirect(w, r, "/history/"+strconv.Itoa(noteID), http.StatusSeeOther)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+)
+
+var noteRevisionRowColumns = []string{"note_id", "revision", "edited_by", "edited_at", "title", "noteType", "description",
+	"due_at", "noteStatus", "noteDelegation"}
+
+func TestDiffNoteRevisions(t *testing.T) {
+	from := NoteRevision{Revision: 1, Title: "Old", NoteType: "Task", Description: "Same",
+		NoteStatus: sql.NullString{String: "None", Valid: true}}
+	to := NoteRevision{Revision: 2, Title: "New", NoteType: "Task", Description: "Same",
+		NoteStatus: sql.NullString{String: "Completed", Valid: true}}
+
+	changes := diffNoteRevisions(from, to)
+
+	want := []FieldChange{
+		{Field: "title", From: "Old", To: "New"},
+		{Field: "note_status", From: "None", To: "Completed"},
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("Expected %d changes, got %v", len(want), changes)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Errorf("Change %d: got %+v, want %+v", i, changes[i], want[i])
+		}
+	}
+
+	if changes := diffNoteRevisions(from, from); len(changes) != 0 {
+		t.Errorf("Expected no changes between identical revisions, got %v", changes)
+	}
+}
+
+func TestUpdateNoteInDatabase_RecordsRevision(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error occurred while opening a stub database connection: %v", err)
+	}
+	defer db.Close()
+
+	a := newSQLTestApp(db)
+	mock.ExpectBegin()
+	mock.ExpectPrepare("UPDATE notes SET title").ExpectExec().WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM note_tags").WithArgs(3).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("UPDATE notes SET tags_text").WithArgs(3, "").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO note_revisions").WithArgs(3, "alice").WillReturnError(sql.ErrConnDone)
+	mock.ExpectRollback()
+
+	// A failed revision insert rolls back the whole update
+	if err := a.notes.UpdateNote(Note{ID: 3, Title: "t", NoteType: "Note", Description: "d"}, "alice"); err == nil {
+		t.Errorf("Expected an error, but got none")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestHistoryHandler_ShowsDiff(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error occurred while opening a stub database connection: %v", err)
+	}
+	defer db.Close()
+
+	a := newSQLTestApp(db)
+	edited := time.Date(2024, 10, 1, 9, 0, 0, 0, time.UTC)
+	expectNoteRole(mock, 4, "bob", "alice", nil, "viewer")
+	mock.ExpectQuery("SELECT note_id, revision, edited_by").WithArgs(4).
+		WillReturnRows(sqlmock.NewRows(noteRevisionRowColumns).
+			AddRow(4, 2, "alice", edited, "Buy oat milk", "Note", "Shopping", nil, "None", "").
+			AddRow(4, 1, "alice", edited, "Buy milk", "Note", "Shopping", nil, "None", ""))
+	expectUserTimezone(mock, "bob", nil)
+
+	req := httptest.NewRequest("GET", "/history/4?from=1&to=2", nil)
+	req = mux.SetURLVars(withSession(req, "bob"), map[string]string{"noteID": "4"})
+	rr := httptest.NewRecorder()
+	a.historyHandler(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v, want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	body := rr.Body.String()
+	if !strings.Contains(body, "Buy oat milk") || !strings.Contains(body, "Changes from revision 1 to revision 2") {
+		t.Errorf("Expected the diff in the page")
+	}
+	// Viewers cannot restore
+	if strings.Contains(body, "/restore") {
+		t.Errorf("Expected no restore buttons for a viewer")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRestoreRevisionHandler_ForbiddenForViewer(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error occurred while opening a stub database connection: %v", err)
+	}
+	defer db.Close()
+
+	a := newSQLTestApp(db)
+	expectNoteRole(mock, 4, "bob", "alice", nil, "viewer")
+
+	form := url.Values{"revision": {"1"}}
+	req := httptest.NewRequest("POST", "/history/4/restore", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req = mux.SetURLVars(withSession(req, "bob"), map[string]string{"noteID": "4"})
+	rr := httptest.NewRecorder()
+	a.restoreRevisionHandler(rr, req)
+
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusForbidden)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPI_ListRevisions(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	edited := time.Date(2024, 10, 1, 9, 0, 0, 0, time.UTC)
+	expectNoteRole(mock, 4, "alice", "alice", nil, nil)
+	mock.ExpectQuery("SELECT note_id, revision, edited_by").WithArgs(4).
+		WillReturnRows(sqlmock.NewRows(noteRevisionRowColumns).
+			AddRow(4, 2, "bob", edited, "New", "Note", "Shopping", nil, "None", nil).
+			AddRow(4, 1, nil, edited, "Old", "Note", "Shopping", nil, "None", nil))
+
+	rr := serveAPI(a, "GET", "/api/v1/notes/4/revisions", "", "alice")
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v, want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+
+	var got struct {
+		Revisions []map[string]interface{} `json:"revisions"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Response is not valid JSON: %v", err)
+	}
+	if len(got.Revisions) != 2 || got.Revisions[0]["edited_by"] != "bob" || got.Revisions[1]["edited_by"] != nil {
+		t.Errorf("Unexpected revisions: %v", got.Revisions)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPI_DiffRevisions_NotFound(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	expectNoteRole(mock, 4, "alice", "alice", nil, nil)
+	mock.ExpectQuery("SELECT note_id, revision, edited_by").WithArgs(4, 9).
+		WillReturnRows(sqlmock.NewRows(noteRevisionRowColumns))
+
+	rr := serveAPI(a, "GET", "/api/v1/notes/4/revisions/diff?from=9&to=1", "", "alice")
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusNotFound)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPI_RestoreRevision_DelegateOnlyRestoresText(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	edited := time.Date(2024, 10, 1, 9, 0, 0, 0, time.UTC)
+	expectNoteRole(mock, 4, "bob", "alice", "bob", nil)
+	mock.ExpectQuery("SELECT note_id, revision, edited_by").WithArgs(4, 1).
+		WillReturnRows(sqlmock.NewRows(noteRevisionRowColumns).
+			AddRow(4, 1, "alice", edited, "Original", "Note", "Original text", nil, "None", ""))
+	expectNoteByID(mock, 4, "Current", "Task", "Delegated", "bob", "alice")
+	mock.ExpectBegin()
+	expectDelegateExists(mock, "bob", true)
+	// The title and description come from revision 1, the task fields stay as they are now
+	mock.ExpectPrepare("UPDATE notes SET title").ExpectExec().
+		WithArgs("Original", "Task", "Original text", testDueAt, "Delegated", "bob", 4).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM note_tags").WithArgs(4).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("UPDATE notes SET tags_text").WithArgs(4, "").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO note_revisions").WithArgs(4, "bob").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	expectNoteByID(mock, 4, "Original", "Task", "Delegated", "bob", "alice")
+
+	rr := serveAPI(a, "POST", "/api/v1/notes/4/revisions/1/restore", "", "bob")
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("Handler returned wrong status code: got %v, want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
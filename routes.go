@@ -17,23 +17,80 @@ func (a *App) initializeRoutes() {
 	a.Router.PathPrefix("/statics/").Handler(staticFileHandler).Methods("GET")
 	a.Router.HandleFunc("/", a.indexHandler).Methods("GET")
 	a.Router.HandleFunc("/login", a.loginHandler).Methods("POST", "GET")
-	a.Router.HandleFunc("/user-logout", a.logoutHandler).Methods("GET")
+	a.Router.HandleFunc("/login/mfa", a.mfaLoginHandler).Methods("POST", "GET")
 	a.Router.HandleFunc("/register", a.registerHandler).Methods("POST", "GET")
-	a.Router.HandleFunc("/list", a.listHandler).Methods("GET")
-	a.Router.HandleFunc("/create", a.createHandler).Methods("POST", "GET")
-	a.Router.HandleFunc("/update", a.updateHandler).Methods("POST", "GET")
-	a.Router.HandleFunc("/delete", a.deleteHandler).Methods("POST", "GET")
-	a.Router.HandleFunc("/share", a.shareHandler).Methods("POST", "GET")
-	a.Router.HandleFunc("/search", a.searchNotesHandler).Methods("POST", "GET")
-	a.Router.HandleFunc("/remove-shared-note", a.removeSharedNoteHandler).Methods("POST")
-	a.Router.HandleFunc("/getSharedUsersForNote/{noteID:[0-9]+}", a.getSharedUsersForNoteHandler).Methods("GET")
-	a.Router.HandleFunc("/getUnsharedUsersForNote/{noteID:[0-9]+}", a.getUnsharedUsersForNoteHandler).Methods("GET")
-	a.Router.HandleFunc("/find/{noteID:[0-9]+}", a.findInNoteHandler).Methods("GET")
-	a.Router.HandleFunc("/update-privileges", a.updatePrivilegesHandler).Methods("POST")
-	a.Router.HandleFunc("/remove-delegation/{noteID:[0-9]+}", a.removeDelegationHandler).Methods("POST")
-	
+	a.Router.HandleFunc("/forgot-password", a.forgotPasswordHandler).Methods("POST", "GET")
+	a.Router.HandleFunc("/reset-password", a.resetPasswordHandler).Methods("POST", "GET")
 
+	// requests that change something on behalf of a session cookie need its CSRF token
+	a.Router.Use(a.csrfMiddleware)
 
+	// versioned JSON API, the only routes personal access tokens sent as "Authorization: Bearer" log in to
+	api := a.Router.PathPrefix("/api/v1").Subrouter()
+	api.Use(a.tokenAuthMiddleware, a.requireAuth)
+	api.HandleFunc("/notes", a.apiListNotesHandler).Methods("GET")
+	api.HandleFunc("/notes", a.apiCreateNoteHandler).Methods("POST")
+	api.HandleFunc("/notes/{id:[0-9]+}", a.apiGetNoteHandler).Methods("GET")
+	api.HandleFunc("/notes/{id:[0-9]+}", a.apiUpdateNoteHandler).Methods("PUT", "PATCH")
+	api.HandleFunc("/notes/{id:[0-9]+}", a.apiDeleteNoteHandler).Methods("DELETE")
+	api.HandleFunc("/notes/{id:[0-9]+}/shares", a.apiListSharesHandler).Methods("GET")
+	api.HandleFunc("/notes/{id:[0-9]+}/shares", a.apiCreateShareHandler).Methods("POST")
+	api.HandleFunc("/notes/{id:[0-9]+}/shares/{username}", a.apiUpdateShareHandler).Methods("PUT")
+	api.HandleFunc("/notes/{id:[0-9]+}/shares/{username}", a.apiDeleteShareHandler).Methods("DELETE")
+	api.HandleFunc("/notes/{id:[0-9]+}/delegation", a.apiGetDelegationHandler).Methods("GET")
+	api.HandleFunc("/notes/{id:[0-9]+}/delegation", a.apiSetDelegationHandler).Methods("PUT")
+	api.HandleFunc("/notes/{id:[0-9]+}/delegation", a.apiRemoveDelegationHandler).Methods("DELETE")
+	api.HandleFunc("/notes/{id:[0-9]+}/revisions", a.apiListRevisionsHandler).Methods("GET")
+	api.HandleFunc("/notes/{id:[0-9]+}/revisions/diff", a.apiDiffRevisionsHandler).Methods("GET")
+	api.HandleFunc("/notes/{id:[0-9]+}/revisions/{revision:[0-9]+}", a.apiGetRevisionHandler).Methods("GET")
+	api.HandleFunc("/notes/{id:[0-9]+}/revisions/{revision:[0-9]+}/restore", a.apiRestoreRevisionHandler).Methods("POST")
+	api.HandleFunc("/search", a.apiSearchNotesHandler).Methods("GET")
+	api.HandleFunc("/search/autocomplete", a.apiAutocompleteSearchHandler).Methods("GET")
+	api.HandleFunc("/saved-searches", a.apiListSavedSearchesHandler).Methods("GET")
+	api.HandleFunc("/saved-searches", a.apiCreateSavedSearchHandler).Methods("POST")
+	api.HandleFunc("/saved-searches/{id:[0-9]+}", a.apiGetSavedSearchHandler).Methods("GET")
+	api.HandleFunc("/saved-searches/{id:[0-9]+}", a.apiDeleteSavedSearchHandler).Methods("DELETE")
+	api.HandleFunc("/saved-searches/{id:[0-9]+}/shares", a.apiShareSavedSearchHandler).Methods("POST")
+	api.HandleFunc("/saved-searches/{id:[0-9]+}/shares/{username}", a.apiUnshareSavedSearchHandler).Methods("DELETE")
+	api.HandleFunc("/tags", a.apiListTagsHandler).Methods("GET")
+	api.HandleFunc("/tags/autocomplete", a.apiAutocompleteTagsHandler).Methods("GET")
+	api.HandleFunc("/trash", a.apiListTrashHandler).Methods("GET")
+	api.HandleFunc("/trash/{id:[0-9]+}/restore", a.apiRestoreFromTrashHandler).Methods("POST")
+	api.HandleFunc("/trash/{id:[0-9]+}", a.apiPurgeFromTrashHandler).Methods("DELETE")
+	api.HandleFunc("/me", a.apiGetMeHandler).Methods("GET")
+	api.HandleFunc("/me", a.apiUpdateMeHandler).Methods("PATCH")
+
+	// the other pages need a logged in user, see requireAuth
+	pages := a.Router.NewRoute().Subrouter()
+	pages.Use(a.requireAuth)
+	pages.HandleFunc("/user-logout", a.logoutHandler).Methods("GET")
+	pages.HandleFunc("/list", a.listHandler).Methods("GET")
+	pages.HandleFunc("/create", a.createHandler).Methods("POST")
+	pages.HandleFunc("/update", a.updateHandler).Methods("POST")
+	pages.HandleFunc("/delete", a.deleteHandler).Methods("POST")
+	pages.HandleFunc("/share", a.shareHandler).Methods("POST")
+	pages.HandleFunc("/search", a.searchNotesHandler).Methods("POST", "GET")
+	pages.HandleFunc("/saved-searches", a.savedSearchesHandler).Methods("GET")
+	pages.HandleFunc("/saved-searches", a.saveSearchHandler).Methods("POST")
+	pages.HandleFunc("/saved-searches/delete", a.deleteSavedSearchHandler).Methods("POST")
+	pages.HandleFunc("/saved-searches/share", a.shareSavedSearchHandler).Methods("POST")
+	pages.HandleFunc("/saved-searches/unshare", a.unshareSavedSearchHandler).Methods("POST")
+	pages.HandleFunc("/remove-shared-note", a.removeSharedNoteHandler).Methods("POST")
+	pages.HandleFunc("/getSharedUsersForNote/{noteID:[0-9]+}", a.getSharedUsersForNoteHandler).Methods("GET")
+	pages.HandleFunc("/getUnsharedUsersForNote/{noteID:[0-9]+}", a.getUnsharedUsersForNoteHandler).Methods("GET")
+	pages.HandleFunc("/find/{noteID:[0-9]+}", a.findInNoteHandler).Methods("GET")
+	pages.HandleFunc("/update-privileges", a.updatePrivilegesHandler).Methods("POST")
+	pages.HandleFunc("/remove-delegation/{noteID:[0-9]+}", a.removeDelegationHandler).Methods("POST")
+	pages.HandleFunc("/history/{noteID:[0-9]+}", a.historyHandler).Methods("GET")
+	pages.HandleFunc("/history/{noteID:[0-9]+}/restore", a.restoreRevisionHandler).Methods("POST")
+	pages.HandleFunc("/trash", a.trashHandler).Methods("GET")
+	pages.HandleFunc("/trash/restore", a.restoreFromTrashHandler).Methods("POST")
+	pages.HandleFunc("/trash/purge", a.purgeFromTrashHandler).Methods("POST")
+	pages.HandleFunc("/tokens", a.tokensHandler).Methods("POST", "GET")
+	pages.HandleFunc("/tokens/revoke", a.revokeTokenHandler).Methods("POST")
+	pages.HandleFunc("/settings", a.settingsHandler).Methods("POST", "GET")
+	pages.HandleFunc("/password", a.passwordHandler).Methods("POST", "GET")
+	pages.HandleFunc("/mfa/setup", a.mfaSetupHandler).Methods("POST", "GET")
 
 	log.Println("Routes established")
 }
\ No newline at end of file
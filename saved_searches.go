@@ -0,0 +1,506 @@
+// Package main contains the main entry point for the Go application
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// MaxSavedSearchNameLength is the maximum length of the name of a saved search.
+const MaxSavedSearchNameLength = 64
+
+// SavedSearch is a search saved under a name, with the due filter and sort order to run it with.
+// It is run with /search?saved=ID by its owner and the users it is shared with, each over the
+// notes they can see.
+type SavedSearch struct {
+	ID        int       `json:"id"`
+	Owner     string    `json:"owner"`
+	Name      string    `json:"name"`
+	Query     string    `json:"query"`
+	Due       dueFilter `json:"due"`
+	Sort      string    `json:"sort"`
+	CreatedAt time.Time `json:"created_at"`
+	// Only listed for the owner
+	SharedWith []string `json:"shared_with,omitempty"`
+}
+
+// savedSearchInput is the JSON body accepted when saving a search.
+type savedSearchInput struct {
+	Name  string    `json:"name"`
+	Query string    `json:"query"`
+	Due   dueFilter `json:"due"`
+	Sort  string    `json:"sort"`
+}
+
+// savedSearchShareInput is the JSON body accepted when sharing a saved search.
+type savedSearchShareInput struct {
+	Username string `json:"username"`
+}
+
+// validateSavedSearch checks a search before it is saved, defaulting the sort order to relevance.
+func validateSavedSearch(s *SavedSearch) error {
+	s.Name = strings.TrimSpace(s.Name)
+	s.Query = strings.TrimSpace(s.Query)
+	if s.Name == "" || len(s.Name) > MaxSavedSearchNameLength {
+		return fmt.Errorf("name is required and must be at most %d characters", MaxSavedSearchNameLength)
+	}
+	if s.Query == "" || len(s.Query) > MaxSearchLength {
+		return fmt.Errorf("query is required and must be at most %d characters", MaxSearchLength)
+	}
+	if _, err := parseSearchQuery(s.Query, time.UTC); err != nil {
+		return err
+	}
+	if !validDueFilter(s.Due) {
+		return errors.New("due must be overdue, today, week or none")
+	}
+	if s.Sort == "" {
+		s.Sort = searchSorts[0]
+	}
+	for _, sortBy := range searchSorts {
+		if s.Sort == sortBy {
+			return nil
+		}
+	}
+	return fmt.Errorf("sort must be %s", strings.Join(searchSorts, " or "))
+}
+
+// savedSearchColumns selects a saved search s, with the users it is shared with when user $1 owns it.
+const savedSearchColumns = `s.id, s.owner, s.name, s.query, s.due, s.sort, s.created_at,
+	CASE WHEN s.owner = $1 THEN COALESCE((SELECT string_agg(ss.username, ' ' ORDER BY ss.username)
+		FROM saved_search_shares ss WHERE ss.saved_search_id = s.id), '') ELSE '' END`
+
+// visibleSavedSearchCondition limits a query on saved searches s to those user $1 owns or has been shared.
+const visibleSavedSearchCondition = `(s.owner = $1
+	OR EXISTS (SELECT 1 FROM saved_search_shares ss WHERE ss.saved_search_id = s.id AND ss.username = $1))`
+
+// scanSavedSearch reads a row selected with savedSearchColumns.
+func scanSavedSearch(row interface{ Scan(...interface{}) error }) (SavedSearch, error) {
+	var s SavedSearch
+	var sharedWith string
+	err := row.Scan(&s.ID, &s.Owner, &s.Name, &s.Query, &s.Due, &s.Sort, &s.CreatedAt, &sharedWith)
+	s.SharedWith = strings.Fields(sharedWith)
+	return s, err
+}
+
+// listSavedSearches returns the user's own saved searches by name, then those shared with them.
+func (a *App) listSavedSearches(username string) ([]SavedSearch, error) {
+	rows, err := a.db.Query(`
+		SELECT `+savedSearchColumns+`
+		FROM saved_searches s
+		WHERE `+visibleSavedSearchCondition+`
+		ORDER BY s.owner <> $1, lower(s.name), s.id
+	`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	searches := []SavedSearch{}
+	for rows.Next() {
+		s, err := scanSavedSearch(rows)
+		if err != nil {
+			return nil, err
+		}
+		searches = append(searches, s)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return searches, nil
+}
+
+// getSavedSearch returns a saved search the user owns or has been shared.
+// Returns sql.ErrNoRows if there is no such search.
+func (a *App) getSavedSearch(id int, username string) (SavedSearch, error) {
+	row := a.db.QueryRow(`
+		SELECT `+savedSearchColumns+`
+		FROM saved_searches s
+		WHERE s.id = $2 AND `+visibleSavedSearchCondition,
+		username, id)
+	return scanSavedSearch(row)
+}
+
+// saveSearch saves a search for its owner and returns its ID. Saving under a name the owner
+// already uses replaces that search, keeping its shares.
+func (a *App) saveSearch(s SavedSearch) (int, error) {
+	var id int
+	err := a.db.QueryRow(`
+		INSERT INTO saved_searches (owner, name, query, due, sort)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (owner, name) DO UPDATE SET query = EXCLUDED.query, due = EXCLUDED.due, sort = EXCLUDED.sort
+		RETURNING id
+	`, s.Owner, s.Name, s.Query, string(s.Due), s.Sort).Scan(&id)
+	return id, err
+}
+
+// deleteSavedSearch deletes one of the owner's saved searches, along with its shares.
+// Returns sql.ErrNoRows if the owner has no such search.
+func (a *App) deleteSavedSearch(id int, owner string) error {
+	result, err := a.db.Exec("DELETE FROM saved_searches WHERE id = $1 AND owner = $2", id, owner)
+	if err != nil {
+		return err
+	}
+	return requireRowsAffected(result)
+}
+
+// shareSavedSearch shares one of the owner's saved searches with another user. Sharing it again
+// does nothing. Returns sql.ErrNoRows if the owner has no such search and errUserNotFound
+// if the user does not exist.
+func (a *App) shareSavedSearch(id int, owner, username string) error {
+	var owned bool
+	err := a.db.QueryRow("SELECT EXISTS(SELECT 1 FROM saved_searches WHERE id = $1 AND owner = $2)", id, owner).Scan(&owned)
+	if err != nil {
+		return err
+	}
+	if !owned {
+		return sql.ErrNoRows
+	}
+
+	var exists bool
+	if err := a.db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE username = $1)", username).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return errUserNotFound
+	}
+
+	_, err = a.db.Exec(`
+		INSERT INTO saved_search_shares (saved_search_id, username) VALUES ($1, $2)
+		ON CONFLICT DO NOTHING
+	`, id, username)
+	return err
+}
+
+// unshareSavedSearch stops sharing a saved search with a user. The owner can remove anyone,
+// and users can remove a search shared with them from their own list.
+// Returns sql.ErrNoRows if there is no such share the actor may remove.
+func (a *App) unshareSavedSearch(id int, username, actor string) error {
+	result, err := a.db.Exec(`
+		DELETE FROM saved_search_shares
+		WHERE saved_search_id = $1 AND username = $2
+			AND (username = $3 OR EXISTS (SELECT 1 FROM saved_searches s WHERE s.id = $1 AND s.owner = $3))
+	`, id, username, actor)
+	if err != nil {
+		return err
+	}
+	return requireRowsAffected(result)
+}
+
+// savedSearchFromRequest loads the saved search named by the ?saved= parameter, if any.
+// Returns sql.ErrNoRows if the parameter is not the ID of a search the user can run.
+func (a *App) savedSearchFromRequest(r *http.Request, username string) (*SavedSearch, error) {
+	value := r.FormValue("saved")
+	if value == "" {
+		return nil, nil
+	}
+	id, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, sql.ErrNoRows
+	}
+	saved, err := a.getSavedSearch(id, username)
+	if err != nil {
+		return nil, err
+	}
+	return &saved, nil
+}
+
+// savedSearchesHandler lists the current user's saved searches and those shared with them.
+func (a *App) savedSearchesHandler(w http.ResponseWriter, r *http.Request) {
+	username := currentUsername(r)
+	searches, err := a.listSavedSearches(username)
+	if err != nil {
+		checkInternalServerError(err, w)
+		return
+	}
+	allUsers, err := a.users.OtherUsers(username)
+	if err != nil {
+		checkInternalServerError(err, w)
+		return
+	}
+
+	data := struct {
+		Username   string
+		Searches   []SavedSearch
+		AllUsers   []User
+		DueFilters []dueFilterOption
+	}{
+		Username:   username,
+		Searches:   searches,
+		AllUsers:   allUsers,
+		DueFilters: dueFilters,
+	}
+
+	t, err := template.New("saved_searches.html").Funcs(csrfFuncs(r)).ParseFiles("tmpl/saved_searches.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	buf.WriteTo(w)
+}
+
+// saveSearchHandler saves the search on the results page under a name, then runs it.
+func (a *App) saveSearchHandler(w http.ResponseWriter, r *http.Request) {
+	saved := SavedSearch{
+		Owner: currentUsername(r),
+		Name:  r.FormValue("name"),
+		Query: r.FormValue("searchQuery"),
+		Due:   dueFilter(r.FormValue("due")),
+		Sort:  r.FormValue("sort"),
+	}
+	if err := validateSavedSearch(&saved); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, err := a.saveSearch(saved)
+	if err != nil {
+		checkInternalServerError(err, w)
+		return
+	}
+
+	http.Redirect(w, r, "/search?saved="+strconv.Itoa(id), http.StatusSeeOther)
+}
+
+// deleteSavedSearchHandler deletes one of the current user's saved searches.
+func (a *App) deleteSavedSearchHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.FormValue("Id"))
+	if err != nil {
+		http.Error(w, "Invalid saved search ID", http.StatusBadRequest)
+		return
+	}
+
+	err = a.deleteSavedSearch(id, currentUsername(r))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Saved search not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		checkInternalServerError(err, w)
+		return
+	}
+
+	http.Redirect(w, r, "/saved-searches", http.StatusSeeOther)
+}
+
+// shareSavedSearchHandler shares one of the current user's saved searches with another user.
+func (a *App) shareSavedSearchHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.FormValue("Id"))
+	if err != nil {
+		http.Error(w, "Invalid saved search ID", http.StatusBadRequest)
+		return
+	}
+	username := currentUsername(r)
+	shareWith := r.FormValue("username")
+	if shareWith == "" || shareWith == username {
+		http.Error(w, "Choose another user to share with", http.StatusBadRequest)
+		return
+	}
+
+	err = a.shareSavedSearch(id, username, shareWith)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Saved search not found", http.StatusNotFound)
+		return
+	}
+	if err == errUserNotFound {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		checkInternalServerError(err, w)
+		return
+	}
+
+	http.Redirect(w, r, "/saved-searches", http.StatusSeeOther)
+}
+
+// unshareSavedSearchHandler stops sharing a saved search with a user, or removes a search
+// shared with the current user from their list.
+func (a *App) unshareSavedSearchHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.FormValue("Id"))
+	if err != nil {
+		http.Error(w, "Invalid saved search ID", http.StatusBadRequest)
+		return
+	}
+
+	err = a.unshareSavedSearch(id, r.FormValue("username"), currentUsername(r))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Saved search not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		checkInternalServerError(err, w)
+		return
+	}
+
+	http.Redirect(w, r, "/saved-searches", http.StatusSeeOther)
+}
+
+// apiListSavedSearchesHandler handles GET /api/v1/saved-searches.
+func (a *App) apiListSavedSearchesHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := a.apiUsername(w, r)
+	if !ok {
+		return
+	}
+
+	searches, err := a.listSavedSearches(username)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"saved_searches": searches})
+}
+
+// apiCreateSavedSearchHandler handles POST /api/v1/saved-searches.
+func (a *App) apiCreateSavedSearchHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := a.apiUsername(w, r)
+	if !ok {
+		return
+	}
+
+	var in savedSearchInput
+	if err := decodeJSON(w, r, &in); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	saved := SavedSearch{Owner: username, Name: in.Name, Query: in.Query, Due: in.Due, Sort: in.Sort}
+	if err := validateSavedSearch(&saved); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	id, err := a.saveSearch(saved)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	saved, err = a.getSavedSearch(id, username)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, saved)
+}
+
+// apiGetSavedSearchHandler handles GET /api/v1/saved-searches/{id}.
+func (a *App) apiGetSavedSearchHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := a.apiUsername(w, r)
+	if !ok {
+		return
+	}
+
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	saved, err := a.getSavedSearch(id, username)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Saved search not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, saved)
+}
+
+// apiDeleteSavedSearchHandler handles DELETE /api/v1/saved-searches/{id}.
+func (a *App) apiDeleteSavedSearchHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := a.apiUsername(w, r)
+	if !ok {
+		return
+	}
+
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	err := a.deleteSavedSearch(id, username)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Saved search not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiShareSavedSearchHandler handles POST /api/v1/saved-searches/{id}/shares.
+func (a *App) apiShareSavedSearchHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := a.apiUsername(w, r)
+	if !ok {
+		return
+	}
+
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	var in savedSearchShareInput
+	if err := decodeJSON(w, r, &in); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if in.Username == "" || in.Username == username {
+		respondWithError(w, http.StatusBadRequest, "username is required and cannot be your own")
+		return
+	}
+
+	err := a.shareSavedSearch(id, username, in.Username)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Saved search not found")
+		return
+	}
+	if err == errUserNotFound {
+		respondWithError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	saved, err := a.getSavedSearch(id, username)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, saved)
+}
+
+// apiUnshareSavedSearchHandler handles DELETE /api/v1/saved-searches/{id}/shares/{username}.
+func (a *App) apiUnshareSavedSearchHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := a.apiUsername(w, r)
+	if !ok {
+		return
+	}
+
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	err := a.unshareSavedSearch(id, mux.Vars(r)["username"], username)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Saved search not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var savedSearchRowColumns = []string{"id", "owner", "name", "query", "due", "sort", "created_at", "shared_with"}
+
+func TestValidateSavedSearch(t *testing.T) {
+	tests := []struct {
+		search   SavedSearch
+		wantSort string
+		wantErr  bool
+	}{
+		{SavedSearch{Name: "My overdue tasks", Query: "type:task owner:me", Due: dueOverdue}, sortRelevance, false},
+		{SavedSearch{Name: "Newest", Query: "budget", Sort: sortCreated}, sortCreated, false},
+		{SavedSearch{Name: " ", Query: "budget"}, "", true},
+		{SavedSearch{Name: "Empty", Query: ""}, "", true},
+		{SavedSearch{Name: "Bad qualifier", Query: "status:finished"}, "", true},
+		{SavedSearch{Name: "Bad due", Query: "budget", Due: "tomorrow"}, "", true},
+		{SavedSearch{Name: "Bad sort", Query: "budget", Sort: "title"}, "", true},
+	}
+
+	for _, tt := range tests {
+		err := validateSavedSearch(&tt.search)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("validateSavedSearch(%q) error = %v, wantErr %v", tt.search.Name, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && tt.search.Sort != tt.wantSort {
+			t.Errorf("validateSavedSearch(%q) sort = %q, want %q", tt.search.Name, tt.search.Sort, tt.wantSort)
+		}
+	}
+}
+
+func TestAPI_CreateSavedSearch(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	created := time.Date(2024, 10, 1, 9, 0, 0, 0, time.UTC)
+	mock.ExpectQuery("INSERT INTO saved_searches .* ON CONFLICT \\(owner, name\\) DO UPDATE").
+		WithArgs("alice", "My overdue tasks", "type:task owner:me", "overdue", "relevance").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(5))
+	mock.ExpectQuery("SELECT s.id, s.owner, .* FROM saved_searches s WHERE s.id = \\$2").WithArgs("alice", 5).
+		WillReturnRows(sqlmock.NewRows(savedSearchRowColumns).
+			AddRow(5, "alice", "My overdue tasks", "type:task owner:me", "overdue", "relevance", created, ""))
+
+	rr := serveAPI(a, "POST", "/api/v1/saved-searches",
+		`{"name":"My overdue tasks","query":"type:task owner:me","due":"overdue"}`, "alice")
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Handler returned wrong status code: got %v, want %v: %s", rr.Code, http.StatusCreated, rr.Body.String())
+	}
+	var saved SavedSearch
+	if err := json.Unmarshal(rr.Body.Bytes(), &saved); err != nil {
+		t.Fatalf("Decoding response: %v", err)
+	}
+	if saved.ID != 5 || saved.Due != dueOverdue || saved.Sort != sortRelevance {
+		t.Errorf("Unexpected saved search: %+v", saved)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPI_SearchNotes_RunsSavedSearch(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	created := time.Date(2024, 10, 1, 9, 0, 0, 0, time.UTC)
+
+	// bob's search, shared with alice, runs over alice's notes
+	mock.ExpectQuery("FROM saved_searches s WHERE s.id = \\$2").WithArgs("alice", 5).
+		WillReturnRows(sqlmock.NewRows(savedSearchRowColumns).
+			AddRow(5, "bob", "My overdue tasks", "type:task owner:me", "overdue", "relevance", created, ""))
+	expectUserTimezone(mock, "alice", nil)
+	mock.ExpectQuery(`0 AS rank.*AND n.noteType = \$2 AND n.owner = \$1\s`).WithArgs("alice", "Task").
+		WillReturnRows(sqlmock.NewRows(searchRowColumns).
+			AddRow(8, "File report", "Task", "Quarterly", created, created.AddDate(0, 0, 1), "None", "", "alice", nil, "",
+				0, "File report", "Quarterly").
+			AddRow(9, "Book venue", "Task", "Party", created, nil, "None", "", "alice", nil, "",
+				0, "Book venue", "Party"))
+
+	rr := serveAPI(a, "GET", "/api/v1/search?saved=5", "", "alice")
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v, want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	var body struct {
+		Results []struct{ Note struct{ ID int } } `json:"results"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Decoding response: %v", err)
+	}
+	// Only the overdue task is left by the saved due filter
+	if len(body.Results) != 1 || body.Results[0].Note.ID != 8 {
+		t.Errorf("Expected only note 8, got %+v", body.Results)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPI_ShareSavedSearch_RequiresOwner(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	mock.ExpectQuery("SELECT EXISTS\\(SELECT 1 FROM saved_searches WHERE id = \\$1 AND owner = \\$2\\)").
+		WithArgs(5, "alice").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+
+	rr := serveAPI(a, "POST", "/api/v1/saved-searches/5/shares", `{"username":"carol"}`, "alice")
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusNotFound)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
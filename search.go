@@ -0,0 +1,331 @@
+// Package main contains the main entry point for the Go application
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxSearchLength is the maximum length of a search query, qualifiers included.
+const MaxSearchLength = 100
+
+// searchSorts are the sort orders offered for search results, best match first by default.
+var searchSorts = []string{sortRelevance, sortCreated, sortDue}
+
+// Matched terms in headlines are wrapped in these control characters by PostgreSQL, which
+// cannot appear in note text typed into the forms. highlightSnippet turns them into <mark> tags
+// after escaping the text, so a note cannot inject HTML through its snippet.
+const (
+	headlineStart = "\x02"
+	headlineStop  = "\x03"
+)
+
+// titleHeadlineOptions highlights every match in the (short) title.
+const titleHeadlineOptions = "StartSel=" + headlineStart + ", StopSel=" + headlineStop + ", HighlightAll=true"
+
+// snippetHeadlineOptions picks up to two fragments of the description around the matches.
+const snippetHeadlineOptions = "StartSel=" + headlineStart + ", StopSel=" + headlineStop +
+	`, MaxFragments=2, MaxWords=25, MinWords=8, FragmentDelimiter=" ... "`
+
+// searchQuery is a parsed search. Text is passed to websearch_to_tsquery, so it supports
+// "quoted phrases", OR and -excluded words; the other fields come from qualifiers.
+type searchQuery struct {
+	Text     string
+	Status   string
+	NoteType string
+	Owner    string
+	Delegate string
+	Tags     []string
+	// DueFrom (inclusive) and DueBefore (exclusive) bound the due date when set.
+	DueFrom   time.Time
+	DueBefore time.Time
+	NoDue     bool
+}
+
+// parseSearchQuery splits the qualifiers out of a search typed by the user:
+//
+//	status:completed  type:task  owner:BIGCAT  delegate:me  tag:work
+//	due:2024-01-01  due:<2024-01-01  due:<=2024-01-01  due:>2024-01-01  due:>=2024-01-01  due:none
+//
+// Values may be quoted (status:"in progress"), and dates are days in loc. owner:me and
+// delegate:me are the user running the search, so saved searches work for everyone.
+// Everything else is kept as the text of the search.
+func parseSearchQuery(input string, loc *time.Location) (searchQuery, error) {
+	var q searchQuery
+	var text []string
+
+	for _, token := range splitSearchTokens(input) {
+		key, value, found := strings.Cut(token, ":")
+		key = strings.ToLower(key)
+		if !found || !isSearchQualifier(key) {
+			text = append(text, token)
+			continue
+		}
+
+		value = strings.Trim(value, `"`)
+		if value == "" {
+			return searchQuery{}, fmt.Errorf("%s: needs a value", key)
+		}
+
+		switch key {
+		case "status":
+			status, ok := canonicalValue(validNoteStatuses, strings.NewReplacer("-", " ", "_", " ").Replace(value))
+			if !ok || status == "" {
+				return searchQuery{}, errors.New("status: must be none, in-progress, completed, cancelled or delegated")
+			}
+			q.Status = status
+		case "type":
+			noteType, ok := canonicalValue(validNoteTypes, value)
+			if !ok {
+				return searchQuery{}, errors.New("type: must be note or task")
+			}
+			q.NoteType = noteType
+		case "owner":
+			q.Owner = value
+		case "delegate":
+			q.Delegate = value
+		case "tag":
+			tags, err := normalizeTags(append(q.Tags, value))
+			if err != nil {
+				return searchQuery{}, err
+			}
+			q.Tags = tags
+		case "due":
+			if err := q.parseDue(value, loc); err != nil {
+				return searchQuery{}, err
+			}
+		}
+	}
+
+	q.Text = strings.Join(text, " ")
+	return q, nil
+}
+
+// isSearchQualifier reports whether key: starts a qualifier rather than search text.
+func isSearchQualifier(key string) bool {
+	switch key {
+	case "status", "type", "owner", "delegate", "tag", "due":
+		return true
+	}
+	return false
+}
+
+// canonicalValue finds value in valid ignoring case, returning it as it is stored.
+func canonicalValue(valid map[string]bool, value string) (string, bool) {
+	for v := range valid {
+		if strings.EqualFold(v, value) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// parseDue reads the value of a due: qualifier, an optional comparison followed by a date.
+func (q *searchQuery) parseDue(value string, loc *time.Location) error {
+	if strings.EqualFold(value, "none") {
+		q.NoDue = true
+		return nil
+	}
+
+	date := strings.TrimLeft(value, "<>=")
+	op := value[:len(value)-len(date)]
+	day, err := time.ParseInLocation("2006-01-02", date, loc)
+	if err != nil {
+		return errors.New("due: must be none or a date like 2024-01-31, optionally after <, <=, > or >=")
+	}
+	nextDay := day.AddDate(0, 0, 1)
+
+	switch op {
+	case "", "=":
+		q.DueFrom, q.DueBefore = day, nextDay
+	case "<":
+		q.DueBefore = day
+	case "<=":
+		q.DueBefore = nextDay
+	case ">":
+		q.DueFrom = nextDay
+	case ">=":
+		q.DueFrom = day
+	default:
+		return errors.New("due: comparison must be <, <=, > or >=")
+	}
+	return nil
+}
+
+// isEmpty reports whether the search has neither text nor qualifiers.
+func (q searchQuery) isEmpty() bool {
+	return strings.TrimSpace(q.Text) == "" && q.Status == "" && q.NoteType == "" && q.Owner == "" &&
+		q.Delegate == "" && len(q.Tags) == 0 && q.DueFrom.IsZero() && q.DueBefore.IsZero() && !q.NoDue
+}
+
+// searchMe stands for the user running the search in owner: and delegate:.
+const searchMe = "me"
+
+// filterSQL returns the conditions on notes n for the qualifiers of the search,
+// appending their values to args. args[0] must be the user running the search.
+func (q searchQuery) filterSQL(args []interface{}) ([]string, []interface{}) {
+	var conditions []string
+	add := func(condition string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, strings.ReplaceAll(condition, "?", "$"+strconv.Itoa(len(args))))
+	}
+
+	if q.Status != "" {
+		add("n.noteStatus = ?", q.Status)
+	}
+	if q.NoteType != "" {
+		add("n.noteType = ?", q.NoteType)
+	}
+	if strings.EqualFold(q.Owner, searchMe) {
+		conditions = append(conditions, "n.owner = $1")
+	} else if q.Owner != "" {
+		add("n.owner = ?", q.Owner)
+	}
+	if strings.EqualFold(q.Delegate, searchMe) {
+		conditions = append(conditions, "n.noteDelegation = $1")
+	} else if q.Delegate != "" {
+		add("n.noteDelegation = ?", q.Delegate)
+	}
+	for _, tag := range q.Tags {
+		add(`EXISTS (SELECT 1 FROM note_tags nt JOIN tags t ON t.id = nt.tag_id
+			WHERE nt.note_id = n.id AND t.name = ?)`, tag)
+	}
+	if !q.DueFrom.IsZero() {
+		add("n.due_at >= ?", q.DueFrom)
+	}
+	if !q.DueBefore.IsZero() {
+		add("n.due_at < ?", q.DueBefore)
+	}
+	if q.NoDue {
+		conditions = append(conditions, "n.due_at IS NULL")
+	}
+	return conditions, args
+}
+
+// splitSearchTokens splits a search on spaces outside double quotes, keeping the quotes,
+// so "a phrase" and status:"in progress" each stay a single token.
+func splitSearchTokens(input string) []string {
+	var tokens []string
+	var current strings.Builder
+	inQuotes := false
+
+	for _, r := range input {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+			current.WriteRune(r)
+		case !inQuotes && (r == ' ' || r == '\t' || r == '\n' || r == '\r'):
+			if current.Len() > 0 {
+				tokens = append(tokens, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if current.Len() > 0 {
+		tokens = append(tokens, current.String())
+	}
+	return tokens
+}
+
+// highlightSnippet escapes a headline from the search query and marks its matched terms.
+func highlightSnippet(headline string) template.HTML {
+	escaped := template.HTMLEscapeString(headline)
+	escaped = strings.ReplaceAll(escaped, headlineStart, "<mark>")
+	escaped = strings.ReplaceAll(escaped, headlineStop, "</mark>")
+	return template.HTML(escaped)
+}
+
+// searchHit is a note found by a search, with its relevance and highlighted snippets.
+type searchHit struct {
+	Note Note
+}
+
+// MarshalJSON writes the note with its rank and snippets. Snippets are HTML with the
+// matched terms in <mark> tags, ready to be shown as they are.
+func (h searchHit) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Note         Note          `json:"note"`
+		Rank         float64       `json:"rank"`
+		TitleSnippet template.HTML `json:"title_snippet"`
+		Snippet      template.HTML `json:"snippet"`
+	}{
+		Note:         h.Note,
+		Rank:         h.Note.Rank,
+		TitleSnippet: highlightSnippet(h.Note.TitleHeadline),
+		Snippet:      highlightSnippet(h.Note.Headline),
+	})
+}
+
+// apiSearchNotesHandler handles GET /api/v1/search?q=... or ?saved=ID, returning the best matches first.
+// q takes the same syntax and qualifiers as the search page. When nothing matches exactly, the
+// results are similar notes, marked fuzzy, with a did_you_mean search when one was found.
+// The due and sort filters of the list endpoint are supported, sort defaults to relevance.
+func (a *App) apiSearchNotesHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := a.apiUsername(w, r)
+	if !ok {
+		return
+	}
+
+	saved, err := a.savedSearchFromRequest(r, username)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Saved search not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	due, sortBy, err := dueOptions(r, searchSorts...)
+	if saved != nil {
+		// A saved search brings its own query, due filter and sort order
+		query, due, sortBy, err = saved.Query, saved.Due, saved.Sort, nil
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if query == "" || len(query) > MaxSearchLength {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("q is required and must be at most %d characters", MaxSearchLength))
+		return
+	}
+	loc, err := a.userLocation(username)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	search, err := parseSearchQuery(query, loc)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	found, err := a.searchWithFallback(query, search, username)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	notes := filterNotesByDue(found.Notes, due, loc)
+	sortNotes(notes, sortBy)
+
+	hits := make([]searchHit, 0, len(notes))
+	for _, note := range notes {
+		hits = append(hits, searchHit{Note: note})
+	}
+
+	body := map[string]interface{}{"results": hits, "fuzzy": found.Fuzzy}
+	if found.DidYouMean != "" {
+		body["did_you_mean"] = found.DidYouMean
+	}
+	respondWithJSON(w, http.StatusOK, body)
+}
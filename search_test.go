@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var searchRowColumns = []string{"id", "title", "noteType", "description", "noteCreated", "due_at", "noteStatus",
+	"noteDelegation", "owner", "privileges", "tags", "rank", "title_headline", "headline"}
+
+// expectSearch expects a ranked search by alice for "milk", returning the best match first
+func expectSearch(mock sqlmock.Sqlmock) {
+	created := time.Date(2024, 10, 1, 9, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(`ts_rank_cd\(n.search_vector, search_query\) AS rank.*websearch_to_tsquery\('english', \$2\).*ORDER BY rank DESC`).
+		WithArgs("alice", "milk", titleHeadlineOptions, snippetHeadlineOptions).
+		WillReturnRows(sqlmock.NewRows(searchRowColumns).
+			AddRow(7, "Buy milk", "Task", "Oat milk", created, nil, "None", "", "alice", nil, "", 0.6,
+				"Buy \x02milk\x03", "Oat \x02milk\x03").
+			AddRow(3, "Shopping", "Note", "Eggs, <b>milk</b>", created, nil, "None", "", "bob", "editor", "", 0.1,
+				"Shopping", "Eggs, <b>\x02milk\x03</b>"))
+}
+
+func TestHighlightSnippet_EscapesNoteText(t *testing.T) {
+	got := highlightSnippet("Eggs & <script>\x02milk\x03</script>")
+	want := "Eggs &amp; &lt;script&gt;<mark>milk</mark>&lt;/script&gt;"
+	if string(got) != want {
+		t.Errorf("highlightSnippet() = %q, want %q", got, want)
+	}
+}
+
+func TestSearchNotesInDatabase_RankedWithSnippets(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error occurred while opening a stub database connection: %v", err)
+	}
+	defer db.Close()
+
+	a := newSQLTestApp(db)
+	expectSearch(mock)
+
+	notes, err := a.search.SearchNotes(searchQuery{Text: "milk"}, "alice")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	// Best match first, including the note bob shared with alice
+	if len(notes) != 2 || notes[0].ID != 7 || notes[1].ID != 3 {
+		t.Fatalf("Expected notes 7 then 3, got %+v", notes)
+	}
+	if notes[1].Privileges != "editor" {
+		t.Errorf("Expected alice's privileges on the shared note, got %q", notes[1].Privileges)
+	}
+	if notes[0].Rank != 0.6 || notes[0].Headline != "Oat \x02milk\x03" {
+		t.Errorf("Expected the rank and headline of note 7, got %v %q", notes[0].Rank, notes[0].Headline)
+	}
+	if !notes[0].NoteStatus.Valid {
+		t.Errorf("Expected the status to be read")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPI_SearchNotes_ReturnsRankAndSnippets(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	expectUserTimezone(mock, "alice", nil)
+	expectSearch(mock)
+
+	rr := serveAPI(a, "GET", "/api/v1/search?q=milk", "", "alice")
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v, want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+
+	var body struct {
+		Results []struct {
+			Note         struct{ ID int } `json:"note"`
+			Rank         float64          `json:"rank"`
+			TitleSnippet string           `json:"title_snippet"`
+			Snippet      string           `json:"snippet"`
+		} `json:"results"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Decoding response: %v", err)
+	}
+	if len(body.Results) != 2 || body.Results[0].Note.ID != 7 {
+		t.Fatalf("Expected note 7 first, got %+v", body.Results)
+	}
+	if body.Results[0].Rank != 0.6 || body.Results[0].TitleSnippet != "Buy <mark>milk</mark>" {
+		t.Errorf("Unexpected rank or title snippet: %+v", body.Results[0])
+	}
+	if body.Results[1].Snippet != "Eggs, &lt;b&gt;<mark>milk</mark>&lt;/b&gt;" {
+		t.Errorf("Expected the snippet to be escaped, got %q", body.Results[1].Snippet)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPI_SearchNotes_RequiresQuery(t *testing.T) {
+	a, mock := newAPITestApp(t)
+
+	rr := serveAPI(a, "GET", "/api/v1/search?q=", "", "alice")
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusBadRequest)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestParseSearchQuery(t *testing.T) {
+	auckland, err := time.LoadLocation("Pacific/Auckland")
+	if err != nil {
+		t.Fatalf("Loading time zone: %v", err)
+	}
+	day := func(d int) time.Time { return time.Date(2024, 1, d, 0, 0, 0, 0, auckland) }
+
+	tests := []struct {
+		input   string
+		want    searchQuery
+		wantErr bool
+	}{
+		{`"project plan" OR budget -draft`, searchQuery{Text: `"project plan" OR budget -draft`}, false},
+		{"status:completed type:task milk", searchQuery{Text: "milk", Status: "Completed", NoteType: "Task"}, false},
+		{`status:"in progress" owner:BIGCAT`, searchQuery{Status: "In Progress", Owner: "BIGCAT"}, false},
+		{"status:in-progress tag:Work tag:home", searchQuery{Status: "In Progress", Tags: []string{"home", "work"}}, false},
+		{"due:<2024-01-01", searchQuery{DueBefore: day(1)}, false},
+		{"due:<=2024-01-01", searchQuery{DueBefore: day(2)}, false},
+		{"due:>2024-01-01", searchQuery{DueFrom: day(2)}, false},
+		{"due:2024-01-01", searchQuery{DueFrom: day(1), DueBefore: day(2)}, false},
+		{"due:none", searchQuery{NoDue: true}, false},
+		{"delegate:me status:in-progress", searchQuery{Delegate: "me", Status: "In Progress"}, false},
+		// Qualifiers inside a quoted phrase are search text
+		{`"status:completed report"`, searchQuery{Text: `"status:completed report"`}, false},
+		{"subject: budget", searchQuery{Text: "subject: budget"}, false},
+		{"status:finished", searchQuery{}, true},
+		{"type:memo", searchQuery{}, true},
+		{"due:<01/01/2024", searchQuery{}, true},
+		{"due:<>2024-01-01", searchQuery{}, true},
+		{"owner:", searchQuery{}, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseSearchQuery(tt.input, auckland)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseSearchQuery(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseSearchQuery(%q) = %+v, want %+v", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestSearchNotesInDatabase_QualifiersOnly(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error occurred while opening a stub database connection: %v", err)
+	}
+	defer db.Close()
+
+	a := newSQLTestApp(db)
+	before := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	// Every note alice can see, including those shared with her, without a text search
+	mock.ExpectQuery(`0 AS rank.*FROM notes n\s+WHERE n.deleted_at IS NULL AND \(n.owner = \$1 OR n.noteDelegation = \$1\s+`+
+		`OR EXISTS \(SELECT 1 FROM user_shares us WHERE us.note_id = n.id AND us.username = \$1\)\) `+
+		`AND n.noteStatus = \$2 AND n.owner = \$3 AND n.due_at < \$4`).
+		WithArgs("alice", "Completed", "BIGCAT", before).
+		WillReturnRows(sqlmock.NewRows(searchRowColumns))
+
+	search := searchQuery{Status: "Completed", Owner: "BIGCAT", DueBefore: before}
+	if _, err := a.search.SearchNotes(search, "alice"); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPI_SearchNotes_RejectsBadQualifier(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	expectUserTimezone(mock, "alice", nil)
+
+	rr := serveAPI(a, "GET", "/api/v1/search?q=status:finished", "", "alice")
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusBadRequest)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
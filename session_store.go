@@ -0,0 +1,359 @@
+// Package main contains the main entry point for the Go application
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/gob"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/icza/session"
+)
+
+// sessionTouchInterval limits how often a session's access time is written back to the
+// database. Without it every request would update the sessions table.
+const sessionTouchInterval = time.Minute
+
+// userSessionStore is a session.Store that can also log a user out everywhere, for when their
+// password changes.
+type userSessionStore interface {
+	session.Store
+	// RemoveUser removes every session of the user except the one with the ID exceptID
+	RemoveUser(username, exceptID string) error
+}
+
+// pgSessionStore is a session.Store that keeps sessions in the sessions table, so users
+// stay logged in across restarts and when requests are spread over several instances.
+// Expired sessions are deleted by a background goroutine until Close is called.
+type pgSessionStore struct {
+	db           *sql.DB
+	closeCleaner chan struct{}
+	closeOnce    sync.Once
+}
+
+// pgSession implements session.Session for sessions loaded from the database.
+// The exported fields have the same names as the session package's own implementation,
+// so sessions created with session.NewSessionOptions decode into it.
+type pgSession struct {
+	IDF       string
+	CreatedF  time.Time
+	AccessedF time.Time
+	CAttrsF   map[string]interface{}
+	AttrsF    map[string]interface{}
+	TimeoutF  time.Duration
+
+	mux     *sync.RWMutex
+	store   *pgSessionStore
+	touched time.Time // access time last written to the database
+}
+
+// newPgSessionStore returns a database backed session store and starts its cleanup goroutine.
+func newPgSessionStore(db *sql.DB, cleanupInterval time.Duration) *pgSessionStore {
+	s := &pgSessionStore{
+		db:           db,
+		closeCleaner: make(chan struct{}),
+	}
+
+	go s.cleaner(cleanupInterval)
+
+	return s
+}
+
+// cleaner deletes expired sessions every interval until the store is closed.
+func (s *pgSessionStore) cleaner(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closeCleaner:
+			return
+		case <-ticker.C:
+			if _, err := s.deleteExpired(); err != nil {
+				slog.Error("Deleting expired sessions failed", "err", err)
+			}
+		}
+	}
+}
+
+// deleteExpired removes every session that has passed its expiry time and returns how many were removed.
+func (s *pgSessionStore) deleteExpired() (int64, error) {
+	result, err := s.db.Exec("DELETE FROM sessions WHERE expires_at <= CURRENT_TIMESTAMP")
+	if err != nil {
+		return 0, err
+	}
+
+	removed, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if removed > 0 {
+		slog.Info("Removed expired sessions", "count", removed)
+	}
+
+	return removed, nil
+}
+
+// encodeSession gob encodes a session, including its constant and variable attributes.
+func encodeSession(sess session.Session) ([]byte, error) {
+	sess.Mutex().RLock()
+	defer sess.Mutex().RUnlock()
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(sess); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// save writes the whole session to the database, replacing any stored copy.
+func (s *pgSessionStore) save(sess session.Session) error {
+	data, err := encodeSession(sess)
+	if err != nil {
+		return err
+	}
+
+	// The username is stored in its own column so a user's sessions can be found
+	var username sql.NullString
+	if u, ok := sess.CAttr("username").(string); ok {
+		username = sql.NullString{String: u, Valid: true}
+	}
+
+	accessed := sess.Accessed()
+	_, err = s.db.Exec(`
+		INSERT INTO sessions (id, username, data, created_at, accessed_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (id) DO UPDATE
+		SET data = EXCLUDED.data, accessed_at = EXCLUDED.accessed_at, expires_at = EXCLUDED.expires_at
+	`, sess.ID(), username, data, sess.Created(), accessed, accessed.Add(sess.Timeout()))
+	return err
+}
+
+// Get is to implement session.Store.Get(). Expired sessions are treated as missing.
+func (s *pgSessionStore) Get(id string) session.Session {
+	var data []byte
+	var accessed time.Time
+	err := s.db.QueryRow(
+		"SELECT data, accessed_at FROM sessions WHERE id = $1 AND expires_at > CURRENT_TIMESTAMP", id,
+	).Scan(&data, &accessed)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		slog.Error("Loading a session failed", "err", err)
+		return nil
+	}
+
+	sess := &pgSession{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(sess); err != nil {
+		slog.Error("Decoding a session failed", "id", id, "err", err)
+		return nil
+	}
+	if sess.AttrsF == nil {
+		sess.AttrsF = make(map[string]interface{})
+	}
+	sess.mux = &sync.RWMutex{}
+	sess.store = s
+	sess.AccessedF = accessed
+	sess.touched = accessed
+
+	sess.Access()
+	return sess
+}
+
+// Add is to implement session.Store.Add().
+func (s *pgSessionStore) Add(sess session.Session) {
+	if err := s.save(sess); err != nil {
+		slog.Error("Saving a session failed", "err", err)
+		return
+	}
+	slog.Debug("Session added", "id", sess.ID())
+}
+
+// Remove is to implement session.Store.Remove().
+func (s *pgSessionStore) Remove(sess session.Session) {
+	if _, err := s.db.Exec("DELETE FROM sessions WHERE id = $1", sess.ID()); err != nil {
+		slog.Error("Removing a session failed", "err", err)
+		return
+	}
+	slog.Debug("Session removed", "id", sess.ID())
+}
+
+// RemoveUser is to implement userSessionStore.RemoveUser().
+func (s *pgSessionStore) RemoveUser(username, exceptID string) error {
+	_, err := s.db.Exec("DELETE FROM sessions WHERE username = $1 AND id <> $2", username, exceptID)
+	return err
+}
+
+// Close is to implement session.Store.Close(). It stops the cleanup goroutine.
+func (s *pgSessionStore) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closeCleaner)
+	})
+}
+
+// ID is to implement session.Session.ID().
+func (s *pgSession) ID() string {
+	return s.IDF
+}
+
+// New is to implement session.Session.New().
+func (s *pgSession) New() bool {
+	return s.CreatedF == s.AccessedF
+}
+
+// CAttr is to implement session.Session.CAttr().
+func (s *pgSession) CAttr(name string) interface{} {
+	return s.CAttrsF[name]
+}
+
+// Attr is to implement session.Session.Attr().
+func (s *pgSession) Attr(name string) interface{} {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	return s.AttrsF[name]
+}
+
+// SetAttr is to implement session.Session.SetAttr(). The change is saved to the database straight away.
+func (s *pgSession) SetAttr(name string, value interface{}) {
+	s.mux.Lock()
+	if value == nil {
+		delete(s.AttrsF, name)
+	} else {
+		s.AttrsF[name] = value
+	}
+	s.mux.Unlock()
+
+	if err := s.store.save(s); err != nil {
+		slog.Error("Saving a session failed", "err", err)
+	}
+}
+
+// Attrs is to implement session.Session.Attrs().
+func (s *pgSession) Attrs() map[string]interface{} {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	m := make(map[string]interface{}, len(s.AttrsF))
+	for k, v := range s.AttrsF {
+		m[k] = v
+	}
+	return m
+}
+
+// Created is to implement session.Session.Created().
+func (s *pgSession) Created() time.Time {
+	return s.CreatedF
+}
+
+// Accessed is to implement session.Session.Accessed().
+func (s *pgSession) Accessed() time.Time {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	return s.AccessedF
+}
+
+// Timeout is to implement session.Session.Timeout().
+func (s *pgSession) Timeout() time.Duration {
+	return s.TimeoutF
+}
+
+// Mutex is to implement session.Session.Mutex().
+func (s *pgSession) Mutex() *sync.RWMutex {
+	return s.mux
+}
+
+// Access is to implement session.Session.Access(). The new access time, and so the
+// expiry, is only written to the database once per sessionTouchInterval.
+func (s *pgSession) Access() {
+	s.mux.Lock()
+	now := time.Now()
+	s.AccessedF = now
+	touch := now.Sub(s.touched) >= sessionTouchInterval
+	if touch {
+		s.touched = now
+	}
+	s.mux.Unlock()
+
+	if !touch {
+		return
+	}
+
+	_, err := s.store.db.Exec(
+		"UPDATE sessions SET accessed_at = $2, expires_at = $3 WHERE id = $1",
+		s.IDF, now, now.Add(s.TimeoutF),
+	)
+	if err != nil {
+		slog.Error("Updating the session access time failed", "err", err)
+	}
+}
+
+// memSessionStore is the session package's in-memory store, which also remembers the sessions
+// of each user so they can be removed together.
+type memSessionStore struct {
+	session.Store
+
+	mu     sync.Mutex
+	byUser map[string]map[string]session.Session // sessions by username and ID
+}
+
+// newMemSessionStore returns an in-memory session store.
+func newMemSessionStore() *memSessionStore {
+	return &memSessionStore{
+		Store:  session.NewInMemStore(),
+		byUser: make(map[string]map[string]session.Session),
+	}
+}
+
+// Add is to implement session.Store.Add(). The user's sessions that have expired are forgotten.
+func (s *memSessionStore) Add(sess session.Session) {
+	s.Store.Add(sess)
+
+	username, ok := sess.CAttr("username").(string)
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sessions := s.byUser[username]
+	if sessions == nil {
+		sessions = make(map[string]session.Session)
+		s.byUser[username] = sessions
+	}
+	for id, other := range sessions {
+		if time.Since(other.Accessed()) > other.Timeout() {
+			delete(sessions, id)
+		}
+	}
+	sessions[sess.ID()] = sess
+}
+
+// Remove is to implement session.Store.Remove().
+func (s *memSessionStore) Remove(sess session.Session) {
+	s.Store.Remove(sess)
+
+	if username, ok := sess.CAttr("username").(string); ok {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.byUser[username], sess.ID())
+	}
+}
+
+// RemoveUser is to implement userSessionStore.RemoveUser().
+func (s *memSessionStore) RemoveUser(username, exceptID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, sess := range s.byUser[username] {
+		if id != exceptID {
+			s.Store.Remove(sess)
+			delete(s.byUser[username], id)
+		}
+	}
+	return nil
+}
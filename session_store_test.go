@@ -0,0 +1,225 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/icza/session"
+)
+
+func newTestSession(username string) session.Session {
+	return session.NewSessionOptions(&session.SessOptions{
+		CAttrs:  map[string]interface{}{"username": username, "userid": ""},
+		Attrs:   map[string]interface{}{"count": 1},
+		Timeout: 30 * time.Minute,
+	})
+}
+
+// useTestSessions keeps the app's login sessions in a new in-memory store for the test, and has
+// the session package use it too, as setupAuth does.
+func useTestSessions(t testing.TB, a *App) {
+	store := newMemSessionStore()
+	previous := session.Global
+	session.Global = session.NewCookieManagerOptions(store, &session.CookieMngrOptions{AllowHTTP: true})
+	a.sessions = store
+	t.Cleanup(func() {
+		session.Global.Close()
+		session.Global = previous
+	})
+}
+
+func TestPgSessionStore_Add(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error occurred while opening a stub database connection: %v", err)
+	}
+	defer db.Close()
+
+	store := &pgSessionStore{db: db}
+	sess := newTestSession("alice")
+
+	mock.ExpectExec("INSERT INTO sessions").
+		WithArgs(sess.ID(), "alice", sqlmock.AnyArg(), sess.Created(), sess.Accessed(), sess.Accessed().Add(30*time.Minute)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	store.Add(sess)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPgSessionStore_GetRestoresAttributes(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error occurred while opening a stub database connection: %v", err)
+	}
+	defer db.Close()
+
+	store := &pgSessionStore{db: db}
+	original := newTestSession("alice")
+	data, err := encodeSession(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The session was last written two minutes ago, so this access is saved
+	accessed := time.Now().Add(-2 * time.Minute)
+	mock.ExpectQuery("SELECT data, accessed_at FROM sessions").WithArgs(original.ID()).
+		WillReturnRows(sqlmock.NewRows([]string{"data", "accessed_at"}).AddRow(data, accessed))
+	mock.ExpectExec("UPDATE sessions SET accessed_at").
+		WithArgs(original.ID(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	sess := store.Get(original.ID())
+	if sess == nil {
+		t.Fatal("Expected a session, got nil")
+	}
+
+	// isAuthenticated type asserts these, so the types must survive the round trip
+	if username, ok := sess.CAttr("username").(string); !ok || username != "alice" {
+		t.Errorf("Unexpected username attribute %#v", sess.CAttr("username"))
+	}
+	if count, ok := sess.Attr("count").(int); !ok || count != 1 {
+		t.Errorf("Unexpected count attribute %#v", sess.Attr("count"))
+	}
+	if sess.Timeout() != 30*time.Minute || !sess.Accessed().After(accessed) {
+		t.Errorf("Unexpected timeout %s or access time %s", sess.Timeout(), sess.Accessed())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPgSessionStore_GetSkipsRecentTouch(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error occurred while opening a stub database connection: %v", err)
+	}
+	defer db.Close()
+
+	store := &pgSessionStore{db: db}
+	original := newTestSession("alice")
+	data, err := encodeSession(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Accessed a moment ago, no UPDATE is expected
+	mock.ExpectQuery("SELECT data, accessed_at FROM sessions").WithArgs(original.ID()).
+		WillReturnRows(sqlmock.NewRows([]string{"data", "accessed_at"}).AddRow(data, time.Now()))
+
+	if sess := store.Get(original.ID()); sess == nil {
+		t.Fatal("Expected a session, got nil")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPgSessionStore_GetMissing(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error occurred while opening a stub database connection: %v", err)
+	}
+	defer db.Close()
+
+	store := &pgSessionStore{db: db}
+	mock.ExpectQuery("SELECT data, accessed_at FROM sessions").WithArgs("expired").
+		WillReturnRows(sqlmock.NewRows([]string{"data", "accessed_at"}))
+
+	if sess := store.Get("expired"); sess != nil {
+		t.Errorf("Expected nil for a missing or expired session, got %v", sess)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPgSessionStore_Remove(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error occurred while opening a stub database connection: %v", err)
+	}
+	defer db.Close()
+
+	store := &pgSessionStore{db: db}
+	sess := newTestSession("alice")
+	mock.ExpectExec("DELETE FROM sessions WHERE id").WithArgs(sess.ID()).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	store.Remove(sess)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPgSessionStore_RemoveUser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error occurred while opening a stub database connection: %v", err)
+	}
+	defer db.Close()
+
+	store := &pgSessionStore{db: db}
+	mock.ExpectExec("DELETE FROM sessions WHERE username = \\$1 AND id <> \\$2").WithArgs("alice", "current").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	if err := store.RemoveUser("alice", "current"); err != nil {
+		t.Errorf("Expected no error, but got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestMemSessionStore_RemoveUser(t *testing.T) {
+	store := newMemSessionStore()
+	defer store.Close()
+
+	kept, removed, other := newTestSession("alice"), newTestSession("alice"), newTestSession("bob")
+	for _, sess := range []session.Session{kept, removed, other} {
+		store.Add(sess)
+	}
+
+	if err := store.RemoveUser("alice", kept.ID()); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if store.Get(kept.ID()) == nil || store.Get(other.ID()) == nil {
+		t.Error("Expected the current session and other users' sessions to be kept")
+	}
+	if store.Get(removed.ID()) != nil {
+		t.Error("Expected the user's other session to be removed")
+	}
+
+	// Without a current session every session of the user goes
+	store.RemoveUser("alice", "")
+	if store.Get(kept.ID()) != nil {
+		t.Error("Expected every session of the user to be removed")
+	}
+}
+
+func TestPgSessionStore_DeleteExpired(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error occurred while opening a stub database connection: %v", err)
+	}
+	defer db.Close()
+
+	store := &pgSessionStore{db: db}
+	mock.ExpectExec("DELETE FROM sessions WHERE expires_at").WillReturnResult(sqlmock.NewResult(0, 3))
+
+	removed, err := store.deleteExpired()
+	if err != nil || removed != 3 {
+		t.Errorf("Expected 3 sessions removed, got %d (%v)", removed, err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,145 @@
+// Package main contains the main entry point for the Go application
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+// userSettingsInput is the JSON body accepted when changing the user's settings.
+type userSettingsInput struct {
+	Timezone *string `json:"timezone"`
+}
+
+// settingsHandler shows the current user's settings (GET) and saves them (POST). Changing the
+// email address, which password reset links are sent to, needs the current password.
+func (a *App) settingsHandler(w http.ResponseWriter, r *http.Request) {
+	username := currentUsername(r)
+	var message, saved string
+
+	if r.Method == http.MethodPost {
+		// The email address has a form of its own
+		r.ParseForm()
+		if _, ok := r.PostForm["email"]; ok {
+			email := strings.TrimSpace(r.PostFormValue("email"))
+			if err := validateEmail(email); err != nil {
+				message = "Invalid email address: " + err.Error()
+			} else if message = a.checkCurrentPassword(r, username, auditEmailChangeFailed); message == "" {
+				if err := a.users.SetEmail(username, email); err != nil {
+					checkInternalServerError(err, w)
+					return
+				}
+				a.audit(r, username, auditEmailChanged)
+				saved = "Email address saved."
+			}
+		} else {
+			timezone := strings.TrimSpace(r.FormValue("timezone"))
+			if err := validateTimezone(timezone); err != nil {
+				message = "Invalid time zone: " + err.Error()
+			} else {
+				if err := a.users.SetTimezone(username, timezone); err != nil {
+					checkInternalServerError(err, w)
+					return
+				}
+				saved = "Settings saved."
+			}
+		}
+	}
+
+	email, err := a.users.Email(username)
+	if err != nil {
+		checkInternalServerError(err, w)
+		return
+	}
+
+	timezone, err := a.users.Timezone(username)
+	if err != nil {
+		checkInternalServerError(err, w)
+		return
+	}
+
+	data := struct {
+		Username        string
+		Timezone        string
+		DefaultTimezone string
+		Email           string
+		Message         string
+		Saved           string
+	}{
+		Username:        username,
+		Timezone:        timezone,
+		DefaultTimezone: a.defaultLocation().String(),
+		Email:           email,
+		Message:         message,
+		Saved:           saved,
+	}
+
+	t, err := template.New("settings.html").Funcs(csrfFuncs(r)).ParseFiles("tmpl/settings.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	buf.WriteTo(w)
+}
+
+// apiGetMeHandler handles GET /api/v1/me, returning the user's name and time zone.
+func (a *App) apiGetMeHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := a.apiUsername(w, r)
+	if !ok {
+		return
+	}
+
+	a.respondWithSettings(w, username)
+}
+
+// apiUpdateMeHandler handles PATCH /api/v1/me. An empty time zone goes back to the default.
+func (a *App) apiUpdateMeHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := a.apiUsername(w, r)
+	if !ok {
+		return
+	}
+
+	var in userSettingsInput
+	if err := decodeJSON(w, r, &in); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if in.Timezone != nil {
+		timezone := strings.TrimSpace(*in.Timezone)
+		if err := validateTimezone(timezone); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := a.users.SetTimezone(username, timezone); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	a.respondWithSettings(w, username)
+}
+
+// respondWithSettings writes the user's settings, with the time zone actually in use.
+func (a *App) respondWithSettings(w http.ResponseWriter, username string) {
+	timezone, err := a.users.Timezone(username)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"username":           username,
+		"timezone":           timezone,
+		"effective_timezone": a.locationFor(timezone).String(),
+	})
+}
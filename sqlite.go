@@ -0,0 +1,217 @@
+// Package main contains the main entry point for the Go application
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"log"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// The SQLite backend runs the same queries as PostgreSQL where it can. The queries number their
+// parameters $1, $2, ..., which SQLite reads as named parameters numbered in order of appearance,
+// so the notes-sqlite3 driver rewrites them as ?1, ?2, ... and stores times as UTC text that
+// sorts and compares like the timestamps SQLite writes itself.
+func init() {
+	sql.Register("notes-sqlite3", sqliteDriver{&sqlite3.SQLiteDriver{ConnectHook: registerSQLiteFunctions}})
+}
+
+// sqliteTimeFormat is how times are stored, matching CURRENT_TIMESTAMP with optional fractions.
+const sqliteTimeFormat = "2006-01-02 15:04:05.999999999"
+
+// errSQLiteNoFTS5 is returned when go-sqlite3 was built without the FTS5 extension the search needs.
+var errSQLiteNoFTS5 = errors.New("SQLite was built without FTS5, build the app with -tags sqlite_fts5")
+
+// numberedParameter matches a $1 style query parameter.
+var numberedParameter = regexp.MustCompile(`\$(\d+)`)
+
+// sqliteDriver opens SQLite connections that accept the PostgreSQL style queries.
+type sqliteDriver struct {
+	*sqlite3.SQLiteDriver
+}
+
+// Open is to implement driver.Driver.Open().
+func (d sqliteDriver) Open(dsn string) (driver.Conn, error) {
+	conn, err := d.SQLiteDriver.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteConn{conn}, nil
+}
+
+// sqliteConn rebinds the parameters of every query before passing it on to SQLite.
+type sqliteConn struct {
+	driver.Conn
+}
+
+func rebindSQLite(query string) string {
+	return numberedParameter.ReplaceAllString(query, "?$1")
+}
+
+// Prepare is to implement driver.Conn.Prepare().
+func (c *sqliteConn) Prepare(query string) (driver.Stmt, error) {
+	return c.Conn.Prepare(rebindSQLite(query))
+}
+
+// PrepareContext is to implement driver.ConnPrepareContext.PrepareContext().
+func (c *sqliteConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if conn, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return conn.PrepareContext(ctx, rebindSQLite(query))
+	}
+	return c.Prepare(query)
+}
+
+// ExecContext is to implement driver.ExecerContext.ExecContext().
+func (c *sqliteConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if conn, ok := c.Conn.(driver.ExecerContext); ok {
+		return conn.ExecContext(ctx, rebindSQLite(query), args)
+	}
+	return nil, driver.ErrSkip
+}
+
+// QueryContext is to implement driver.QueryerContext.QueryContext().
+func (c *sqliteConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if conn, ok := c.Conn.(driver.QueryerContext); ok {
+		return conn.QueryContext(ctx, rebindSQLite(query), args)
+	}
+	return nil, driver.ErrSkip
+}
+
+// BeginTx is to implement driver.ConnBeginTx.BeginTx().
+func (c *sqliteConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if conn, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return conn.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+// Ping is to implement driver.Pinger.Ping().
+func (c *sqliteConn) Ping(ctx context.Context) error {
+	if conn, ok := c.Conn.(driver.Pinger); ok {
+		return conn.Ping(ctx)
+	}
+	return nil
+}
+
+// CheckNamedValue is to implement driver.NamedValueChecker.CheckNamedValue().
+// Arguments are converted as usual, then times are written as UTC text.
+func (c *sqliteConn) CheckNamedValue(nv *driver.NamedValue) error {
+	value, err := driver.DefaultParameterConverter.ConvertValue(nv.Value)
+	if err != nil {
+		return err
+	}
+	if t, ok := value.(time.Time); ok {
+		value = t.UTC().Format(sqliteTimeFormat)
+	}
+	nv.Value = value
+	return nil
+}
+
+// registerSQLiteFunctions adds the pg_trgm functions the fuzzy search uses to each connection.
+func registerSQLiteFunctions(conn *sqlite3.SQLiteConn) error {
+	if err := conn.RegisterFunc("similarity", trigramSimilarity, true); err != nil {
+		return err
+	}
+	return conn.RegisterFunc("word_similarity", trigramWordSimilarity, true)
+}
+
+// setupSQLiteDatabase opens the SQLite database file, creating it if needed, with foreign keys
+// enforced and write-ahead logging so pages can be read while a note is being saved.
+func setupSQLiteDatabase(cfg *Config) (*sql.DB, error) {
+	log.Println("Opening SQLite database", cfg.Database.Path)
+
+	params := url.Values{}
+	params.Set("_foreign_keys", "on")
+	params.Set("_busy_timeout", "5000")
+	params.Set("_journal_mode", "WAL")
+	// Transactions take the write lock up front, so two writers wait rather than deadlock
+	params.Set("_txlock", "immediate")
+
+	db, err := sql.Open("notes-sqlite3", "file:"+cfg.Database.Path+"?"+params.Encode())
+	if err != nil {
+		return nil, err
+	}
+
+	db.SetMaxOpenConns(cfg.Database.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.Database.MaxIdleConns)
+	db.SetConnMaxLifetime(cfg.Database.ConnMaxLifetime)
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// go-sqlite3 only compiles in FTS5 with the sqlite_fts5 build tag
+	var fts5 bool
+	if err := db.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&fts5); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if !fts5 {
+		db.Close()
+		return nil, errSQLiteNoFTS5
+	}
+
+	log.Println("Database opened successfully")
+	return db, nil
+}
+
+// trigrams returns the trigrams of the words of text the way pg_trgm builds them:
+// lower case, with each word padded by two spaces in front and one behind.
+func trigrams(text string) map[string]bool {
+	set := make(map[string]bool)
+	for _, word := range searchWordPattern.FindAllString(strings.ToLower(text), -1) {
+		addWordTrigrams(set, word)
+	}
+	return set
+}
+
+func addWordTrigrams(set map[string]bool, word string) {
+	padded := []rune("  " + word + " ")
+	for i := 0; i+3 <= len(padded); i++ {
+		set[string(padded[i:i+3])] = true
+	}
+}
+
+// sharedTrigrams is the number of trigrams two sets have in common over the number in either.
+func sharedTrigrams(a, b map[string]bool) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	shared := 0
+	for trigram := range a {
+		if b[trigram] {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(a)+len(b)-shared)
+}
+
+// trigramSimilarity is pg_trgm's similarity(a, b), from 0 (nothing in common) to 1.
+func trigramSimilarity(a, b string) float64 {
+	return sharedTrigrams(trigrams(a), trigrams(b))
+}
+
+// trigramWordSimilarity is pg_trgm's word_similarity(a, b): the greatest similarity
+// between a and any run of consecutive words of b.
+func trigramWordSimilarity(a, b string) float64 {
+	query := trigrams(a)
+	words := searchWordPattern.FindAllString(strings.ToLower(b), -1)
+
+	best := 0.0
+	for i := range words {
+		extent := make(map[string]bool)
+		for _, word := range words[i:] {
+			addWordTrigrams(extent, word)
+			best = max(best, sharedTrigrams(query, extent))
+		}
+	}
+	return best
+}
@@ -0,0 +1,135 @@
+// Package main contains the main entry point for the Go application
+package main
+
+import "errors"
+
+// The handlers reach notes, users, shares and search through these interfaces rather than the
+// database, so they can run on PostgreSQL (postgresStore, db.go), SQLite (sqliteStore,
+// store_sqlite.go) or in memory (memoryStore, store_memory.go). The trash, note history,
+// saved searches and API tokens use a.db directly, with SQL that both databases run.
+//
+// Lookups of a single note or user return sql.ErrNoRows when it does not exist,
+// whichever store is used.
+
+// errUserExists is returned when registering a username that is already taken.
+var errUserExists = errors.New("user already exists")
+
+// Errors of the share store, which handlers turn into HTTP statuses with shareErrorStatus.
+var (
+	// errUserNotFound is returned when sharing with a user that does not exist
+	errUserNotFound = errors.New("user not found")
+	// errNoteNotFound is returned when the note does not exist or is in the trash
+	errNoteNotFound = errors.New("note not found")
+	// errAlreadyShared is returned when sharing a note with a user it is already shared with
+	errAlreadyShared = errors.New("note is already shared with this user")
+	// errShareNotFound is returned when changing or removing a share that does not exist
+	errShareNotFound = errors.New("note is not shared with this user")
+	// errShareForbidden is returned when sharing a note with its owner
+	errShareForbidden = errors.New("a note cannot be shared with its owner")
+)
+
+// NoteStore reads and writes notes.
+type NoteStore interface {
+	// ListNotes returns a page of the notes in scope for the user, see noteListOptions
+	ListNotes(username string, opts noteListOptions) (notePage, error)
+	// GetNote returns a note by ID, including notes in the trash
+	GetNote(noteID int) (*Note, error)
+	// NoteRole returns the role the user holds on a note, RoleNone for notes in the trash
+	NoteRole(noteID int, username string) (NoteRole, error)
+	// CreateNote stores a new note, with its tags and first revision, and returns its ID.
+	// It returns errUserNotFound if the note is delegated to a user that does not exist
+	CreateNote(note Note) (int, error)
+	// UpdateNote replaces a note's fields and tags, recording a revision edited by editedBy.
+	// It returns errUserNotFound if the note is delegated to a user that does not exist
+	UpdateNote(note Note, editedBy string) error
+	// DeleteNote moves a note to the trash
+	DeleteNote(noteID int, deletedBy string) error
+	// SetDelegation delegates a note to a user and marks it as delegated, or returns
+	// errUserNotFound if there is no such user
+	SetDelegation(noteID int, username string) error
+	// RemoveDelegation removes a note's delegate and clears its status
+	RemoveDelegation(noteID int) error
+	// TagCounts returns the tags on the notes the user can see, with how many of them carry each
+	TagCounts(username string) ([]TagCount, error)
+}
+
+// UserStore reads and writes user accounts.
+type UserStore interface {
+	// CreateUser adds a user with a bcrypt password hash, errUserExists if the name is taken
+	CreateUser(username string, passwordHash []byte) error
+	// PasswordHash returns the user's bcrypt password hash
+	PasswordHash(username string) ([]byte, error)
+	// SetPasswordHash replaces the user's bcrypt password hash
+	SetPasswordHash(username string, passwordHash []byte) error
+	// OtherUsers lists every user except the given one
+	OtherUsers(username string) ([]User, error)
+	// Timezone returns the time zone the user has chosen, "" if they use the default
+	Timezone(username string) (string, error)
+	// SetTimezone stores the user's time zone, "" to use the default
+	SetTimezone(username, timezone string) error
+	// Email returns the address password reset links are sent to, "" if the user has not given one
+	Email(username string) (string, error)
+	// SetEmail stores the user's email address, "" to remove it
+	SetEmail(username, email string) error
+	// TOTPSecret returns the secret of the user's authenticator app, "" if they have not set one up
+	TOTPSecret(username string) (string, error)
+	// EnableTOTP stores the secret of the user's authenticator app and replaces their recovery codes
+	EnableTOTP(username, secret string, recoveryCodeHashes []string) error
+	// DisableTOTP removes the user's authenticator app secret and recovery codes
+	DisableTOTP(username string) error
+	// UseTOTPStep records that a code of the time step was used, false if one of it or a later step already was
+	UseTOTPStep(username string, step int64) (bool, error)
+	// UseRecoveryCode deletes the recovery code with the hash, false if the user has no such code
+	UseRecoveryCode(username, codeHash string) (bool, error)
+	// RecoveryCodesLeft returns how many unused recovery codes the user has
+	RecoveryCodesLeft(username string) (int, error)
+	// SetRecoveryCodes replaces the user's recovery codes
+	SetRecoveryCodes(username string, codeHashes []string) error
+}
+
+// ShareStore reads and writes the users notes are shared with.
+type ShareStore interface {
+	// NoteShares lists the users a note is shared with
+	NoteShares(noteID int) ([]UserShare, error)
+	// SharedUsers lists the users each note is shared with, keyed by note ID
+	SharedUsers(noteIDs []int) (map[int][]UserShare, error)
+	// UnsharedUsers lists the users, other than owner, a note is not shared with yet
+	UnsharedUsers(noteID int, owner string) ([]User, error)
+	// ShareNote shares a note with a user, returning errNoteNotFound, errUserNotFound,
+	// errShareForbidden or errAlreadyShared when it cannot
+	ShareNote(noteID int, username, privileges string) error
+	// UpdateShare changes the privileges of a user on a note, errNoteNotFound or errShareNotFound
+	// if the note is not shared with them
+	UpdateShare(noteID int, username, privileges string) error
+	// RemoveShare stops sharing a note with a user, errNoteNotFound or errShareNotFound
+	// if the note is not shared with them
+	RemoveShare(noteID int, username string) error
+}
+
+// SearchStore finds the notes a user can see by their text. Searches are parsed by parseSearchQuery.
+type SearchStore interface {
+	// SearchNotes returns the notes matching the search, best match first, with the matches marked
+	// in their headlines; a search with only qualifiers returns every matching note, newest first
+	SearchNotes(search searchQuery, username string) ([]Note, error)
+	// FuzzySearchNotes returns the notes with words starting with the words of the search, or text
+	// similar to it, best match first and at most limit notes when limit is positive
+	FuzzySearchNotes(search searchQuery, username string, limit int) ([]Note, error)
+	// SimilarWords returns the most similar word in the notes to each of words, for those that have one
+	SimilarWords(words []string, username string) (map[string]string, error)
+}
+
+// Store is every store the handlers need, as implemented by postgresStore, sqliteStore and memoryStore.
+type Store interface {
+	NoteStore
+	UserStore
+	ShareStore
+	SearchStore
+}
+
+// useStore sets the stores the handlers read and write through.
+func (a *App) useStore(s Store) {
+	a.notes = s
+	a.users = s
+	a.shares = s
+	a.search = s
+}
@@ -0,0 +1,813 @@
+// Package main contains the main entry point for the Go application
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// memoryStore keeps notes, users and shares in memory, for handler tests and for trying the
+// application out without a database (database backend "memory"). It implements Store.
+// Everything is lost when the process exits, and notes have no revision history.
+type memoryStore struct {
+	mu     sync.RWMutex
+	nextID int
+	users  map[string]*memoryUser
+	notes  map[int]*memoryNote
+	// shares maps a note ID to the privileges of each user it is shared with
+	shares map[int]map[string]string
+}
+
+// memoryUser is a user account kept by memoryStore.
+type memoryUser struct {
+	passwordHash []byte
+	timezone     string
+	email        string
+	totpSecret   string
+	totpLastStep int64
+	// recoveryCodes holds the hashes of the unused recovery codes
+	recoveryCodes map[string]bool
+}
+
+// memoryNote is a note kept by memoryStore, with when it was moved to the trash.
+type memoryNote struct {
+	note      Note
+	deletedAt sql.NullTime
+	deletedBy string
+}
+
+// newMemoryStore returns an empty store.
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		nextID: 1,
+		users:  make(map[string]*memoryUser),
+		notes:  make(map[int]*memoryNote),
+		shares: make(map[int]map[string]string),
+	}
+}
+
+// CreateUser adds a user with a bcrypt password hash, or returns errUserExists if the name is taken.
+func (s *memoryStore) CreateUser(username string, passwordHash []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[username]; ok {
+		return errUserExists
+	}
+	s.users[username] = &memoryUser{passwordHash: passwordHash}
+	return nil
+}
+
+// PasswordHash returns the user's bcrypt password hash, or sql.ErrNoRows if there is no such user.
+func (s *memoryStore) PasswordHash(username string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	user, ok := s.users[username]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return user.passwordHash, nil
+}
+
+// SetPasswordHash replaces the user's bcrypt password hash, or returns sql.ErrNoRows if there is no such user.
+func (s *memoryStore) SetPasswordHash(username string, passwordHash []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[username]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	user.passwordHash = passwordHash
+	return nil
+}
+
+// OtherUsers lists every user except the given one, by name.
+func (s *memoryStore) OtherUsers(username string) ([]User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.usersExcept(func(name string) bool { return name == username }), nil
+}
+
+// usersExcept lists the users for whom skip is false, by name. The caller holds the lock.
+func (s *memoryStore) usersExcept(skip func(string) bool) []User {
+	var users []User
+	for name := range s.users {
+		if !skip(name) {
+			users = append(users, User{Username: name})
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users
+}
+
+// Timezone returns the time zone the user has chosen, or "" if they use the default.
+func (s *memoryStore) Timezone(username string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if user, ok := s.users[username]; ok {
+		return user.timezone, nil
+	}
+	return "", nil
+}
+
+// SetTimezone stores the user's time zone, or clears it to use the default.
+func (s *memoryStore) SetTimezone(username, timezone string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if user, ok := s.users[username]; ok {
+		user.timezone = timezone
+	}
+	return nil
+}
+
+// Email returns the user's email address, or "" if they have not given one.
+func (s *memoryStore) Email(username string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if user, ok := s.users[username]; ok {
+		return user.email, nil
+	}
+	return "", nil
+}
+
+// SetEmail stores the user's email address, or removes it.
+func (s *memoryStore) SetEmail(username, email string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if user, ok := s.users[username]; ok {
+		user.email = email
+	}
+	return nil
+}
+
+// TOTPSecret returns the secret of the user's authenticator app, or "" if they have not set one up.
+func (s *memoryStore) TOTPSecret(username string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if user, ok := s.users[username]; ok {
+		return user.totpSecret, nil
+	}
+	return "", nil
+}
+
+// EnableTOTP stores the secret of the user's authenticator app and replaces their recovery codes.
+func (s *memoryStore) EnableTOTP(username, secret string, recoveryCodeHashes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[username]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	user.totpSecret = secret
+	user.totpLastStep = 0
+	user.recoveryCodes = codeSet(recoveryCodeHashes)
+	return nil
+}
+
+// DisableTOTP removes the user's authenticator app secret and recovery codes.
+func (s *memoryStore) DisableTOTP(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if user, ok := s.users[username]; ok {
+		user.totpSecret = ""
+		user.totpLastStep = 0
+		user.recoveryCodes = nil
+	}
+	return nil
+}
+
+// UseTOTPStep records that a code of the time step was used, or returns false if a code of it
+// or a later step already was.
+func (s *memoryStore) UseTOTPStep(username string, step int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[username]
+	if !ok || user.totpSecret == "" || step <= user.totpLastStep {
+		return false, nil
+	}
+	user.totpLastStep = step
+	return true, nil
+}
+
+// UseRecoveryCode deletes the user's recovery code with the hash, or returns false if there is none.
+func (s *memoryStore) UseRecoveryCode(username, codeHash string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[username]
+	if !ok || !user.recoveryCodes[codeHash] {
+		return false, nil
+	}
+	delete(user.recoveryCodes, codeHash)
+	return true, nil
+}
+
+// RecoveryCodesLeft returns how many unused recovery codes the user has.
+func (s *memoryStore) RecoveryCodesLeft(username string) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if user, ok := s.users[username]; ok {
+		return len(user.recoveryCodes), nil
+	}
+	return 0, nil
+}
+
+// SetRecoveryCodes replaces the user's recovery codes.
+func (s *memoryStore) SetRecoveryCodes(username string, codeHashes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[username]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	user.recoveryCodes = codeSet(codeHashes)
+	return nil
+}
+
+// codeSet returns the recovery code hashes as a set.
+func codeSet(codeHashes []string) map[string]bool {
+	set := make(map[string]bool, len(codeHashes))
+	for _, h := range codeHashes {
+		set[h] = true
+	}
+	return set
+}
+
+// liveNote returns a note that is not in the trash. The caller holds the lock.
+func (s *memoryStore) liveNote(noteID int) (*memoryNote, bool) {
+	n, ok := s.notes[noteID]
+	if !ok || n.deletedAt.Valid {
+		return nil, false
+	}
+	return n, true
+}
+
+// copyNote returns a copy of a stored note that the caller can change freely.
+func copyNote(note Note) Note {
+	note.Tags = append([]string(nil), note.Tags...)
+	note.SharedUsers = nil
+	return note
+}
+
+// GetNote returns a note by ID, including notes in the trash, or sql.ErrNoRows.
+func (s *memoryStore) GetNote(noteID int) (*Note, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	n, ok := s.notes[noteID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	note := copyNote(n.note)
+	return &note, nil
+}
+
+// NoteRole resolves the role a user holds on a note, in the same way as the Postgres store.
+func (s *memoryStore) NoteRole(noteID int, username string) (NoteRole, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	n, ok := s.liveNote(noteID)
+	if !ok {
+		return RoleNone, nil
+	}
+	return s.role(n.note, username), nil
+}
+
+// role returns the role a user holds on a live note. The caller holds the lock.
+func (s *memoryStore) role(note Note, username string) NoteRole {
+	privileges, shared := s.shares[note.ID][username]
+	switch {
+	case note.Owner == username:
+		return RoleOwner
+	case privileges == "editor":
+		return RoleEditor
+	case note.NoteDelegation.String == username && note.NoteDelegation.Valid:
+		return RoleDelegate
+	case shared:
+		return RoleViewer
+	}
+	return RoleNone
+}
+
+// checkDelegate returns errUserNotFound if there is no user called username to delegate a
+// note to, like checkDelegate does for the database. The caller holds the lock.
+func (s *memoryStore) checkDelegate(username string) error {
+	if _, ok := s.users[username]; username != "" && !ok {
+		return errUserNotFound
+	}
+	return nil
+}
+
+// CreateNote stores a new note and returns its ID. Notes are created now.
+func (s *memoryStore) CreateNote(note Note) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkDelegate(note.NoteDelegation.String); err != nil {
+		return 0, err
+	}
+
+	note.ID = s.nextID
+	s.nextID++
+	note.NoteCreated = time.Now().UTC()
+	note.NoteStatus = sql.NullString{String: note.NoteStatus.String, Valid: true}
+	note.NoteDelegation = sql.NullString{String: note.NoteDelegation.String, Valid: true}
+	s.notes[note.ID] = &memoryNote{note: copyNote(note)}
+	return note.ID, nil
+}
+
+// UpdateNote replaces a note's fields and tags. No revision is recorded.
+func (s *memoryStore) UpdateNote(note Note, editedBy string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, ok := s.notes[note.ID]
+	if !ok {
+		return nil
+	}
+	if err := s.checkDelegate(note.NoteDelegation.String); err != nil {
+		return err
+	}
+	n.note.Title = note.Title
+	n.note.NoteType = note.NoteType
+	n.note.Description = note.Description
+	n.note.DueAt = note.DueAt
+	n.note.NoteStatus = sql.NullString{String: note.NoteStatus.String, Valid: true}
+	n.note.NoteDelegation = sql.NullString{String: note.NoteDelegation.String, Valid: true}
+	n.note.Tags = append([]string(nil), note.Tags...)
+	return nil
+}
+
+// DeleteNote moves a note to the trash.
+func (s *memoryStore) DeleteNote(noteID int, deletedBy string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if n, ok := s.liveNote(noteID); ok {
+		n.deletedAt = sql.NullTime{Time: time.Now(), Valid: true}
+		n.deletedBy = deletedBy
+	}
+	return nil
+}
+
+// SetDelegation delegates a note to a user and marks it as delegated.
+func (s *memoryStore) SetDelegation(noteID int, username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkDelegate(username); err != nil {
+		return err
+	}
+
+	if n, ok := s.notes[noteID]; ok {
+		n.note.NoteDelegation = sql.NullString{String: username, Valid: true}
+		n.note.NoteStatus = sql.NullString{String: "Delegated", Valid: true}
+	}
+	return nil
+}
+
+// RemoveDelegation removes a note's delegate and clears its status.
+func (s *memoryStore) RemoveDelegation(noteID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if n, ok := s.notes[noteID]; ok {
+		n.note.NoteDelegation = sql.NullString{}
+		n.note.NoteStatus = sql.NullString{}
+	}
+	return nil
+}
+
+// TagCounts returns every tag on the notes the user can see, by name, with how many of them carry it.
+func (s *memoryStore) TagCounts(username string) ([]TagCount, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	counts := make(map[string]int)
+	for _, n := range s.notes {
+		if n.deletedAt.Valid || s.role(n.note, username) == RoleNone {
+			continue
+		}
+		for _, tag := range n.note.Tags {
+			counts[tag]++
+		}
+	}
+
+	tagCounts := []TagCount{}
+	for name, count := range counts {
+		tagCounts = append(tagCounts, TagCount{Name: name, Count: count})
+	}
+	sort.Slice(tagCounts, func(i, j int) bool { return tagCounts[i].Name < tagCounts[j].Name })
+	return tagCounts, nil
+}
+
+// inScope reports whether a live note is in the scope of the user's list.
+func (s *memoryStore) inScope(note Note, username, scope string) bool {
+	_, shared := s.shares[note.ID][username]
+	owned := note.Owner == username
+	delegated := note.NoteDelegation.Valid && note.NoteDelegation.String == username
+
+	switch scope {
+	case scopeOwned:
+		return owned
+	case scopeShared:
+		return shared
+	case scopeDelegated:
+		return delegated
+	}
+	return owned || shared || delegated
+}
+
+// matchesFilter reports whether a note passes the type, status, owner, delegate, tag and due date
+// qualifiers of a search, as filterSQL does.
+func matchesFilter(note Note, q searchQuery, username string) bool {
+	is := func(value, want string) bool {
+		return want == "" || value == want || (strings.EqualFold(want, searchMe) && value == username)
+	}
+
+	if q.Status != "" && note.NoteStatus.String != q.Status {
+		return false
+	}
+	if q.NoteType != "" && note.NoteType != q.NoteType {
+		return false
+	}
+	if !is(note.Owner, q.Owner) || (q.Delegate != "" && !is(note.NoteDelegation.String, q.Delegate)) {
+		return false
+	}
+	for _, tag := range q.Tags {
+		if !hasTag(note.Tags, tag) {
+			return false
+		}
+	}
+	if !q.DueFrom.IsZero() && (!note.DueAt.Valid || note.DueAt.Time.Before(q.DueFrom)) {
+		return false
+	}
+	if !q.DueBefore.IsZero() && (!note.DueAt.Valid || !note.DueAt.Time.Before(q.DueBefore)) {
+		return false
+	}
+	return !q.NoDue || !note.DueAt.Valid
+}
+
+// compareNotes orders two notes as a list sorted by sortBy, by their sort key then ID,
+// the same way the Postgres store orders them. It returns -1, 0 or 1.
+func compareNotes(sortBy string, a, b Note) int {
+	cmp := 0
+	switch sortBy {
+	case sortCreated:
+		// Newest first, and the highest ID first among notes created together
+		cmp = -compareTimes(a.NoteCreated, b.NoteCreated)
+		if cmp == 0 {
+			return -compareInts(a.ID, b.ID)
+		}
+		return cmp
+	case sortTitle:
+		cmp = strings.Compare(strings.ToLower(a.Title), strings.ToLower(b.Title))
+	case sortDue:
+		// Notes without a due date last
+		switch {
+		case a.DueAt.Valid && b.DueAt.Valid:
+			cmp = compareTimes(a.DueAt.Time, b.DueAt.Time)
+		case a.DueAt.Valid:
+			cmp = -1
+		case b.DueAt.Valid:
+			cmp = 1
+		}
+	case sortStatus:
+		cmp = strings.Compare(a.NoteStatus.String, b.NoteStatus.String)
+	}
+	if cmp == 0 {
+		return compareInts(a.ID, b.ID)
+	}
+	return cmp
+}
+
+// compareTimes returns -1, 0 or 1 as a is before, at or after b.
+func compareTimes(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	}
+	return 0
+}
+
+// compareInts returns -1, 0 or 1 as a is less than, equal to or greater than b.
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// cursorNote returns a note with the sort key and ID of a cursor, to compare notes with.
+func cursorNote(c *noteCursor) (Note, error) {
+	note := Note{ID: c.ID}
+	if c.Key == nil {
+		return note, nil
+	}
+
+	var err error
+	switch c.Sort {
+	case sortCreated:
+		note.NoteCreated, err = time.Parse(time.RFC3339Nano, *c.Key)
+	case sortTitle:
+		note.Title = *c.Key
+	case sortDue:
+		var due time.Time
+		due, err = time.Parse(time.RFC3339Nano, *c.Key)
+		note.DueAt = sql.NullTime{Time: due, Valid: true}
+	case sortStatus:
+		note.NoteStatus = sql.NullString{String: *c.Key, Valid: true}
+	}
+	if err != nil {
+		return note, errors.New("invalid cursor")
+	}
+	return note, nil
+}
+
+// ListNotes returns a page of the notes in scope for the user, filtered, sorted and paged
+// like the Postgres store's list.
+func (s *memoryStore) ListNotes(username string, opts noteListOptions) (notePage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	loc := opts.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	now := time.Now()
+
+	notes := []Note{}
+	for _, n := range s.notes {
+		note := n.note
+		if n.deletedAt.Valid || !s.inScope(note, username, opts.Scope) || !matchesFilter(note, opts.Filter, username) ||
+			!opts.Due.matches(note, now, loc) {
+			continue
+		}
+		if (!opts.CreatedFrom.IsZero() && note.NoteCreated.Before(opts.CreatedFrom)) ||
+			(!opts.CreatedBefore.IsZero() && !note.NoteCreated.Before(opts.CreatedBefore)) {
+			continue
+		}
+
+		// The user's role on the note: owner, their share's privileges or delegate
+		note = copyNote(note)
+		privileges, shared := s.shares[note.ID][username]
+		switch {
+		case note.Owner == username:
+			note.Privileges = string(RoleOwner)
+		case shared:
+			note.Privileges = privileges
+		default:
+			note.Privileges = string(RoleDelegate)
+		}
+		notes = append(notes, note)
+	}
+	sort.Slice(notes, func(i, j int) bool { return compareNotes(opts.Sort, notes[i], notes[j]) < 0 })
+
+	// The page starts after the cursor, or ends before it when going back
+	start, end := 0, len(notes)
+	if opts.Cursor != nil {
+		edge, err := cursorNote(opts.Cursor)
+		if err != nil {
+			return notePage{}, err
+		}
+		at := sort.Search(len(notes), func(i int) bool { return compareNotes(opts.Sort, notes[i], edge) >= 0 })
+		if opts.Cursor.Before {
+			end = at
+		} else {
+			for at < len(notes) && compareNotes(opts.Sort, notes[at], edge) == 0 {
+				at++
+			}
+			start = at
+		}
+	}
+
+	var hasNext, hasPrev bool
+	if opts.Cursor != nil && opts.Cursor.Before {
+		start = end - opts.Limit
+		if start < 0 {
+			start = 0
+		}
+		hasNext, hasPrev = true, start > 0
+	} else {
+		if end > start+opts.Limit {
+			end = start + opts.Limit
+		}
+		hasNext, hasPrev = end < len(notes), opts.Cursor != nil
+	}
+
+	page := notePage{Notes: notes[start:end]}
+	if len(page.Notes) == 0 {
+		return page, nil
+	}
+	sortKey := noteSortKeys[opts.Sort]
+	if hasNext {
+		last := page.Notes[len(page.Notes)-1]
+		page.Next = &noteCursor{Sort: opts.Sort, Key: sortKey.key(last), ID: last.ID}
+	}
+	if hasPrev {
+		first := page.Notes[0]
+		page.Prev = &noteCursor{Sort: opts.Sort, Key: sortKey.key(first), ID: first.ID, Before: true}
+	}
+	return page, nil
+}
+
+// NoteShares lists the users a note is shared with, by name.
+func (s *memoryStore) NoteShares(noteID int) ([]UserShare, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.noteShares(noteID), nil
+}
+
+// noteShares lists the users a note is shared with, by name. The caller holds the lock.
+func (s *memoryStore) noteShares(noteID int) []UserShare {
+	var shares []UserShare
+	for username, privileges := range s.shares[noteID] {
+		shares = append(shares, UserShare{
+			Username:   sql.NullString{String: username, Valid: true},
+			Privileges: sql.NullString{String: privileges, Valid: true},
+		})
+	}
+	sort.Slice(shares, func(i, j int) bool { return shares[i].Username.String < shares[j].Username.String })
+	return shares
+}
+
+// SharedUsers lists the users each note is shared with, keyed by note ID.
+func (s *memoryStore) SharedUsers(noteIDs []int) (map[int][]UserShare, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sharedUsers := make(map[int][]UserShare)
+	for _, noteID := range noteIDs {
+		if shares := s.noteShares(noteID); len(shares) > 0 {
+			sharedUsers[noteID] = shares
+		}
+	}
+	return sharedUsers, nil
+}
+
+// UnsharedUsers lists the users, other than owner, a note is not shared with yet.
+func (s *memoryStore) UnsharedUsers(noteID int, owner string) ([]User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.usersExcept(func(name string) bool {
+		_, shared := s.shares[noteID][name]
+		return shared || name == owner
+	}), nil
+}
+
+// ShareNote shares a note with a user, with the same checks as the Postgres store.
+func (s *memoryStore) ShareNote(noteID int, username, privileges string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	note, ok := s.liveNote(noteID)
+	if !ok {
+		return errNoteNotFound
+	}
+	if _, ok := s.users[username]; !ok {
+		return errUserNotFound
+	}
+	if note.note.Owner == username {
+		return errShareForbidden
+	}
+	if _, shared := s.shares[noteID][username]; shared {
+		return errAlreadyShared
+	}
+
+	if s.shares[noteID] == nil {
+		s.shares[noteID] = make(map[string]string)
+	}
+	s.shares[noteID][username] = privileges
+	return nil
+}
+
+// UpdateShare changes the privileges of a user on a note.
+func (s *memoryStore) UpdateShare(noteID int, username, privileges string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.requireShare(noteID, username); err != nil {
+		return err
+	}
+	s.shares[noteID][username] = privileges
+	return nil
+}
+
+// RemoveShare stops sharing a note with a user.
+func (s *memoryStore) RemoveShare(noteID int, username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.requireShare(noteID, username); err != nil {
+		return err
+	}
+	delete(s.shares[noteID], username)
+	return nil
+}
+
+// requireShare returns errNoteNotFound or errShareNotFound unless the note is shared with the user,
+// like requireShareChanged. The caller holds the lock.
+func (s *memoryStore) requireShare(noteID int, username string) error {
+	if _, shared := s.shares[noteID][username]; shared {
+		return nil
+	}
+	if _, ok := s.liveNote(noteID); !ok {
+		return errNoteNotFound
+	}
+	return errShareNotFound
+}
+
+// SearchNotes is not available in memory, search needs a database.
+func (s *memoryStore) SearchNotes(search searchQuery, username string) ([]Note, error) {
+	return nil, errNoDatabase
+}
+
+// FuzzySearchNotes is not available in memory, search needs a database.
+func (s *memoryStore) FuzzySearchNotes(search searchQuery, username string, limit int) ([]Note, error) {
+	return nil, errNoDatabase
+}
+
+// SimilarWords is not available in memory, search needs a database.
+func (s *memoryStore) SimilarWords(words []string, username string) (map[string]string, error) {
+	return nil, errNoDatabase
+}
+
+// errNoDatabase is returned by the features that need a database when running on the memory backend.
+var errNoDatabase = errors.New("this feature needs a database and is not available with the in-memory store")
+
+// noDatabaseDriver is the database/sql driver a.db uses on the memory backend. Every connection fails
+// with errNoDatabase, so features that query the database directly report that instead of crashing.
+type noDatabaseDriver struct{}
+
+func (noDatabaseDriver) Open(string) (driver.Conn, error) {
+	return nil, errNoDatabase
+}
+
+func init() {
+	sql.Register("nodb", noDatabaseDriver{})
+}
+
+// seedMemoryDemoData adds the demo users and notes to the memory store.
+func (a *App) seedMemoryDemoData() error {
+	for _, username := range []string{"mydog7", "BIGCAT"} {
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte("admin"), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		if err := a.users.CreateUser(username, hashedPassword); err != nil {
+			return err
+		}
+	}
+
+	rows, err := readData("data/notes.csv")
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		dueAt, err := parseDueAt(row[4], row[3], a.defaultLocation())
+		if err != nil {
+			return err
+		}
+		_, err = a.notes.CreateNote(Note{
+			Title:          row[0],
+			NoteType:       row[1],
+			Description:    row[2],
+			DueAt:          dueAt,
+			NoteStatus:     sql.NullString{String: row[5], Valid: true},
+			NoteDelegation: sql.NullString{String: row[6], Valid: true},
+			Owner:          row[7],
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,324 @@
+// Package main contains the main entry point for the Go application
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// sqliteStore keeps notes, users and shares in a SQLite database, for single-user and offline
+// deployments. Most queries are shared with postgresStore, and run through the notes-sqlite3
+// driver (sqlite.go); the methods here replace those that use PostgreSQL's arrays, casts or
+// full text search. Search uses the notes_fts table, an FTS5 index kept up to date by triggers.
+type sqliteStore struct {
+	*postgresStore
+}
+
+// newSQLiteStore returns a store on the SQLite database.
+func newSQLiteStore(db *sql.DB) *sqliteStore {
+	return &sqliteStore{newPostgresStore(db)}
+}
+
+// sqliteOrdering compares times as the UTC text SQLite stores them as,
+// with the latest possible date standing in for PostgreSQL's infinity.
+var sqliteOrdering = noteOrdering{
+	expr: func(sortKey noteSortKey, operand string, cursor bool) string {
+		return fmt.Sprintf(strings.ReplaceAll(sortKey.expr, "'infinity'::timestamptz", "'9999-12-31'"), operand)
+	},
+	value: func(sortKey noteSortKey, key *string) (interface{}, error) {
+		if key == nil || !strings.HasPrefix(sortKey.cast, "timestamp") {
+			return key, nil
+		}
+		t, err := time.Parse(time.RFC3339Nano, *key)
+		if err != nil {
+			return nil, errors.New("invalid cursor")
+		}
+		return t, nil
+	},
+}
+
+// ListNotes returns a page of the notes in scope for the user, see postgresStore.ListNotes.
+func (s *sqliteStore) ListNotes(username string, opts noteListOptions) (notePage, error) {
+	return listNotePage(s.db, sqliteOrdering, username, opts)
+}
+
+// CreateNote inserts a new note and its tags and returns its ID.
+// The new note is also recorded as its first revision.
+func (s *sqliteStore) CreateNote(note Note) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if err := checkDelegate(tx, note.NoteDelegation.String); err != nil {
+		return 0, err
+	}
+
+	var id int
+	err = tx.QueryRow(`
+		INSERT INTO notes (title, noteType, description, due_at, noteStatus, noteDelegation, owner)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id
+	`, note.Title, note.NoteType, note.Description, note.DueAt, note.NoteStatus.String, note.NoteDelegation.String, note.Owner).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO note_revisions (note_id, revision, edited_by, edited_at, title, noteType, description,
+			due_at, noteStatus, noteDelegation)
+		SELECT id, 1, owner, noteCreated, title, noteType, description,
+			due_at, noteStatus, noteDelegation
+		FROM notes
+		WHERE id = $1
+	`, id)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(note.Tags) > 0 {
+		if err := setSQLiteNoteTags(tx, id, note.Tags); err != nil {
+			return 0, err
+		}
+	}
+
+	return id, tx.Commit()
+}
+
+// UpdateNote updates note fields and tags and records the updated note as a new revision.
+func (s *sqliteStore) UpdateNote(note Note, editedBy string) error {
+	return updateNote(s.db, note, editedBy, setSQLiteNoteTags)
+}
+
+// setSQLiteNoteTags replaces the tags of a note like setNoteTags, a tag at a time.
+func setSQLiteNoteTags(tx *sql.Tx, noteID int, tags []string) error {
+	if _, err := tx.Exec("DELETE FROM note_tags WHERE note_id = $1", noteID); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("UPDATE notes SET tags_text = $2 WHERE id = $1", noteID, strings.Join(tags, " ")); err != nil {
+		return err
+	}
+
+	for _, tag := range tags {
+		if _, err := tx.Exec("INSERT INTO tags (name) VALUES ($1) ON CONFLICT (name) DO NOTHING", tag); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT INTO note_tags (note_id, tag_id) SELECT $1, id FROM tags WHERE name = $2", noteID, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SharedUsers retrieves the shared users of several notes in one query, keyed by note ID.
+// The IDs are passed as a JSON array.
+func (s *sqliteStore) SharedUsers(noteIDs []int) (map[int][]UserShare, error) {
+	sharedUsers := make(map[int][]UserShare)
+	if len(noteIDs) == 0 {
+		return sharedUsers, nil
+	}
+
+	ids, err := json.Marshal(noteIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(`
+		SELECT note_id, username, privileges FROM user_shares
+		WHERE note_id IN (SELECT value FROM json_each($1))
+		ORDER BY note_id, username
+	`, string(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var noteID int
+		var user UserShare
+		if err := rows.Scan(&noteID, &user.Username, &user.Privileges); err != nil {
+			return nil, err
+		}
+		sharedUsers[noteID] = append(sharedUsers[noteID], user)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sharedUsers, nil
+}
+
+// ftsQuery translates the text of a search, as websearch_to_tsquery reads it, into an FTS5 query:
+// words must all match, "quoted phrases" match as phrases and OR joins the terms either side.
+// Excluded (-word) terms are returned as a separate query of any of them, since FTS5 has no unary NOT.
+// Each term is written as a quoted string of its words, so nothing in it is read as FTS5 syntax.
+func ftsQuery(text string) (match, excluded string) {
+	var groups [][]string
+	var exclusions []string
+	or := false
+	for _, token := range splitSearchTokens(text) {
+		if token == "OR" {
+			or = len(groups) > 0
+			continue
+		}
+
+		exclude := strings.HasPrefix(token, "-")
+		words := searchWordPattern.FindAllString(strings.TrimPrefix(token, "-"), -1)
+		if len(words) == 0 {
+			continue
+		}
+		term := `"` + strings.Join(words, " ") + `"`
+
+		switch {
+		case exclude:
+			exclusions = append(exclusions, term)
+		case or:
+			groups[len(groups)-1] = append(groups[len(groups)-1], term)
+		default:
+			groups = append(groups, []string{term})
+		}
+		or = false
+	}
+
+	terms := make([]string, len(groups))
+	for i, group := range groups {
+		terms[i] = "(" + strings.Join(group, " OR ") + ")"
+	}
+	return strings.Join(terms, " AND "), strings.Join(exclusions, " OR ")
+}
+
+// The FTS5 functions ranking a match and marking it in the title and description.
+// The columns are weighted like the search_vector of PostgreSQL.
+const (
+	ftsRank    = "-bm25(notes_fts, 1.0, 0.4, 0.2, 0.1)"
+	ftsTitle   = "highlight(notes_fts, 0, $%[1]d, $%[2]d)"
+	ftsSnippet = "snippet(notes_fts, 2, $%[1]d, $%[2]d, ' ... ', 25)"
+)
+
+// SearchNotes searches the notes the user owns, has been delegated or has been shared,
+// ranked by bm25 on the FTS5 index, see postgresStore.SearchNotes.
+func (s *sqliteStore) SearchNotes(search searchQuery, username string) ([]Note, error) {
+	// An empty search matches nothing
+	if search.isEmpty() {
+		return nil, nil
+	}
+
+	text, excluded := ftsQuery(search.Text)
+	if strings.TrimSpace(search.Text) != "" && text == "" && excluded == "" {
+		// Like websearch_to_tsquery, text with no words matches nothing
+		return nil, nil
+	}
+
+	match := searchMatch{ranking: "0 AS rank, n.title, n.description"}
+	if text != "" {
+		match = searchMatch{
+			ranking:   ftsRank + " AS rank, " + fmt.Sprintf(ftsTitle, 3, 4) + ", " + fmt.Sprintf(ftsSnippet, 3, 4),
+			from:      "JOIN notes_fts ON notes_fts.rowid = n.id",
+			condition: "notes_fts MATCH $2",
+			args:      []interface{}{text, headlineStart, headlineStop},
+		}
+	}
+	if excluded != "" {
+		match.args = append(match.args, excluded)
+		exclusion := fmt.Sprintf("n.id NOT IN (SELECT rowid FROM notes_fts WHERE notes_fts MATCH $%d)", len(match.args)+1)
+		if match.condition != "" {
+			exclusion = match.condition + " AND " + exclusion
+		}
+		match.condition = exclusion
+	}
+
+	return querySearch(s.db, search, username, match, 0)
+}
+
+// FuzzySearchNotes finds notes with words starting with the words of the search, or a title
+// or description similar to it, see postgresStore.FuzzySearchNotes. Notes matching by prefix
+// rank above those only similar to the search.
+func (s *sqliteStore) FuzzySearchNotes(search searchQuery, username string, limit int) ([]Note, error) {
+	words := searchWords(search.Text)
+	if len(words) == 0 {
+		return nil, nil
+	}
+
+	terms := make([]string, len(words))
+	for i, word := range words {
+		terms[i] = `"` + word + `"*`
+	}
+
+	// A prefix match adds 1 to the rank, more than similarity alone can
+	match := searchMatch{
+		ranking: `COALESCE(1 + m.rank, 0) +
+				max(word_similarity($2, n.title), word_similarity($2, n.description)) AS rank,
+			COALESCE(m.title, n.title), COALESCE(m.description, n.description)`,
+		from: `LEFT JOIN (
+				SELECT rowid AS id, ` + ftsRank + ` AS rank, ` + fmt.Sprintf(ftsTitle, 4, 5) + ` AS title,
+					` + fmt.Sprintf(ftsSnippet, 4, 5) + ` AS description
+				FROM notes_fts
+				WHERE notes_fts MATCH $3
+			) m ON m.id = n.id`,
+		condition: "(m.id IS NOT NULL OR word_similarity($2, n.title) >= $6 OR word_similarity($2, n.description) >= $6)",
+		args: []interface{}{strings.Join(words, " "), strings.Join(terms, " AND "), headlineStart, headlineStop,
+			wordSimilarityThreshold},
+	}
+
+	return querySearch(s.db, search, username, match, limit)
+}
+
+// The pg_trgm thresholds of the % and <% operators.
+const (
+	similarityThreshold     = 0.3
+	wordSimilarityThreshold = 0.6
+)
+
+// SimilarWords finds the most similar word in the notes the user can see to each word,
+// see postgresStore.SimilarWords. The words of the notes are compared in Go.
+func (s *sqliteStore) SimilarWords(words []string, username string) (map[string]string, error) {
+	rows, err := s.db.Query(`
+		SELECT n.title || ' ' || n.description || ' ' || `+noteTagsColumn("n")+`
+		FROM notes n
+		WHERE `+visibleNoteCondition, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	seen := make(map[string]bool)
+	var noteWords []string
+	for rows.Next() {
+		var text string
+		if err := rows.Scan(&text); err != nil {
+			return nil, err
+		}
+		for _, word := range searchWordPattern.FindAllString(strings.ToLower(text), -1) {
+			if !seen[word] {
+				seen[word] = true
+				noteWords = append(noteWords, word)
+			}
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Ties go to the word first in alphabetical order, as in PostgreSQL
+	sort.Strings(noteWords)
+	corrections := make(map[string]string)
+	for _, word := range words {
+		best := 0.0
+		for _, candidate := range noteWords {
+			if similarity := trigramSimilarity(candidate, word); similarity >= similarityThreshold && similarity > best {
+				best, corrections[word] = similarity, candidate
+			}
+		}
+	}
+
+	return corrections, nil
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newSQLiteTestApp returns an App on a new SQLite database with the schema migrated, the API
+// routes and the given users. The test is skipped when go-sqlite3 was built without cgo or FTS5;
+// run the tests with -tags sqlite_fts5 to include them.
+func newSQLiteTestApp(t *testing.T, usernames ...string) *App {
+	cfg := defaultConfig()
+	cfg.Database.Backend = "sqlite"
+	cfg.Database.Path = filepath.Join(t.TempDir(), "notes.db")
+
+	db, err := setupSQLiteDatabase(&cfg)
+	if errors.Is(err, errSQLiteNoFTS5) || (err != nil && strings.Contains(err.Error(), "CGO_ENABLED=0")) {
+		t.Skipf("SQLite is not available: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("Opening the database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	a := &App{db: db, config: &cfg}
+	a.useStore(newSQLiteStore(db))
+	useTestSessions(t, a)
+	if err := a.migrateUp(); err != nil {
+		t.Fatalf("Migrating the database: %v", err)
+	}
+	createTestUsers(t, a, usernames)
+	a.initializeRoutes()
+	return a
+}
+
+// createTestNote creates a note and fails the test if it cannot.
+func createTestNote(t *testing.T, a *App, note Note) int {
+	t.Helper()
+	id, err := a.notes.CreateNote(note)
+	if err != nil {
+		t.Fatalf("Creating note %q: %v", note.Title, err)
+	}
+	return id
+}
+
+func TestFTSQuery(t *testing.T) {
+	tests := []struct {
+		text, match, excluded string
+	}{
+		{"milk eggs", `("milk") AND ("eggs")`, ""},
+		{`"planning meeting" agenda`, `("planning meeting") AND ("agenda")`, ""},
+		{"milk OR eggs bread", `("milk" OR "eggs") AND ("bread")`, ""},
+		{"OR milk -eggs -\"sour cream\"", `("milk")`, `"eggs" OR "sour cream"`},
+		{`NEAR("a" b)*`, `("NEAR a") AND ("b")`, ""},
+	}
+
+	for _, test := range tests {
+		match, excluded := ftsQuery(test.text)
+		if match != test.match || excluded != test.excluded {
+			t.Errorf("ftsQuery(%q) = %q, %q, want %q, %q", test.text, match, excluded, test.match, test.excluded)
+		}
+	}
+}
+
+func TestTrigramSimilarity(t *testing.T) {
+	if got := trigramSimilarity("word", "word"); got != 1 {
+		t.Errorf("Expected identical words to be similar 1, got %v", got)
+	}
+	// 4 of the 12 distinct trigrams are shared, as pg_trgm counts them
+	if got := trigramSimilarity("meetnig", "meeting"); got < 0.33 || got > 0.34 {
+		t.Errorf("Expected a similarity of 1/3, got %v", got)
+	}
+	if got := trigramWordSimilarity("meting", "Agenda for the team meeting"); got < wordSimilarityThreshold {
+		t.Errorf("Expected meting to be word similar to the title, got %v", got)
+	}
+	if got := trigramWordSimilarity("", "anything"); got != 0 {
+		t.Errorf("Expected no similarity to nothing, got %v", got)
+	}
+}
+
+func TestSQLiteStore_Search(t *testing.T) {
+	a := newSQLiteTestApp(t, "alice", "bob")
+	createTestNote(t, a, Note{Title: "Buy groceries", NoteType: "Task", Owner: "alice",
+		Description: "Milk, eggs and bread for the week", Tags: []string{"shopping"}})
+	meeting := createTestNote(t, a, Note{Title: "Team meeting", NoteType: "Note", Owner: "alice",
+		Description: "Agenda and minutes of the planning meeting", Tags: []string{"work"}})
+	createTestNote(t, a, Note{Title: "Plan holiday", NoteType: "Note", Owner: "alice",
+		Description: "Book the flights and a hotel"})
+	createTestNote(t, a, Note{Title: "Bob's groceries", NoteType: "Task", Owner: "bob", Description: "Cheese"})
+
+	search := func(text string) []Note {
+		t.Helper()
+		query, err := parseSearchQuery(text, time.UTC)
+		if err != nil {
+			t.Fatalf("parseSearchQuery(%q): %v", text, err)
+		}
+		notes, err := a.search.SearchNotes(query, "alice")
+		if err != nil {
+			t.Fatalf("SearchNotes(%q): %v", text, err)
+		}
+		return notes
+	}
+	titles := func(notes []Note) string {
+		var got []string
+		for _, note := range notes {
+			got = append(got, note.Title)
+		}
+		return strings.Join(got, ", ")
+	}
+
+	tests := map[string]string{
+		"meetings":                   "Team meeting",
+		"groceries":                  "Buy groceries",
+		`"planning meeting"`:         "Team meeting",
+		`"meeting planning"`:         "",
+		"groceries OR hotel":         "Plan holiday, Buy groceries",
+		"-meeting":                   "Buy groceries, Plan holiday",
+		"tag:work":                   "Team meeting",
+		"type:task":                  "Buy groceries",
+		"milk -shopping":             "",
+		"!!!":                        "",
+		"shopping week type:task":    "Buy groceries",
+		"holiday OR groceries -eggs": "Plan holiday",
+	}
+	for text, want := range tests {
+		if got := titles(search(text)); got != want {
+			t.Errorf("Search %q found %q, want %q", text, got, want)
+		}
+	}
+
+	// Matches are marked in the title and description
+	notes := search("meeting")
+	if len(notes) != 1 || notes[0].ID != meeting || notes[0].Rank <= 0 {
+		t.Fatalf("Expected the meeting note with a rank, got %+v", notes)
+	}
+	if notes[0].TitleHeadline != "Team "+headlineStart+"meeting"+headlineStop ||
+		!strings.Contains(notes[0].Headline, headlineStart+"meeting"+headlineStop) {
+		t.Errorf("Unexpected headlines %q and %q", notes[0].TitleHeadline, notes[0].Headline)
+	}
+
+	// The index follows edits
+	note, err := a.notes.GetNote(meeting)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	note.Title = "Team standup"
+	note.Tags = []string{"daily"}
+	if err := a.notes.UpdateNote(*note, "alice"); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if got := titles(search("standup tag:daily")); got != "Team standup" {
+		t.Errorf("Expected the renamed note, got %q", got)
+	}
+	if got := titles(search("tag:work")); got != "" {
+		t.Errorf("Expected no notes tagged work, got %q", got)
+	}
+}
+
+func TestSQLiteStore_FuzzySearchAndDidYouMean(t *testing.T) {
+	a := newSQLiteTestApp(t, "alice")
+	createTestNote(t, a, Note{Title: "Buy groceries", NoteType: "Task", Owner: "alice", Description: "Milk and eggs"})
+	createTestNote(t, a, Note{Title: "Team meeting", NoteType: "Note", Owner: "alice", Description: "Agenda"})
+
+	fallback := func(text string) searchResults {
+		t.Helper()
+		query, err := parseSearchQuery(text, time.UTC)
+		if err != nil {
+			t.Fatalf("parseSearchQuery(%q): %v", text, err)
+		}
+		results, err := a.searchWithFallback(text, query, "alice")
+		if err != nil {
+			t.Fatalf("searchWithFallback(%q): %v", text, err)
+		}
+		return results
+	}
+
+	// Words are found by their start
+	results := fallback("grocer")
+	if !results.Fuzzy || len(results.Notes) != 1 || results.Notes[0].Title != "Buy groceries" {
+		t.Errorf("Expected a fuzzy match on groceries, got %+v", results)
+	}
+	if results.Notes[0].TitleHeadline != "Buy "+headlineStart+"groceries"+headlineStop {
+		t.Errorf("Expected the prefix match to be marked, got %q", results.Notes[0].TitleHeadline)
+	}
+
+	// And misspelt words by their trigrams, with a corrected search to suggest
+	results = fallback("team meting")
+	if len(results.Notes) != 1 || results.Notes[0].Title != "Team meeting" || results.DidYouMean != "team meeting" {
+		t.Errorf("Expected the meeting note and a correction, got %+v", results)
+	}
+	results = fallback("meetnig")
+	if len(results.Notes) != 0 || results.DidYouMean != "meeting" {
+		t.Errorf("Expected only a correction, got %+v", results)
+	}
+}
+
+func TestSQLiteStore_MigrateDownAndUp(t *testing.T) {
+	a := newSQLiteTestApp(t)
+
+	tableExists := func(name string) bool {
+		t.Helper()
+		var count int
+		if err := a.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = $1", name).Scan(&count); err != nil {
+			t.Fatalf("Expected no error, but got %v", err)
+		}
+		return count > 0
+	}
+
+	if err := a.migrateDown(3); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if tableExists("audit_log") || tableExists("password_reset_tokens") || tableExists("recovery_codes") || !tableExists("notes") {
+		t.Error("Expected only the tables of the later migrations to be dropped")
+	}
+
+	if err := a.migrateDown(1); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if tableExists("notes") || tableExists("notes_fts") {
+		t.Error("Expected the schema to be dropped")
+	}
+
+	if err := a.migrateUp(); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if !tableExists("notes") || !tableExists("notes_fts") || !tableExists("audit_log") {
+		t.Error("Expected the schema to be created again")
+	}
+}
+
+func TestSQLiteStore_HistoryTrashAndTokens(t *testing.T) {
+	a := newSQLiteTestApp(t, "alice", "bob")
+	id := createTestNote(t, a, Note{Title: "Report", NoteType: "Task", Owner: "alice", Tags: []string{"q_1"}})
+
+	// Every edit is a revision
+	note, err := a.notes.GetNote(id)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	note.Description = "Due Friday"
+	if err := a.notes.UpdateNote(*note, "bob"); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	revisions, err := a.listNoteRevisions(id)
+	if err != nil || len(revisions) != 2 || revisions[0].Revision != 2 || revisions[0].EditedBy.String != "bob" {
+		t.Errorf("Expected bob's edit as revision 2, got %+v (%v)", revisions, err)
+	}
+
+	// Underscores in tag prefixes are not wildcards
+	if tags, err := a.autocompleteTags("alice", "q_"); err != nil || len(tags) != 1 {
+		t.Errorf("Expected tag q_1, got %v (%v)", tags, err)
+	}
+	if tags, err := a.autocompleteTags("alice", "q1"); err != nil || len(tags) != 0 {
+		t.Errorf("Expected no tags, got %v (%v)", tags, err)
+	}
+
+	// Deleted notes wait in the trash until they are restored or expire
+	if err := a.notes.DeleteNote(id, "alice"); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if trashed, err := a.listTrashedNotes("alice"); err != nil || len(trashed) != 1 {
+		t.Errorf("Expected the note in the trash, got %+v (%v)", trashed, err)
+	}
+	if purged, err := a.purgeExpiredTrash(time.Hour); err != nil || purged != 0 {
+		t.Errorf("Expected nothing to expire yet, got %d (%v)", purged, err)
+	}
+	if err := a.restoreNoteFromTrash(id, "alice"); err != nil {
+		t.Errorf("Expected no error, but got %v", err)
+	}
+
+	// Tokens are found until they expire
+	token, err := a.createAPIToken("alice", "laptop", []string{ScopeNotesRead}, sql.NullTime{})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if found, err := a.lookupAPIToken(token); err != nil || found.Username != "alice" {
+		t.Errorf("Expected alice's token, got %+v (%v)", found, err)
+	}
+	expired, err := a.createAPIToken("alice", "old", []string{ScopeNotesRead}, sql.NullTime{Time: time.Now().Add(-time.Minute), Valid: true})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if _, err := a.lookupAPIToken(expired); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows for an expired token, got %v", err)
+	}
+
+	// Saved searches can be shared, and removed by the user they are shared with
+	searchID, err := a.saveSearch(SavedSearch{Owner: "alice", Name: "Reports", Query: "report", Sort: sortRelevance})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if err := a.shareSavedSearch(searchID, "alice", "bob"); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if searches, err := a.listSavedSearches("alice"); err != nil || len(searches) != 1 || len(searches[0].SharedWith) != 1 {
+		t.Errorf("Expected the search shared with bob, got %+v (%v)", searches, err)
+	}
+	if err := a.unshareSavedSearch(searchID, "alice", "bob"); err != sql.ErrNoRows {
+		t.Errorf("Expected bob not to be able to remove alice, got %v", err)
+	}
+	if err := a.unshareSavedSearch(searchID, "bob", "bob"); err != nil {
+		t.Errorf("Expected no error, but got %v", err)
+	}
+
+	// Sessions survive in the database
+	store := &pgSessionStore{db: a.db}
+	sess := newTestSession("alice")
+	store.Add(sess)
+	if loaded := store.Get(sess.ID()); loaded == nil || loaded.CAttr("username") != "alice" {
+		t.Errorf("Expected alice's session, got %v", loaded)
+	}
+}
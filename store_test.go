@@ -0,0 +1,448 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newMemoryTestApp returns an App on the in-memory store, with the API routes and the given users
+func newMemoryTestApp(t *testing.T, usernames ...string) *App {
+	a := &App{}
+	// As Initialize does on the memory backend, features that need a database report errNoDatabase
+	a.db, _ = sql.Open("nodb", "")
+	a.useStore(newMemoryStore())
+	useTestSessions(t, a)
+	createTestUsers(t, a, usernames)
+	a.initializeRoutes()
+	return a
+}
+
+// createTestUsers registers the users on the app's store.
+func createTestUsers(t testing.TB, a *App, usernames []string) {
+	t.Helper()
+	for _, username := range usernames {
+		if err := a.users.CreateUser(username, []byte("hash")); err != nil {
+			t.Fatalf("Creating user %s: %v", username, err)
+		}
+	}
+}
+
+// eachStore runs a test on the in-memory store, on SQLite and on PostgreSQL, so they all pass the
+// same tests. Each app has the API routes and the given users. SQLite needs -tags sqlite_fts5 and
+// PostgreSQL needs NOTES_TEST_POSTGRES_URL, the test is skipped on them otherwise.
+func eachStore(t *testing.T, usernames []string, test func(t *testing.T, a *App)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, newMemoryTestApp(t, usernames...))
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		test(t, newSQLiteTestApp(t, usernames...))
+	})
+	t.Run("postgres", func(t *testing.T) {
+		test(t, newPostgresTestApp(t, usernames...))
+	})
+}
+
+func TestStore_ListNotesPagesByTitle(t *testing.T) {
+	eachStore(t, []string{"alice", "bob"}, func(t *testing.T, a *App) {
+		for _, title := range []string{"walk dog", "Buy milk", "Pay rent", "Oats", "call mum"} {
+			if _, err := a.notes.CreateNote(Note{Title: title, NoteType: "Task", Owner: "alice"}); err != nil {
+				t.Fatalf("Expected no error, but got %v", err)
+			}
+		}
+		if _, err := a.notes.CreateNote(Note{Title: "Apples", NoteType: "Note", Owner: "alice"}); err != nil {
+			t.Fatalf("Expected no error, but got %v", err)
+		}
+
+		titles := func(page notePage) []string {
+			var got []string
+			for _, note := range page.Notes {
+				got = append(got, note.Title)
+			}
+			return got
+		}
+		opts := noteListOptions{Scope: scopeOwned, Filter: searchQuery{NoteType: "Task"}, Sort: sortTitle, Limit: 2}
+
+		// Forward through every page, titles ignoring case
+		var pages [][]string
+		var page notePage
+		for {
+			var err error
+			page, err = a.notes.ListNotes("alice", opts)
+			if err != nil {
+				t.Fatalf("Expected no error, but got %v", err)
+			}
+			pages = append(pages, titles(page))
+			if page.Next == nil {
+				break
+			}
+			opts.Cursor = page.Next
+		}
+		want := [][]string{{"Buy milk", "call mum"}, {"Oats", "Pay rent"}, {"walk dog"}}
+		if len(pages) != len(want) {
+			t.Fatalf("Expected pages %v, got %v", want, pages)
+		}
+		for i := range want {
+			if len(pages[i]) != len(want[i]) || pages[i][0] != want[i][0] || pages[i][len(pages[i])-1] != want[i][len(want[i])-1] {
+				t.Errorf("Page %d: expected %v, got %v", i, want[i], pages[i])
+			}
+		}
+
+		// And back again from the last page
+		opts.Cursor = page.Prev
+		page, err := a.notes.ListNotes("alice", opts)
+		if err != nil {
+			t.Fatalf("Expected no error, but got %v", err)
+		}
+		if got := titles(page); len(got) != 2 || got[0] != "Oats" || got[1] != "Pay rent" || page.Prev == nil || page.Next == nil {
+			t.Errorf("Expected the middle page with links both ways, got %v (prev %v, next %v)", got, page.Prev, page.Next)
+		}
+
+		// Nobody else sees alice's notes
+		page, err = a.notes.ListNotes("bob", noteListOptions{Scope: scopeAll, Sort: sortCreated, Limit: 10})
+		if err != nil || len(page.Notes) != 0 {
+			t.Errorf("Expected no notes for bob, got %v (%v)", page.Notes, err)
+		}
+	})
+}
+
+func TestStore_ListNotesByDueDateThenCreated(t *testing.T) {
+	eachStore(t, []string{"alice"}, func(t *testing.T, a *App) {
+		due := time.Date(2024, 10, 23, 9, 0, 0, 0, time.UTC)
+		for _, note := range []Note{
+			{Title: "Later", DueAt: sql.NullTime{Time: due.Add(48 * time.Hour), Valid: true}},
+			{Title: "Someday"},
+			{Title: "Soon", DueAt: sql.NullTime{Time: due, Valid: true}},
+			{Title: "Tomorrow", DueAt: sql.NullTime{Time: due.Add(24 * time.Hour), Valid: true}},
+		} {
+			note.NoteType, note.Owner = "Task", "alice"
+			if _, err := a.notes.CreateNote(note); err != nil {
+				t.Fatalf("Expected no error, but got %v", err)
+			}
+		}
+
+		// Follows the next cursors to the end of the list
+		list := func(sort string) []string {
+			t.Helper()
+			opts := noteListOptions{Scope: scopeOwned, Sort: sort, Limit: 3}
+			var titles []string
+			for {
+				page, err := a.notes.ListNotes("alice", opts)
+				if err != nil {
+					t.Fatalf("Expected no error, but got %v", err)
+				}
+				for _, note := range page.Notes {
+					titles = append(titles, note.Title)
+				}
+				if page.Next == nil {
+					return titles
+				}
+				opts.Cursor = page.Next
+			}
+		}
+
+		// Undated notes come last
+		if got := strings.Join(list(sortDue), ", "); got != "Soon, Tomorrow, Later, Someday" {
+			t.Errorf("Expected the notes soonest due first, got %s", got)
+		}
+		if got := strings.Join(list(sortCreated), ", "); got != "Tomorrow, Soon, Someday, Later" {
+			t.Errorf("Expected the notes newest first, got %s", got)
+		}
+	})
+}
+
+func TestStore_RolesFollowSharesAndDelegation(t *testing.T) {
+	eachStore(t, nil, func(t *testing.T, a *App) {
+		for _, username := range []string{"alice", "bob", "carol"} {
+			if err := a.users.CreateUser(username, []byte("hash")); err != nil {
+				t.Fatalf("Creating user %s: %v", username, err)
+			}
+		}
+		if err := a.users.CreateUser("alice", []byte("hash")); err != errUserExists {
+			t.Errorf("Expected errUserExists registering alice twice, got %v", err)
+		}
+
+		id, err := a.notes.CreateNote(Note{Title: "Report", NoteType: "Task", Owner: "alice"})
+		if err != nil {
+			t.Fatalf("Expected no error, but got %v", err)
+		}
+
+		expectRole := func(username string, want NoteRole) {
+			t.Helper()
+			role, err := a.notes.NoteRole(id, username)
+			if err != nil || role != want {
+				t.Errorf("NoteRole(%s) = %v, %v, want %v", username, role, err, want)
+			}
+		}
+		expectRole("alice", RoleOwner)
+		expectRole("bob", RoleNone)
+
+		if err := a.shares.ShareNote(id, "bob", "viewer"); err != nil {
+			t.Fatalf("Expected no error, but got %v", err)
+		}
+		expectRole("bob", RoleViewer)
+		if err := a.shares.ShareNote(id, "bob", "editor"); err != errAlreadyShared {
+			t.Errorf("Expected errAlreadyShared sharing the note with bob twice, got %v", err)
+		}
+		if err := a.shares.ShareNote(id, "nobody", "viewer"); err != errUserNotFound {
+			t.Errorf("Expected errUserNotFound sharing with an unknown user, got %v", err)
+		}
+		if err := a.shares.ShareNote(id, "alice", "viewer"); err != errShareForbidden {
+			t.Errorf("Expected errShareForbidden sharing with the owner, got %v", err)
+		}
+		if err := a.shares.ShareNote(id+1, "bob", "viewer"); err != errNoteNotFound {
+			t.Errorf("Expected errNoteNotFound sharing a missing note, got %v", err)
+		}
+		if err := a.shares.UpdateShare(id, "carol", "editor"); err != errShareNotFound {
+			t.Errorf("Expected errShareNotFound updating a missing share, got %v", err)
+		}
+		if err := a.shares.UpdateShare(id, "bob", "editor"); err != nil {
+			t.Fatalf("Expected no error, but got %v", err)
+		}
+		expectRole("bob", RoleEditor)
+
+		if err := a.notes.SetDelegation(id, "nobody"); err != errUserNotFound {
+			t.Errorf("Expected errUserNotFound delegating to an unknown user, got %v", err)
+		}
+		if err := a.notes.SetDelegation(id, "carol"); err != nil {
+			t.Fatalf("Expected no error, but got %v", err)
+		}
+		expectRole("carol", RoleDelegate)
+		page, err := a.notes.ListNotes("carol", noteListOptions{Scope: scopeDelegated, Sort: sortCreated, Limit: 10})
+		if err != nil || len(page.Notes) != 1 || page.Notes[0].Privileges != string(RoleDelegate) {
+			t.Errorf("Expected the note delegated to carol, got %+v (%v)", page.Notes, err)
+		}
+
+		unshared, err := a.shares.UnsharedUsers(id, "alice")
+		if err != nil || len(unshared) != 1 || unshared[0].Username != "carol" {
+			t.Errorf("Expected only carol to be unshared, got %+v (%v)", unshared, err)
+		}
+
+		// A note in the trash is out of reach, but can still be looked up
+		if err := a.notes.DeleteNote(id, "alice"); err != nil {
+			t.Fatalf("Expected no error, but got %v", err)
+		}
+		expectRole("alice", RoleNone)
+		if _, err := a.notes.GetNote(id); err != nil {
+			t.Errorf("Expected the deleted note to be found, got %v", err)
+		}
+		if _, err := a.notes.GetNote(id + 1); err != sql.ErrNoRows {
+			t.Errorf("Expected sql.ErrNoRows for a missing note, got %v", err)
+		}
+		if err := a.shares.RemoveShare(id, "carol"); err != errNoteNotFound {
+			t.Errorf("Expected errNoteNotFound unsharing a note in the trash, got %v", err)
+		}
+		if err := a.shares.RemoveShare(id, "bob"); err != nil {
+			t.Errorf("Expected bob's share to be removed, got %v", err)
+		}
+	})
+}
+
+func TestAPI_Store_CreateAndShareNote(t *testing.T) {
+	eachStore(t, []string{"alice", "bob"}, func(t *testing.T, a *App) {
+
+		rr := serveAPI(a, "POST", "/api/v1/notes", `{"title":"Groceries","note_type":"Note","description":"Milk","tags":["shopping"]}`, "alice")
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("Handler returned wrong status code: got %v, want %v: %s", rr.Code, http.StatusCreated, rr.Body.String())
+		}
+		location := rr.Header().Get("Location")
+
+		// bob cannot see the note until alice shares it
+		if rr := serveAPI(a, "GET", location, "", "bob"); rr.Code != http.StatusNotFound {
+			t.Errorf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusNotFound)
+		}
+		rr = serveAPI(a, "POST", location+"/shares", `{"username":"bob","privileges":"viewer"}`, "alice")
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("Handler returned wrong status code: got %v, want %v: %s", rr.Code, http.StatusCreated, rr.Body.String())
+		}
+
+		rr = serveAPI(a, "GET", location, "", "bob")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Handler returned wrong status code: got %v, want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+		}
+		var note struct {
+			Title string
+			Owner string
+			Tags  []string
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &note); err != nil {
+			t.Fatalf("Decoding response: %v", err)
+		}
+		if note.Title != "Groceries" || note.Owner != "alice" || len(note.Tags) != 1 || note.Tags[0] != "shopping" {
+			t.Errorf("Unexpected note %+v", note)
+		}
+
+		// Viewers cannot edit
+		if rr := serveAPI(a, "PATCH", location, `{"title":"Mine now"}`, "bob"); rr.Code != http.StatusForbidden {
+			t.Errorf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusForbidden)
+		}
+
+		// Only the owner sees who the note is shared with
+		var owned struct {
+			SharedUsers []map[string]string `json:"shared_users"`
+		}
+		rr = serveAPI(a, "GET", location, "", "alice")
+		if err := json.Unmarshal(rr.Body.Bytes(), &owned); err != nil || len(owned.SharedUsers) != 1 {
+			t.Errorf("Expected the owner to see the share, got %s (%v)", rr.Body.String(), err)
+		}
+		if strings.Contains(serveAPI(a, "GET", location, "", "bob").Body.String(), "shared_users") {
+			t.Error("Expected the shares to be hidden from a viewer")
+		}
+		if rr := serveAPI(a, "GET", location+"/shares", "", "alice"); rr.Code != http.StatusOK {
+			t.Errorf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusOK)
+		}
+		if rr := serveAPI(a, "GET", location+"/shares", "", "bob"); rr.Code != http.StatusForbidden {
+			t.Errorf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusForbidden)
+		}
+		if rr := serveAPI(a, "GET", "/api/v1/notes?scope=shared", "", "bob"); strings.Contains(rr.Body.String(), "shared_users") {
+			t.Errorf("Expected the shares to be hidden from a viewer's list, got %s", rr.Body.String())
+		}
+
+		// Notes can only be delegated to users that exist
+		if rr := serveAPI(a, "PUT", location+"/delegation", `{"username":"nobody"}`, "alice"); rr.Code != http.StatusNotFound {
+			t.Errorf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusNotFound)
+		}
+	})
+}
+
+func TestStore_DelegateMustExist(t *testing.T) {
+	eachStore(t, []string{"alice", "bob"}, func(t *testing.T, a *App) {
+		nobody := sql.NullString{String: "nobody", Valid: true}
+		if _, err := a.notes.CreateNote(Note{Title: "Groceries", NoteType: "Note", Description: "Milk", Owner: "alice", NoteDelegation: nobody}); err != errUserNotFound {
+			t.Errorf("Expected errUserNotFound creating a note delegated to an unknown user, got %v", err)
+		}
+		id, err := a.notes.CreateNote(Note{Title: "Groceries", NoteType: "Note", Description: "Milk", Owner: "alice"})
+		if err != nil {
+			t.Fatalf("Expected no error, but got %v", err)
+		}
+		if err := a.notes.UpdateNote(Note{ID: id, Title: "Groceries", NoteType: "Note", Description: "Milk", NoteDelegation: nobody}, "alice"); err != errUserNotFound {
+			t.Errorf("Expected errUserNotFound updating a note delegated to an unknown user, got %v", err)
+		}
+		location := "/api/v1/notes/" + strconv.Itoa(id)
+
+		// The API
+		if rr := serveAPI(a, "POST", "/api/v1/notes", `{"title":"Groceries","description":"Milk","note_delegation":"nobody"}`, "alice"); rr.Code != http.StatusNotFound {
+			t.Errorf("POST returned wrong status code: got %v, want %v: %s", rr.Code, http.StatusNotFound, rr.Body.String())
+		}
+		if rr := serveAPI(a, "PUT", location, `{"title":"Groceries","note_type":"Note","description":"Milk","note_delegation":"nobody"}`, "alice"); rr.Code != http.StatusNotFound {
+			t.Errorf("PUT returned wrong status code: got %v, want %v: %s", rr.Code, http.StatusNotFound, rr.Body.String())
+		}
+		if rr := serveAPI(a, "PATCH", location, `{"note_delegation":"nobody"}`, "alice"); rr.Code != http.StatusNotFound {
+			t.Errorf("PATCH returned wrong status code: got %v, want %v: %s", rr.Code, http.StatusNotFound, rr.Body.String())
+		}
+		if rr := serveAPI(a, "PATCH", location, `{"note_delegation":"bob","note_status":"Delegated"}`, "alice"); rr.Code != http.StatusOK {
+			t.Errorf("PATCH returned wrong status code: got %v, want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+		}
+
+		// The create and update forms
+		form := url.Values{"Id": {strconv.Itoa(id)}, "Title": {"Groceries"}, "NoteType": {"Note"}, "Description": {"Milk"}, "NoteStatus": {"Delegated"}, "NoteDelegation": {"nobody"}}
+		for path, handler := range map[string]http.HandlerFunc{"/create": a.createHandler, "/update": a.updateHandler} {
+			req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rr := httptest.NewRecorder()
+			handler(rr, withUser(req, "alice"))
+			if rr.Code != http.StatusNotFound {
+				t.Errorf("%s returned wrong status code: got %v, want %v: %s", path, rr.Code, http.StatusNotFound, rr.Body.String())
+			}
+		}
+
+		note, err := a.notes.GetNote(id)
+		if err != nil || note.NoteDelegation.String != "bob" {
+			t.Errorf("Expected the note to stay delegated to bob, got %+v (%v)", note, err)
+		}
+		page, err := a.notes.ListNotes("alice", noteListOptions{Scope: scopeOwned, Sort: sortCreated, Limit: 10})
+		if err != nil || len(page.Notes) != 1 {
+			t.Errorf("Expected only the one note, got %+v (%v)", page.Notes, err)
+		}
+	})
+}
+
+func TestStore_PasswordHashAndEmail(t *testing.T) {
+	eachStore(t, []string{"alice"}, func(t *testing.T, a *App) {
+		if err := a.users.SetPasswordHash("alice", []byte("new hash")); err != nil {
+			t.Fatalf("Expected no error, but got %v", err)
+		}
+		if hash, err := a.users.PasswordHash("alice"); err != nil || string(hash) != "new hash" {
+			t.Errorf("Expected the new hash, got %q, %v", hash, err)
+		}
+		if err := a.users.SetPasswordHash("nobody", []byte("hash")); err != sql.ErrNoRows {
+			t.Errorf("Expected sql.ErrNoRows for an unknown user, got %v", err)
+		}
+
+		if email, err := a.users.Email("alice"); err != nil || email != "" {
+			t.Errorf("Expected no email address yet, got %q, %v", email, err)
+		}
+		if err := a.users.SetEmail("alice", "alice@example.com"); err != nil {
+			t.Fatalf("Expected no error, but got %v", err)
+		}
+		if email, err := a.users.Email("alice"); err != nil || email != "alice@example.com" {
+			t.Errorf("Expected the email address, got %q, %v", email, err)
+		}
+	})
+}
+
+func TestStore_TOTPAndRecoveryCodes(t *testing.T) {
+	eachStore(t, []string{"alice"}, func(t *testing.T, a *App) {
+		if secret, err := a.users.TOTPSecret("alice"); err != nil || secret != "" {
+			t.Errorf("Expected no secret yet, got %q, %v", secret, err)
+		}
+		if ok, err := a.users.UseTOTPStep("alice", 100); err != nil || ok {
+			t.Errorf("Expected no code to be accepted without a secret, got %v, %v", ok, err)
+		}
+
+		if err := a.users.EnableTOTP("alice", "SECRET", []string{"hash1", "hash2"}); err != nil {
+			t.Fatalf("Expected no error, but got %v", err)
+		}
+		if secret, err := a.users.TOTPSecret("alice"); err != nil || secret != "SECRET" {
+			t.Errorf("Expected the secret, got %q, %v", secret, err)
+		}
+		if err := a.users.EnableTOTP("nobody", "SECRET", nil); err != sql.ErrNoRows {
+			t.Errorf("Expected sql.ErrNoRows for an unknown user, got %v", err)
+		}
+
+		// Each step can be used once, and earlier steps not after a later one
+		for _, use := range []struct {
+			step int64
+			ok   bool
+		}{{100, true}, {100, false}, {99, false}, {101, true}} {
+			if ok, err := a.users.UseTOTPStep("alice", use.step); err != nil || ok != use.ok {
+				t.Errorf("Using step %d: expected %v, got %v, %v", use.step, use.ok, ok, err)
+			}
+		}
+
+		if ok, err := a.users.UseRecoveryCode("alice", "hash1"); err != nil || !ok {
+			t.Errorf("Expected the recovery code to be accepted, got %v, %v", ok, err)
+		}
+		if ok, err := a.users.UseRecoveryCode("alice", "hash1"); err != nil || ok {
+			t.Errorf("Expected the used recovery code to be refused, got %v, %v", ok, err)
+		}
+		if left, err := a.users.RecoveryCodesLeft("alice"); err != nil || left != 1 {
+			t.Errorf("Expected 1 recovery code left, got %d, %v", left, err)
+		}
+
+		if err := a.users.SetRecoveryCodes("alice", []string{"hash3", "hash4", "hash5"}); err != nil {
+			t.Fatalf("Expected no error, but got %v", err)
+		}
+		if ok, _ := a.users.UseRecoveryCode("alice", "hash2"); ok {
+			t.Error("Expected the replaced recovery code to be refused")
+		}
+		if left, err := a.users.RecoveryCodesLeft("alice"); err != nil || left != 3 {
+			t.Errorf("Expected 3 recovery codes left, got %d, %v", left, err)
+		}
+
+		if err := a.users.DisableTOTP("alice"); err != nil {
+			t.Fatalf("Expected no error, but got %v", err)
+		}
+		secret, _ := a.users.TOTPSecret("alice")
+		left, _ := a.users.RecoveryCodesLeft("alice")
+		if secret != "" || left != 0 {
+			t.Errorf("Expected no secret and no recovery codes, got %q and %d", secret, left)
+		}
+	})
+}
@@ -0,0 +1,270 @@
+// Package main contains the main entry point for the Go application
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	// MaxTagLength is the maximum length of a tag name.
+	MaxTagLength = 32
+	// MaxTagsPerNote is the maximum number of tags on one note.
+	MaxTagsPerNote = 10
+	// maxTagSuggestions is the number of tags returned by the autocomplete endpoint.
+	maxTagSuggestions = 10
+)
+
+// invalidTagsMessage explains the tag rules on the HTML pages.
+const invalidTagsMessage = "Use at most 10 tags of up to 32 letters, digits, '.', '-' or '_'."
+
+// tagPattern is the form of a normalised tag: lower case letters, digits, dots, dashes and underscores.
+// Tags cannot contain spaces, so they can be typed as a space or comma separated list.
+var tagPattern = regexp.MustCompile(`^[\p{Ll}\p{N}][\p{Ll}\p{N}_.-]*$`)
+
+// TagCount is a tag and the number of notes visible to the user that carry it.
+type TagCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// normalizeTag lower cases a tag and drops surrounding spaces and a leading '#'.
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(tag), "#"))
+}
+
+// parseTags reads a comma or space separated list of tags, as typed in the note forms.
+func parseTags(input string) ([]string, error) {
+	fields := strings.FieldsFunc(input, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	})
+	return normalizeTags(fields)
+}
+
+// normalizeTags normalises, de-duplicates, sorts and validates a list of tags.
+func normalizeTags(tags []string) ([]string, error) {
+	seen := make(map[string]bool)
+	normalized := []string{}
+	for _, tag := range tags {
+		tag = normalizeTag(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if len(tag) > MaxTagLength {
+			return nil, fmt.Errorf("tag %q exceeds %d characters", tag, MaxTagLength)
+		}
+		if !tagPattern.MatchString(tag) {
+			return nil, fmt.Errorf("tag %q may only contain letters, digits, '.', '-' and '_'", tag)
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+
+	if len(normalized) > MaxTagsPerNote {
+		return nil, fmt.Errorf("a note can have at most %d tags", MaxTagsPerNote)
+	}
+
+	sort.Strings(normalized)
+	return normalized, nil
+}
+
+// noteTagsColumn selects a note's tags as one space separated string, to be read with splitTags.
+// noteAlias is the name of the notes table in the surrounding query.
+func noteTagsColumn(noteAlias string) string {
+	return noteAlias + ".tags_text"
+}
+
+// joinTags formats tags for the tags input of the note forms.
+func joinTags(tags []string) string {
+	return strings.Join(tags, ", ")
+}
+
+// hasTag reports whether tag is in tags.
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// splitTags turns the value of noteTagsColumn back into a list.
+func splitTags(column string) []string {
+	return strings.Fields(column)
+}
+
+// pgTextArray formats tags as a PostgreSQL array literal. Normalised tags never need quoting.
+func pgTextArray(values []string) string {
+	return "{" + strings.Join(values, ",") + "}"
+}
+
+// setNoteTags replaces the tags of a note, creating any tags that do not exist yet.
+// The note keeps a copy of its tags in tags_text, which its generated search_vector is built from,
+// so both are written in the caller's transaction.
+func setNoteTags(tx *sql.Tx, noteID int, tags []string) error {
+	if _, err := tx.Exec("DELETE FROM note_tags WHERE note_id = $1", noteID); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("UPDATE notes SET tags_text = $2 WHERE id = $1", noteID, strings.Join(tags, " ")); err != nil {
+		return err
+	}
+
+	if len(tags) == 0 {
+		return nil
+	}
+
+	names := pgTextArray(tags)
+	if _, err := tx.Exec("INSERT INTO tags (name) SELECT unnest($1::text[]) ON CONFLICT (name) DO NOTHING", names); err != nil {
+		return err
+	}
+
+	_, err := tx.Exec("INSERT INTO note_tags (note_id, tag_id) SELECT $1, id FROM tags WHERE name = ANY($2::text[])", noteID, names)
+	return err
+}
+
+// visibleNoteCondition limits a query on notes n to the notes user $1 can see:
+// their own, those delegated to them and those shared with them.
+const visibleNoteCondition = `n.deleted_at IS NULL AND (n.owner = $1 OR n.noteDelegation = $1
+	OR EXISTS (SELECT 1 FROM user_shares us WHERE us.note_id = n.id AND us.username = $1))`
+
+// TagCounts returns every tag on the notes the user can see, with the number of those notes carrying it.
+func (s *postgresStore) TagCounts(username string) ([]TagCount, error) {
+	rows, err := s.db.Query(`
+		SELECT t.name, COUNT(*)
+		FROM tags t
+		JOIN note_tags nt ON nt.tag_id = t.id
+		JOIN notes n ON n.id = nt.note_id
+		WHERE `+visibleNoteCondition+`
+		GROUP BY t.name
+		ORDER BY t.name
+	`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []TagCount{}
+	for rows.Next() {
+		var tc TagCount
+		if err := rows.Scan(&tc.Name, &tc.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, tc)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return counts, nil
+}
+
+// autocompleteTags suggests tags starting with prefix, most used first. Only tags on notes the user
+// can see are suggested, so tag names do not leak between users.
+func (a *App) autocompleteTags(username, prefix string) ([]string, error) {
+	suggestions := []string{}
+
+	prefix = normalizeTag(prefix)
+	if prefix != "" && !tagPattern.MatchString(prefix) {
+		// Nothing can match a prefix that is not a valid tag
+		return suggestions, nil
+	}
+
+	rows, err := a.db.Query(`
+		SELECT t.name
+		FROM tags t
+		JOIN note_tags nt ON nt.tag_id = t.id
+		JOIN notes n ON n.id = nt.note_id
+		WHERE `+visibleNoteCondition+` AND t.name LIKE $2 || '%' ESCAPE '\'
+		GROUP BY t.name
+		ORDER BY COUNT(*) DESC, t.name
+		LIMIT $3
+	`, username, strings.ReplaceAll(prefix, "_", `\_`), maxTagSuggestions)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		suggestions = append(suggestions, name)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return suggestions, nil
+}
+
+// filterNotesByTags keeps the notes that carry every one of the given tags.
+func filterNotesByTags(notes []Note, tags []string) []Note {
+	if len(tags) == 0 {
+		return notes
+	}
+
+	filtered := []Note{}
+	for _, note := range notes {
+		if noteHasTags(note, tags) {
+			filtered = append(filtered, note)
+		}
+	}
+	return filtered
+}
+
+// noteHasTags reports whether the note carries every one of the given tags.
+func noteHasTags(note Note, tags []string) bool {
+	for _, tag := range tags {
+		if !hasTag(note.Tags, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// tagFilter reads the tag filters from the query string. Tags can be repeated (?tag=a&tag=b)
+// or given as a comma separated list (?tag=a,b).
+func tagFilter(r *http.Request) ([]string, error) {
+	return parseTags(strings.Join(r.URL.Query()["tag"], ","))
+}
+
+// apiListTagsHandler handles GET /api/v1/tags, listing the user's tags with their note counts.
+func (a *App) apiListTagsHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := a.apiUsername(w, r)
+	if !ok {
+		return
+	}
+
+	counts, err := a.notes.TagCounts(username)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"tags": counts})
+}
+
+// apiAutocompleteTagsHandler handles GET /api/v1/tags/autocomplete?q=prefix.
+func (a *App) apiAutocompleteTagsHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := a.apiUsername(w, r)
+	if !ok {
+		return
+	}
+
+	suggestions, err := a.autocompleteTags(username, r.URL.Query().Get("q"))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"tags": suggestions})
+}
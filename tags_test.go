@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestParseTags(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    []string
+		wantErr bool
+	}{
+		{"", []string{}, false},
+		{"Work, #urgent  work,,home", []string{"home", "urgent", "work"}, false},
+		{"q3-report release_1.2", []string{"q3-report", "release_1.2"}, false},
+		{"über", []string{"über"}, false},
+		{"semi;colon", nil, true},
+		{"-leading", nil, true},
+		{strings.Repeat("x", MaxTagLength+1), nil, true},
+		{"a b c d e f g h i j k", nil, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseTags(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseTags(%q): unexpected error %v", tt.input, err)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseTags(%q) = %v, want %v", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestFilterNotesByTags(t *testing.T) {
+	notes := []Note{
+		{ID: 1, Tags: []string{"home", "urgent"}},
+		{ID: 2, Tags: []string{"urgent", "work"}},
+		{ID: 3},
+	}
+
+	if got := filterNotesByTags(notes, nil); len(got) != 3 {
+		t.Errorf("Expected every note without a filter, got %v", got)
+	}
+
+	got := filterNotesByTags(notes, []string{"urgent", "work"})
+	if len(got) != 1 || got[0].ID != 2 {
+		t.Errorf("Expected only note 2 to carry both tags, got %v", got)
+	}
+}
+
+func TestAPI_ListTags(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	mock.ExpectQuery("SELECT t.name, COUNT\\(\\*\\) FROM tags t").WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows([]string{"name", "count"}).AddRow("home", 1).AddRow("work", 3))
+
+	rr := serveAPI(a, "GET", "/api/v1/tags", "", "alice")
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v, want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+
+	var got struct {
+		Tags []TagCount `json:"tags"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Response is not valid JSON: %v", err)
+	}
+	want := []TagCount{{Name: "home", Count: 1}, {Name: "work", Count: 3}}
+	if !reflect.DeepEqual(got.Tags, want) {
+		t.Errorf("Got tags %v, want %v", got.Tags, want)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPI_AutocompleteTags(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	// Underscores are escaped so they are not LIKE wildcards
+	mock.ExpectQuery("SELECT t.name FROM tags t").WithArgs("alice", `release\_`, maxTagSuggestions).
+		WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("release_1.2"))
+
+	rr := serveAPI(a, "GET", "/api/v1/tags/autocomplete?q=Release_", "", "alice")
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v, want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	if body := strings.TrimSpace(rr.Body.String()); body != `{"tags":["release_1.2"]}` {
+		t.Errorf("Unexpected suggestions: %s", body)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPI_AutocompleteTags_InvalidPrefix(t *testing.T) {
+	a, mock := newAPITestApp(t)
+
+	rr := serveAPI(a, "GET", "/api/v1/tags/autocomplete?q=%25", "", "alice")
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusOK)
+	}
+	if body := strings.TrimSpace(rr.Body.String()); body != `{"tags":[]}` {
+		t.Errorf("Expected no suggestions, got %s", body)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
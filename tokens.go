@@ -0,0 +1,330 @@
+// Package main contains the main entry point for the Go application
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Scopes a personal access token can be granted.
+const (
+	ScopeNotesRead  = "notes:read"
+	ScopeNotesWrite = "notes:write"
+)
+
+// apiTokenPrefix marks personal access tokens so they are easy to recognise, e.g. in leaked logs.
+const apiTokenPrefix = "nt_"
+
+var validScopes = map[string]bool{ScopeNotesRead: true, ScopeNotesWrite: true}
+
+// APIToken is a personal access token. The plain token is never stored, only its hash.
+type APIToken struct {
+	ID         int
+	Username   string
+	Name       string
+	Scopes     []string
+	CreatedAt  time.Time
+	LastUsedAt sql.NullTime
+	ExpiresAt  sql.NullTime
+}
+
+// hasScope reports whether the token was granted the given scope.
+func (t *APIToken) hasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenContextKey is the request context key holding the *APIToken of a token authenticated request.
+type tokenContextKey struct{}
+
+// tokenFromContext returns the token that authenticated the request, or nil for session (or anonymous) requests.
+func tokenFromContext(r *http.Request) *APIToken {
+	token, _ := r.Context().Value(tokenContextKey{}).(*APIToken)
+	return token
+}
+
+// generateAPIToken returns a new random token in plain text.
+func generateAPIToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return apiTokenPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashAPIToken returns the hex SHA-256 of a token. Tokens are long and random,
+// so a fast hash is enough and lets the token be looked up directly.
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseScopes checks the requested scopes and returns them de-duplicated in a fixed order.
+func parseScopes(requested []string) ([]string, error) {
+	seen := make(map[string]bool)
+	for _, scope := range requested {
+		if !validScopes[scope] {
+			return nil, fmt.Errorf("unknown scope %q", scope)
+		}
+		seen[scope] = true
+	}
+
+	var scopes []string
+	for _, scope := range []string{ScopeNotesRead, ScopeNotesWrite} {
+		if seen[scope] {
+			scopes = append(scopes, scope)
+		}
+	}
+	if len(scopes) == 0 {
+		return nil, errors.New("at least one scope is required")
+	}
+	return scopes, nil
+}
+
+// createAPIToken stores a new token for the user and returns it in plain text. It cannot be retrieved again.
+func (a *App) createAPIToken(username, name string, scopes []string, expiresAt sql.NullTime) (string, error) {
+	token, err := generateAPIToken()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = a.db.Exec(
+		"INSERT INTO api_tokens (username, name, token_hash, scopes, expires_at) VALUES ($1, $2, $3, $4, $5)",
+		username, name, hashAPIToken(token), strings.Join(scopes, " "), expiresAt,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// listAPITokens returns the user's tokens, newest first.
+func (a *App) listAPITokens(username string) ([]APIToken, error) {
+	rows, err := a.db.Query(`
+		SELECT id, username, name, scopes, created_at, last_used_at, expires_at
+		FROM api_tokens
+		WHERE username = $1
+		ORDER BY created_at DESC, id DESC
+	`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []APIToken
+	for rows.Next() {
+		var token APIToken
+		var scopes string
+		if err := rows.Scan(&token.ID, &token.Username, &token.Name, &scopes, &token.CreatedAt, &token.LastUsedAt, &token.ExpiresAt); err != nil {
+			return nil, err
+		}
+		token.Scopes = strings.Fields(scopes)
+		tokens = append(tokens, token)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// revokeAPIToken deletes one of the user's tokens. Revoking a token that does not
+// exist, or belongs to someone else, returns sql.ErrNoRows.
+func (a *App) revokeAPIToken(id int, username string) error {
+	result, err := a.db.Exec("DELETE FROM api_tokens WHERE id = $1 AND username = $2", id, username)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// lookupAPIToken finds the unexpired token matching the plain text token and records that it was used.
+// Unknown and expired tokens return sql.ErrNoRows.
+func (a *App) lookupAPIToken(plain string) (*APIToken, error) {
+	var token APIToken
+	var scopes string
+	err := a.db.QueryRow(`
+		SELECT id, username, name, scopes, created_at, last_used_at, expires_at
+		FROM api_tokens
+		WHERE token_hash = $1 AND (expires_at IS NULL OR expires_at > CURRENT_TIMESTAMP)
+	`, hashAPIToken(plain)).Scan(&token.ID, &token.Username, &token.Name, &scopes, &token.CreatedAt, &token.LastUsedAt, &token.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	token.Scopes = strings.Fields(scopes)
+
+	if _, err := a.db.Exec("UPDATE api_tokens SET last_used_at = CURRENT_TIMESTAMP WHERE id = $1", token.ID); err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// requiredScope returns the scope a token needs for the request: reads need notes:read, anything else notes:write.
+func requiredScope(r *http.Request) string {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return ScopeNotesRead
+	}
+	return ScopeNotesWrite
+}
+
+// tokenAuthMiddleware authenticates requests carrying an "Authorization: Bearer" header.
+// The token is stored in the request context, where requireAuth picks it up.
+// Requests without the header are passed through unchanged so the session cookie is used instead.
+func (a *App) tokenAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		if header == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		plain, found := strings.CutPrefix(header, "Bearer ")
+		if !found || plain == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_request"`)
+			respondWithError(w, http.StatusUnauthorized, "Authorization header must use the Bearer scheme")
+			return
+		}
+
+		token, err := a.lookupAPIToken(strings.TrimSpace(plain))
+		if err == sql.ErrNoRows {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			respondWithError(w, http.StatusUnauthorized, "Invalid or expired token")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		scope := requiredScope(r)
+		if !token.hasScope(scope) {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, scope))
+			respondWithError(w, http.StatusForbidden, "Token is missing the "+scope+" scope")
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenContextKey{}, token)))
+	})
+}
+
+// tokensHandler shows the user's personal access tokens (GET) and creates a new one (POST).
+// A newly created token is shown once on the page and cannot be retrieved afterwards.
+// API tokens only log in to /api/v1, so tokens are managed from a logged in browser session.
+func (a *App) tokensHandler(w http.ResponseWriter, r *http.Request) {
+	username := currentUsername(r)
+
+	var message, newToken string
+
+	if r.Method == http.MethodPost {
+		name := strings.TrimSpace(r.FormValue("name"))
+		scopes, err := parseScopes(r.Form["scopes"])
+
+		switch {
+		case name == "" || len(name) > 100:
+			message = "Token name is required and must be at most 100 characters."
+		case err != nil:
+			message = "Invalid scopes: " + err.Error()
+		default:
+			var expiresAt sql.NullTime
+			if days := r.FormValue("expires_in_days"); days != "" && days != "0" {
+				var n int
+				if _, err := fmt.Sscan(days, &n); err != nil || n < 1 {
+					message = "Expiry must be a number of days."
+					break
+				}
+				expiresAt = sql.NullTime{Time: time.Now().AddDate(0, 0, n), Valid: true}
+			}
+
+			newToken, err = a.createAPIToken(username, name, scopes, expiresAt)
+			if err != nil {
+				checkInternalServerError(err, w)
+				return
+			}
+		}
+	}
+
+	tokens, err := a.listAPITokens(username)
+	if err != nil {
+		checkInternalServerError(err, w)
+		return
+	}
+
+	data := struct {
+		Username string
+		Tokens   []APIToken
+		NewToken string
+		Message  string
+		Now      time.Time
+	}{
+		Username: username,
+		Tokens:   tokens,
+		NewToken: newToken,
+		Message:  message,
+		Now:      time.Now(),
+	}
+
+	t, err := template.New("tokens.html").Funcs(csrfFuncs(r)).ParseFiles("tmpl/tokens.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	buf.WriteTo(w)
+}
+
+// revokeTokenHandler deletes one of the user's personal access tokens.
+func (a *App) revokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	username := currentUsername(r)
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid token ID", http.StatusBadRequest)
+		return
+	}
+
+	err = a.revokeAPIToken(id, username)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		checkInternalServerError(err, w)
+		return
+	}
+
+	http.Redirect(w, r, "/tokens", http.StatusSeeOther)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var apiTokenColumns = []string{"id", "username", "name", "scopes", "created_at", "last_used_at", "expires_at"}
+
+// expectTokenLookup expects a bearer token to be looked up and returns a token for username with the given scopes
+func expectTokenLookup(mock sqlmock.Sqlmock, plain, username, scopes string) {
+	mock.ExpectQuery("SELECT id, username, name, scopes, created_at, last_used_at, expires_at FROM api_tokens").
+		WithArgs(hashAPIToken(plain)).
+		WillReturnRows(sqlmock.NewRows(apiTokenColumns).AddRow(3, username, "script", scopes, time.Now(), nil, nil))
+	mock.ExpectExec("UPDATE api_tokens SET last_used_at").WithArgs(3).WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func TestGenerateAPIToken(t *testing.T) {
+	first, err := generateAPIToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := generateAPIToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(first, apiTokenPrefix) || len(first) < 40 {
+		t.Errorf("Unexpected token format %q", first)
+	}
+	if first == second {
+		t.Errorf("Expected unique tokens")
+	}
+	if len(hashAPIToken(first)) != 64 || hashAPIToken(first) == first {
+		t.Errorf("Expected a hex SHA-256 hash, got %q", hashAPIToken(first))
+	}
+}
+
+func TestParseScopes(t *testing.T) {
+	scopes, err := parseScopes([]string{"notes:write", "notes:read", "notes:write"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(scopes, " ") != "notes:read notes:write" {
+		t.Errorf("Unexpected scopes %v", scopes)
+	}
+
+	if _, err := parseScopes(nil); err == nil {
+		t.Errorf("Expected an error when no scopes are requested")
+	}
+	if _, err := parseScopes([]string{"admin"}); err == nil {
+		t.Errorf("Expected an error for an unknown scope")
+	}
+}
+
+func TestCreateAPIToken_StoresHash(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error occurred while opening a stub database connection: %v", err)
+	}
+	defer db.Close()
+
+	a := newSQLTestApp(db)
+	mock.ExpectExec("INSERT INTO api_tokens").
+		WithArgs("alice", "backup", sqlmock.AnyArg(), "notes:read", sql.NullTime{}).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	token, err := a.createAPIToken("alice", "backup", []string{ScopeNotesRead}, sql.NullTime{})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		t.Errorf("Unexpected token %q", token)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRevokeAPIToken_NotOwned(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error occurred while opening a stub database connection: %v", err)
+	}
+	defer db.Close()
+
+	a := newSQLTestApp(db)
+	mock.ExpectExec("DELETE FROM api_tokens").WithArgs(5, "bob").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := a.revokeAPIToken(5, "bob"); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestTokenAuth_AuthenticatesAPIRequests(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	expectTokenLookup(mock, "nt_valid", "alice", "notes:read")
+	expectNoteRole(mock, 7, "alice", "alice", nil, nil)
+	expectNoteByID(mock, 7, "Groceries", "Note", "None", "", "alice")
+	mock.ExpectPrepare("SELECT username, privileges FROM user_shares").ExpectQuery().WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"username", "privileges"}))
+
+	req := httptest.NewRequest("GET", "/api/v1/notes/7", nil)
+	req.Header.Set("Authorization", "Bearer nt_valid")
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("Handler returned wrong status code: got %v, want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestTokenAuth_RejectsInvalidToken(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	mock.ExpectQuery("SELECT id, username, name, scopes").WithArgs(hashAPIToken("nt_unknown")).
+		WillReturnRows(sqlmock.NewRows(apiTokenColumns))
+
+	req := httptest.NewRequest("GET", "/api/v1/notes", nil)
+	req.Header.Set("Authorization", "Bearer nt_unknown")
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusUnauthorized)
+	}
+	if !strings.Contains(rr.Header().Get("WWW-Authenticate"), "invalid_token") {
+		t.Errorf("Expected an invalid_token challenge, got %q", rr.Header().Get("WWW-Authenticate"))
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestTokenAuth_RequiresWriteScope(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	expectTokenLookup(mock, "nt_readonly", "alice", "notes:read")
+
+	req := httptest.NewRequest("DELETE", "/api/v1/notes/7", nil)
+	req.Header.Set("Authorization", "Bearer nt_readonly")
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusForbidden)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestTokenAuth_OnlyLogsInToAPI(t *testing.T) {
+	a, mock := newAPITestApp(t)
+
+	// The token is not even looked up outside the API, and the pages want a session
+	for _, target := range []string{"/tokens", "/list", "/settings", "/password"} {
+		req := httptest.NewRequest("GET", target, nil)
+		req.Header.Set("Authorization", "Bearer nt_valid")
+		rr := httptest.NewRecorder()
+		a.Router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/login" {
+			t.Errorf("GET %s: expected a redirect to /login, got %v %q", target, rr.Code, rr.Header().Get("Location"))
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
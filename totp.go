@@ -0,0 +1,122 @@
+// Package main contains the main entry point for the Go application
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"html/template"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// The time-based one-time passwords of RFC 6238, with the settings every authenticator app
+// supports: HMAC-SHA1, 6 digits and a new code every 30 seconds.
+const (
+	totpDigits = 6
+	totpPeriod = 30
+	// totpSkew is how many steps a code may be early or late, for clocks that are a little off
+	totpSkew = 1
+)
+
+// totpEncoding is the base32 encoding of secrets, without the padding authenticator apps leave out.
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// generateTOTPSecret returns a new random secret of 160 bits, base32 encoded.
+func generateTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// totpStep returns the time step of a time, the number of periods since the Unix epoch.
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// totpCode returns the code of the secret for a time step.
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation, RFC 4226 section 5.3
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%totpModulus()), nil
+}
+
+// totpModulus returns 10^totpDigits, the number the truncated value is reduced by to give
+// a code of totpDigits digits.
+func totpModulus() uint32 {
+	m := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		m *= 10
+	}
+	return m
+}
+
+// validTOTP checks a code against the secret at the time, allowing totpSkew steps either way,
+// and returns the step it is the code of. Spaces in the code are ignored.
+func validTOTP(secret, code string, now time.Time) (int64, bool) {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := totpStep(now)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(code), []byte(expected)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpProvisioningURI returns the otpauth URI authenticator apps read from a QR code to set up the secret.
+func totpProvisioningURI(issuer, username, secret string) string {
+	params := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + username,
+		RawQuery: params.Encode(),
+	}
+	return u.String()
+}
+
+// totpQRCode returns a QR code of the provisioning URI as a PNG data URI, for an img tag.
+func totpQRCode(uri string) (template.URL, error) {
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		return "", err
+	}
+	return template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png)), nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA1 key of the test vectors of RFC 6238, "12345678901234567890", base32 encoded.
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode_RFC6238Vectors(t *testing.T) {
+	// The last 6 of the 8 digits of the RFC's SHA1 codes
+	tests := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+
+	for unix, want := range tests {
+		got, err := totpCode(rfc6238Secret, totpStep(time.Unix(unix, 0)))
+		if err != nil || got != want {
+			t.Errorf("At %d: expected %s, got %s, %v", unix, want, got, err)
+		}
+	}
+}
+
+func TestTOTPModulus(t *testing.T) {
+	if m := totpModulus(); len(strconv.FormatUint(uint64(m-1), 10)) != totpDigits || m%10 != 0 {
+		t.Errorf("Expected 10^%d, got %d", totpDigits, m)
+	}
+}
+
+func TestValidTOTP_AllowsOneStepOfSkew(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	code := func(offset time.Duration) string {
+		c, _ := totpCode(rfc6238Secret, totpStep(now.Add(offset)))
+		return c
+	}
+
+	if step, ok := validTOTP(rfc6238Secret, code(0), now); !ok || step != totpStep(now) {
+		t.Errorf("Expected the current code to be valid for step %d, got %d, %v", totpStep(now), step, ok)
+	}
+	if _, ok := validTOTP(rfc6238Secret, code(-totpPeriod*time.Second), now); !ok {
+		t.Error("Expected the code of the previous step to be valid")
+	}
+	if _, ok := validTOTP(rfc6238Secret, code(-3*totpPeriod*time.Second), now); ok {
+		t.Error("Expected an old code to be invalid")
+	}
+	if _, ok := validTOTP(rfc6238Secret, "12345", now); ok {
+		t.Error("Expected a short code to be invalid")
+	}
+}
+
+func TestTOTPProvisioningURI(t *testing.T) {
+	uri := totpProvisioningURI("Enterprise Notes", "alice", "ABC")
+
+	if !strings.HasPrefix(uri, "otpauth://totp/Enterprise%20Notes:alice?") {
+		t.Errorf("Expected the issuer and username in the label, got %s", uri)
+	}
+	for _, param := range []string{"secret=ABC", "issuer=Enterprise+Notes", "digits=6", "period=30"} {
+		if !strings.Contains(uri, param) {
+			t.Errorf("Expected %s in %s", param, uri)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+// Package main contains the main entry point for the Go application
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// TrashedNote is a note in its owner's trash.
+type TrashedNote struct {
+	Note      Note
+	DeletedAt time.Time
+	DeletedBy sql.NullString
+	PurgeAt   time.Time // when the purge job will delete the note for good
+}
+
+// MarshalJSON writes the trashed note as the note's own fields plus the trash details.
+func (tn TrashedNote) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Note      Note      `json:"note"`
+		DeletedAt time.Time `json:"deleted_at"`
+		DeletedBy *string   `json:"deleted_by"`
+		PurgeAt   time.Time `json:"purge_at"`
+	}{
+		Note:      tn.Note,
+		DeletedAt: tn.DeletedAt,
+		DeletedBy: nullStringPtr(tn.DeletedBy),
+		PurgeAt:   tn.PurgeAt,
+	})
+}
+
+// listTrashedNotes returns the notes in the user's trash, most recently deleted first.
+func (a *App) listTrashedNotes(username string) ([]TrashedNote, error) {
+	rows, err := a.db.Query(`
+		SELECT id, title, noteType, description, noteCreated, due_at,
+			noteStatus, noteDelegation, owner, deleted_at, deleted_by
+		FROM notes
+		WHERE owner = $1 AND deleted_at IS NOT NULL
+		ORDER BY deleted_at DESC
+	`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	trashed := []TrashedNote{}
+	for rows.Next() {
+		var tn TrashedNote
+		err := rows.Scan(
+			&tn.Note.ID, &tn.Note.Title, &tn.Note.NoteType, &tn.Note.Description, &tn.Note.NoteCreated,
+			&tn.Note.DueAt, &tn.Note.NoteStatus,
+			&tn.Note.NoteDelegation, &tn.Note.Owner, &tn.DeletedAt, &tn.DeletedBy,
+		)
+		if err != nil {
+			return nil, err
+		}
+		tn.PurgeAt = tn.DeletedAt.Add(a.config.Trash.Retention)
+		trashed = append(trashed, tn)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return trashed, nil
+}
+
+// restoreNoteFromTrash takes a note out of the owner's trash. Its shares and history were never removed,
+// so they are back as they were. Returns sql.ErrNoRows if the note is not in the user's trash.
+func (a *App) restoreNoteFromTrash(noteID int, username string) error {
+	result, err := a.db.Exec(
+		"UPDATE notes SET deleted_at = NULL, deleted_by = NULL WHERE id = $1 AND owner = $2 AND deleted_at IS NOT NULL",
+		noteID, username,
+	)
+	if err != nil {
+		return err
+	}
+	return requireRowsAffected(result)
+}
+
+// purgeNoteFromTrash permanently deletes a note from the owner's trash, along with its shares and history.
+// Returns sql.ErrNoRows if the note is not in the user's trash.
+func (a *App) purgeNoteFromTrash(noteID int, username string) error {
+	result, err := a.db.Exec(
+		"DELETE FROM notes WHERE id = $1 AND owner = $2 AND deleted_at IS NOT NULL",
+		noteID, username,
+	)
+	if err != nil {
+		return err
+	}
+	return requireRowsAffected(result)
+}
+
+// requireRowsAffected returns sql.ErrNoRows when a statement did not change any rows.
+func requireRowsAffected(result sql.Result) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// purgeExpiredTrash permanently deletes every note that has been in the trash longer than the retention period.
+func (a *App) purgeExpiredTrash(retention time.Duration) (int64, error) {
+	result, err := a.db.Exec("DELETE FROM notes WHERE deleted_at IS NOT NULL AND deleted_at < $1", time.Now().Add(-retention))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// startTrashPurger purges expired notes from every trash now and then every purge interval,
+// until the context is cancelled.
+func (a *App) startTrashPurger(ctx context.Context) {
+	purge := func() {
+		purged, err := a.purgeExpiredTrash(a.config.Trash.Retention)
+		if err != nil {
+			slog.Error("Purging the trash failed", "err", err)
+			return
+		}
+		if purged > 0 {
+			slog.Info("Purged notes from the trash", "count", purged)
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(a.config.Trash.PurgeInterval)
+		defer ticker.Stop()
+
+		purge()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				purge()
+			}
+		}
+	}()
+}
+
+// trashHandler shows the notes in the current user's trash.
+func (a *App) trashHandler(w http.ResponseWriter, r *http.Request) {
+	username := currentUsername(r)
+	trashed, err := a.listTrashedNotes(username)
+	if err != nil {
+		checkInternalServerError(err, w)
+		return
+	}
+
+	data := struct {
+		Username  string
+		Notes     []TrashedNote
+		Retention time.Duration
+	}{
+		Username:  username,
+		Notes:     trashed,
+		Retention: a.config.Trash.Retention,
+	}
+
+	t, err := template.New("trash.html").Funcs(csrfFuncs(r)).ParseFiles("tmpl/trash.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	buf.WriteTo(w)
+}
+
+// restoreFromTrashHandler restores a note from the current user's trash.
+func (a *App) restoreFromTrashHandler(w http.ResponseWriter, r *http.Request) {
+	noteID, err := strconv.Atoi(r.FormValue("Id"))
+	if err != nil {
+		http.Error(w, "Invalid note ID", http.StatusBadRequest)
+		return
+	}
+
+	err = a.restoreNoteFromTrash(noteID, currentUsername(r))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Note not found in your trash", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		checkInternalServerError(err, w)
+		return
+	}
+
+	http.Redirect(w, r, "/trash", http.StatusSeeOther)
+}
+
+// purgeFromTrashHandler permanently deletes a note from the current user's trash.
+func (a *App) purgeFromTrashHandler(w http.ResponseWriter, r *http.Request) {
+	noteID, err := strconv.Atoi(r.FormValue("Id"))
+	if err != nil {
+		http.Error(w, "Invalid note ID", http.StatusBadRequest)
+		return
+	}
+
+	err = a.purgeNoteFromTrash(noteID, currentUsername(r))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Note not found in your trash", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		checkInternalServerError(err, w)
+		return
+	}
+
+	http.Redirect(w, r, "/trash", http.StatusSeeOther)
+}
+
+// apiListTrashHandler handles GET /api/v1/trash.
+func (a *App) apiListTrashHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := a.apiUsername(w, r)
+	if !ok {
+		return
+	}
+
+	trashed, err := a.listTrashedNotes(username)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"notes": trashed})
+}
+
+// apiRestoreFromTrashHandler handles POST /api/v1/trash/{id}/restore.
+func (a *App) apiRestoreFromTrashHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := a.apiUsername(w, r)
+	if !ok {
+		return
+	}
+
+	noteID, _ := strconv.Atoi(mux.Vars(r)["id"])
+	err := a.restoreNoteFromTrash(noteID, username)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Note not found in your trash")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	note, err := a.notes.GetNote(noteID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	note.Privileges = string(RoleOwner)
+
+	respondWithJSON(w, http.StatusOK, note)
+}
+
+// apiPurgeFromTrashHandler handles DELETE /api/v1/trash/{id}.
+func (a *App) apiPurgeFromTrashHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := a.apiUsername(w, r)
+	if !ok {
+		return
+	}
+
+	noteID, _ := strconv.Atoi(mux.Vars(r)["id"])
+	err := a.purgeNoteFromTrash(noteID, username)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Note not found in your trash")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
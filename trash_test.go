@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var trashedNoteColumns = []string{"id", "title", "noteType", "description", "noteCreated", "due_at",
+	"noteStatus", "noteDelegation", "owner", "deleted_at", "deleted_by"}
+
+func TestPurgeExpiredTrash(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error occurred while opening a stub database connection: %v", err)
+	}
+	defer db.Close()
+
+	a := newSQLTestApp(db)
+	mock.ExpectExec("DELETE FROM notes WHERE deleted_at IS NOT NULL AND deleted_at <").
+		WithArgs(sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 3))
+
+	purged, err := a.purgeExpiredTrash(30 * 24 * time.Hour)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if purged != 3 {
+		t.Errorf("Expected 3 purged notes, got %d", purged)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestTrashHandler_ListsOwnNotes(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error occurred while opening a stub database connection: %v", err)
+	}
+	defer db.Close()
+
+	cfg := defaultConfig()
+	a := App{db: db, config: &cfg}
+	deleted := time.Date(2024, 10, 1, 9, 0, 0, 0, time.UTC)
+	mock.ExpectQuery("FROM notes WHERE owner = \\$1 AND deleted_at IS NOT NULL").WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows(trashedNoteColumns).
+			AddRow(5, "Old groceries", "Note", "Milk", deleted, nil, "None", nil, "alice", deleted, "alice"))
+
+	req := withSession(httptest.NewRequest("GET", "/trash", nil), "alice")
+	rr := httptest.NewRecorder()
+	a.trashHandler(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v, want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	body := rr.Body.String()
+	if !strings.Contains(body, "Old groceries") || !strings.Contains(body, "31/10/2024") {
+		t.Errorf("Expected the trashed note and its purge date in the page")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRestoreFromTrashHandler_NotInTrash(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error occurred while opening a stub database connection: %v", err)
+	}
+	defer db.Close()
+
+	a := newSQLTestApp(db)
+	// Another user's note is not in alice's trash
+	mock.ExpectExec("UPDATE notes SET deleted_at = NULL, deleted_by = NULL").WithArgs(9, "alice").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	form := url.Values{"Id": {"9"}}
+	req := httptest.NewRequest("POST", "/trash/restore", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	a.restoreFromTrashHandler(rr, withSession(req, "alice"))
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusNotFound)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPI_ListTrash(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	cfg := defaultConfig()
+	a.config = &cfg
+	deleted := time.Date(2024, 10, 1, 9, 0, 0, 0, time.UTC)
+	mock.ExpectQuery("FROM notes WHERE owner = \\$1 AND deleted_at IS NOT NULL").WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows(trashedNoteColumns).
+			AddRow(5, "Old groceries", "Note", "Milk", deleted, nil, "None", nil, "alice", deleted, nil))
+
+	rr := serveAPI(a, "GET", "/api/v1/trash", "", "alice")
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v, want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+
+	var got struct {
+		Notes []map[string]interface{} `json:"notes"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Response is not valid JSON: %v", err)
+	}
+	if len(got.Notes) != 1 || got.Notes[0]["deleted_by"] != nil || got.Notes[0]["purge_at"] != "2024-10-31T09:00:00Z" {
+		t.Errorf("Unexpected trash: %v", got.Notes)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPI_PurgeFromTrash(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	mock.ExpectExec("DELETE FROM notes WHERE id = \\$1 AND owner = \\$2 AND deleted_at IS NOT NULL").WithArgs(5, "alice").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	rr := serveAPI(a, "DELETE", "/api/v1/trash/5", "", "alice")
+
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusNoContent)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}